@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.etcd.io/etcd/etcdserver/api/snap"
+	"go.etcd.io/etcd/pkg/fileutil"
+	"go.etcd.io/etcd/raft/raftpb"
+	"go.etcd.io/etcd/wal"
+	"go.etcd.io/etcd/wal/walpb"
+	"go.uber.org/zap"
+)
+
+// backupVersion is bumped whenever the backup file layout changes.
+const backupVersion = 1
+
+// backupMetadata describes a point-in-time copy of the key-value store.
+type backupMetadata struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Revision  int64     `json:"revision"`
+	Keys      int       `json:"keys"`
+	Leases    int       `json:"leases"`
+	SHA256    string    `json:"sha256"` // of Data
+}
+
+// backupFile is what `snapshot save` writes and `snapshot restore` reads. Data
+// holds the state machine as it is stored in raft snapshots; cluster
+// membership is left out so that a restore can pick fresh member IDs.
+type backupFile struct {
+	Metadata backupMetadata `json:"metadata"`
+	Data     []byte         `json:"data"`
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Backup returns a backup of the store that reflects every write committed
+// before it was called. A no-op proposal is committed first so that a lagging
+// follower catches up before its state is copied.
+func (s *kvstore) Backup(ctx context.Context) ([]byte, error) {
+	if r := s.proposeAndWait(ctx, kv{Op: opNoop}); r.err != nil {
+		return nil, r.err
+	}
+	s.mu.Lock()
+	md := backupMetadata{
+		Version:   backupVersion,
+		CreatedAt: time.Now().UTC(),
+		Revision:  s.rev,
+		Keys:      len(s.kvStore),
+		Leases:    len(s.leases),
+	}
+	data, err := s.marshal()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	md.SHA256 = checksum(data)
+	return json.Marshal(backupFile{Metadata: md, Data: data})
+}
+
+// readBackup decodes a backup file and verifies its checksum.
+func readBackup(b []byte) (*backupFile, error) {
+	var bf backupFile
+	if err := json.Unmarshal(b, &bf); err != nil {
+		return nil, fmt.Errorf("not a backup file: %v", err)
+	}
+	if bf.Metadata.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", bf.Metadata.Version)
+	}
+	if got := checksum(bf.Data); got != bf.Metadata.SHA256 {
+		return nil, fmt.Errorf("backup checksum mismatch: got %s, want %s", got, bf.Metadata.SHA256)
+	}
+	if err := (&kvstore{}).recoverFromSnapshot(bf.Data); err != nil {
+		return nil, fmt.Errorf("corrupt backup data: %v", err)
+	}
+	return &bf, nil
+}
+
+// newClusterToken returns a random token for a restored cluster.
+func newClusterToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// restoredMemberID returns the raft ID of the member at peer URL u in the
+// cluster created with token. Every member restored with the same token and
+// peers agrees on the IDs, and a new token never reuses those of the cluster
+// the backup was taken from.
+func restoredMemberID(token, u string) uint64 { return hashID("member", token, u) }
+
+// restoreBackup writes the WAL and snapshot for member id, the position in
+// peers, of a new cluster created with token and seeded with the state in bf.
+// Member and cluster IDs are derived from the token and stored in the WAL, so
+// starting every member with the same peers brings the cluster up with the
+// restored data.
+func restoreBackup(bf *backupFile, id int, peers []string, token, waldir, snapdir string, logger *zap.Logger) error {
+	if id < 1 || id > len(peers) {
+		return fmt.Errorf("member ID %d is not in a cluster of %d", id, len(peers))
+	}
+	if token == "" {
+		return errors.New("restoring requires a cluster token")
+	}
+	if wal.Exist(waldir) || fileutil.Exist(snapdir) {
+		return errors.New("refusing to overwrite existing member data in " + waldir + " or " + snapdir)
+	}
+
+	members := newMembership()
+	cs := raftpb.ConfState{}
+	for _, u := range peers {
+		mid := restoredMemberID(token, u)
+		if _, ok := members.Members[mid]; ok {
+			return fmt.Errorf("duplicate peer %s", u)
+		}
+		members.Members[mid] = memberContext{URL: u}
+		cs.Voters = append(cs.Voters, mid)
+	}
+	data, err := encodeSnapshot(members, bf.Data)
+	if err != nil {
+		return err
+	}
+	// the restored log starts at index 1 of term 1 with no entries after it
+	rs := raftpb.Snapshot{
+		Data:     data,
+		Metadata: raftpb.SnapshotMetadata{Index: 1, Term: 1, ConfState: cs},
+	}
+
+	if err := os.Mkdir(snapdir, 0750); err != nil {
+		return err
+	}
+	if err := snap.New(logger, snapdir).SaveSnap(rs); err != nil {
+		return err
+	}
+	mi := memberIdentity{NodeID: restoredMemberID(token, peers[id-1]), ClusterID: clusterIDFromToken(token)}
+	w, err := wal.Create(logger, waldir, encodeMemberIdentity(mi))
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.SaveSnapshot(walpb.Snapshot{Index: 1, Term: 1}); err != nil {
+		return err
+	}
+	return w.Save(raftpb.HardState{Term: 1, Commit: 1}, nil)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/raft/raftpb"
+	"go.uber.org/zap"
+)
+
+func TestSnapshotSaveAndRestore(t *testing.T) {
+	src := newTestCluster(t, 3, 20)
+	lead := src.leader()
+	for i := 0; i < 30; i++ {
+		lead.store().Propose(fmt.Sprintf("/k%d", i), strconv.Itoa(i))
+	}
+	src.put(lead, "/last", "v", 1, 2, 3)
+	lease := grant(t, lead, 60)
+	putWithLease(t, lead, "/leased", "v", lease)
+
+	// save through a follower; the backup still holds every committed write
+	follower := src.node(lead.id%3 + 1)
+	srv := httptest.NewServer(&httpKVAPI{store: follower.store(), confChangeC: make(chan raftpb.ConfChangeI)})
+	defer srv.Close()
+	file := filepath.Join(t.TempDir(), "backup.snap")
+	if err := runSnapshotCommand([]string{"save", "-endpoint", srv.URL, file}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf, err := readBackup(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, srcRev, _ := lead.store().Get("/leased")
+	if md := bf.Metadata; md.Keys != 32 || md.Leases != 1 || md.Revision != srcRev {
+		t.Fatalf("metadata = %+v, want 32 keys, 1 lease at revision %d", md, srcRev)
+	}
+
+	// restore into a bigger cluster with new peers; member and cluster IDs
+	// are derived from a fresh cluster token
+	dir := t.TempDir()
+	token, err := newClusterToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var peers []string
+	for i := 1; i <= 5; i++ {
+		peers = append(peers, peerURL(i))
+	}
+	chdir(t, dir)
+	for i := 1; i <= 5; i++ {
+		args := []string{"restore", "-id", strconv.Itoa(i), "-cluster", strings.Join(peers, ","), "-cluster-token", token, file}
+		if err := runSnapshotCommand(args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := runSnapshotCommand([]string{"restore", "-id", "1", "-cluster", strings.Join(peers, ","), file}); err == nil {
+		t.Fatal("restore overwrote an existing member")
+	}
+
+	dst := newTestClusterIn(t, dir, 5, defaultSnapCount)
+	dst.leader()
+	all := []int{1, 2, 3, 4, 5}
+	for i := 0; i < 30; i++ {
+		if !dst.applied(fmt.Sprintf("/k%d", i), strconv.Itoa(i), time.Second, all...) {
+			t.Fatalf("/k%d missing after restore", i)
+		}
+	}
+	for _, id := range all {
+		kv, rev, ok := dst.node(id).store().Get("/leased")
+		if !ok || kv.Lease != lease || rev != srcRev {
+			t.Fatalf("node %d: /leased = %+v at revision %d, want lease %d at %d", id, kv, rev, lease, srcRev)
+		}
+		rc := dst.node(id).rc
+		if len(rc.members.ids()) != 5 {
+			t.Fatalf("node %d knows members %v", id, rc.members.ids())
+		}
+		if rc.memberID != restoredMemberID(token, peers[id-1]) || rc.memberID <= 5 {
+			t.Fatalf("node %d has member ID %x", id, rc.memberID)
+		}
+		if rc.clusterID != clusterIDFromToken(token) || rc.clusterID == defaultClusterID {
+			t.Fatalf("node %d has cluster ID %x", id, rc.clusterID)
+		}
+		for _, sid := range src.running() {
+			if src.node(sid).rc.memberID == rc.memberID {
+				t.Fatalf("node %d reuses member ID %x of the source cluster", id, rc.memberID)
+			}
+		}
+	}
+	dst.put(dst.node(4), "/after", "v", all...)
+	if kv, _, _ := dst.node(1).store().Get("/after"); kv.CreateRevision != srcRev+1 {
+		t.Fatalf("revisions did not continue: /after created at %d", kv.CreateRevision)
+	}
+}
+
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestBackupRejectsCorruption(t *testing.T) {
+	c := newTestCluster(t, 1, defaultSnapCount)
+	c.leader()
+	c.put(c.node(1), "/k", "v", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b, err := c.node(1).store().Backup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf, err := readBackup(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := *bf
+	flipped.Data = append([]byte(nil), bf.Data...)
+	flipped.Data[len(flipped.Data)/2] ^= 0xff
+	if _, err := readBackup(mustJSON(t, flipped)); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("corrupted data: %v", err)
+	}
+
+	future := *bf
+	future.Metadata.Version = backupVersion + 1
+	if _, err := readBackup(mustJSON(t, future)); err == nil {
+		t.Fatal("unknown version accepted")
+	}
+	if _, err := readBackup(b[:len(b)/2]); err == nil {
+		t.Fatal("truncated file accepted")
+	}
+
+	dir := t.TempDir()
+	if err := restoreBackup(bf, 4, []string{peerURL(1)}, "token", filepath.Join(dir, "w"), filepath.Join(dir, "s"), zap.NewNop()); err == nil {
+		t.Fatal("restored a member outside the cluster")
+	}
+	if err := restoreBackup(bf, 1, []string{peerURL(1)}, "", filepath.Join(dir, "w"), filepath.Join(dir, "s"), zap.NewNop()); err == nil {
+		t.Fatal("restored a member without a cluster token")
+	}
+	if restoredMemberID("a", peerURL(1)) == restoredMemberID("b", peerURL(1)) {
+		t.Fatal("member IDs do not depend on the cluster token")
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
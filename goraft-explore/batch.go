@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// Proposals queued on proposeC while raft is busy are packed into a single
+// log entry. An entry holding one proposal keeps the plain encoding, so logs
+// written before batching still replay.
+var (
+	maxProposalBatch      = 256        // proposals per entry
+	maxProposalBatchBytes = 512 * 1024 // bytes per entry, well below MaxSizePerMsg
+)
+
+// batchMarker starts a batched entry. A gob stream never begins with a zero
+// byte, so it cannot be confused with a single proposal.
+const batchMarker = 0x00
+
+// drainProposals collects prop and whatever else is already waiting on
+// proposeC, and reports whether proposeC is still open.
+func drainProposals(prop string, proposeC <-chan string) (batch []string, open bool) {
+	batch = []string{prop}
+	size := len(prop)
+	for len(batch) < maxProposalBatch && size < maxProposalBatchBytes {
+		select {
+		case p, ok := <-proposeC:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, p)
+			size += len(p)
+		default:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+func encodeProposals(batch []string) []byte {
+	if len(batch) == 1 {
+		return []byte(batch[0])
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(batchMarker)
+	if err := gob.NewEncoder(&buf).Encode(batch); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeProposals(data []byte) ([]string, error) {
+	if data[0] != batchMarker {
+		return []string{string(data)}, nil
+	}
+	var batch []string
+	if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
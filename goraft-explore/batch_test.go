@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProposalBatchEncoding(t *testing.T) {
+	for _, batch := range [][]string{
+		{"single"},
+		{"a", "b", "c"},
+		{"", "x"},
+	} {
+		got, err := decodeProposals(encodeProposals(batch))
+		if err != nil {
+			t.Fatalf("decode %q: %v", batch, err)
+		}
+		if !reflect.DeepEqual(got, batch) {
+			t.Errorf("round trip = %q, want %q", got, batch)
+		}
+	}
+}
+
+func TestDrainProposals(t *testing.T) {
+	proposeC := make(chan string, maxProposalBatch+10)
+	for i := 0; i < maxProposalBatch+10; i++ {
+		proposeC <- fmt.Sprint(i)
+	}
+	batch, open := drainProposals(<-proposeC, proposeC)
+	if !open || len(batch) != maxProposalBatch {
+		t.Fatalf("drained %d proposals (open %v), want %d", len(batch), open, maxProposalBatch)
+	}
+	close(proposeC)
+	batch, open = drainProposals(<-proposeC, proposeC)
+	if open || len(batch) != 10 {
+		t.Fatalf("drained %d proposals (open %v), want 10 and closed", len(batch), open)
+	}
+}
+
+// BenchmarkClusterWrites measures write throughput of a 3-node in-process
+// cluster with many concurrent clients proposing to the leader.
+func BenchmarkClusterWrites(b *testing.B) {
+	c := newTestCluster(b, 3, defaultSnapCount)
+	lead := c.leader()
+	kvs := lead.store()
+
+	b.ResetTimer()
+	start := time.Now()
+	var wg sync.WaitGroup
+	const clients = 64
+	for w := 0; w < clients; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < b.N; i += clients {
+				kvs.Propose(fmt.Sprintf("/bench/%d", i), "v")
+			}
+		}(w)
+	}
+	wg.Wait()
+	c.waitFor(time.Minute, "writes to apply", func() bool {
+		for id := 1; id <= 3; id++ {
+			s := c.node(id).store()
+			s.mu.RLock()
+			n := len(s.kvStore)
+			s.mu.RUnlock()
+			if n < b.N {
+				return false
+			}
+		}
+		return true
+	})
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "writes/s")
+}
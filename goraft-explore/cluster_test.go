@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/pkg/transport"
+	"go.etcd.io/etcd/pkg/types"
+	"go.etcd.io/etcd/raft"
+	"go.etcd.io/etcd/raft/raftpb"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// speed up elections and keep only a short log tail after compaction
+	tickInterval = 10 * time.Millisecond
+	snapshotCatchUpEntriesN = 5
+	promoteRetryInterval = 200 * time.Millisecond
+	leaseCheckInterval = 10 * time.Millisecond
+	leaseClock = testClock
+	waitTimeout = time.Second
+	raft.SetLogger(&raft.DefaultLogger{Logger: log.New(ioutil.Discard, "", 0)})
+	os.Exit(m.Run())
+}
+
+// network is an in-process message bus between raft nodes. It can drop,
+// delay and partition traffic.
+type network struct {
+	mu       sync.Mutex
+	nodes    map[uint64]*raftNode
+	inboxes  map[uint64]chan raftpb.Message
+	blocked  map[[2]uint64]bool // from, to
+	dropRate float64
+	maxDelay time.Duration
+	rand     *rand.Rand
+}
+
+func newNetwork() *network {
+	return &network{
+		nodes:   make(map[uint64]*raftNode),
+		inboxes: make(map[uint64]chan raftpb.Message),
+		blocked: make(map[[2]uint64]bool),
+		rand:    rand.New(rand.NewSource(1)),
+	}
+}
+
+func (n *network) attach(id uint64, rc *raftNode) {
+	inbox := make(chan raftpb.Message, 1024)
+	n.mu.Lock()
+	n.nodes[id] = rc
+	n.inboxes[id] = inbox
+	n.mu.Unlock()
+
+	go func() {
+		for m := range inbox {
+			rc.Process(context.TODO(), m)
+			if m.Type == raftpb.MsgSnap {
+				n.reportSnapshot(m, raft.SnapshotFinish)
+			}
+		}
+	}()
+}
+
+// detach removes rc from the network unless it has already been replaced by
+// a restarted node with the same ID.
+func (n *network) detach(rc *raftNode) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	id := rc.memberID
+	if n.nodes[id] != rc {
+		return
+	}
+	close(n.inboxes[id])
+	delete(n.nodes, id)
+	delete(n.inboxes, id)
+}
+
+func (n *network) attached(rc *raftNode) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, node := range n.nodes {
+		if node == rc {
+			return true
+		}
+	}
+	return false
+}
+
+// drop discards the given fraction of messages.
+func (n *network) drop(rate float64) {
+	n.mu.Lock()
+	n.dropRate = rate
+	n.mu.Unlock()
+}
+
+// delay holds every message back for a random duration up to max.
+func (n *network) delay(max time.Duration) {
+	n.mu.Lock()
+	n.maxDelay = max
+	n.mu.Unlock()
+}
+
+// partition cuts every link between nodes in different groups.
+func (n *network) partition(groups ...[]uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for i, g := range groups {
+		for j, h := range groups {
+			if i == j {
+				continue
+			}
+			for _, from := range g {
+				for _, to := range h {
+					n.blocked[[2]uint64{from, to}] = true
+				}
+			}
+		}
+	}
+}
+
+// heal restores every link and stops dropping and delaying messages.
+func (n *network) heal() {
+	n.mu.Lock()
+	n.blocked = make(map[[2]uint64]bool)
+	n.dropRate, n.maxDelay = 0, 0
+	n.mu.Unlock()
+}
+
+func (n *network) send(from *raftNode, msgs []raftpb.Message) {
+	for _, m := range msgs {
+		n.mu.Lock()
+		_, up := n.nodes[m.To]
+		reachable := up && !n.blocked[[2]uint64{m.From, m.To}]
+		dropped := n.dropRate > 0 && n.rand.Float64() < n.dropRate
+		var delay time.Duration
+		if n.maxDelay > 0 {
+			delay = time.Duration(n.rand.Int63n(int64(n.maxDelay)))
+		}
+		n.mu.Unlock()
+
+		if !reachable || dropped {
+			if !reachable {
+				from.ReportUnreachable(m.To)
+			}
+			if m.Type == raftpb.MsgSnap {
+				from.ReportSnapshot(m.To, raft.SnapshotFailure)
+			}
+			continue
+		}
+		if delay == 0 {
+			n.deliver(m)
+			continue
+		}
+		m := m
+		time.AfterFunc(delay, func() { n.deliver(m) })
+	}
+}
+
+func (n *network) deliver(m raftpb.Message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	inbox, ok := n.inboxes[m.To]
+	if !ok || n.blocked[[2]uint64{m.From, m.To}] {
+		return
+	}
+	select {
+	case inbox <- m:
+	default:
+		// receiver is overloaded; lose the message like a real network
+	}
+}
+
+func (n *network) reportSnapshot(m raftpb.Message, status raft.SnapshotStatus) {
+	n.mu.Lock()
+	rc, ok := n.nodes[m.From]
+	n.mu.Unlock()
+	if ok {
+		rc.ReportSnapshot(m.To, status)
+	}
+}
+
+// fakeTransport routes a node's messages over the in-process network.
+type fakeTransport struct {
+	rc  *raftNode
+	net *network
+}
+
+func (t *fakeTransport) Start() error {
+	t.net.attach(t.rc.memberID, t.rc)
+	return nil
+}
+func (t *fakeTransport) Stop()                              { t.net.detach(t.rc) }
+func (t *fakeTransport) Send(msgs []raftpb.Message)         { t.net.send(t.rc, msgs) }
+func (t *fakeTransport) AddPeer(id types.ID, urls []string) {}
+func (t *fakeTransport) RemovePeer(id types.ID)             {}
+
+// testNode is a raftNode and the kvstore on top of it.
+type testNode struct {
+	id          int
+	rc          *raftNode
+	proposeC    chan string
+	confChangeC chan raftpb.ConfChangeI
+	errorC      <-chan error
+
+	mu  sync.Mutex
+	kvs *kvstore
+}
+
+func (n *testNode) store() *kvstore {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.kvs
+}
+
+// testCluster runs raft nodes in a single process over a fake network.
+type testCluster struct {
+	t         testing.TB
+	dir       string
+	peers     []string
+	net       *network
+	snapCount uint64
+	peerTLS   *transport.TLSInfo // use rafthttp with TLS instead of net
+
+	mu    sync.Mutex
+	nodes map[int]*testNode
+}
+
+// newTestCluster starts a cluster of n voters that snapshot every snapCount
+// applied entries.
+func newTestCluster(t testing.TB, n int, snapCount uint64) *testCluster {
+	return newTestClusterIn(t, t.TempDir(), n, snapCount)
+}
+
+// newTestClusterIn is newTestCluster with the members' data kept in dir, where
+// it may have been prepared beforehand.
+func newTestClusterIn(t testing.TB, dir string, n int, snapCount uint64) *testCluster {
+	c := &testCluster{
+		t:         t,
+		dir:       dir,
+		net:       newNetwork(),
+		snapCount: snapCount,
+		nodes:     make(map[int]*testNode),
+	}
+	for i := 1; i <= n; i++ {
+		c.peers = append(c.peers, peerURL(i))
+	}
+	for i := 1; i <= n; i++ {
+		c.start(i, false)
+	}
+	t.Cleanup(c.stopAll)
+	return c
+}
+
+// newTLSTestCluster starts a cluster of n voters that talk to each other over
+// rafthttp with mutual TLS on loopback ports.
+func newTLSTestCluster(t testing.TB, n int, peerTLS transport.TLSInfo) *testCluster {
+	c := &testCluster{
+		t:         t,
+		dir:       t.TempDir(),
+		net:       newNetwork(),
+		snapCount: defaultSnapCount,
+		peerTLS:   &peerTLS,
+		nodes:     make(map[int]*testNode),
+	}
+	for i := 1; i <= n; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.peers = append(c.peers, "https://"+ln.Addr().String())
+		ln.Close()
+	}
+	for i := 1; i <= n; i++ {
+		c.start(i, false)
+	}
+	t.Cleanup(c.stopAll)
+	return c
+}
+
+func peerURL(id int) string { return fmt.Sprintf("http://127.0.0.1:%d", 10000+id) }
+
+// start runs node id, restarting it from disk if it has run before.
+func (c *testCluster) start(id int, join bool) *testNode {
+	n := &testNode{
+		id:          id,
+		proposeC:    make(chan string),
+		confChangeC: make(chan raftpb.ConfChangeI),
+	}
+	getSnapshot := func() ([]byte, error) { return n.store().getSnapshot() }
+
+	peers := c.peers
+	for len(peers) < id {
+		peers = append(peers, peerURL(len(peers)+1))
+	}
+	rc, commitC, errorC := initRaftNode(id, peers, join, getSnapshot, n.proposeC, n.confChangeC)
+	rc.waldir = filepath.Join(c.dir, defaultWALDir(id))
+	rc.snapdir = filepath.Join(c.dir, defaultSnapDir(id))
+	rc.snapCount = c.snapCount
+	rc.logger = zap.NewNop()
+	if c.peerTLS != nil {
+		rc.peerTLS = *c.peerTLS
+	} else {
+		rc.transport = &fakeTransport{rc: rc, net: c.net}
+	}
+	n.rc, n.errorC = rc, errorC
+
+	go rc.startRaft()
+	kvs := newKVStore(<-rc.snapshotterReady, n.proposeC, commitC, errorC)
+	go kvs.runLeases(rc.leaderC)
+	if c.peerTLS == nil {
+		// the transport attaches once the raft node exists
+		c.waitFor(5*time.Second, "node start", func() bool { return c.net.attached(rc) })
+	}
+	n.mu.Lock()
+	n.kvs = kvs
+	n.mu.Unlock()
+
+	c.mu.Lock()
+	c.nodes[id] = n
+	c.mu.Unlock()
+	return n
+}
+
+// crash cuts node id off the network and stops it. Its WAL and snapshots are
+// kept so it can be restarted.
+func (c *testCluster) crash(id int) {
+	c.mu.Lock()
+	n, ok := c.nodes[id]
+	delete(c.nodes, id)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	c.net.detach(n.rc)
+	// stopping raft first unblocks a proposal waiting for a leader. proposeC
+	// stays open since the lease loop may still be sending on it.
+	n.rc.node.Stop()
+	close(n.confChangeC)
+	<-n.rc.donec
+}
+
+func (c *testCluster) restart(id int) *testNode {
+	return c.start(id, false)
+}
+
+func (c *testCluster) stopAll() {
+	c.mu.Lock()
+	ids := make([]int, 0, len(c.nodes))
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+	for _, id := range ids {
+		c.crash(id)
+	}
+}
+
+func (c *testCluster) node(id int) *testNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nodes[id]
+}
+
+// running returns the IDs of the running nodes, leaving out any node that
+// shut itself down after being removed from the cluster.
+func (c *testCluster) running() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]int, 0, len(c.nodes))
+	for id, n := range c.nodes {
+		select {
+		case <-n.rc.donec:
+		default:
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// leader waits until the nodes in ids (all running nodes if none are given)
+// agree on a leader among themselves and returns it.
+func (c *testCluster) leader(only ...int) *testNode {
+	var lead *testNode
+	c.waitFor(10*time.Second, "leader election", func() bool {
+		ids := only
+		if len(ids) == 0 {
+			ids = c.running()
+		}
+		lead = nil
+		for _, id := range ids {
+			if n := c.node(id); n != nil && n.rc.node.Status().RaftState == raft.StateLeader {
+				lead = n
+			}
+		}
+		if lead == nil {
+			return false
+		}
+		for _, id := range ids {
+			n := c.node(id)
+			if n == nil || n.rc.node.Status().Lead != lead.rc.memberID {
+				return false
+			}
+		}
+		return true
+	})
+	return lead
+}
+
+// put proposes k=v through node n until every node in ids has applied it.
+func (c *testCluster) put(n *testNode, k, v string, ids ...int) {
+	deadline := time.Now().Add(20 * time.Second)
+	for time.Now().Before(deadline) {
+		n.store().Propose(k, v)
+		if c.applied(k, v, 2*time.Second, ids...) {
+			return
+		}
+	}
+	c.t.Fatalf("%s=%s was not applied on nodes %v", k, v, ids)
+}
+
+// applied reports whether k=v is visible on every node in ids within d.
+func (c *testCluster) applied(k, v string, d time.Duration, ids ...int) bool {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		ok := true
+		for _, id := range ids {
+			n := c.node(id)
+			if n == nil {
+				ok = false
+				break
+			}
+			if got, found := n.store().Lookup(k); !found || got != v {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func (c *testCluster) waitFor(d time.Duration, what string, cond func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("timed out waiting for %s", what)
+}
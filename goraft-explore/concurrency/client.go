@@ -0,0 +1,269 @@
+// Package concurrency implements distributed locks and leader election on top
+// of the goraft-explore key-value HTTP API.
+//
+// Both recipes queue contenders by the revision at which their key was
+// created. Revisions follow the raft log, so every node agrees on the order,
+// each contender waits only for the one queued directly ahead of it, and the
+// create revision of a lock key doubles as its fencing token.
+package concurrency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrLeaseNotFound is returned for a lease that expired or was revoked.
+	ErrLeaseNotFound = errors.New("concurrency: lease not found")
+	// ErrUnavailable is returned when the node could not commit a request in
+	// time, typically because it is cut off from the leader.
+	ErrUnavailable = errors.New("concurrency: node unavailable")
+)
+
+// KeyValue is a key with the revisions at which it was created and last
+// modified.
+type KeyValue struct {
+	Key            string `json:"key"`
+	Value          string `json:"value"`
+	CreateRevision int64  `json:"create_revision"`
+	ModRevision    int64  `json:"mod_revision"`
+	Lease          int64  `json:"lease,omitempty"`
+}
+
+// Client talks to the key-value API of a single node.
+type Client struct {
+	endpoint string
+	hc       *http.Client
+}
+
+// NewClient returns a client for the node serving the key-value API at
+// endpoint, such as "http://127.0.0.1:9121". A nil hc uses
+// http.DefaultClient.
+func NewClient(endpoint string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{endpoint: strings.TrimSuffix(endpoint, "/"), hc: hc}
+}
+
+func (c *Client) do(ctx context.Context, method, path, body string) (*http.Response, error) {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.endpoint+path, r)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// statusError turns a failed response into an error and closes its body.
+func statusError(resp *http.Response) error {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrLeaseNotFound
+	case http.StatusServiceUnavailable:
+		return ErrUnavailable
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("concurrency: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+type leaseResponse struct {
+	ID  int64 `json:"id"`
+	TTL int64 `json:"ttl"`
+}
+
+// Grant creates a lease with the given TTL in seconds.
+func (c *Client) Grant(ctx context.Context, ttl int64) (int64, error) {
+	resp, err := c.do(ctx, "POST", "/lease?ttl="+strconv.FormatInt(ttl, 10), "")
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, statusError(resp)
+	}
+	defer resp.Body.Close()
+	var lr leaseResponse
+	if err := json.NewDecoder(resp.Body).Decode(&lr); err != nil {
+		return 0, err
+	}
+	return lr.ID, nil
+}
+
+// KeepAlive restarts the TTL of a lease.
+func (c *Client) KeepAlive(ctx context.Context, lease int64) error {
+	resp, err := c.do(ctx, "POST", "/lease/"+strconv.FormatInt(lease, 10)+"/keepalive", "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Revoke deletes a lease and every key attached to it.
+func (c *Client) Revoke(ctx context.Context, lease int64) error {
+	resp, err := c.do(ctx, "DELETE", "/lease/"+strconv.FormatInt(lease, 10), "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return statusError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Put stores key=val attached to lease (none if zero) and returns the key as
+// committed.
+func (c *Client) Put(ctx context.Context, key, val string, lease int64) (KeyValue, error) {
+	resp, err := c.do(ctx, "PUT", key+"?lease="+strconv.FormatInt(lease, 10), val)
+	if err != nil {
+		return KeyValue{}, err
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return KeyValue{}, statusError(resp)
+	}
+	resp.Body.Close()
+	kv := keyFromHeaders(key, resp.Header)
+	kv.Value = val
+	return kv, nil
+}
+
+// Delete removes key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, "DELETE", key, "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return statusError(resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get returns key as the node currently sees it.
+func (c *Client) Get(ctx context.Context, key string) (KeyValue, bool, error) {
+	return c.get(ctx, key)
+}
+
+// Wait blocks until key is deleted or modified after revision rev and returns
+// it as it then is. The node gives up after a while, so Wait may return the
+// key unchanged; callers loop until they see what they are waiting for.
+func (c *Client) Wait(ctx context.Context, key string, rev int64) (KeyValue, bool, error) {
+	return c.get(ctx, key+"?wait="+strconv.FormatInt(rev, 10))
+}
+
+func (c *Client) get(ctx context.Context, path string) (KeyValue, bool, error) {
+	resp, err := c.do(ctx, "GET", path, "")
+	if err != nil {
+		return KeyValue{}, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return KeyValue{}, false, nil
+	default:
+		return KeyValue{}, false, statusError(resp)
+	}
+	val, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return KeyValue{}, false, err
+	}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	kv := keyFromHeaders(path, resp.Header)
+	kv.Value = string(val)
+	return kv, true, nil
+}
+
+// Range returns the keys starting with prefix, oldest first, and the store
+// revision they were read at.
+func (c *Client) Range(ctx context.Context, prefix string) ([]KeyValue, int64, error) {
+	return c.rangeKeys(ctx, prefix+"?prefix")
+}
+
+// WaitRange is Range once the store revision has moved past rev. Like Wait,
+// it may return early with nothing changed.
+func (c *Client) WaitRange(ctx context.Context, prefix string, rev int64) ([]KeyValue, int64, error) {
+	return c.rangeKeys(ctx, prefix+"?prefix&wait="+strconv.FormatInt(rev, 10))
+}
+
+func (c *Client) rangeKeys(ctx context.Context, path string) ([]KeyValue, int64, error) {
+	resp, err := c.do(ctx, "GET", path, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, statusError(resp)
+	}
+	defer resp.Body.Close()
+	var kvs []KeyValue
+	if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, 0, err
+	}
+	rev, _ := strconv.ParseInt(resp.Header.Get("X-Revision"), 10, 64)
+	return kvs, rev, nil
+}
+
+func keyFromHeaders(key string, h http.Header) KeyValue {
+	n := func(name string) int64 {
+		v, _ := strconv.ParseInt(h.Get(name), 10, 64)
+		return v
+	}
+	return KeyValue{
+		Key:            key,
+		CreateRevision: n("X-Create-Revision"),
+		ModRevision:    n("X-Mod-Revision"),
+		Lease:          n("X-Lease"),
+	}
+}
+
+// retryInterval is the pause before retrying a request a node could not
+// commit.
+var retryInterval = 100 * time.Millisecond
+
+// attemptTimeout bounds each attempt made by retry, so that a proposal the
+// node dropped is retried rather than waited on.
+var attemptTimeout = time.Second
+
+// retry runs f until it succeeds, the lease it depends on is gone or ctx is
+// done. Anything else, such as a node cut off from the leader, is retried.
+func retry(ctx context.Context, f func(ctx context.Context) error) error {
+	for {
+		actx, cancel := context.WithTimeout(ctx, attemptTimeout)
+		err := f(actx)
+		cancel()
+		if err == nil || err == ErrLeaseNotFound || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
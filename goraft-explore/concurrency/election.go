@@ -0,0 +1,120 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrElectionNotLeader is returned by Proclaim and Resign when the
+	// election was not won through this Election.
+	ErrElectionNotLeader = errors.New("concurrency: not leader")
+	// ErrElectionNoLeader is returned by Leader when nobody is campaigning.
+	ErrElectionNoLeader = errors.New("concurrency: no leader")
+)
+
+// Election elects a leader among the sessions campaigning under a prefix. The
+// leader is the oldest campaigner; the others take over in the order they
+// started campaigning.
+type Election struct {
+	s         *Session
+	pfx       string
+	leaderKey string
+	leaderRev int64
+}
+
+// NewElection returns an election named pfx, such as "/elections/scheduler",
+// contested through session s.
+func NewElection(s *Session, pfx string) *Election {
+	return &Election{s: s, pfx: pfx + "/"}
+}
+
+// Campaign blocks until this session is elected or ctx is done. val is the
+// value announced to observers, typically the candidate's address.
+func (e *Election) Campaign(ctx context.Context, val string) error {
+	key, rev, err := enqueue(ctx, e.s, e.pfx, val)
+	if err != nil {
+		return err
+	}
+	e.leaderKey, e.leaderRev = key, rev
+	return nil
+}
+
+// Proclaim announces a new value while leading.
+func (e *Election) Proclaim(ctx context.Context, val string) error {
+	if e.leaderKey == "" {
+		return ErrElectionNotLeader
+	}
+	c := e.s.client
+	err := retry(ctx, func(ctx context.Context) error {
+		_, err := c.Put(ctx, e.leaderKey, val, e.s.lease)
+		return err
+	})
+	if err == ErrLeaseNotFound {
+		e.leaderKey, e.leaderRev = "", 0
+		return ErrSessionExpired
+	}
+	return err
+}
+
+// Resign gives up leadership so the next campaigner is elected.
+func (e *Election) Resign(ctx context.Context) error {
+	if e.leaderKey == "" {
+		return ErrElectionNotLeader
+	}
+	c := e.s.client
+	if err := retry(ctx, func(ctx context.Context) error { return c.Delete(ctx, e.leaderKey) }); err != nil {
+		return err
+	}
+	e.leaderKey, e.leaderRev = "", 0
+	return nil
+}
+
+// Rev is the revision at which this session's campaign key was created, or 0
+// if it is not leading.
+func (e *Election) Rev() int64 { return e.leaderRev }
+
+// Leader returns the current leader's key and value.
+func (e *Election) Leader(ctx context.Context) (KeyValue, error) {
+	kvs, _, err := e.s.client.Range(ctx, e.pfx)
+	if err != nil {
+		return KeyValue{}, err
+	}
+	if len(kvs) == 0 {
+		return KeyValue{}, ErrElectionNoLeader
+	}
+	return kvs[0], nil
+}
+
+// Observe reports the leader whenever it changes or proclaims a new value,
+// until ctx is done.
+func (e *Election) Observe(ctx context.Context) <-chan KeyValue {
+	ch := make(chan KeyValue)
+	go func() {
+		defer close(ch)
+		var last KeyValue
+		kvs, rev, err := e.s.client.Range(ctx, e.pfx)
+		for ctx.Err() == nil {
+			if err != nil {
+				select {
+				case <-time.After(retryInterval):
+				case <-ctx.Done():
+					return
+				}
+				kvs, rev, err = e.s.client.Range(ctx, e.pfx)
+				continue
+			}
+			if len(kvs) > 0 && (kvs[0].Key != last.Key || kvs[0].ModRevision != last.ModRevision) {
+				last = kvs[0]
+				select {
+				case ch <- last:
+				case <-ctx.Done():
+					return
+				}
+			}
+			kvs, rev, err = e.s.client.WaitRange(ctx, e.pfx, rev)
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,162 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrSessionExpired is returned when the session's lease is lost before
+	// a lock or leadership is acquired.
+	ErrSessionExpired = errors.New("concurrency: session expired")
+	// ErrNotHeld is returned when releasing a lock that is not held.
+	ErrNotHeld = errors.New("concurrency: lock not held")
+)
+
+// cleanupTimeout bounds the removal of a queued key after a failed attempt.
+var cleanupTimeout = 5 * time.Second
+
+// Mutex is a distributed lock. Contenders queue under a common prefix in the
+// order their keys were created and are granted the lock in that order.
+type Mutex struct {
+	s     *Session
+	pfx   string
+	myKey string
+	myRev int64
+}
+
+// NewMutex returns a lock named pfx, such as "/locks/reindex", held through
+// session s.
+func NewMutex(s *Session, pfx string) *Mutex {
+	return &Mutex{s: s, pfx: pfx + "/"}
+}
+
+// Lock blocks until the lock is held or ctx is done.
+func (m *Mutex) Lock(ctx context.Context) error {
+	key, rev, err := enqueue(ctx, m.s, m.pfx, "")
+	if err != nil {
+		return err
+	}
+	m.myKey, m.myRev = key, rev
+	return nil
+}
+
+// Unlock releases the lock, retrying until ctx is done if the node cannot
+// commit the release.
+func (m *Mutex) Unlock(ctx context.Context) error {
+	if m.myKey == "" {
+		return ErrNotHeld
+	}
+	c := m.s.client
+	if err := retry(ctx, func(ctx context.Context) error { return c.Delete(ctx, m.myKey) }); err != nil {
+		return err
+	}
+	m.myKey, m.myRev = "", 0
+	return nil
+}
+
+// Key is the key that holds the lock, or "" if it is not held.
+func (m *Mutex) Key() string { return m.myKey }
+
+// Token is the fencing token of the current hold: the raft revision at which
+// the lock key was created. Tokens grow with every new holder, so a resource
+// that rejects tokens lower than the highest it has seen also rejects a
+// holder whose session expired while it was paused or partitioned.
+func (m *Mutex) Token() int64 { return m.myRev }
+
+// enqueue creates the session's key under pfx with value val and waits until
+// every key created before it has been deleted. It returns the key and its
+// create revision.
+func enqueue(ctx context.Context, s *Session, pfx, val string) (string, int64, error) {
+	c := s.client
+	key := pfx + strconv.FormatInt(s.lease, 16)
+	var kv KeyValue
+	err := retry(ctx, func(ctx context.Context) (err error) {
+		// the key is named after the lease, so a retried put keeps the
+		// create revision of one that went through
+		kv, err = c.Put(ctx, key, val, s.lease)
+		return err
+	})
+	if err == ErrLeaseNotFound {
+		return "", 0, ErrSessionExpired
+	}
+	if err != nil {
+		dequeue(c, key)
+		return "", 0, err
+	}
+
+	if err := waitPredecessors(ctx, c, pfx, kv.CreateRevision); err != nil {
+		dequeue(c, key)
+		return "", 0, err
+	}
+
+	// the lease may have run out while waiting
+	cur, ok, err := c.Get(ctx, key)
+	if err != nil {
+		dequeue(c, key)
+		return "", 0, err
+	}
+	if !ok || cur.CreateRevision != kv.CreateRevision {
+		return "", 0, ErrSessionExpired
+	}
+	return key, kv.CreateRevision, nil
+}
+
+// dequeue makes a best effort to remove a key left behind by a failed
+// attempt. Failing that, it goes when the session's lease does.
+func dequeue(c *Client, key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	c.Delete(ctx, key)
+}
+
+// waitPredecessors blocks until no key under pfx was created before rev. Each
+// contender watches only the key directly ahead of it.
+func waitPredecessors(ctx context.Context, c *Client, pfx string, rev int64) error {
+	for {
+		var kvs []KeyValue
+		err := retry(ctx, func(ctx context.Context) (err error) {
+			kvs, _, err = c.Range(ctx, pfx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		var pred *KeyValue
+		for i := range kvs {
+			if kvs[i].CreateRevision < rev {
+				pred = &kvs[i]
+			}
+		}
+		if pred == nil {
+			return nil
+		}
+		if err := waitDelete(ctx, c, *pred); err != nil {
+			return err
+		}
+	}
+}
+
+// waitDelete blocks until kv has been deleted.
+func waitDelete(ctx context.Context, c *Client, kv KeyValue) error {
+	for {
+		cur, ok, err := c.Wait(ctx, kv.Key, kv.ModRevision)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			select {
+			case <-time.After(retryInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if !ok || cur.CreateRevision != kv.CreateRevision {
+			return nil
+		}
+		kv = cur
+	}
+}
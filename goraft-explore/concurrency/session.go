@@ -0,0 +1,87 @@
+package concurrency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Session is a lease kept alive in the background. Keys created by locks and
+// elections are attached to it, so they disappear if the owner stops
+// renewing it.
+type Session struct {
+	client *Client
+	lease  int64
+	ttl    int64
+
+	cancel context.CancelFunc
+	once   sync.Once
+	donec  chan struct{}
+}
+
+// NewSession grants a lease with the given TTL in seconds and keeps it alive
+// until the session is closed.
+func NewSession(ctx context.Context, client *Client, ttl int64) (*Session, error) {
+	var lease int64
+	err := retry(ctx, func(ctx context.Context) (err error) {
+		lease, err = client.Grant(ctx, ttl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	kctx, cancel := context.WithCancel(context.Background())
+	s := &Session{client: client, lease: lease, ttl: ttl, cancel: cancel, donec: make(chan struct{})}
+	go s.keepAlive(kctx)
+	return s, nil
+}
+
+// Client is the client the session was created with.
+func (s *Session) Client() *Client { return s.client }
+
+// Lease is the ID of the session's lease.
+func (s *Session) Lease() int64 { return s.lease }
+
+// Done is closed once the lease has expired or the session is closed. A lock
+// or leadership held through the session must be considered lost by then.
+func (s *Session) Done() <-chan struct{} { return s.donec }
+
+// Close stops renewing the lease and revokes it, releasing every lock and
+// leadership held through the session.
+func (s *Session) Close(ctx context.Context) error {
+	s.end()
+	err := retry(ctx, func(ctx context.Context) error { return s.client.Revoke(ctx, s.lease) })
+	if err == ErrLeaseNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *Session) end() {
+	s.once.Do(func() {
+		s.cancel()
+		close(s.donec)
+	})
+}
+
+// keepAlive renews the lease three times per TTL, and retries sooner when a
+// renewal does not go through.
+func (s *Session) keepAlive(ctx context.Context) {
+	interval := time.Duration(s.ttl) * time.Second / 3
+	for {
+		err := s.client.KeepAlive(ctx, s.lease)
+		if err == ErrLeaseNotFound {
+			s.end()
+			return
+		}
+		wait := interval
+		if err != nil && retryInterval < wait {
+			wait = retryInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ishworgurung/go-experiments/goraft-explore/concurrency"
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+// serveKV serves the key-value API of node id, whichever incarnation of it is
+// running, and returns its URL.
+func (c *testCluster) serveKV(id int) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := c.node(id)
+		if n == nil {
+			http.Error(w, "node is down", http.StatusServiceUnavailable)
+			return
+		}
+		(&httpKVAPI{store: n.store(), confChangeC: n.confChangeC}).ServeHTTP(w, r)
+	}))
+	c.t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func newSession(t *testing.T, ctx context.Context, url string, ttl int64) *concurrency.Session {
+	t.Helper()
+	s, err := concurrency.NewSession(ctx, concurrency.NewClient(url, nil), ttl)
+	if err != nil {
+		t.Fatalf("session: %v", err)
+	}
+	return s
+}
+
+// fencedResource accepts writes only from the newest lock holder it has seen.
+type fencedResource struct {
+	mu    sync.Mutex
+	token int64
+}
+
+func (r *fencedResource) write(token int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if token < r.token {
+		return false
+	}
+	r.token = token
+	return true
+}
+
+func TestMutexNoOverlapUnderPartitions(t *testing.T) {
+	c := newTestCluster(t, 3, defaultSnapCount)
+	c.leader()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var (
+		holders   int32
+		mu        sync.Mutex
+		lastToken int64
+		acquired  int
+		wg        sync.WaitGroup
+	)
+	stop := make(chan struct{})
+	for i := 0; i < 6; i++ {
+		// two contenders per node
+		m := concurrency.NewMutex(newSession(t, ctx, c.serveKV(i%3+1), 60), "/locks/test")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := m.Lock(ctx); err != nil {
+					t.Errorf("lock: %v", err)
+					return
+				}
+				if n := atomic.AddInt32(&holders, 1); n != 1 {
+					t.Errorf("%d holders at once", n)
+				}
+				mu.Lock()
+				if m.Token() <= lastToken {
+					t.Errorf("fencing token %d after %d", m.Token(), lastToken)
+				}
+				lastToken = m.Token()
+				acquired++
+				mu.Unlock()
+				time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+				atomic.AddInt32(&holders, -1)
+				if err := m.Unlock(ctx); err != nil {
+					t.Errorf("unlock: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	// isolate each node in turn while the contenders run
+	for round := 0; round < 9; round++ {
+		c.net.partition([]uint64{uint64(round%3 + 1)}, others(round%3+1, 3))
+		time.Sleep(300 * time.Millisecond)
+		c.net.heal()
+		time.Sleep(200 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	if acquired < 10 {
+		t.Fatalf("lock acquired only %d times", acquired)
+	}
+}
+
+func others(id, n int) []uint64 {
+	var ids []uint64
+	for i := 1; i <= n; i++ {
+		if i != id {
+			ids = append(ids, uint64(i))
+		}
+	}
+	return ids
+}
+
+func TestMutexFencingAfterExpiry(t *testing.T) {
+	c := newTestCluster(t, 3, defaultSnapCount)
+	c.leader()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var res fencedResource
+
+	sa := newSession(t, ctx, c.serveKV(1), 3)
+	ma := concurrency.NewMutex(sa, "/locks/fence")
+	if err := ma.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !res.write(ma.Token()) {
+		t.Fatal("first holder rejected")
+	}
+
+	// the holder is cut off and its lease runs out on the majority side
+	c.net.partition([]uint64{1}, []uint64{2, 3})
+	c.leader(2, 3)
+	settle()
+	testClock.Advance(4 * time.Second)
+	c.waitDeleted(ma.Key(), 2, 3)
+
+	mb := concurrency.NewMutex(newSession(t, ctx, c.serveKV(2), 3), "/locks/fence")
+	if err := mb.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if mb.Token() <= ma.Token() {
+		t.Fatalf("new holder token %d not above %d", mb.Token(), ma.Token())
+	}
+	if !res.write(mb.Token()) {
+		t.Fatal("new holder rejected")
+	}
+	if res.write(ma.Token()) {
+		t.Fatal("stale holder accepted")
+	}
+
+	// once reconnected, the old holder learns that its session is gone
+	c.net.heal()
+	select {
+	case <-sa.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("expired session not reported")
+	}
+}
+
+func TestMutexFairOrder(t *testing.T) {
+	c := newTestCluster(t, 3, defaultSnapCount)
+	c.leader()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	first := concurrency.NewMutex(newSession(t, ctx, c.serveKV(1), 60), "/locks/fair")
+	if err := first.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cl := concurrency.NewClient(c.serveKV(1), nil)
+	queued := func(n int) {
+		c.waitFor(5*time.Second, "contender to queue", func() bool {
+			kvs, _, err := cl.Range(ctx, "/locks/fair/")
+			return err == nil && len(kvs) == n
+		})
+	}
+	order := make(chan int, 2)
+	waiters := make([]*concurrency.Mutex, 2)
+	for i := range waiters {
+		i := i
+		// alternate nodes; queue order is still the order of creation
+		waiters[i] = concurrency.NewMutex(newSession(t, ctx, c.serveKV(3-i), 60), "/locks/fair")
+		go func() {
+			if err := waiters[i].Lock(ctx); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+		}()
+		queued(i + 2)
+	}
+
+	if err := first.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-order; got != 0 {
+		t.Fatalf("contender %d overtook the first in line", got)
+	}
+	select {
+	case <-order:
+		t.Fatal("lock granted to two contenders")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := waiters[0].Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-order; got != 1 {
+		t.Fatalf("got contender %d, want 1", got)
+	}
+}
+
+func TestElection(t *testing.T) {
+	c := newTestCluster(t, 3, defaultSnapCount)
+	c.leader()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	e1 := concurrency.NewElection(newSession(t, ctx, c.serveKV(1), 60), "/elections/test")
+	e2 := concurrency.NewElection(newSession(t, ctx, c.serveKV(2), 60), "/elections/test")
+	observer := concurrency.NewElection(newSession(t, ctx, c.serveKV(3), 60), "/elections/test")
+
+	if _, err := observer.Leader(ctx); err != concurrency.ErrElectionNoLeader {
+		t.Fatalf("leader before any campaign: %v", err)
+	}
+	if err := e1.Campaign(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	obs := observer.Observe(ctx)
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case kv := <-obs:
+			if kv.Value != want {
+				t.Fatalf("observed leader %q, want %q", kv.Value, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("leader %q not observed", want)
+		}
+	}
+	expect("a")
+
+	elected := make(chan error, 1)
+	go func() { elected <- e2.Campaign(ctx, "b") }()
+
+	if err := e1.Proclaim(ctx, "a2"); err != nil {
+		t.Fatal(err)
+	}
+	expect("a2")
+	select {
+	case <-elected:
+		t.Fatal("second candidate elected while the first leads")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := e1.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-elected; err != nil {
+		t.Fatal(err)
+	}
+	expect("b")
+	if kv, err := observer.Leader(ctx); err != nil || kv.Value != "b" {
+		t.Fatalf("leader = %q, %v", kv.Value, err)
+	}
+	if err := e1.Proclaim(ctx, "stale"); err != concurrency.ErrElectionNotLeader {
+		t.Fatalf("proclaim after resigning: %v", err)
+	}
+}
+
+// TestMemberRoutes checks that membership changes go through /members/<id>
+// and the deprecated /<id>, and that keys the member, lease and snapshot
+// endpoints would shadow are refused.
+func TestMemberRoutes(t *testing.T) {
+	c := newTestCluster(t, 1, defaultSnapCount)
+	c.leader()
+	confChangeC := make(chan raftpb.ConfChangeI, 1)
+	srv := httptest.NewServer(&httpKVAPI{store: c.node(1).store(), confChangeC: confChangeC})
+	defer srv.Close()
+	do := func(method, path string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader("v"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	removed := func(path string, id uint64) {
+		t.Helper()
+		if got := do("DELETE", path); got != http.StatusNoContent {
+			t.Fatalf("DELETE %s = %d", path, got)
+		}
+		if cc := (<-confChangeC).AsV2().Changes[0]; cc.Type != raftpb.ConfChangeRemoveNode || cc.NodeID != id {
+			t.Errorf("DELETE %s proposed %v", path, cc)
+		}
+	}
+
+	for _, k := range []string{"/42", "/0x10", "/members/x", "/snapshot", "/lease", "/lease/7"} {
+		if got := do("PUT", k); got != http.StatusBadRequest {
+			t.Errorf("PUT %s = %d, want %d", k, got, http.StatusBadRequest)
+		}
+	}
+	removed("/members/2", 2)
+	removed("/42", 42)
+	removed("/0x10", 16)
+	if got := do("DELETE", "/members/two"); got != http.StatusBadRequest {
+		t.Errorf("DELETE /members/two = %d", got)
+	}
+
+	c.put(c.node(1), "/lock/42", "v", 1)
+	if got := do("DELETE", "/lock/42"); got != http.StatusNoContent {
+		t.Fatalf("DELETE /lock/42 = %d", got)
+	}
+	if c.present("/lock/42", 1) {
+		t.Error("/lock/42 was not deleted")
+	}
+	select {
+	case cc := <-confChangeC:
+		t.Fatalf("DELETE /lock/42 proposed conf change %v", cc)
+	default:
+	}
+}
@@ -15,22 +15,72 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/coreos/etcd/raft/raftpb"
+	"go.etcd.io/etcd/pkg/transport"
+	"go.etcd.io/etcd/raft/raftpb"
 )
 
 // Handler for a http based key-value store backed by raft
 type httpKVAPI struct {
 	store       *kvstore
-	confChangeC chan<- raftpb.ConfChange
+	confChangeC chan<- raftpb.ConfChangeI
 }
 
+// proposeTimeout bounds how long a request waits for its proposal to apply.
+var proposeTimeout = 5 * time.Second
+
+// waitTimeout bounds a GET ?wait long poll; the key is returned as it is then.
+var waitTimeout = 30 * time.Second
+
+// Revision headers carried by GET and by PUT and DELETE requests that wait
+// for their commit.
+const (
+	headerRevision       = "X-Revision" // store revision the response reflects
+	headerCreateRevision = "X-Create-Revision"
+	headerModRevision    = "X-Mod-Revision"
+	headerLease          = "X-Lease"
+)
+
 func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	key := r.RequestURI
+	if i := strings.IndexByte(key, '?'); i >= 0 {
+		key = key[:i]
+	}
+	if r.Method == "PUT" {
+		// keys the other endpoints take could never be read back
+		if err := checkKey(key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if r.URL.Path == "/lease" || strings.HasPrefix(r.URL.Path, "/lease/") {
+		h.serveLease(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/members/") {
+		h.serveMembers(w, r)
+		return
+	}
+	if r.URL.Path == "/snapshot" && r.Method == "GET" {
+		h.serveBackup(w, r)
+		return
+	}
+	if nodeId, ok := deprecatedMemberID(key); ok && (r.Method == "POST" || r.Method == "DELETE") {
+		log.Printf("%s %s is deprecated, use %s /members/%d\n", r.Method, key, r.Method, nodeId)
+		h.changeMember(w, r, nodeId)
+		return
+	}
 	switch {
 	case r.Method == "PUT":
 		v, err := ioutil.ReadAll(r.Body)
@@ -40,49 +90,174 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if l := r.URL.Query().Get("lease"); l != "" {
+			// a key on a lease (or ?lease=0 for none) waits for the
+			// commit so a missing lease and the key's revisions are
+			// reported to the client
+			id, err := strconv.ParseInt(l, 0, 64)
+			if err != nil {
+				http.Error(w, "Failed on PUT", http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), proposeTimeout)
+			defer cancel()
+			kv, err := h.store.PutWithLease(ctx, key, string(v), id)
+			if err != nil {
+				writeProposeError(w, err)
+				return
+			}
+			writeKeyHeaders(w, kv, kv.ModRevision)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
 		h.store.Propose(key, string(v))
 
 		// Optimistic-- no waiting for ack from raft. Value is not yet
 		// committed so a subsequent GET on the key may return old value
 		w.WriteHeader(http.StatusNoContent)
 	case r.Method == "GET":
-		if v, ok := h.store.Lookup(key); ok {
-			w.Write([]byte(v))
+		q := r.URL.Query()
+		if _, ok := q["prefix"]; ok {
+			if wait := q.Get("wait"); wait != "" {
+				// long poll until anything in the store changes after
+				// the given revision
+				after, err := strconv.ParseInt(wait, 0, 64)
+				if err != nil {
+					http.Error(w, "Failed to GET", http.StatusBadRequest)
+					return
+				}
+				ctx, cancel := context.WithTimeout(r.Context(), waitTimeout)
+				defer cancel()
+				h.store.WaitRevision(ctx, after)
+			}
+			kvs, rev := h.store.Range(key)
+			if kvs == nil {
+				kvs = []keyValue{}
+			}
+			w.Header().Set(headerRevision, strconv.FormatInt(rev, 10))
+			writeJSON(w, kvs)
+			return
+		}
+
+		var (
+			kv  keyValue
+			rev int64
+			ok  bool
+		)
+		if wait := q.Get("wait"); wait != "" {
+			// long poll until the key is deleted or modified after the
+			// given revision
+			after, err := strconv.ParseInt(wait, 0, 64)
+			if err != nil {
+				http.Error(w, "Failed to GET", http.StatusBadRequest)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), waitTimeout)
+			defer cancel()
+			kv, rev, ok = h.store.Wait(ctx, key, after)
 		} else {
+			kv, rev, ok = h.store.Get(key)
+		}
+		if ok {
+			writeKeyHeaders(w, kv, rev)
+			w.Write([]byte(kv.Value))
+		} else {
+			w.Header().Set(headerRevision, strconv.FormatInt(rev, 10))
 			http.Error(w, "Failed to GET", http.StatusNotFound)
 		}
-	case r.Method == "POST":
-		url, err := ioutil.ReadAll(r.Body)
+	case r.Method == "DELETE":
+		ctx, cancel := context.WithTimeout(r.Context(), proposeTimeout)
+		defer cancel()
+		rev, err := h.store.Delete(ctx, key)
 		if err != nil {
-			log.Printf("Failed to read on POST (%v)\n", err)
-			http.Error(w, "Failed on POST", http.StatusBadRequest)
+			writeProposeError(w, err)
 			return
 		}
+		w.Header().Set(headerRevision, strconv.FormatInt(rev, 10))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "PUT")
+		w.Header().Add("Allow", "GET")
+		w.Header().Add("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deprecatedMemberID returns the node ID of a key of the original membership
+// API, POST /<id> and DELETE /<id>, which is kept as an alias of
+// /members/<id>.
+func deprecatedMemberID(key string) (uint64, bool) {
+	nodeId, err := strconv.ParseUint(strings.TrimPrefix(key, "/"), 0, 64)
+	return nodeId, err == nil
+}
 
-		nodeId, err := strconv.ParseUint(key[1:], 0, 64)
+// checkKey rejects the keys a PUT may not store: node IDs, which DELETE takes
+// as the deprecated member API, and the paths of the member, lease and
+// snapshot endpoints.
+func checkKey(key string) error {
+	if _, ok := deprecatedMemberID(key); ok {
+		return fmt.Errorf("key %s is reserved: numeric keys are node IDs of the member API", key)
+	}
+	switch {
+	case strings.HasPrefix(key, "/members/"):
+		return fmt.Errorf("key %s is reserved for the member API", key)
+	case key == "/lease" || strings.HasPrefix(key, "/lease/"):
+		return fmt.Errorf("key %s is reserved for the lease API", key)
+	case key == "/snapshot":
+		return fmt.Errorf("key %s is reserved for snapshot save", key)
+	}
+	return nil
+}
+
+// serveMembers handles membership changes on a path of their own, so that no
+// key can be mistaken for a node ID:
+//
+//	POST   /members/<id>    add the node at the URL in the body as a learner
+//	DELETE /members/<id>    remove the node
+func (h *httpKVAPI) serveMembers(w http.ResponseWriter, r *http.Request) {
+	nodeId, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/members/"), 0, 64)
+	if err != nil {
+		log.Printf("Failed to convert ID for conf change (%v)\n", err)
+		http.Error(w, "Failed on conf change", http.StatusBadRequest)
+		return
+	}
+	h.changeMember(w, r, nodeId)
+}
+
+// changeMember proposes the membership change of a member API request for
+// node nodeId.
+func (h *httpKVAPI) changeMember(w http.ResponseWriter, r *http.Request, nodeId uint64) {
+	switch r.Method {
+	case "POST":
+		url, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Printf("Failed to convert ID for conf change (%v)\n", err)
+			log.Printf("Failed to read on POST (%v)\n", err)
 			http.Error(w, "Failed on POST", http.StatusBadRequest)
 			return
 		}
 
+		// the node joins as a learner and is promoted by the leader once
+		// it has caught up; ?replace=<id> removes that voter on promotion
+		mc := memberContext{URL: string(url)}
+		if old := r.URL.Query().Get("replace"); old != "" {
+			if mc.Replaces, err = strconv.ParseUint(old, 0, 64); err != nil {
+				log.Printf("Failed to convert ID for conf change (%v)\n", err)
+				http.Error(w, "Failed on POST", http.StatusBadRequest)
+				return
+			}
+		}
+
 		cc := raftpb.ConfChange{
-			Type:    raftpb.ConfChangeAddNode,
+			Type:    raftpb.ConfChangeAddLearnerNode,
 			NodeID:  nodeId,
-			Context: url,
+			Context: encodeMemberContext(mc),
 		}
 		h.confChangeC <- cc
 
 		// As above, optimistic that raft will apply the conf change
 		w.WriteHeader(http.StatusNoContent)
-	case r.Method == "DELETE":
-		nodeId, err := strconv.ParseUint(key[1:], 0, 64)
-		if err != nil {
-			log.Printf("Failed to convert ID for conf change (%v)\n", err)
-			http.Error(w, "Failed on DELETE", http.StatusBadRequest)
-			return
-		}
-
+	case "DELETE":
 		cc := raftpb.ConfChange{
 			Type:   raftpb.ConfChangeRemoveNode,
 			NodeID: nodeId,
@@ -92,16 +267,148 @@ func (h *httpKVAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// As above, optimistic that raft will apply the conf change
 		w.WriteHeader(http.StatusNoContent)
 	default:
-		w.Header().Set("Allow", "PUT")
-		w.Header().Add("Allow", "GET")
-		w.Header().Add("Allow", "POST")
+		w.Header().Set("Allow", "POST")
 		w.Header().Add("Allow", "DELETE")
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// serveBackup writes a backup of the store, as read by `snapshot restore`.
+func (h *httpKVAPI) serveBackup(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), proposeTimeout)
+	defer cancel()
+	b, err := h.store.Backup(ctx)
+	if err != nil {
+		writeProposeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// leaseResponse is the JSON body returned by the lease endpoints.
+type leaseResponse struct {
+	ID        int64    `json:"id"`
+	TTL       int64    `json:"ttl"`
+	Remaining float64  `json:"remaining,omitempty"` // seconds, as seen by this node
+	Keys      []string `json:"keys,omitempty"`
+}
+
+// serveLease handles the lease API:
+//
+//	POST   /lease?ttl=<seconds>     grant a lease
+//	POST   /lease/<id>/keepalive    restart its TTL
+//	GET    /lease/<id>              TTL, time remaining and attached keys
+//	DELETE /lease/<id>              revoke it, deleting its keys
+//
+// Keys are attached with PUT /<key>?lease=<id>.
+func (h *httpKVAPI) serveLease(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), proposeTimeout)
+	defer cancel()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) == 1 {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ttl, err := strconv.ParseInt(r.URL.Query().Get("ttl"), 0, 64)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "Failed on POST: ttl must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		id, err := h.store.Grant(ctx, ttl)
+		if err != nil {
+			writeProposeError(w, err)
+			return
+		}
+		writeJSON(w, leaseResponse{ID: id, TTL: ttl})
+		return
+	}
+
+	id, err := strconv.ParseInt(parts[1], 0, 64)
+	if err != nil || len(parts) > 3 || (len(parts) == 3 && parts[2] != "keepalive") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(parts) == 3 && r.Method == "POST":
+		if err := h.store.KeepAlive(ctx, id); err != nil {
+			writeProposeError(w, err)
+			return
+		}
+		ttl, _, _, _ := h.store.LeaseTimeToLive(id)
+		writeJSON(w, leaseResponse{ID: id, TTL: ttl})
+	case len(parts) == 2 && r.Method == "GET":
+		ttl, remaining, keys, ok := h.store.LeaseTimeToLive(id)
+		if !ok {
+			http.Error(w, errLeaseNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, leaseResponse{ID: id, TTL: ttl, Remaining: remaining.Seconds(), Keys: keys})
+	case len(parts) == 2 && r.Method == "DELETE":
+		if err := h.store.Revoke(ctx, id); err != nil {
+			writeProposeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeKeyHeaders(w http.ResponseWriter, kv keyValue, rev int64) {
+	w.Header().Set(headerRevision, strconv.FormatInt(rev, 10))
+	w.Header().Set(headerCreateRevision, strconv.FormatInt(kv.CreateRevision, 10))
+	w.Header().Set(headerModRevision, strconv.FormatInt(kv.ModRevision, 10))
+	if kv.Lease != 0 {
+		w.Header().Set(headerLease, strconv.FormatInt(kv.Lease, 10))
+	}
+}
+
+// writeProposeError maps the outcome of a proposal to an HTTP status.
+func writeProposeError(w http.ResponseWriter, err error) {
+	switch err {
+	case errLeaseNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errLeaseExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case context.DeadlineExceeded, errStopped:
+		// the proposal may still commit later
+		http.Error(w, "proposal timed out", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response (%v)\n", err)
+	}
+}
+
+// kvAPITLSConfig builds the server TLS configuration for the key-value API.
+// Client certificates are only requested when ClientCertAuth is set.
+func kvAPITLSConfig(tlsInfo transport.TLSInfo) (*tls.Config, error) {
+	if tlsInfo.ClientCertAuth && tlsInfo.TrustedCAFile == "" {
+		return nil, errors.New("client certificate auth requires a trusted CA file")
+	}
+	cfg, err := tlsInfo.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	if !tlsInfo.ClientCertAuth {
+		cfg.ClientAuth = tls.NoClientCert
+	}
+	return cfg, nil
+}
+
 // serveHttpKVAPI starts a key-value server with a GET/PUT API and listens.
-func serveHttpKVAPI(kv *kvstore, port int, confChangeC chan<- raftpb.ConfChange, errorC <-chan error) {
+// The API is served over TLS when tlsInfo is not empty, and clients must
+// present a certificate when tlsInfo.ClientCertAuth is set.
+func serveHttpKVAPI(kv *kvstore, port int, tlsInfo transport.TLSInfo, confChangeC chan<- raftpb.ConfChangeI, errorC <-chan error) {
 	srv := http.Server{
 		Addr: ":" + strconv.Itoa(port),
 		Handler: &httpKVAPI{
@@ -109,8 +416,21 @@ func serveHttpKVAPI(kv *kvstore, port int, confChangeC chan<- raftpb.ConfChange,
 			confChangeC: confChangeC,
 		},
 	}
+	if !tlsInfo.Empty() {
+		cfg, err := kvAPITLSConfig(tlsInfo)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = cfg
+	}
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil {
 			log.Fatal(err)
 		}
 	}()
@@ -16,33 +16,112 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"log"
+	"math/rand"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/coreos/etcd/snap"
+	"go.etcd.io/etcd/etcdserver/api/snap"
 )
 
+// errStopped is returned to proposers once raft has shut down.
+var errStopped = errors.New("raft stopped")
+
 // a key-value store backed by raft
 type kvstore struct {
 	proposeC    chan<- string // channel for proposing updates
 	mu          sync.RWMutex
 	kvStore     map[string]string // current committed key-value pairs
 	snapshotter *snap.Snapshotter
+	snapIndex   uint64 // index of the last snapshot loaded into kvStore
+	leases      map[int64]*lease
+	keyLeases   map[string]int64 // lease each attached key belongs to
+	primary     bool             // this node leads and expires leases
+	donec       chan struct{}    // closed once raft stops delivering commits
+	rev         int64            // bumped by every applied change to kvStore
+	revs        map[string]keyRevs
+	changed     chan struct{} // closed and replaced after each applied batch
+
+	reqID   uint64 // last proposal ID handed out, see nextID
+	wmu     sync.Mutex
+	waiters map[uint64]chan applyResult // proposals waiting to be applied
+}
+
+// keyRevs records the store revisions at which a key was created and last
+// modified. Revisions follow the order of the raft log, so they are the same
+// on every node.
+type keyRevs struct {
+	Create int64 `json:"create"`
+	Mod    int64 `json:"mod"`
+}
+
+// keyValue is a key with its revisions, as returned by Get and Range.
+type keyValue struct {
+	Key            string `json:"key"`
+	Value          string `json:"value"`
+	CreateRevision int64  `json:"create_revision"`
+	ModRevision    int64  `json:"mod_revision"`
+	Lease          int64  `json:"lease,omitempty"`
 }
 
+// applyResult is handed to the proposer once its proposal is applied.
+type applyResult struct {
+	rev    int64 // store revision after applying
+	create int64 // create revision of the key put
+	err    error
+}
+
+// kvOp is the operation carried by a proposal. The zero value is a put so
+// that entries written before operations existed still decode as puts.
+type kvOp uint8
+
+const (
+	opPut kvOp = iota
+	opLeaseGrant
+	opLeaseKeepAlive
+	opLeaseRevoke
+	opDelete
+	opNoop // commits nothing; a barrier for reads
+)
+
 type kv struct {
-	Key string
-	Val string
+	Key   string
+	Val   string
+	Op    kvOp
+	Lease int64  // lease a put attaches its key to, or the lease operated on
+	TTL   int64  // seconds, for grants
+	ID    uint64 // wakes the proposer once applied; zero if nobody waits
 }
 
-func newKVStore(snapshotter *snap.Snapshotter, proposeC chan<- string, commitC <-chan *string, errorC <-chan error) *kvstore {
-	s := &kvstore{proposeC: proposeC, kvStore: make(map[string]string), snapshotter: snapshotter}
+func newKVStore(snapshotter *snap.Snapshotter, proposeC chan<- string, commitC <-chan *commit, errorC <-chan error) *kvstore {
+	s := &kvstore{
+		proposeC:    proposeC,
+		kvStore:     make(map[string]string),
+		snapshotter: snapshotter,
+		leases:      make(map[int64]*lease),
+		keyLeases:   make(map[string]int64),
+		donec:       make(chan struct{}),
+		revs:        make(map[string]keyRevs),
+		changed:     make(chan struct{}),
+		reqID:       uint64(rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()) << 32,
+		waiters:     make(map[uint64]chan applyResult),
+	}
+	// start from the last snapshot; the log replayed below follows it
+	s.loadSnapshot()
 	// replay log into key-value map
 	s.readCommits(commitC, errorC)
 	// read commits from raft into kvStore map until error
-	go s.readCommits(commitC, errorC)
+	go func() {
+		s.readCommits(commitC, errorC)
+		close(s.donec)
+	}()
 	return s
 }
 
@@ -53,61 +132,345 @@ func (s *kvstore) Lookup(key string) (string, bool) {
 	return v, ok
 }
 
+// Get returns key with its revisions and the current store revision.
+func (s *kvstore) Get(key string) (keyValue, int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	kv, ok := s.get(key)
+	return kv, s.rev, ok
+}
+
+// get looks up key. The caller holds s.mu.
+func (s *kvstore) get(key string) (keyValue, bool) {
+	v, ok := s.kvStore[key]
+	if !ok {
+		return keyValue{}, false
+	}
+	r := s.revs[key]
+	return keyValue{Key: key, Value: v, CreateRevision: r.Create, ModRevision: r.Mod, Lease: s.keyLeases[key]}, true
+}
+
+// Range returns the keys starting with prefix in the order they were created,
+// and the store revision they were read at.
+func (s *kvstore) Range(prefix string) ([]keyValue, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var kvs []keyValue
+	for k := range s.kvStore {
+		if strings.HasPrefix(k, prefix) {
+			kv, _ := s.get(k)
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		if kvs[i].CreateRevision != kvs[j].CreateRevision {
+			return kvs[i].CreateRevision < kvs[j].CreateRevision
+		}
+		return kvs[i].Key < kvs[j].Key
+	})
+	return kvs, s.rev
+}
+
+// Wait blocks until key is deleted or modified after revision rev, or ctx is
+// done, and returns the key as it then is.
+func (s *kvstore) Wait(ctx context.Context, key string, rev int64) (keyValue, int64, bool) {
+	for {
+		s.mu.RLock()
+		kv, ok := s.get(key)
+		cur, changed := s.rev, s.changed
+		s.mu.RUnlock()
+		if !ok || kv.ModRevision > rev {
+			return kv, cur, ok
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return kv, cur, ok
+		case <-s.donec:
+			return kv, cur, ok
+		}
+	}
+}
+
+// WaitRevision blocks until the store revision exceeds rev or ctx is done.
+func (s *kvstore) WaitRevision(ctx context.Context, rev int64) {
+	for {
+		s.mu.RLock()
+		cur, changed := s.rev, s.changed
+		s.mu.RUnlock()
+		if cur > rev {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		case <-s.donec:
+			return
+		}
+	}
+}
+
+// broadcast wakes everything blocked in Wait and WaitRevision. The caller holds s.mu.
+func (s *kvstore) broadcast() {
+	if s.changed != nil {
+		close(s.changed)
+	}
+	s.changed = make(chan struct{})
+}
+
 func (s *kvstore) Propose(k string, v string) {
+	s.propose(kv{Key: k, Val: v})
+}
+
+// propose sends op to raft and reports false if raft has stopped.
+func (s *kvstore) propose(op kv) bool {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(op); err != nil {
+		log.Fatal(err)
+	}
+	select {
+	case s.proposeC <- buf.String():
+		return true
+	case <-s.donec:
+		return false
+	}
+}
+
+// nextID returns a proposal ID. The high half is random per store so that
+// entries proposed through other nodes never wake a local waiter.
+func (s *kvstore) nextID() uint64 {
+	return atomic.AddUint64(&s.reqID, 1)
+}
+
+// proposeAndWait proposes op and waits until it has been applied locally,
+// returning the outcome of applying it. A proposal lost to a leader change is
+// reported as ctx.Err().
+func (s *kvstore) proposeAndWait(ctx context.Context, op kv) applyResult {
+	op.ID = s.nextID()
+	ch := make(chan applyResult, 1)
+	s.wmu.Lock()
+	s.waiters[op.ID] = ch
+	s.wmu.Unlock()
+	defer func() {
+		s.wmu.Lock()
+		delete(s.waiters, op.ID)
+		s.wmu.Unlock()
+	}()
+
 	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(kv{k, v}); err != nil {
+	if err := gob.NewEncoder(&buf).Encode(op); err != nil {
 		log.Fatal(err)
 	}
-	//spew.Dump(buf)
-	s.proposeC <- buf.String()
+	select {
+	case s.proposeC <- buf.String():
+	case <-ctx.Done():
+		return applyResult{err: ctx.Err()}
+	case <-s.donec:
+		return applyResult{err: errStopped}
+	}
+	select {
+	case r := <-ch:
+		return r
+	case <-ctx.Done():
+		return applyResult{err: ctx.Err()}
+	case <-s.donec:
+		return applyResult{err: errStopped}
+	}
+}
+
+// PutWithLease puts k=v attached to lease id (none if zero) and returns the
+// key as applied.
+func (s *kvstore) PutWithLease(ctx context.Context, k, v string, id int64) (keyValue, error) {
+	r := s.proposeAndWait(ctx, kv{Key: k, Val: v, Lease: id})
+	if r.err != nil {
+		return keyValue{}, r.err
+	}
+	return keyValue{Key: k, Value: v, CreateRevision: r.create, ModRevision: r.rev, Lease: id}, nil
+}
+
+// Delete removes key once committed and returns the resulting revision.
+func (s *kvstore) Delete(ctx context.Context, key string) (int64, error) {
+	r := s.proposeAndWait(ctx, kv{Op: opDelete, Key: key})
+	return r.rev, r.err
+}
+
+// Grant creates a lease with the given TTL in seconds and returns its ID.
+func (s *kvstore) Grant(ctx context.Context, ttl int64) (int64, error) {
+	id := int64(s.nextID() &^ (1 << 63))
+	return id, s.proposeAndWait(ctx, kv{Op: opLeaseGrant, Lease: id, TTL: ttl}).err
+}
+
+// KeepAlive restarts the TTL of lease id on every node.
+func (s *kvstore) KeepAlive(ctx context.Context, id int64) error {
+	return s.proposeAndWait(ctx, kv{Op: opLeaseKeepAlive, Lease: id}).err
+}
+
+// Revoke removes lease id and deletes the keys attached to it.
+func (s *kvstore) Revoke(ctx context.Context, id int64) error {
+	return s.proposeAndWait(ctx, kv{Op: opLeaseRevoke, Lease: id}).err
+}
+
+// apply applies a committed proposal. The caller holds s.mu.
+func (s *kvstore) apply(op kv) applyResult {
+	switch op.Op {
+	case opPut:
+		if err := s.attach(op.Key, op.Lease); err != nil {
+			return applyResult{rev: s.rev, err: err}
+		}
+		s.rev++
+		r, ok := s.revs[op.Key]
+		if _, exists := s.kvStore[op.Key]; !exists || !ok {
+			r.Create = s.rev
+		}
+		r.Mod = s.rev
+		s.revs[op.Key] = r
+		s.kvStore[op.Key] = op.Val
+		return applyResult{rev: s.rev, create: r.Create}
+	case opDelete:
+		if _, ok := s.kvStore[op.Key]; ok {
+			s.attach(op.Key, 0)
+			s.rev++
+			s.deleteKey(op.Key)
+		}
+		return applyResult{rev: s.rev}
+	case opNoop:
+		return applyResult{rev: s.rev}
+	}
+	err := s.applyLease(op)
+	return applyResult{rev: s.rev, err: err}
+}
+
+// deleteKey removes key from the store. The caller holds s.mu and has
+// detached key from its lease.
+func (s *kvstore) deleteKey(key string) {
+	delete(s.kvStore, key)
+	delete(s.revs, key)
+}
+
+// notify wakes the local proposer of op, if any.
+func (s *kvstore) notify(op kv, r applyResult) {
+	if op.ID == 0 {
+		return
+	}
+	s.wmu.Lock()
+	ch, ok := s.waiters[op.ID]
+	s.wmu.Unlock()
+	if ok {
+		ch <- r
+	}
 }
 
-func (s *kvstore) readCommits(commitC <-chan *string, errorC <-chan error) {
-	for data := range commitC {
-		if data == nil {
+func (s *kvstore) readCommits(commitC <-chan *commit, errorC <-chan error) {
+	for c := range commitC {
+		if c == nil {
 			// done replaying log; new data incoming
 			// OR signaled to load snapshot
-			snapshot, err := s.snapshotter.Load()
-			if err == snap.ErrNoSnapshot {
+			if !s.loadSnapshot() {
 				return
 			}
-			if err != nil && err != snap.ErrNoSnapshot {
-				log.Panic(err)
-			}
-			log.Printf("loading snapshot at term %d and index %d", snapshot.Metadata.Term, snapshot.Metadata.Index)
-			if err := s.recoverFromSnapshot(snapshot.Data); err != nil {
-				log.Panic(err)
-			}
 			continue
 		}
 
-		var dataKv kv
-		dec := gob.NewDecoder(bytes.NewBufferString(*data))
-		if err := dec.Decode(&dataKv); err != nil {
-			log.Fatalf("raftexample: could not decode message (%v)", err)
+		batch := make([]kv, len(c.data))
+		for i, data := range c.data {
+			dec := gob.NewDecoder(bytes.NewBufferString(data))
+			if err := dec.Decode(&batch[i]); err != nil {
+				log.Fatalf("raftexample: could not decode message (%v)", err)
+			}
 		}
+		results := make([]applyResult, len(batch))
 		s.mu.Lock()
-		s.kvStore[dataKv.Key] = dataKv.Val
+		for i, dataKv := range batch {
+			results[i] = s.apply(dataKv)
+		}
+		s.broadcast()
 		s.mu.Unlock()
+		close(c.applyDoneC)
+		for i, dataKv := range batch {
+			s.notify(dataKv, results[i])
+		}
 	}
 	if err, ok := <-errorC; ok {
 		log.Fatal(err)
 	}
 }
 
+// loadSnapshot recovers the store from a snapshot newer than the one it was
+// last loaded from, and reports whether it did so.
+func (s *kvstore) loadSnapshot() bool {
+	snapshot, err := s.snapshotter.Load()
+	if err == snap.ErrNoSnapshot {
+		return false
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	if snapshot.Metadata.Index <= s.snapIndex {
+		return false
+	}
+	log.Printf("loading snapshot at term %d and index %d", snapshot.Metadata.Term, snapshot.Metadata.Index)
+	_, data := decodeSnapshot(snapshot.Data)
+	if err := s.recoverFromSnapshot(data); err != nil {
+		log.Panic(err)
+	}
+	s.snapIndex = snapshot.Metadata.Index
+	return true
+}
+
+// kvSnapshot is the state machine data stored in snapshots.
+type kvSnapshot struct {
+	KV     map[string]string  `json:"kv"`
+	Leases map[int64]*lease   `json:"leases"`
+	Rev    int64              `json:"rev"`
+	Revs   map[string]keyRevs `json:"revs"`
+}
+
 func (s *kvstore) getSnapshot() ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return json.Marshal(s.kvStore)
+	return s.marshal()
 }
 
+// marshal encodes the store as a snapshot. The caller holds s.mu.
+func (s *kvstore) marshal() ([]byte, error) {
+	return json.Marshal(kvSnapshot{KV: s.kvStore, Leases: s.leases, Rev: s.rev, Revs: s.revs})
+}
+
+// recoverFromSnapshot also accepts snapshots holding only the key-value map,
+// as written before leases existed.
 func (s *kvstore) recoverFromSnapshot(snapshot []byte) error {
-	var store map[string]string
-	if err := json.Unmarshal(snapshot, &store); err != nil {
+	var ks kvSnapshot
+	if err := json.Unmarshal(snapshot, &ks); err != nil {
 		return err
 	}
+	if ks.KV == nil {
+		if err := json.Unmarshal(snapshot, &ks.KV); err != nil {
+			return err
+		}
+		ks.Leases, ks.Revs = nil, nil
+	}
+	if ks.Leases == nil {
+		ks.Leases = make(map[int64]*lease)
+	}
+	if ks.Revs == nil {
+		ks.Revs = make(map[string]keyRevs)
+	}
+	keyLeases := make(map[string]int64)
+	now := leaseClock.Now()
+	for id, l := range ks.Leases {
+		if l.Keys == nil {
+			l.Keys = make(map[string]bool)
+		}
+		for k := range l.Keys {
+			keyLeases[k] = id
+		}
+		l.refresh(now)
+	}
 	s.mu.Lock()
-	s.kvStore = store
+	s.kvStore, s.leases, s.keyLeases = ks.KV, ks.Leases, keyLeases
+	s.rev, s.revs = ks.Rev, ks.Revs
+	s.broadcast()
 	s.mu.Unlock()
 	return nil
 }
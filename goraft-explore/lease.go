@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	errLeaseNotFound = errors.New("lease not found")
+	errLeaseExists   = errors.New("lease already exists")
+)
+
+// clock is the time source for lease expiry; tests substitute a fake one.
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+var leaseClock clock = realClock{}
+
+// leaseCheckInterval is how often the leader looks for expired leases.
+var leaseCheckInterval = 500 * time.Millisecond
+
+// leaseRevokeRetry is how long the leader waits for a revocation to commit
+// before proposing it again.
+var leaseRevokeRetry = 3 * time.Second
+
+// lease is a TTL shared by the keys attached to it. Grants, keepalives and
+// revocations go through raft; the expiry deadline is local to each node and
+// only the leader acts on it.
+type lease struct {
+	ID   int64           `json:"id"`
+	TTL  int64           `json:"ttl"` // seconds
+	Keys map[string]bool `json:"keys"`
+
+	expiry time.Time
+}
+
+func (l *lease) refresh(now time.Time) {
+	l.expiry = now.Add(time.Duration(l.TTL) * time.Second)
+}
+
+// remaining is the time left before l expires.
+func (l *lease) remaining(now time.Time) time.Duration {
+	if d := l.expiry.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// applyLease applies a committed lease operation. The caller holds s.mu.
+func (s *kvstore) applyLease(op kv) error {
+	now := leaseClock.Now()
+	l := s.leases[op.Lease]
+	switch op.Op {
+	case opLeaseGrant:
+		if l != nil {
+			return errLeaseExists
+		}
+		l = &lease{ID: op.Lease, TTL: op.TTL, Keys: make(map[string]bool)}
+		l.refresh(now)
+		s.leases[l.ID] = l
+	case opLeaseKeepAlive:
+		if l == nil {
+			return errLeaseNotFound
+		}
+		l.refresh(now)
+	case opLeaseRevoke:
+		if l == nil {
+			return errLeaseNotFound
+		}
+		if len(l.Keys) > 0 {
+			s.rev++
+		}
+		for k := range l.Keys {
+			s.deleteKey(k)
+			delete(s.keyLeases, k)
+		}
+		delete(s.leases, l.ID)
+	}
+	return nil
+}
+
+// attach moves key onto lease id, detaching it from any previous lease. A
+// zero id only detaches. The caller holds s.mu.
+func (s *kvstore) attach(key string, id int64) error {
+	var l *lease
+	if id != 0 {
+		if l = s.leases[id]; l == nil {
+			return errLeaseNotFound
+		}
+	}
+	if old, ok := s.keyLeases[key]; ok {
+		delete(s.leases[old].Keys, key)
+		delete(s.keyLeases, key)
+	}
+	if l != nil {
+		l.Keys[key] = true
+		s.keyLeases[key] = id
+	}
+	return nil
+}
+
+// LeaseTimeToLive returns the TTL of a lease, the time this node believes it
+// has left and its keys in sorted order.
+func (s *kvstore) LeaseTimeToLive(id int64) (ttl int64, remaining time.Duration, keys []string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l := s.leases[id]
+	if l == nil {
+		return 0, 0, nil, false
+	}
+	for k := range l.Keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return l.TTL, l.remaining(leaseClock.Now()), keys, true
+}
+
+// runLeases revokes expired leases through raft while this node leads. A new
+// leader first extends every lease by its full TTL so that a failover never
+// expires keys early.
+func (s *kvstore) runLeases(leaderC <-chan bool) {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case leader := <-leaderC:
+			s.mu.Lock()
+			if leader && !s.primary {
+				now := leaseClock.Now()
+				for _, l := range s.leases {
+					l.refresh(now)
+				}
+			}
+			s.primary = leader
+			s.mu.Unlock()
+		case <-ticker.C:
+			for _, id := range s.expiredLeases() {
+				if !s.propose(kv{Op: opLeaseRevoke, Lease: id}) {
+					return
+				}
+			}
+		case <-s.donec:
+			return
+		}
+	}
+}
+
+// expiredLeases returns the leases the leader should revoke now, pushing
+// their deadlines back so that each revocation is only proposed once per
+// leaseRevokeRetry.
+func (s *kvstore) expiredLeases() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.primary {
+		return nil
+	}
+	now := leaseClock.Now()
+	var ids []int64
+	for id, l := range s.leases {
+		if !l.expiry.After(now) {
+			ids = append(ids, id)
+			l.expiry = now.Add(leaseRevokeRetry)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+// fakeClock is a clock shared by every node in a test that only moves when
+// advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+var testClock = &fakeClock{now: time.Unix(1e9, 0)}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// settle gives the lease loops time to act on the clock.
+func settle() { time.Sleep(20 * leaseCheckInterval) }
+
+func grant(t *testing.T, n *testNode, ttl int64) int64 {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id, err := n.store().Grant(ctx, ttl)
+	if err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	return id
+}
+
+func putWithLease(t *testing.T, n *testNode, k, v string, id int64) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := n.store().PutWithLease(ctx, k, v, id); err != nil {
+		t.Fatalf("put %s on lease %d: %v", k, id, err)
+	}
+}
+
+// present reports whether k is visible on any of the nodes in ids.
+func (c *testCluster) present(k string, ids ...int) bool {
+	for _, id := range ids {
+		if _, ok := c.node(id).store().Lookup(k); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *testCluster) waitDeleted(k string, ids ...int) {
+	c.t.Helper()
+	c.waitFor(10*time.Second, k+" to expire", func() bool { return !c.present(k, ids...) })
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	c := newTestCluster(t, 3, defaultSnapCount)
+	c.leader()
+	n := c.node(1)
+
+	id := grant(t, n, 5)
+	putWithLease(t, n, "/ephemeral", "v", id)
+	c.put(n, "/durable", "v", 1, 2, 3)
+	if !c.applied("/ephemeral", "v", 5*time.Second, 1, 2, 3) {
+		t.Fatal("leased key was not replicated")
+	}
+
+	testClock.Advance(3 * time.Second)
+	settle()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.node(2).store().KeepAlive(ctx, id); err != nil {
+		t.Fatalf("keepalive: %v", err)
+	}
+
+	// past the original deadline but within the renewed one
+	testClock.Advance(3 * time.Second)
+	settle()
+	if !c.applied("/ephemeral", "v", time.Second, 1, 2, 3) {
+		t.Fatal("key expired although its lease was kept alive")
+	}
+
+	testClock.Advance(3 * time.Second)
+	c.waitDeleted("/ephemeral", 1, 2, 3)
+	for _, i := range []int{1, 2, 3} {
+		if _, _, _, ok := c.node(i).store().LeaseTimeToLive(id); ok {
+			t.Errorf("node %d still has lease %d", i, id)
+		}
+	}
+	if !c.applied("/durable", "v", time.Second, 1, 2, 3) {
+		t.Fatal("key without a lease was deleted")
+	}
+
+	if err := n.store().KeepAlive(ctx, id); err != errLeaseNotFound {
+		t.Fatalf("keepalive of expired lease = %v, want %v", err, errLeaseNotFound)
+	}
+	if _, err := n.store().PutWithLease(ctx, "/late", "v", id); err != errLeaseNotFound {
+		t.Fatalf("put on expired lease = %v, want %v", err, errLeaseNotFound)
+	}
+}
+
+func TestLeaseExpirySurvivesFailover(t *testing.T) {
+	c := newTestCluster(t, 3, defaultSnapCount)
+	lead := c.leader()
+
+	id := grant(t, lead, 5)
+	putWithLease(t, lead, "/ephemeral", "v", id)
+	if !c.applied("/ephemeral", "v", 5*time.Second, 1, 2, 3) {
+		t.Fatal("leased key was not replicated")
+	}
+
+	testClock.Advance(4 * time.Second)
+	settle()
+	c.crash(lead.id)
+	var rest []int
+	for _, i := range []int{1, 2, 3} {
+		if i != lead.id {
+			rest = append(rest, i)
+		}
+	}
+	c.leader(rest...)
+	settle()
+
+	// the new leader restarts the TTL rather than expiring the lease early
+	testClock.Advance(3 * time.Second)
+	settle()
+	if !c.applied("/ephemeral", "v", time.Second, rest...) {
+		t.Fatal("key expired early after failover")
+	}
+
+	testClock.Advance(3 * time.Second)
+	c.waitDeleted("/ephemeral", rest...)
+
+	// the old leader learns of the revocation from the log
+	c.restart(lead.id)
+	c.put(c.node(rest[0]), "/after", "v", 1, 2, 3)
+	if c.present("/ephemeral", lead.id) {
+		t.Fatal("restarted node still has the expired key")
+	}
+}
+
+func TestLeaseSnapshotRoundTrip(t *testing.T) {
+	s := &kvstore{
+		kvStore:   map[string]string{"/a": "1", "/b": "2"},
+		leases:    map[int64]*lease{7: {ID: 7, TTL: 10, Keys: map[string]bool{"/a": true}}},
+		keyLeases: map[string]int64{"/a": 7},
+	}
+	data, err := s.getSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &kvstore{}
+	if err := r.recoverFromSnapshot(data); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _, keys, ok := r.LeaseTimeToLive(7); !ok || ttl != 10 || len(keys) != 1 || keys[0] != "/a" {
+		t.Fatalf("recovered lease = %d %v %v", ttl, keys, ok)
+	}
+	if r.keyLeases["/a"] != 7 || len(r.kvStore) != 2 {
+		t.Fatalf("recovered store = %v %v", r.kvStore, r.keyLeases)
+	}
+
+	// snapshots written before leases existed hold only the key-value map
+	if err := r.recoverFromSnapshot([]byte(`{"/old":"v"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := r.Lookup("/old"); !ok || v != "v" || len(r.leases) != 0 {
+		t.Fatalf("legacy snapshot recovered as %v %v", r.kvStore, r.leases)
+	}
+}
+
+func TestLeaseHTTPAPI(t *testing.T) {
+	c := newTestCluster(t, 1, defaultSnapCount)
+	c.leader()
+	srv := httptest.NewServer(&httpKVAPI{store: c.node(1).store(), confChangeC: make(chan raftpb.ConfChangeI)})
+	defer srv.Close()
+
+	do := func(method, path, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	decode := func(resp *http.Response) leaseResponse {
+		t.Helper()
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+		var lr leaseResponse
+		if err := json.NewDecoder(resp.Body).Decode(&lr); err != nil {
+			t.Fatal(err)
+		}
+		return lr
+	}
+	status := func(resp *http.Response) int {
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := status(do("POST", "/lease?ttl=0", "")); got != http.StatusBadRequest {
+		t.Fatalf("grant with ttl 0 = %d", got)
+	}
+	lr := decode(do("POST", "/lease?ttl=30", ""))
+	if lr.ID == 0 || lr.TTL != 30 {
+		t.Fatalf("grant = %+v", lr)
+	}
+	path := "/lease/" + strconv.FormatInt(lr.ID, 10)
+
+	if got := status(do("PUT", "/k?lease="+strconv.FormatInt(lr.ID, 10), "v")); got != http.StatusNoContent {
+		t.Fatalf("put with lease = %d", got)
+	}
+	if got := status(do("PUT", "/k2?lease=12345", "v")); got != http.StatusNotFound {
+		t.Fatalf("put with unknown lease = %d", got)
+	}
+	if v, ok := c.node(1).store().Lookup("/k"); !ok || v != "v" {
+		t.Fatal("key stored with its query string")
+	}
+
+	info := decode(do("GET", path, ""))
+	if info.TTL != 30 || len(info.Keys) != 1 || info.Keys[0] != "/k" || info.Remaining != 30 {
+		t.Fatalf("lease info = %+v", info)
+	}
+	if ka := decode(do("POST", path+"/keepalive", "")); ka.ID != lr.ID || ka.TTL != 30 {
+		t.Fatalf("keepalive = %+v", ka)
+	}
+	if got := status(do("DELETE", path, "")); got != http.StatusNoContent {
+		t.Fatalf("revoke = %d", got)
+	}
+	if _, ok := c.node(1).store().Lookup("/k"); ok {
+		t.Fatal("revoke left the attached key")
+	}
+	if got := status(do("GET", path, "")); got != http.StatusNotFound {
+		t.Fatalf("revoked lease lookup = %d", got)
+	}
+	if got := status(do("POST", "/lease/1/keepalive", "")); got != http.StatusNotFound {
+		t.Fatalf("keepalive of unknown lease = %d", got)
+	}
+}
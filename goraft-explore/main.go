@@ -2,9 +2,12 @@ package main
 
 import (
 	"flag"
+	"log"
+	"os"
 	"strings"
 
-	"github.com/coreos/etcd/raft/raftpb"
+	"go.etcd.io/etcd/pkg/transport"
+	"go.etcd.io/etcd/raft/raftpb"
 )
 
 var (
@@ -12,17 +15,30 @@ var (
 	id      = flag.Int("id", 1, "node ID")
 	kvport  = flag.Int("port", 9121, "key-value server port")
 	join    = flag.Bool("join", false, "join an existing cluster")
+	token   = flag.String("cluster-token", "", "token of a restored cluster to join")
+
+	peerCertFile   = flag.String("peer-cert-file", "", "peer TLS certificate; enables mutual TLS between https peers")
+	peerKeyFile    = flag.String("peer-key-file", "", "peer TLS key")
+	peerCAFile     = flag.String("peer-trusted-ca-file", "", "CA that signs every peer certificate")
+	certFile       = flag.String("cert-file", "", "key-value API TLS certificate; enables https")
+	keyFile        = flag.String("key-file", "", "key-value API TLS key")
+	clientCAFile   = flag.String("trusted-ca-file", "", "CA that signs key-value API client certificates")
+	clientCertAuth = flag.Bool("client-cert-auth", false, "require key-value API clients to present a certificate")
 )
 
-func init() {
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		if err := runSnapshotCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	flag.Parse()
-}
 
-func main() {
 	proposeCh := make(chan string)
 	defer close(proposeCh)
 
-	confChangeCh := make(chan raftpb.ConfChange)
+	confChangeCh := make(chan raftpb.ConfChangeI)
 	defer close(confChangeCh)
 
 	// raft provides a commit stream for the proposals from the http api
@@ -31,16 +47,36 @@ func main() {
 		return kvs.getSnapshot()
 	}
 
-	commitCh, errorCh, snapshotterReady := newRaftNode(
+	peers := strings.Split(*cluster, ",")
+	peerTLS := transport.TLSInfo{
+		CertFile:       *peerCertFile,
+		KeyFile:        *peerKeyFile,
+		TrustedCAFile:  *peerCAFile,
+		ClientCertAuth: *peerCertFile != "",
+	}
+	if err := checkPeerTLS(peers, peerTLS); err != nil {
+		log.Fatal(err)
+	}
+	commitCh, errorCh, snapshotterReady, leaderCh := newRaftNode(
 		*id,
-		strings.Split(*cluster, ","),
+		peers,
 		*join,
+		*token,
+		peerTLS,
 		getSnapshot,
 		proposeCh,
 		confChangeCh)
 
 	kvs = newKVStore(<-snapshotterReady, proposeCh, commitCh, errorCh)
+	// the leader revokes leases that were not kept alive
+	go kvs.runLeases(leaderCh)
 
 	// the key-value http handler will propose updates to raft
-	serveHttpKVAPI(kvs, *kvport, confChangeCh, errorCh)
+	kvTLS := transport.TLSInfo{
+		CertFile:       *certFile,
+		KeyFile:        *keyFile,
+		TrustedCAFile:  *clientCAFile,
+		ClientCertAuth: *clientCertAuth,
+	}
+	serveHttpKVAPI(kvs, *kvport, kvTLS, confChangeCh, errorCh)
 }
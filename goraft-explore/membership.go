@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+// memberContext is carried in the Context of every membership conf change so
+// that the peer URL (and any voter it replaces) is recorded in the raft log.
+type memberContext struct {
+	URL      string `json:"url"`
+	Replaces uint64 `json:"replaces,omitempty"` // voter removed once this learner is promoted
+}
+
+func encodeMemberContext(mc memberContext) []byte {
+	b, err := json.Marshal(mc)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// decodeMemberContext accepts both the JSON context and a bare peer URL.
+func decodeMemberContext(b []byte) memberContext {
+	var mc memberContext
+	if len(b) == 0 {
+		return mc
+	}
+	if err := json.Unmarshal(b, &mc); err != nil {
+		return memberContext{URL: string(b)}
+	}
+	return mc
+}
+
+// membership tracks the URLs of the raft peers and the IDs that have been
+// removed from the cluster. It is persisted in every snapshot and rebuilt from
+// the WAL on restart, so the -cluster flag is only used to bootstrap.
+type membership struct {
+	mu      sync.RWMutex
+	Members map[uint64]memberContext `json:"members"`
+	Removed map[uint64]bool          `json:"removed"`
+}
+
+func newMembership() *membership {
+	return &membership{
+		Members: make(map[uint64]memberContext),
+		Removed: make(map[uint64]bool),
+	}
+}
+
+func (m *membership) url(id uint64) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mc, ok := m.Members[id]
+	return mc.URL, ok && mc.URL != ""
+}
+
+func (m *membership) member(id uint64) (memberContext, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	mc, ok := m.Members[id]
+	return mc, ok
+}
+
+func (m *membership) isRemoved(id uint64) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.Removed[id]
+}
+
+// ids returns the IDs of all known members.
+func (m *membership) ids() []uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]uint64, 0, len(m.Members))
+	for id := range m.Members {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// applyConfChange records the effect of a committed conf change.
+func (m *membership) applyConfChange(cc raftpb.ConfChangeSingle, context []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.Members[cc.NodeID]
+	switch cc.Type {
+	case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
+		mc := decodeMemberContext(context)
+		if mc.URL == "" {
+			// promotions carry no URL; keep the one we already know
+			mc.URL = old.URL
+		}
+		if cc.Type == raftpb.ConfChangeAddNode {
+			mc.Replaces = 0
+		}
+		m.Members[cc.NodeID] = mc
+		delete(m.Removed, cc.NodeID)
+	case raftpb.ConfChangeRemoveNode:
+		delete(m.Members, cc.NodeID)
+		m.Removed[cc.NodeID] = true
+	}
+}
+
+// replayEntries rebuilds membership from conf change entries committed at or
+// below commit.
+func (m *membership) replayEntries(ents []raftpb.Entry, commit uint64) {
+	for _, ent := range ents {
+		if ent.Index > commit {
+			break
+		}
+		cc, err := confChangeFromEntry(ent)
+		if err != nil {
+			continue // normal entry; publishEntries fails on undecodable ones
+		}
+		for _, c := range cc.AsV2().Changes {
+			m.applyConfChange(c, cc.AsV2().Context)
+		}
+	}
+}
+
+// reset replaces the contents of m with those of other.
+func (m *membership) reset(other *membership) {
+	c := other.clone()
+	m.mu.Lock()
+	m.Members, m.Removed = c.Members, c.Removed
+	m.mu.Unlock()
+}
+
+func (m *membership) clone() *membership {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c := newMembership()
+	for id, mc := range m.Members {
+		c.Members[id] = mc
+	}
+	for id := range m.Removed {
+		c.Removed[id] = true
+	}
+	return c
+}
+
+// confChangeFromEntry decodes either flavour of conf change entry.
+func confChangeFromEntry(ent raftpb.Entry) (raftpb.ConfChangeI, error) {
+	switch ent.Type {
+	case raftpb.EntryConfChange:
+		var cc raftpb.ConfChange
+		if err := cc.Unmarshal(ent.Data); err != nil {
+			return nil, err
+		}
+		return cc, nil
+	case raftpb.EntryConfChangeV2:
+		var cc raftpb.ConfChangeV2
+		if err := cc.Unmarshal(ent.Data); err != nil {
+			return nil, err
+		}
+		return cc, nil
+	}
+	return nil, fmt.Errorf("entry %d is not a conf change", ent.Index)
+}
+
+// clusterSnapshot is the payload stored in raft snapshots: the membership
+// alongside the opaque state machine data.
+type clusterSnapshot struct {
+	Members *membership `json:"membership"`
+	Data    []byte      `json:"data"`
+}
+
+func encodeSnapshot(m *membership, data []byte) ([]byte, error) {
+	return json.Marshal(clusterSnapshot{Members: m.clone(), Data: data})
+}
+
+// decodeSnapshot splits a snapshot payload into membership and state machine
+// data. Snapshots taken before membership was persisted are returned as-is.
+func decodeSnapshot(b []byte) (*membership, []byte) {
+	var cs clusterSnapshot
+	if err := json.Unmarshal(b, &cs); err != nil || cs.Members == nil {
+		return newMembership(), b
+	}
+	if cs.Members.Members == nil {
+		cs.Members.Members = make(map[uint64]memberContext)
+	}
+	if cs.Members.Removed == nil {
+		cs.Members.Removed = make(map[uint64]bool)
+	}
+	return cs.Members, cs.Data
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/etcdserver/api/rafthttp"
+	stats "go.etcd.io/etcd/etcdserver/api/v2stats"
+	"go.etcd.io/etcd/pkg/types"
+	"go.etcd.io/etcd/raft"
+	"go.etcd.io/etcd/raft/raftpb"
+	"go.etcd.io/etcd/raft/tracker"
+	"go.uber.org/zap"
+)
+
+func confChangeEntry(t *testing.T, index uint64, cc raftpb.ConfChangeI) raftpb.Entry {
+	t.Helper()
+	typ, data, err := raftpb.MarshalConfChange(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raftpb.Entry{Index: index, Type: typ, Data: data}
+}
+
+func TestConfChangeFromEntry(t *testing.T) {
+	v1 := raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 2}
+	v2 := raftpb.ConfChangeV2{Changes: []raftpb.ConfChangeSingle{{Type: raftpb.ConfChangeAddLearnerNode, NodeID: 3}}}
+	for _, cc := range []raftpb.ConfChangeI{v1, v2} {
+		got, err := confChangeFromEntry(confChangeEntry(t, 1, cc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g, w := got.AsV2().Changes[0], cc.AsV2().Changes[0]; g.Type != w.Type || g.NodeID != w.NodeID {
+			t.Errorf("decoded %v, want %v", got.AsV2(), cc.AsV2())
+		}
+	}
+	for _, ent := range []raftpb.Entry{
+		{Index: 1, Type: raftpb.EntryNormal, Data: []byte("put")},
+		{Index: 2, Type: raftpb.EntryConfChange, Data: []byte{0xff, 0xff}},
+		{Index: 3, Type: raftpb.EntryConfChangeV2, Data: []byte{0xff, 0xff}},
+	} {
+		if cc, err := confChangeFromEntry(ent); err == nil {
+			t.Errorf("entry %d decoded as %v", ent.Index, cc)
+		}
+	}
+}
+
+func TestMembershipReplay(t *testing.T) {
+	m := newMembership()
+	learner := raftpb.ConfChangeV2{
+		Changes: []raftpb.ConfChangeSingle{{Type: raftpb.ConfChangeAddLearnerNode, NodeID: 4}},
+		Context: encodeMemberContext(memberContext{URL: "http://127.0.0.1:42379", Replaces: 3}),
+	}
+	promote := raftpb.ConfChangeV2{Changes: []raftpb.ConfChangeSingle{
+		{Type: raftpb.ConfChangeAddNode, NodeID: 4},
+		{Type: raftpb.ConfChangeRemoveNode, NodeID: 3},
+	}}
+	ents := []raftpb.Entry{
+		confChangeEntry(t, 1, raftpb.ConfChange{Type: raftpb.ConfChangeAddNode, NodeID: 3, Context: []byte("http://127.0.0.1:32379")}),
+		{Index: 2, Type: raftpb.EntryNormal, Data: []byte("put")},
+		confChangeEntry(t, 3, learner),
+		confChangeEntry(t, 4, promote),
+		confChangeEntry(t, 5, raftpb.ConfChange{Type: raftpb.ConfChangeRemoveNode, NodeID: 4}),
+	}
+	m.replayEntries(ents, 4) // the removal of 4 is not committed
+
+	if mc, ok := m.member(4); !ok || mc.URL != "http://127.0.0.1:42379" || mc.Replaces != 0 {
+		t.Errorf("promoted learner is %+v, %v", mc, ok)
+	}
+	if _, ok := m.member(3); ok || !m.isRemoved(3) {
+		t.Error("replaced voter is still a member")
+	}
+	if m.isRemoved(4) {
+		t.Error("applied an uncommitted removal")
+	}
+
+	data, err := encodeSnapshot(m, []byte("kv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, kv := decodeSnapshot(data)
+	if string(kv) != "kv" || !restored.isRemoved(3) {
+		t.Errorf("snapshot restored %+v with data %q", restored, kv)
+	}
+	if u, ok := restored.url(4); !ok || u != "http://127.0.0.1:42379" {
+		t.Errorf("snapshot restored url %q, %v", u, ok)
+	}
+	if legacy, kv := decodeSnapshot([]byte(`{"a":"b"}`)); len(legacy.ids()) != 0 || string(kv) != `{"a":"b"}` {
+		t.Errorf("legacy snapshot decoded as %+v with data %q", legacy, kv)
+	}
+}
+
+// testRaftNode returns a node with a started transport, connected to the other
+// voters of a configuration of 1 to 3.
+func testRaftNode(t *testing.T, id int) *raftNode {
+	t.Helper()
+	rc := &raftNode{
+		id:        id,
+		memberID:  uint64(id),
+		members:   newMembership(),
+		connected: make(map[uint64]bool),
+		promoting: make(map[uint64]*promotion),
+	}
+	rc.transport = &rafthttp.Transport{
+		Logger:      zap.NewNop(),
+		ID:          types.ID(id),
+		ClusterID:   defaultClusterID,
+		Raft:        rc,
+		ServerStats: stats.NewServerStats("", ""),
+		LeaderStats: stats.NewLeaderStats(strconv.Itoa(id)),
+		ErrorC:      make(chan error),
+	}
+	if err := rc.transport.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rc.transport.Stop)
+	for i := uint64(1); i <= 3; i++ {
+		rc.members.applyConfChange(raftpb.ConfChangeSingle{Type: raftpb.ConfChangeAddNode, NodeID: i},
+			[]byte("http://127.0.0.1:"+strconv.Itoa(int(i))+"2379"))
+	}
+	rc.confState = raftpb.ConfState{Voters: []uint64{1, 2, 3}}
+	rc.syncPeers()
+	return rc
+}
+
+func TestRemovedVoterConnectedUntilJointLeft(t *testing.T) {
+	remove := raftpb.ConfChangeV2{
+		Transition: raftpb.ConfChangeTransitionJointExplicit,
+		Changes:    []raftpb.ConfChangeSingle{{Type: raftpb.ConfChangeRemoveNode, NodeID: 3}},
+	}
+	joint := raftpb.ConfState{Voters: []uint64{1, 2}, VotersOutgoing: []uint64{1, 2, 3}}
+	left := raftpb.ConfState{Voters: []uint64{1, 2}}
+
+	rc := testRaftNode(t, 1)
+	rc.confState = joint
+	if !rc.applyMembership(remove) {
+		t.Fatal("node 1 shut down")
+	}
+	if !rc.connected[2] || !rc.connected[3] {
+		t.Errorf("connected to %v in the joint configuration, want 2 and 3", rc.connected)
+	}
+	rc.confState = left
+	if !rc.applyMembership(raftpb.ConfChangeV2{}) {
+		t.Fatal("node 1 shut down")
+	}
+	if !rc.connected[2] || rc.connected[3] {
+		t.Errorf("connected to %v after leaving the joint configuration, want 2", rc.connected)
+	}
+
+	removed := testRaftNode(t, 3)
+	removed.confState = joint
+	if !removed.applyMembership(remove) {
+		t.Fatal("removed voter shut down before the joint configuration was left")
+	}
+	removed.confState = left
+	if removed.applyMembership(raftpb.ConfChangeV2{}) {
+		t.Fatal("removed voter kept running after the joint configuration was left")
+	}
+}
+
+// promotingNode is a raft.Node whose status shows caught-up learner 4 and
+// whose ProposeConfChange blocks until its context is cancelled.
+type promotingNode struct {
+	raft.Node
+	proposals chan raftpb.ConfChangeI
+}
+
+func (n *promotingNode) Status() raft.Status {
+	var st raft.Status
+	st.RaftState = raft.StateLeader
+	st.Commit = 10
+	st.Progress = map[uint64]tracker.Progress{
+		4: {IsLearner: true, RecentActive: true, State: tracker.StateReplicate, Match: 10},
+	}
+	return st
+}
+
+func (n *promotingNode) ProposeConfChange(ctx context.Context, cc raftpb.ConfChangeI) error {
+	n.proposals <- cc
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPromotionProposedOnce(t *testing.T) {
+	n := &promotingNode{proposals: make(chan raftpb.ConfChangeI, 10)}
+	rc := &raftNode{node: n, members: newMembership(), promoting: make(map[uint64]*promotion)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rc.maybePromoteLearners(ctx)
+	cc := <-n.proposals
+	if c := cc.AsV2().Changes; len(c) != 1 || c[0].Type != raftpb.ConfChangeAddNode || c[0].NodeID != 4 {
+		t.Fatalf("proposed %v", cc)
+	}
+	// later ticks, even past the retry interval, leave the pending proposal
+	time.Sleep(promoteRetryInterval)
+	rc.maybePromoteLearners(ctx)
+	select {
+	case cc := <-n.proposals:
+		t.Fatalf("proposed %v again while the first was pending", cc)
+	default:
+	}
+
+	// stopping the node cancels the proposal
+	p := rc.promoting[4]
+	cancel()
+	select {
+	case <-p.donec:
+	case <-time.After(time.Second):
+		t.Fatal("proposal not cancelled")
+	}
+}
@@ -15,39 +15,58 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
-	"strconv"
+	"strings"
 	"time"
 
 	"net/http"
 	"net/url"
 
-	"github.com/coreos/etcd/etcdserver/stats"
-	"github.com/coreos/etcd/pkg/fileutil"
-	"github.com/coreos/etcd/pkg/types"
-	"github.com/coreos/etcd/raft"
-	"github.com/coreos/etcd/raft/raftpb"
-	"github.com/coreos/etcd/rafthttp"
-	"github.com/coreos/etcd/snap"
-	"github.com/coreos/etcd/wal"
-	"github.com/coreos/etcd/wal/walpb"
-	"golang.org/x/net/context"
+	"go.etcd.io/etcd/etcdserver/api/rafthttp"
+	"go.etcd.io/etcd/etcdserver/api/snap"
+	stats "go.etcd.io/etcd/etcdserver/api/v2stats"
+	"go.etcd.io/etcd/pkg/fileutil"
+	"go.etcd.io/etcd/pkg/transport"
+	"go.etcd.io/etcd/pkg/types"
+	"go.etcd.io/etcd/raft"
+	"go.etcd.io/etcd/raft/raftpb"
+	"go.etcd.io/etcd/raft/tracker"
+	"go.etcd.io/etcd/wal"
+	"go.etcd.io/etcd/wal/walpb"
+	"go.uber.org/zap"
 )
 
+// commit is a batch of committed proposals handed to the state machine.
+// applyDoneC is closed once they have been applied, so a snapshot never
+// misses them.
+type commit struct {
+	data       []string
+	applyDoneC chan<- struct{}
+}
+
 // A key-value stream backed by raft
 type raftNode struct {
-	proposeC    <-chan string            // proposed messages (k,v)
-	confChangeC <-chan raftpb.ConfChange // proposed cluster config changes
-	commitC     chan<- *string           // entries committed to log (k,v)
-	errorC      chan<- error             // errors from raft session
-
-	id          int      // client ID for raft session
-	peers       []string // raft peer URLs
-	join        bool     // node is joining an existing cluster
-	waldir      string   // path to WAL directory
-	snapdir     string   // path to snapshot directory
+	proposeC    <-chan string             // proposed messages (k,v)
+	confChangeC <-chan raftpb.ConfChangeI // proposed cluster config changes
+	commitC     chan<- *commit            // entries committed to log (k,v)
+	errorC      chan<- error              // errors from raft session
+
+	id          int         // position in -cluster, names the data directories
+	memberID    uint64      // raft ID, read from the WAL once it exists
+	clusterID   uint64      // cluster the member belongs to, from the WAL
+	peers       []string    // raft peer URLs used to bootstrap a new cluster
+	join        bool        // node is joining an existing cluster
+	members     *membership // raft peer URLs as recorded in the log
+	waldir      string      // path to WAL directory
+	snapdir     string      // path to snapshot directory
 	getSnapshot func() ([]byte, error)
 	lastIndex   uint64 // index of log at start
 
@@ -63,24 +82,81 @@ type raftNode struct {
 	snapshotter      *snap.Snapshotter
 	snapshotterReady chan *snap.Snapshotter // signals when snapshotter is ready
 
-	snapCount uint64
-	transport *rafthttp.Transport
-	stopc     chan struct{} // signals proposal channel closed
-	httpstopc chan struct{} // signals http server to shutdown
-	httpdonec chan struct{} // signals http server shutdown complete
+	snapCount  uint64
+	transport  raftTransport
+	transportC <-chan error      // errors from the transport
+	peerTLS    transport.TLSInfo // certificates for mutual TLS between peers
+	logger     *zap.Logger
+	connected  map[uint64]bool       // peers added to the transport
+	promoting  map[uint64]*promotion // learners with a proposed promotion
+	leaderC    chan bool             // latest change in whether this node leads
+	stopc      chan struct{}         // signals proposal channel closed
+	httpstopc  chan struct{}         // signals http server to shutdown
+	httpdonec  chan struct{}         // signals http server shutdown complete
+	donec      chan struct{}         // signals raft node shutdown complete
 }
 
 var defaultSnapCount uint64 = 10000
 
+// tickInterval is the wall clock duration of a single raft tick.
+var tickInterval = 100 * time.Millisecond
+
+// raftTransport is the part of rafthttp.Transport used by raftNode; it lets
+// the test harness swap in an in-process network.
+type raftTransport interface {
+	Start() error
+	Stop()
+	Send(msgs []raftpb.Message)
+	AddPeer(id types.ID, urls []string)
+	RemovePeer(id types.ID)
+}
+
+// checkPeerTLS rejects peer TLS settings that would silently weaken mutual
+// TLS: certificates with plain http peers, or peer certificates checked
+// against the system roots instead of a trusted CA.
+func checkPeerTLS(peers []string, peerTLS transport.TLSInfo) error {
+	if peerTLS.Empty() {
+		return nil
+	}
+	if peerTLS.TrustedCAFile == "" {
+		return errors.New("peer mutual TLS requires a trusted CA file")
+	}
+	for _, peer := range peers {
+		u, err := url.Parse(peer)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "https" {
+			return fmt.Errorf("peer certificates require https peer URLs, got %s", peer)
+		}
+	}
+	return nil
+}
+
 // newRaftNode initiates a raft instance and returns a committed log entry
 // channel and error channel. Proposals for log updates are sent over the
 // provided the proposal channel. All log entries are replayed over the
 // commit channel, followed by a nil message (to indicate the channel is
 // current), then new log entries. To shutdown, close proposeC and read errorC.
-func newRaftNode(id int, peers []string, join bool,
-	getSnapshot func() ([]byte, error), proposeC <-chan string, confChangeC <-chan raftpb.ConfChange) (<-chan *string, <-chan error, <-chan *snap.Snapshotter) {
+// Peer traffic uses mutual TLS when peerTLS is not empty. A node without a
+// WAL joins the cluster created with clusterToken. The leader channel
+// reports whenever this node gains or loses leadership.
+func newRaftNode(id int, peers []string, join bool, clusterToken string, peerTLS transport.TLSInfo,
+	getSnapshot func() ([]byte, error), proposeC <-chan string, confChangeC <-chan raftpb.ConfChangeI) (<-chan *commit, <-chan error, <-chan *snap.Snapshotter, <-chan bool) {
+
+	rc, commitC, errorC := initRaftNode(id, peers, join, getSnapshot, proposeC, confChangeC)
+	rc.clusterID = clusterIDFromToken(clusterToken)
+	rc.peerTLS = peerTLS
+	go rc.startRaft()
+	return commitC, errorC, rc.snapshotterReady, rc.leaderC
+}
 
-	commitC := make(chan *string)
+// initRaftNode builds a raftNode without starting it. Callers may override the
+// storage directories, logger and transport before calling startRaft.
+func initRaftNode(id int, peers []string, join bool,
+	getSnapshot func() ([]byte, error), proposeC <-chan string, confChangeC <-chan raftpb.ConfChangeI) (*raftNode, chan *commit, chan error) {
+
+	commitC := make(chan *commit)
 	errorC := make(chan error)
 
 	rc := &raftNode{
@@ -89,23 +165,71 @@ func newRaftNode(id int, peers []string, join bool,
 		commitC:     commitC,
 		errorC:      errorC,
 		id:          id,
+		memberID:    uint64(id),
+		clusterID:   defaultClusterID,
 		peers:       peers,
 		join:        join,
-		waldir:      fmt.Sprintf("goraft-explore-%d", id),
-		snapdir:     fmt.Sprintf("goraft-explore-%d-snap", id),
+		members:     newMembership(),
+		connected:   make(map[uint64]bool),
+		promoting:   make(map[uint64]*promotion),
+		leaderC:     make(chan bool, 1),
+		waldir:      defaultWALDir(id),
+		snapdir:     defaultSnapDir(id),
 		getSnapshot: getSnapshot,
 		snapCount:   defaultSnapCount,
+		logger:      zap.NewExample(),
 		stopc:       make(chan struct{}),
 		httpstopc:   make(chan struct{}),
 		httpdonec:   make(chan struct{}),
+		donec:       make(chan struct{}),
 
 		snapshotterReady: make(chan *snap.Snapshotter, 1),
 		// rest of structure populated after WAL replay
 	}
-	go rc.startRaft()
-	return commitC, errorC, rc.snapshotterReady
+	return rc, commitC, errorC
 }
 
+// defaultClusterID identifies clusters bootstrapped without a cluster token.
+const defaultClusterID = 0x1000
+
+// clusterIDFromToken returns the ID of the cluster created with token.
+func clusterIDFromToken(token string) uint64 {
+	if token == "" {
+		return defaultClusterID
+	}
+	return hashID("cluster", token)
+}
+
+// hashID derives a non-zero ID from parts.
+func hashID(parts ...string) uint64 {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	if id := binary.BigEndian.Uint64(sum[:8]); id != 0 {
+		return id
+	}
+	return 1
+}
+
+// memberIdentity is kept in the WAL metadata so that a member restarts with
+// the raft and cluster IDs it was created with, which differ from -id and
+// the default cluster ID once a cluster has been restored from a backup.
+type memberIdentity struct {
+	NodeID    uint64 `json:"node_id"`
+	ClusterID uint64 `json:"cluster_id"`
+}
+
+func encodeMemberIdentity(mi memberIdentity) []byte {
+	b, err := json.Marshal(mi)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// defaultWALDir and defaultSnapDir are where member id keeps its log and
+// snapshots, relative to the working directory.
+func defaultWALDir(id int) string  { return fmt.Sprintf("goraft-explore-%d", id) }
+func defaultSnapDir(id int) string { return fmt.Sprintf("goraft-explore-%d-snap", id) }
+
 func (rc *raftNode) saveSnap(snap raftpb.Snapshot) error {
 	fmt.Println("saveSnap")
 	// must save the snapshot index to the WAL before saving the
@@ -138,9 +262,15 @@ func (rc *raftNode) entriesToApply(ents []raftpb.Entry) (nents []raftpb.Entry) {
 	return
 }
 
-// publishEntries writes committed log entries to commit channel and returns
-// whether all entries could be published.
-func (rc *raftNode) publishEntries(ents []raftpb.Entry) bool {
+// publishEntries writes committed log entries to commit channel as a single
+// batch. It returns a channel that is closed once the state machine has
+// applied the batch, and whether all entries could be published.
+func (rc *raftNode) publishEntries(ents []raftpb.Entry) (<-chan struct{}, bool) {
+	if len(ents) == 0 {
+		return nil, true
+	}
+
+	data := make([]string, 0, len(ents))
 	for i := range ents {
 		switch ents[i].Type {
 		case raftpb.EntryNormal:
@@ -148,46 +278,103 @@ func (rc *raftNode) publishEntries(ents []raftpb.Entry) bool {
 				// ignore empty messages
 				break
 			}
-			s := string(ents[i].Data)
-			select {
-			case rc.commitC <- &s:
-			case <-rc.stopc:
-				return false
+			props, err := decodeProposals(ents[i].Data)
+			if err != nil {
+				log.Fatalf("raftexample: could not decode proposals at index %d (%v)", ents[i].Index, err)
 			}
+			data = append(data, props...)
 
-		case raftpb.EntryConfChange:
-			var cc raftpb.ConfChange
-			cc.Unmarshal(ents[i].Data)
+		case raftpb.EntryConfChange, raftpb.EntryConfChangeV2:
+			cc, err := confChangeFromEntry(ents[i])
+			if err != nil {
+				log.Fatalf("raftexample: failed to decode conf change at index %d (%v)", ents[i].Index, err)
+			}
 			rc.confState = *rc.node.ApplyConfChange(cc)
-			switch cc.Type {
-			case raftpb.ConfChangeAddNode:
-				if len(cc.Context) > 0 {
-					rc.transport.AddPeer(types.ID(cc.NodeID), []string{string(cc.Context)})
-				}
-			case raftpb.ConfChangeRemoveNode:
-				if cc.NodeID == uint64(rc.id) {
-					log.Println("I've been removed from the cluster! Shutting down.")
-					return false
-				}
-				rc.transport.RemovePeer(types.ID(cc.NodeID))
+			if ok := rc.applyMembership(cc.AsV2()); !ok {
+				return nil, false
 			}
 		}
+	}
 
-		// after commit, update appliedIndex
-		rc.appliedIndex = ents[i].Index
+	// the state machine applies the batch while raft moves on; only
+	// snapshots need to wait for it
+	var applyDoneC chan struct{}
+	if len(data) > 0 {
+		applyDoneC = make(chan struct{})
+		select {
+		case rc.commitC <- &commit{data, applyDoneC}:
+		case <-rc.stopc:
+			return nil, false
+		}
+	}
 
-		// special nil commit to signal replay has finished
-		if ents[i].Index == rc.lastIndex {
-			select {
-			case rc.commitC <- nil:
-			case <-rc.stopc:
-				return false
-			}
+	// after commit, update appliedIndex
+	rc.appliedIndex = ents[len(ents)-1].Index
+
+	// special nil commit to signal replay has finished
+	if ents[0].Index <= rc.lastIndex && rc.lastIndex <= rc.appliedIndex {
+		select {
+		case rc.commitC <- nil:
+		case <-rc.stopc:
+			return nil, false
 		}
 	}
+	return applyDoneC, true
+}
+
+// applyMembership updates the member URLs and the transport peers after a conf
+// change has been applied, and returns false if this node has been removed.
+func (rc *raftNode) applyMembership(cc raftpb.ConfChangeV2) bool {
+	for _, c := range cc.Changes {
+		rc.members.applyConfChange(c, cc.Context)
+		delete(rc.promoting, c.NodeID)
+	}
+	rc.syncPeers()
+
+	// a removed voter keeps serving until the cluster has also left the
+	// joint configuration it was removed in
+	self := rc.memberID
+	if rc.members.isRemoved(self) && !confStateIDs(rc.confState)[self] {
+		log.Println("I've been removed from the cluster! Shutting down.")
+		return false
+	}
 	return true
 }
 
+// confStateIDs returns every node in the configuration, including those in
+// the outgoing half of a joint configuration.
+func confStateIDs(cs raftpb.ConfState) map[uint64]bool {
+	ids := make(map[uint64]bool)
+	for _, set := range [][]uint64{cs.Voters, cs.Learners, cs.VotersOutgoing, cs.LearnersNext} {
+		for _, id := range set {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// syncPeers connects the transport to every other node in the current
+// configuration and disconnects it from nodes that have left.
+func (rc *raftNode) syncPeers() {
+	want := confStateIDs(rc.confState)
+	delete(want, rc.memberID)
+	for id := range want {
+		if rc.connected[id] {
+			continue
+		}
+		if u, ok := rc.members.url(id); ok {
+			rc.transport.AddPeer(types.ID(id), []string{u})
+			rc.connected[id] = true
+		}
+	}
+	for id := range rc.connected {
+		if !want[id] {
+			rc.transport.RemovePeer(types.ID(id))
+			delete(rc.connected, id)
+		}
+	}
+}
+
 func (rc *raftNode) loadSnapshot() *raftpb.Snapshot {
 	snapshot, err := rc.snapshotter.Load()
 	if err != nil && err != snap.ErrNoSnapshot {
@@ -203,7 +390,8 @@ func (rc *raftNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
 			log.Fatalf("raftexample: cannot create dir for wal (%v)", err)
 		}
 
-		w, err := wal.Create(rc.waldir, nil)
+		mi := memberIdentity{NodeID: rc.memberID, ClusterID: rc.clusterID}
+		w, err := wal.Create(rc.logger, rc.waldir, encodeMemberIdentity(mi))
 		if err != nil {
 			log.Fatalf("raftexample: create wal error (%v)", err)
 		}
@@ -215,7 +403,7 @@ func (rc *raftNode) openWAL(snapshot *raftpb.Snapshot) *wal.WAL {
 		walsnap.Index, walsnap.Term = snapshot.Metadata.Index, snapshot.Metadata.Term
 	}
 	log.Printf("loading WAL at term %d and index %d", walsnap.Term, walsnap.Index)
-	w, err := wal.Open(rc.waldir, walsnap)
+	w, err := wal.Open(rc.logger, rc.waldir, walsnap)
 	if err != nil {
 		log.Fatalf("raftexample: error loading wal (%v)", err)
 	}
@@ -228,16 +416,29 @@ func (rc *raftNode) replayWAL() *wal.WAL {
 	log.Printf("replaying WAL of member %d", rc.id)
 	snapshot := rc.loadSnapshot()
 	w := rc.openWAL(snapshot)
-	_, st, ents, err := w.ReadAll()
+	metadata, st, ents, err := w.ReadAll()
 	if err != nil {
 		log.Fatalf("raftexample: failed to read WAL (%v)", err)
 	}
+	// WALs written before the identity was recorded have no metadata
+	if len(metadata) > 0 {
+		var mi memberIdentity
+		if err := json.Unmarshal(metadata, &mi); err != nil {
+			log.Fatalf("raftexample: failed to decode WAL metadata (%v)", err)
+		}
+		rc.memberID, rc.clusterID = mi.NodeID, mi.ClusterID
+	}
 	rc.raftStorage = raft.NewMemoryStorage()
 	if snapshot != nil {
 		rc.raftStorage.ApplySnapshot(*snapshot)
+		members, _ := decodeSnapshot(snapshot.Data)
+		rc.members.reset(members)
 	}
 	rc.raftStorage.SetHardState(st)
 
+	// rebuild the member URLs from conf changes committed since the snapshot
+	rc.members.replayEntries(ents, st.Commit)
+
 	// append to storage so raft starts at the right place in log
 	rc.raftStorage.Append(ents)
 	// send nil once lastIndex is published so client knows commit channel is current
@@ -263,52 +464,78 @@ func (rc *raftNode) startRaft() {
 			log.Fatalf("raftexample: cannot create dir for snapshot (%v)", err)
 		}
 	}
-	rc.snapshotter = snap.New(rc.snapdir)
+	rc.snapshotter = snap.New(rc.logger, rc.snapdir)
 	rc.snapshotterReady <- rc.snapshotter
 
 	oldwal := wal.Exist(rc.waldir)
 	rc.wal = rc.replayWAL()
 
+	// the -cluster flag order only assigns IDs when bootstrapping; once a
+	// WAL exists the members recorded in the log are authoritative
 	rpeers := make([]raft.Peer, len(rc.peers))
 	for i := range rpeers {
-		rpeers[i] = raft.Peer{ID: uint64(i + 1)}
+		rpeers[i] = raft.Peer{
+			ID:      uint64(i + 1),
+			Context: encodeMemberContext(memberContext{URL: rc.peers[i]}),
+		}
 	}
 	c := &raft.Config{
-		ID:              uint64(rc.id),
-		ElectionTick:    10,
-		HeartbeatTick:   1,
-		Storage:         rc.raftStorage,
-		MaxSizePerMsg:   1024 * 1024,
-		MaxInflightMsgs: 256,
+		ID:                        rc.memberID,
+		ElectionTick:              10,
+		HeartbeatTick:             1,
+		Storage:                   rc.raftStorage,
+		MaxSizePerMsg:             1024 * 1024,
+		MaxInflightMsgs:           256,
+		MaxUncommittedEntriesSize: 1 << 30,
 	}
 
-	if oldwal {
+	if oldwal || rc.join {
+		// a joining node learns the membership from the leader
 		rc.node = raft.RestartNode(c)
 	} else {
-		startPeers := rpeers
-		if rc.join {
-			startPeers = nil
+		rc.node = raft.StartNode(c, rpeers)
+	}
+
+	var tr *rafthttp.Transport
+	if rc.transport == nil {
+		tr = &rafthttp.Transport{
+			Logger:      rc.logger,
+			ID:          types.ID(rc.memberID),
+			ClusterID:   types.ID(rc.clusterID),
+			Raft:        rc,
+			TLSInfo:     rc.peerTLS,
+			ServerStats: stats.NewServerStats("", ""),
+			LeaderStats: stats.NewLeaderStats(types.ID(rc.memberID).String()),
+			ErrorC:      make(chan error),
 		}
-		rc.node = raft.StartNode(c, startPeers)
+		rc.transport, rc.transportC = tr, tr.ErrorC
 	}
 
-	rc.transport = &rafthttp.Transport{
-		ID:          types.ID(rc.id),
-		ClusterID:   0x1000,
-		Raft:        rc,
-		ServerStats: stats.NewServerStats("", ""),
-		LeaderStats: stats.NewLeaderStats(strconv.Itoa(rc.id)),
-		ErrorC:      make(chan error),
+	if err := rc.transport.Start(); err != nil {
+		log.Fatalf("raftexample: cannot start raft transport (%v)", err)
 	}
-
-	rc.transport.Start()
-	for i := range rc.peers {
-		if i+1 != rc.id {
-			rc.transport.AddPeer(types.ID(i+1), []string{rc.peers[i]})
+	if oldwal {
+		for _, id := range rc.members.ids() {
+			if u, ok := rc.members.url(id); ok && id != rc.memberID {
+				rc.transport.AddPeer(types.ID(id), []string{u})
+				rc.connected[id] = true
+			}
+		}
+	} else {
+		for i := range rc.peers {
+			if i+1 != rc.id {
+				rc.transport.AddPeer(types.ID(i+1), []string{rc.peers[i]})
+				rc.connected[uint64(i+1)] = true
+			}
 		}
 	}
 
-	go rc.serveRaft()
+	if tr != nil {
+		go rc.serveRaft(tr.Handler())
+	} else {
+		// the injected transport needs no listener
+		close(rc.httpdonec)
+	}
 	go rc.serveChannels()
 }
 
@@ -339,20 +566,36 @@ func (rc *raftNode) publishSnapshot(snapshotToSave raftpb.Snapshot) {
 	}
 	rc.commitC <- nil // trigger kvstore to load snapshot
 
+	members, _ := decodeSnapshot(snapshotToSave.Data)
+	rc.members.reset(members)
 	rc.confState = snapshotToSave.Metadata.ConfState
+	rc.syncPeers()
 	rc.snapshotIndex = snapshotToSave.Metadata.Index
 	rc.appliedIndex = snapshotToSave.Metadata.Index
 }
 
 var snapshotCatchUpEntriesN uint64 = 10000
 
-func (rc *raftNode) maybeTriggerSnapshot() {
+func (rc *raftNode) maybeTriggerSnapshot(applyDoneC <-chan struct{}) {
 	if rc.appliedIndex-rc.snapshotIndex <= rc.snapCount {
 		return
 	}
 
+	// wait until all committed entries are applied (or server is closed)
+	if applyDoneC != nil {
+		select {
+		case <-applyDoneC:
+		case <-rc.stopc:
+			return
+		}
+	}
+
 	log.Printf("start snapshot [applied index: %d | last snapshot index: %d]", rc.appliedIndex, rc.snapshotIndex)
-	data, err := rc.getSnapshot()
+	kvData, err := rc.getSnapshot()
+	if err != nil {
+		log.Panic(err)
+	}
+	data, err := encodeSnapshot(rc.members, kvData)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -385,11 +628,16 @@ func (rc *raftNode) serveChannels() {
 	rc.snapshotIndex = snapShot.Metadata.Index
 	rc.appliedIndex = snapShot.Metadata.Index
 
+	defer close(rc.donec)
 	defer rc.wal.Close()
 
-	ticker := time.NewTicker(100 * time.Millisecond)
+	ticker := time.NewTicker(tickInterval)
 	defer ticker.Stop()
 
+	// proposals blocked waiting for a leader give up once raft stops
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// send proposals over raft
 	go func() {
 		var confChangeCount uint64 = 0
@@ -400,8 +648,13 @@ func (rc *raftNode) serveChannels() {
 				if !ok {
 					rc.proposeC = nil
 				} else {
+					// everything queued behind prop goes into the same entry
+					batch, open := drainProposals(prop, rc.proposeC)
 					// blocks until accepted by raft state machine
-					rc.node.Propose(context.TODO(), []byte(prop))
+					rc.node.Propose(ctx, encodeProposals(batch))
+					if !open {
+						rc.proposeC = nil
+					}
 				}
 
 			case cc, ok := <-rc.confChangeC:
@@ -409,8 +662,11 @@ func (rc *raftNode) serveChannels() {
 					rc.confChangeC = nil
 				} else {
 					confChangeCount += 1
-					cc.ID = confChangeCount
-					rc.node.ProposeConfChange(context.TODO(), cc)
+					if v1, ok := cc.(raftpb.ConfChange); ok {
+						v1.ID = confChangeCount
+						cc = v1
+					}
+					rc.node.ProposeConfChange(ctx, cc)
 				}
 			}
 		}
@@ -419,13 +675,27 @@ func (rc *raftNode) serveChannels() {
 	}()
 
 	// event loop on raft state machine updates
+	isLeader := false
 	for {
 		select {
 		case <-ticker.C:
 			rc.node.Tick()
+			rc.maybePromoteLearners(ctx)
 
 		// store raft entries to wal, then publish over commit channel
 		case rd := <-rc.node.Ready():
+			if rd.SoftState != nil {
+				if lead := rd.RaftState == raft.StateLeader; lead != isLeader {
+					isLeader = lead
+					rc.publishLeadership(lead)
+				}
+			}
+			// the leader may replicate entries while it writes them to its
+			// own WAL (raft thesis 10.2.1); followers must persist before
+			// acknowledging. wal.Save only fsyncs when raft.MustSync says so.
+			if isLeader {
+				rc.transport.Send(rd.Messages)
+			}
 			rc.wal.Save(rd.HardState, rd.Entries)
 			if !raft.IsEmptySnap(rd.Snapshot) {
 				rc.saveSnap(rd.Snapshot)
@@ -433,15 +703,18 @@ func (rc *raftNode) serveChannels() {
 				rc.publishSnapshot(rd.Snapshot)
 			}
 			rc.raftStorage.Append(rd.Entries)
-			rc.transport.Send(rd.Messages)
-			if ok := rc.publishEntries(rc.entriesToApply(rd.CommittedEntries)); !ok {
+			if !isLeader {
+				rc.transport.Send(rd.Messages)
+			}
+			applyDoneC, ok := rc.publishEntries(rc.entriesToApply(rd.CommittedEntries))
+			if !ok {
 				rc.stop()
 				return
 			}
-			rc.maybeTriggerSnapshot()
+			rc.maybeTriggerSnapshot(applyDoneC)
 			rc.node.Advance()
 
-		case err := <-rc.transport.ErrorC:
+		case err := <-rc.transportC:
 			rc.writeError(err)
 			return
 
@@ -452,18 +725,107 @@ func (rc *raftNode) serveChannels() {
 	}
 }
 
-func (rc *raftNode) serveRaft() {
-	raftUrl, err := url.Parse(rc.peers[rc.id-1])
+// publishLeadership replaces any leadership change not yet read from leaderC
+// with the latest one, so the Ready loop never blocks on it.
+func (rc *raftNode) publishLeadership(leader bool) {
+	select {
+	case <-rc.leaderC:
+	default:
+	}
+	rc.leaderC <- leader
+}
+
+// learnerCatchUpEntries is how far a learner's log may trail the leader's
+// commit index before it is promoted to a voter.
+var learnerCatchUpEntries uint64 = 100
+
+// promoteRetryInterval bounds how often a dropped promotion is re-proposed.
+var promoteRetryInterval = 5 * time.Second
+
+// promotion is a learner promotion proposed by this node. It is forgotten
+// once the conf change applies; raft may drop the proposal, so one that has
+// returned is proposed again after promoteRetryInterval.
+type promotion struct {
+	proposed time.Time
+	donec    chan struct{} // closed when ProposeConfChange returns
+}
+
+// pending reports whether p is still in flight or too recent to retry.
+func (p *promotion) pending() bool {
+	select {
+	case <-p.donec:
+		return time.Since(p.proposed) < promoteRetryInterval
+	default:
+		return true
+	}
+}
+
+// maybePromoteLearners promotes learners that have caught up with the leader.
+// A learner added to replace a voter is promoted and the voter removed in a
+// single joint consensus change, so the cluster never loses quorum. ctx is
+// cancelled when the node stops.
+func (rc *raftNode) maybePromoteLearners(ctx context.Context) {
+	st := rc.node.Status()
+	if st.RaftState != raft.StateLeader {
+		return
+	}
+	for id, pr := range st.Progress {
+		if !pr.IsLearner || !pr.RecentActive || pr.State != tracker.StateReplicate {
+			continue
+		}
+		if p, ok := rc.promoting[id]; ok && p.pending() {
+			continue
+		}
+		if pr.Match+learnerCatchUpEntries < st.Commit {
+			continue
+		}
+		cc := raftpb.ConfChangeV2{
+			Changes: []raftpb.ConfChangeSingle{{Type: raftpb.ConfChangeAddNode, NodeID: id}},
+		}
+		if mc, ok := rc.members.member(id); ok && mc.Replaces != 0 {
+			cc.Changes = append(cc.Changes, raftpb.ConfChangeSingle{Type: raftpb.ConfChangeRemoveNode, NodeID: mc.Replaces})
+		}
+		log.Printf("promoting learner %x (match %d, commit %d)", id, pr.Match, st.Commit)
+		p := &promotion{proposed: time.Now(), donec: make(chan struct{})}
+		rc.promoting[id] = p
+		go func(id uint64) {
+			defer close(p.donec)
+			if err := rc.node.ProposeConfChange(ctx, cc); err != nil && ctx.Err() == nil {
+				log.Printf("failed to propose promotion of learner %x (%v)", id, err)
+			}
+		}(id)
+	}
+}
+
+// raftURL returns the URL this node serves raft traffic on.
+func (rc *raftNode) raftURL() string {
+	if u, ok := rc.members.url(rc.memberID); ok {
+		return u
+	}
+	return rc.peers[rc.id-1]
+}
+
+func (rc *raftNode) serveRaft(handler http.Handler) {
+	raftUrl, err := url.Parse(rc.raftURL())
 	if err != nil {
 		log.Fatalf("raftexample: Failed parsing URL (%v)", err)
 	}
 
-	ln, err := newStoppableListener(raftUrl.Host, rc.httpstopc)
+	var ln net.Listener
+	ln, err = newStoppableListener(raftUrl.Host, rc.httpstopc)
 	if err != nil {
 		log.Fatalf("raftexample: Failed to listen rafthttp (%v)", err)
 	}
+	if raftUrl.Scheme == "https" {
+		// peers must present a certificate signed by the shared CA
+		tlsInfo := rc.peerTLS
+		tlsInfo.ClientCertAuth = true
+		if ln, err = transport.NewTLSListener(ln, &tlsInfo); err != nil {
+			log.Fatalf("raftexample: Failed to listen rafthttp with TLS (%v)", err)
+		}
+	}
 
-	err = (&http.Server{Handler: rc.transport.Handler()}).Serve(ln)
+	err = (&http.Server{Handler: handler}).Serve(ln)
 	select {
 	case <-rc.httpstopc:
 	default:
@@ -475,6 +837,8 @@ func (rc *raftNode) serveRaft() {
 func (rc *raftNode) Process(ctx context.Context, m raftpb.Message) error {
 	return rc.node.Step(ctx, m)
 }
-func (rc *raftNode) IsIDRemoved(id uint64) bool                           { return false }
-func (rc *raftNode) ReportUnreachable(id uint64)                          {}
-func (rc *raftNode) ReportSnapshot(id uint64, status raft.SnapshotStatus) {}
+func (rc *raftNode) IsIDRemoved(id uint64) bool  { return rc.members.isRemoved(id) }
+func (rc *raftNode) ReportUnreachable(id uint64) { rc.node.ReportUnreachable(id) }
+func (rc *raftNode) ReportSnapshot(id uint64, status raft.SnapshotStatus) {
+	rc.node.ReportSnapshot(id, status)
+}
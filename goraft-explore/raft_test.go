@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+func TestLeaderElection(t *testing.T) {
+	c := newTestCluster(t, 3, defaultSnapCount)
+	lead := c.leader()
+
+	// an isolated leader is replaced by the majority
+	var others []int
+	for _, id := range c.running() {
+		if id != lead.id {
+			others = append(others, id)
+		}
+	}
+	c.net.partition([]uint64{uint64(lead.id)}, []uint64{uint64(others[0]), uint64(others[1])})
+	newLead := c.leader(others...)
+	if newLead.id == lead.id {
+		t.Fatalf("isolated leader %d kept leadership", lead.id)
+	}
+
+	// after healing the old leader follows the new one
+	c.net.heal()
+	if got := c.leader(); got.id != newLead.id {
+		t.Fatalf("leader = %d after heal, want %d", got.id, newLead.id)
+	}
+
+	// a crashed leader is replaced and rejoins as a follower
+	c.crash(newLead.id)
+	c.leader()
+	c.restart(newLead.id)
+	c.leader()
+}
+
+func TestLogReplicationUnderFaults(t *testing.T) {
+	c := newTestCluster(t, 3, defaultSnapCount)
+	c.net.drop(0.2)
+	c.net.delay(20 * time.Millisecond)
+
+	for i := 0; i < 20; i++ {
+		c.put(c.leader(), fmt.Sprintf("/k%d", i), fmt.Sprintf("v%d", i), 1, 2, 3)
+	}
+
+	// a partitioned follower catches up once healed
+	lead := c.leader()
+	follower := lead.id%3 + 1
+	c.net.heal()
+	c.net.partition([]uint64{uint64(follower)}, []uint64{uint64(lead.id), uint64(6 - lead.id - follower)})
+	c.put(lead, "/partitioned", "v", lead.id)
+	if c.applied("/partitioned", "v", 500*time.Millisecond, follower) {
+		t.Fatalf("partitioned node %d applied an entry", follower)
+	}
+	c.net.heal()
+	if !c.applied("/partitioned", "v", 10*time.Second, 1, 2, 3) {
+		t.Fatalf("node %d did not catch up after heal", follower)
+	}
+	for i := 0; i < 20; i++ {
+		if !c.applied(fmt.Sprintf("/k%d", i), fmt.Sprintf("v%d", i), time.Second, 1, 2, 3) {
+			t.Fatalf("/k%d missing after faults", i)
+		}
+	}
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	c := newTestCluster(t, 3, 10)
+	c.crash(3)
+
+	for i := 0; i < 50; i++ {
+		c.put(c.leader(1, 2), fmt.Sprintf("/k%d", i), "v", 1, 2)
+	}
+
+	// node 3 is too far behind the compacted log and needs a snapshot
+	n := c.restart(3)
+	if !c.applied("/k49", "v", 10*time.Second, 3) {
+		t.Fatal("restarted node did not catch up")
+	}
+	for i := 0; i < 50; i++ {
+		if !c.applied(fmt.Sprintf("/k%d", i), "v", time.Second, 3) {
+			t.Fatalf("/k%d missing after snapshot install", i)
+		}
+	}
+	snapshot, err := n.rc.snapshotter.Load()
+	if err != nil {
+		t.Fatalf("node 3 has no snapshot: %v", err)
+	}
+	members, _ := decodeSnapshot(snapshot.Data)
+	for id := uint64(1); id <= 3; id++ {
+		if u, ok := members.url(id); !ok || u != peerURL(int(id)) {
+			t.Errorf("snapshot member %d url = %q, want %q", id, u, peerURL(int(id)))
+		}
+	}
+
+	// a node restarted from its own snapshot and WAL keeps every key
+	c.crash(1)
+	c.restart(1)
+	for i := 0; i < 50; i++ {
+		if !c.applied(fmt.Sprintf("/k%d", i), "v", 5*time.Second, 1) {
+			t.Fatalf("/k%d missing after restart from snapshot", i)
+		}
+	}
+}
+
+func addLearner(c *testCluster, id int, replaces uint64) {
+	c.leader().confChangeC <- raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddLearnerNode,
+		NodeID:  uint64(id),
+		Context: encodeMemberContext(memberContext{URL: peerURL(id), Replaces: replaces}),
+	}
+}
+
+func isVoter(n *testNode, id int) bool {
+	_, ok := n.rc.node.Status().Config.Voters.IDs()[uint64(id)]
+	return ok
+}
+
+func TestMembershipChangeUnderFaults(t *testing.T) {
+	c := newTestCluster(t, 3, defaultSnapCount)
+	c.put(c.leader(), "/before", "v", 1, 2, 3)
+	c.net.drop(0.05)
+	c.net.delay(10 * time.Millisecond)
+
+	// node 4 joins as a learner and is promoted once caught up
+	addLearner(c, 4, 0)
+	c.start(4, true)
+	c.waitFor(20*time.Second, "promotion of node 4", func() bool { return isVoter(c.leader(), 4) })
+	if !c.applied("/before", "v", 10*time.Second, 4) {
+		t.Fatal("node 4 did not replicate the log")
+	}
+
+	// node 5 replaces a follower in a single joint consensus change
+	lead := c.leader()
+	old := 1
+	for old == lead.id || old == 4 {
+		old++
+	}
+	addLearner(c, 5, uint64(old))
+	c.start(5, true)
+	c.waitFor(20*time.Second, "replacement by node 5", func() bool {
+		lead := c.leader()
+		return isVoter(lead, 5) && !isVoter(lead, old)
+	})
+	if !c.leader().rc.IsIDRemoved(uint64(old)) {
+		t.Fatalf("node %d not reported as removed", old)
+	}
+	c.crash(old)
+
+	// membership survives a restart without relying on -cluster
+	c.net.heal()
+	c.crash(4)
+	n := c.restart(4)
+	if u, ok := n.rc.members.url(5); !ok || u != peerURL(5) {
+		t.Fatalf("restarted node lost member 5 (url %q)", u)
+	}
+	c.put(c.leader(), "/after", "v", 4, 5)
+}
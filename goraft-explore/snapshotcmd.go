@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/pkg/transport"
+	"go.uber.org/zap"
+)
+
+var errSnapshotUsage = errors.New(`usage:
+  goraft-explore snapshot save [-endpoint url] <file>
+  goraft-explore snapshot restore [-id n] [-cluster urls] [-cluster-token token] <file>`)
+
+// runSnapshotCommand runs `goraft-explore snapshot save|restore`.
+func runSnapshotCommand(args []string) error {
+	if len(args) == 0 {
+		return errSnapshotUsage
+	}
+	switch args[0] {
+	case "save":
+		return snapshotSave(args[1:])
+	case "restore":
+		return snapshotRestore(args[1:])
+	}
+	return errSnapshotUsage
+}
+
+// snapshotSave fetches a backup from a live node, verifies it and writes it
+// to a file.
+func snapshotSave(args []string) error {
+	fs := flag.NewFlagSet("snapshot save", flag.ContinueOnError)
+	endpoint := fs.String("endpoint", "http://127.0.0.1:9121", "key-value API of a live node")
+	certFile := fs.String("cert-file", "", "client TLS certificate for the key-value API")
+	keyFile := fs.String("key-file", "", "client TLS key")
+	caFile := fs.String("trusted-ca-file", "", "CA that signs the key-value API certificate")
+	timeout := fs.Duration("timeout", 30*time.Second, "time allowed to fetch the snapshot")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errSnapshotUsage
+	}
+	path := fs.Arg(0)
+
+	client := &http.Client{Timeout: *timeout}
+	if strings.HasPrefix(*endpoint, "https://") {
+		cfg, err := transport.TLSInfo{CertFile: *certFile, KeyFile: *keyFile, TrustedCAFile: *caFile}.ClientConfig()
+		if err != nil {
+			return err
+		}
+		client.Transport = &http.Transport{TLSClientConfig: cfg}
+	}
+	resp, err := client.Get(strings.TrimSuffix(*endpoint, "/") + "/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	bf, err := readBackup(b)
+	if err != nil {
+		return err
+	}
+
+	// never leave a truncated file behind under the final name
+	tmp := path + ".part"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	md := bf.Metadata
+	fmt.Printf("saved revision %d (%d keys, %d leases, sha256 %s) to %s\n", md.Revision, md.Keys, md.Leases, md.SHA256, path)
+	return nil
+}
+
+// snapshotRestore seeds the data directories of one member of a new cluster
+// from a backup. Run it once per member with the same -cluster and
+// -cluster-token, then start every member with its usual flags. Without a
+// token a random one is generated and printed for the remaining members.
+func snapshotRestore(args []string) error {
+	fs := flag.NewFlagSet("snapshot restore", flag.ContinueOnError)
+	id := fs.Int("id", 1, "ID of the member to restore, its position in -cluster")
+	cluster := fs.String("cluster", "http://127.0.0.1:9021", "comma separated peers of the new cluster")
+	token := fs.String("cluster-token", "", "token shared by every member of the new cluster; generated if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errSnapshotUsage
+	}
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	bf, err := readBackup(b)
+	if err != nil {
+		return err
+	}
+	if *token == "" {
+		if *token, err = newClusterToken(); err != nil {
+			return err
+		}
+	}
+	peers := strings.Split(*cluster, ",")
+	if err := restoreBackup(bf, *id, peers, *token, defaultWALDir(*id), defaultSnapDir(*id), zap.NewNop()); err != nil {
+		return err
+	}
+	md := bf.Metadata
+	fmt.Printf("restored revision %d (%d keys, %d leases) taken at %s as member %d of %d\n",
+		md.Revision, md.Keys, md.Leases, md.CreatedAt.Format(time.RFC3339), *id, len(peers))
+	fmt.Printf("restore the other members with -cluster-token %s\n", *token)
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/pkg/transport"
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+// testCA issues certificates for loopback peers and clients.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string // PEM encoded CA certificate
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{t: t, dir: t.TempDir(), cert: cert, key: key}
+	ca.file = ca.writePEM(name+".crt", "CERTIFICATE", der)
+	return ca
+}
+
+// issue returns the certificate and key files for a loopback peer or client.
+func (ca *testCA) issue(name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return ca.writePEM(name+".crt", "CERTIFICATE", der), ca.writePEM(name+".key", "EC PRIVATE KEY", keyDER)
+}
+
+func (ca *testCA) writePEM(name, typ string, der []byte) string {
+	path := filepath.Join(ca.dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+// client returns an https client trusting ca that presents the given
+// certificate, or none if certFile is empty.
+func (ca *testCA) client(certFile, keyFile string) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: pool}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			ca.t.Fatal(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}, Timeout: 5 * time.Second}
+}
+
+func TestPeerMutualTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue("peer")
+	c := newTLSTestCluster(t, 3, transport.TLSInfo{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		TrustedCAFile:  ca.file,
+		ClientCertAuth: true,
+	})
+
+	c.put(c.node(1), "/secure", "v", 1, 2, 3)
+	c.leader()
+
+	resp, err := ca.client(certFile, keyFile).Get(c.peers[0] + "/raft/probing")
+	if err != nil {
+		t.Fatalf("peer rejected a certificate from the shared CA: %v", err)
+	}
+	resp.Body.Close()
+
+	// peers reject clients without a certificate from the shared CA
+	rogue := newTestCA(t, "rogue")
+	rogueCert, rogueKey := rogue.issue("rogue")
+	for name, cl := range map[string]*http.Client{
+		"no certificate":    ca.client("", ""),
+		"foreign authority": ca.client(rogueCert, rogueKey),
+	} {
+		resp, err := cl.Get(c.peers[0] + "/raft/probing")
+		if err == nil {
+			resp.Body.Close()
+			t.Errorf("%s: peer accepted the connection", name)
+		}
+	}
+}
+
+func TestKVAPIClientCertAuth(t *testing.T) {
+	c := newTestCluster(t, 1, defaultSnapCount)
+	c.put(c.node(1), "/k", "v", 1)
+
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue("server")
+	clientCert, clientKey := ca.issue("client")
+	cfg, err := kvAPITLSConfig(transport.TLSInfo{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		TrustedCAFile:  ca.file,
+		ClientCertAuth: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   &httpKVAPI{store: c.node(1).store(), confChangeC: make(chan raftpb.ConfChangeI)},
+		TLSConfig: cfg,
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+	url := "https://" + ln.Addr().String() + "/k"
+
+	resp, err := ca.client(clientCert, clientKey).Get(url)
+	if err != nil {
+		t.Fatalf("GET with client certificate: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "v" {
+		t.Fatalf("GET = %d %q, want 200 \"v\"", resp.StatusCode, body)
+	}
+
+	if resp, err := ca.client("", "").Get(url); err == nil {
+		resp.Body.Close()
+		t.Fatal("GET without client certificate succeeded")
+	}
+}
+
+func TestKVAPITLSWithoutClientAuth(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue("server")
+	cfg, err := kvAPITLSConfig(transport.TLSInfo{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientAuth != tls.NoClientCert {
+		t.Fatalf("ClientAuth = %v, want NoClientCert", cfg.ClientAuth)
+	}
+	if _, err := kvAPITLSConfig(transport.TLSInfo{CertFile: certFile, KeyFile: keyFile, ClientCertAuth: true}); err == nil {
+		t.Fatal("client cert auth without a trusted CA was accepted")
+	}
+}
+
+func TestCheckPeerTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	certFile, keyFile := ca.issue("peer")
+	mutual := transport.TLSInfo{CertFile: certFile, KeyFile: keyFile, TrustedCAFile: ca.file, ClientCertAuth: true}
+	https := []string{"https://127.0.0.1:12379", "https://127.0.0.1:22379"}
+
+	if err := checkPeerTLS(https, mutual); err != nil {
+		t.Fatalf("rejected mutual TLS between https peers: %v", err)
+	}
+	if err := checkPeerTLS([]string{"http://127.0.0.1:12379"}, transport.TLSInfo{}); err != nil {
+		t.Fatalf("rejected plain http peers: %v", err)
+	}
+	// certificates would be ignored for plain http peers
+	if err := checkPeerTLS([]string{"https://127.0.0.1:12379", "http://127.0.0.1:22379"}, mutual); err == nil {
+		t.Error("accepted peer certificates with an http peer")
+	}
+	// without a CA, any certificate from the system roots would pass
+	noCA := mutual
+	noCA.TrustedCAFile = ""
+	if err := checkPeerTLS(https, noCA); err == nil {
+		t.Error("accepted peer certificates without a trusted CA")
+	}
+}
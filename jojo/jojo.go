@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
@@ -10,6 +9,7 @@ import (
 	"log"
 	"math"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
@@ -50,11 +50,15 @@ type UpstreamServer struct {
 	offline  bool
 }
 
-// UpstreamServers List of upstream servers
+// UpstreamServers Pool of upstream servers for the names under suffix
 type UpstreamServers struct {
-	lock    sync.RWMutex
-	servers []UpstreamServer
-	live    []string
+	suffix     string
+	lock       sync.RWMutex
+	servers    []UpstreamServer
+	live       []string
+	transports map[string]Upstream
+	stats      map[string]*UpstreamStats
+	rtt        UpstreamRTT
 }
 
 // UpstreamRTT Keep track of the mean RTT
@@ -91,16 +95,11 @@ type CacheVal struct {
 	Response   *dns.Msg
 }
 
-// LocalRR Structure containing a locally served record
-type LocalRR struct {
-	Name string `dns:"cdomain-name"`
-	RR   *dns.RR
-}
-
 var (
 	address            = flag.String("listen", ":53", "Address to listen to (TCP and UDP)")
-	upstreamServersStr = flag.String("upstream", "8.8.8.8:53,8.8.4.4:53", "Comma-delimited list of upstream servers")
+	upstreamServersStr = flag.String("upstream", "8.8.8.8:53,8.8.4.4:53", "Comma-delimited list of upstream servers: host:port, tls://host[:port] or https://host/path")
 	upstreamServers    *UpstreamServers
+	forwardRulesStr    = flag.String("forward", "", "Semicolon-delimited list of forwarding rules, each a domain suffix and its upstream servers, e.g. corp.example=10.0.0.53:53,10.0.1.53:53")
 	cacheSize          = flag.Int("cachesize", 2*1024*1024*1024/2048, "Number of cached responses")
 	memSize            = flag.Uint64("memsize", 2*1024, "Memory size in MB")
 	minLabelsCount     = flag.Int("minlabels", 2, "Minimum number of labels")
@@ -110,26 +109,43 @@ var (
 	sipHashKey         = SipHashKey{k1: 0, k2: 0}
 	maxClients         = flag.Uint("maxclients", 1000, "Maximum number of simultaneous clients")
 	maxRTT             = flag.Float64("maxrtt", 0.25, "Maximum mean RTT for upstream queries before marking a server as dead")
-	localRRSFile       = flag.String("local-rrs", "", "Config files with local records")
-	upstreamRtt        UpstreamRTT
+	localRRSFile       = flag.String("local-rrs", "", "Config files with local records, answered authoritatively if they include an SOA record")
+	zoneFiles          = flag.String("zones", "", "Comma-delimited list of RFC 1035 zone files to answer authoritatively, each as file or origin=file")
+	tlsAddress         = flag.String("listen-tls", "", "Address to listen to for DNS over TLS, e.g. :853")
+	httpsAddress       = flag.String("listen-https", "", "Address to listen to for DNS over HTTPS, e.g. :443")
+	dohPath            = flag.String("doh-path", "/dns-query", "URL path of DNS over HTTPS queries")
+	tlsCertFile        = flag.String("tls-cert", "", "TLS certificate file (PEM) of the encrypted listeners")
+	tlsKeyFile         = flag.String("tls-key", "", "TLS private key file (PEM) of the encrypted listeners")
+	blocklistFiles     = flag.String("blocklist", "", "Comma-delimited list of files with domains to block, in hosts file or plain format")
+	allowlistFiles     = flag.String("allowlist", "", "Comma-delimited list of files with domains never to block")
+	blockMode          = flag.String("block-mode", "nxdomain", "How to answer blocked names: nxdomain, or null for 0.0.0.0 and ::")
+	metricsAddress     = flag.String("listen-metrics", "", "Address to serve Prometheus metrics (/metrics) and stats (/stats) on over HTTP, e.g. 127.0.0.1:9153")
 	resolverRing       chan QueuedRequest
 	globalTimeout      = 2 * time.Second
 	slip               uint32
 	udpClient          dns.Client
 	tcpClient          dns.Client
-	localRRS           []LocalRR
+	localRRS           *Zone
 )
 
-func parseUpstreamServers(str string) (*UpstreamServers, error) {
+func parseUpstreamServers(suffix string, str string) (*UpstreamServers, error) {
 	var servers []UpstreamServer
 	var live []string
+	transports := make(map[string]Upstream)
+	stats := make(map[string]*UpstreamStats)
 	for _, addr := range strings.Split(str, ",") {
+		transport, err := newUpstream(addr, nil)
+		if err != nil {
+			return nil, err
+		}
 		server := UpstreamServer{addr: addr}
 		servers = append(servers, server)
 		live = append(live, addr)
+		transports[addr] = transport
+		stats[addr] = new(UpstreamStats)
 	}
-	res := UpstreamServers{servers: servers, live: live}
-	log.Printf("Configured upstream servers: %v\n", live)
+	res := UpstreamServers{suffix: suffix, servers: servers, live: live, transports: transports, stats: stats}
+	log.Printf("Configured upstream servers for [%v]: %v\n", suffix, live)
 	return &res, nil
 }
 
@@ -142,6 +158,9 @@ func randUint64() uint64 {
 	return binary.LittleEndian.Uint64(buf)
 }
 
+// parseLocalRRSFile Loads the -local-rrs records, relative names being under
+// the root. A file with an SOA record is a zone: names under its origin are
+// then answered authoritatively, with NXDOMAIN for those it does not have.
 func parseLocalRRSFile(file string) {
 	if file == "" {
 		return
@@ -151,19 +170,8 @@ func parseLocalRRSFile(file string) {
 		log.Fatal(err)
 	}
 	defer fp.Close()
-	scanner := bufio.NewScanner(fp)
-	localRRS = make([]LocalRR, 0)
-	for scanner.Scan() {
-		s := scanner.Text()
-		rr, err := dns.NewRR(s)
-		if err != nil {
-			log.Fatal("failed to parse RR: ", err)
-		}
-		if rr == nil {
-			continue
-		}
-		localRR := LocalRR{Name: strings.ToLower(rr.Header().Name), RR: &rr}
-		localRRS = append(localRRS, localRR)
+	if localRRS, err = parseZone(fp, ".", file); err != nil {
+		log.Fatal("failed to parse RR: ", err)
 	}
 }
 
@@ -174,17 +182,35 @@ func main() {
 		log.Fatal("Cache size too small")
 	}
 	parseLocalRRSFile(*localRRSFile)
+	var err error
+	if zones, err = loadZones(splitList(*zoneFiles)); err != nil {
+		log.Fatal(err)
+	}
+	if blockFiles := splitList(*blocklistFiles); len(blockFiles) > 0 {
+		allowFiles := splitList(*allowlistFiles)
+		if err := reloadFilter(blockFiles, allowFiles, *blockMode); err != nil {
+			log.Fatal(err)
+		}
+		go filterThread(blockFiles, allowFiles, *blockMode)
+	}
 	cache, _ = lru.NewARC(*cacheSize)
-	upstreamServers, _ = parseUpstreamServers(*upstreamServersStr)
+	if upstreamServers, err = parseUpstreamServers(".", *upstreamServersStr); err != nil {
+		log.Fatal(err)
+	}
+	if forwardRules, err = parseForwardRules(*forwardRulesStr); err != nil {
+		log.Fatal(err)
+	}
 	sipHashKey = SipHashKey{k1: randUint64(), k2: randUint64()}
 	resolverRing = make(chan QueuedRequest, *maxClients)
 	globalTimeout = time.Duration((*maxRTT) * 3.0 * 1e9)
 	udpClient = dns.Client{Net: "udp", DialTimeout: globalTimeout, ReadTimeout: globalTimeout, WriteTimeout: globalTimeout, SingleInflight: true}
 	tcpClient = dns.Client{Net: "tcp", DialTimeout: globalTimeout, ReadTimeout: globalTimeout, WriteTimeout: globalTimeout, SingleInflight: true}
 	probeUpstreamServers(true)
-	upstreamServers.lock.Lock()
-	log.Printf("Live upstream servers: %v\n", upstreamServers.live)
-	upstreamServers.lock.Unlock()
+	for _, pool := range upstreamPools() {
+		pool.lock.RLock()
+		log.Printf("Live upstream servers for [%v]: %v\n", pool.suffix, pool.live)
+		pool.lock.RUnlock()
+	}
 	for i := uint(0); i < *maxClients; i++ {
 		go func() {
 			resolverThread()
@@ -231,6 +257,37 @@ func main() {
 	go func() {
 		log.Fatal(tcpServer.ActivateAndServe())
 	}()
+	if *tlsAddress != "" || *httpsAddress != "" {
+		tlsConfig, err := loadTLSConfig(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *tlsAddress != "" {
+			tlsServer, err := newDoTServer(*tlsAddress, tlsConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer tlsServer.Shutdown()
+			go func() {
+				log.Fatal(tlsServer.ActivateAndServe())
+			}()
+		}
+		if *httpsAddress != "" {
+			httpsServer, httpsListener, err := newDoHServer(*httpsAddress, *dohPath, tlsConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer httpsServer.Close()
+			go func() {
+				log.Fatal(httpsServer.ServeTLS(httpsListener, "", ""))
+			}()
+		}
+	}
+	if *metricsAddress != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsAddress, metricsHandler()))
+		}()
+	}
 	fmt.Println("Ready")
 	vacuumThread()
 }
@@ -258,7 +315,13 @@ func getKey(req *dns.Msg) (*CacheKey, error) {
 	return &CacheKey, nil
 }
 
-func getMaxPayloadSize(req *dns.Msg) uint16 {
+// getMaxPayloadSize Returns the largest response that can be sent to the
+// client without truncation: any size over stream transports (TCP, DoT and
+// DoH), else what the EDNS payload size allows
+func getMaxPayloadSize(w dns.ResponseWriter, req *dns.Msg) uint16 {
+	if _, isTCP := w.RemoteAddr().(*net.TCPAddr); isTCP {
+		return dns.MaxMsgSize
+	}
 	opt := req.IsEdns0()
 	if opt == nil {
 		return dns.MinMsgSize
@@ -270,93 +333,93 @@ func getMaxPayloadSize(req *dns.Msg) uint16 {
 	return maxPayloadSize
 }
 
-func pickUpstream(req *dns.Msg) (*string, error) {
+func (us *UpstreamServers) pickUpstream(req *dns.Msg) (*string, error) {
 	name := strings.ToLower(req.Question[0].Name)
 	h := siphash.Hash(sipHashKey.k1, sipHashKey.k2, []byte(name))
-	upstreamServers.lock.RLock()
-	defer upstreamServers.lock.RUnlock()
-	liveCount := uint64(len(upstreamServers.live))
+	us.lock.RLock()
+	defer us.lock.RUnlock()
+	liveCount := uint64(len(us.live))
 	if liveCount <= 0 {
-		return nil, errors.New("All upstream servers are down")
+		return nil, fmt.Errorf("All upstream servers for [%v] are down", us.suffix)
 	}
 	i := h / (math.MaxUint64 / liveCount)
 	if i >= liveCount {
 		i = liveCount - 1
 	}
-	res := upstreamServers.live[i]
+	res := us.live[i]
 	return &res, nil
 }
 
-func markFailed(addr string) {
-	upstreamServers.lock.Lock()
-	defer upstreamServers.lock.Unlock()
-	for i, server := range upstreamServers.servers {
+func (us *UpstreamServers) markFailed(addr string) {
+	us.lock.Lock()
+	defer us.lock.Unlock()
+	for i, server := range us.servers {
 		if server.addr != addr {
 			continue
 		}
 		if server.offline {
 			return
 		}
-		upstreamServers.servers[i].failures++
-		if upstreamServers.servers[i].failures < *maxFailures {
+		us.servers[i].failures++
+		if us.servers[i].failures < *maxFailures {
 			return
 		}
 		break
 	}
-	if len(upstreamServers.live) <= 1 {
-		resetUpstreamServersNoLock()
+	if len(us.live) <= 1 {
+		us.resetNoLock()
 		return
 	}
-	servers := upstreamServers.servers
+	servers := us.servers
 	live := []string{}
-	for i, server := range upstreamServers.servers {
+	for i, server := range us.servers {
 		if server.addr == addr {
 			servers[i].offline = true
 		} else if server.offline == false {
 			live = append(live, server.addr)
 		}
 	}
-	upstreamServers.servers = servers
-	upstreamServers.live = live
+	us.servers = servers
+	us.live = live
 }
 
-func resetRTT() {
-	upstreamRtt.lock.Lock()
-	defer upstreamRtt.lock.Unlock()
-	upstreamRtt.count = 0.0
-	upstreamRtt.RTT = 0.0
+func (us *UpstreamServers) resetRTT() {
+	us.rtt.lock.Lock()
+	defer us.rtt.lock.Unlock()
+	us.rtt.count = 0.0
+	us.rtt.RTT = 0.0
 }
 
-func resetUpstreamServersNoLock() {
-	servers := upstreamServers.servers
-	if len(servers) == len(upstreamServers.live) {
+func (us *UpstreamServers) resetNoLock() {
+	servers := us.servers
+	if len(servers) == len(us.live) {
 		return
 	}
 	live := []string{}
-	for i, server := range upstreamServers.servers {
+	for i, server := range us.servers {
 		servers[i].failures = 0
 		servers[i].offline = false
 		live = append(live, server.addr)
 	}
-	upstreamServers.servers = servers
-	upstreamServers.live = live
-	resetRTT()
+	us.servers = servers
+	us.live = live
+	us.resetRTT()
 }
 
-func resetUpstreamServers() {
-	upstreamServers.lock.Lock()
-	resetUpstreamServersNoLock()
-	upstreamServers.lock.Unlock()
+func (us *UpstreamServers) reset() {
+	us.lock.Lock()
+	us.resetNoLock()
+	us.lock.Unlock()
 }
 
-func probeUpstreamServers(verbose bool) {
-	upstreamServers.lock.Lock()
-	servers := upstreamServers.servers
-	upstreamServers.lock.Unlock()
+func (us *UpstreamServers) probe(verbose bool) {
+	us.lock.Lock()
+	servers := us.servers
+	us.lock.Unlock()
 	live := []string{}
 	req := new(dns.Msg)
-	req.SetQuestion(".", dns.TypeSOA)
-	for i, server := range upstreamServers.servers {
+	req.SetQuestion(us.suffix, dns.TypeSOA)
+	for i, server := range us.servers {
 		if server.offline == false && server.failures > 0 {
 			if verbose {
 				log.Printf("[%v] assumed to be online", server.addr)
@@ -367,7 +430,7 @@ func probeUpstreamServers(verbose bool) {
 		if verbose {
 			log.Printf("Probing [%v] ...", server.addr)
 		}
-		_, rtt, err := udpClient.Exchange(req, server.addr)
+		_, rtt, err := us.transports[server.addr].Exchange(req)
 		if err == nil && rtt.Seconds() < *maxRTT {
 			servers[i].offline = false
 			servers[i].failures = 0
@@ -381,37 +444,45 @@ func probeUpstreamServers(verbose bool) {
 			}
 		}
 	}
-	upstreamServers.lock.Lock()
-	upstreamServers.servers = servers
-	upstreamServers.live = live
-	upstreamServers.lock.Unlock()
-	resetRTT()
+	us.lock.Lock()
+	us.servers = servers
+	us.live = live
+	us.lock.Unlock()
+	us.resetRTT()
 }
 
-func syncResolve(req *dns.Msg) (*dns.Msg, time.Duration, error) {
-	addr, err := pickUpstream(req)
+func probeUpstreamServers(verbose bool) {
+	for _, pool := range upstreamPools() {
+		pool.probe(verbose)
+	}
+}
+
+func (us *UpstreamServers) syncResolve(req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	addr, err := us.pickUpstream(req)
 	if err != nil {
 		return nil, 0, err
 	}
-	resolved, rtt, err := udpClient.Exchange(req, *addr)
-	if err != nil || (resolved != nil && resolved.Truncated) {
-		resolved, rtt, err = tcpClient.Exchange(req, *addr)
-	}
+	resolved, rtt, err := us.transports[*addr].Exchange(req)
+	us.recordUpstream(*addr, rtt.Seconds(), err)
 	if err != nil {
-		markFailed(*addr)
+		us.markFailed(*addr)
 		return nil, 0, err
 	}
-	upstreamRtt.lock.Lock()
-	upstreamRtt.count++
-	upstreamRtt.RTT += rtt.Seconds()
-	meanRTT := upstreamRtt.RTT / (upstreamRtt.count + BayesianAverageC)
-	upstreamRtt.lock.Unlock()
+	us.rtt.lock.Lock()
+	us.rtt.count++
+	us.rtt.RTT += rtt.Seconds()
+	meanRTT := us.rtt.RTT / (us.rtt.count + BayesianAverageC)
+	us.rtt.lock.Unlock()
 	if meanRTT > *maxRTT {
-		markFailed(*addr)
+		us.markFailed(*addr)
 	}
 	return resolved, rtt, nil
 }
 
+func syncResolve(req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return upstreamsFor(req.Question[0].Name).syncResolve(req)
+}
+
 func resolverThread() {
 	for {
 		queuedRequest := <-resolverRing
@@ -420,6 +491,7 @@ func resolverThread() {
 			queuedRequest.responseChan <- response
 			close(queuedRequest.responseChan)
 			atomic.AddUint32(&slip, 1)
+			atomic.AddUint64(&metrics.tooOld, 1)
 			continue
 		}
 		resolved, rtt, err := syncResolve(queuedRequest.req)
@@ -440,6 +512,7 @@ func resolveViaResolverThreads(req *dns.Msg) (*dns.Msg, time.Duration, error) {
 			old := <-resolverRing
 			evictedResponse := QueuedResponse{resolved: nil, rtt: 0, err: errors.New("Evicted")}
 			old.responseChan <- evictedResponse
+			atomic.AddUint64(&metrics.evicted, 1)
 		}
 	}
 	response := <-responseChan
@@ -514,18 +587,11 @@ func failWithRcode(w dns.ResponseWriter, r *dns.Msg, rCode int) {
 }
 
 func handleSpecialNames(w dns.ResponseWriter, req *dns.Msg) bool {
-	question := req.Question[0]
-	nameLC := strings.ToLower(question.Name)
-	for _, localRR := range localRRS {
-		if nameLC == localRR.Name {
-			m := new(dns.Msg)
-			m.Id = req.Id
-			m.Answer = []dns.RR{*localRR.RR}
-			m.Response = true
-			w.WriteMsg(m)
-			return true
-		}
+	if m := answerLocally(req); m != nil {
+		w.WriteMsg(m)
+		return true
 	}
+	question := req.Question[0]
 	if question.Qtype != dns.TypeANY {
 		return false
 	}
@@ -543,6 +609,9 @@ func handleSpecialNames(w dns.ResponseWriter, req *dns.Msg) bool {
 }
 
 func route(w dns.ResponseWriter, req *dns.Msg) {
+	mw := &metricsResponseWriter{ResponseWriter: w}
+	defer mw.record(req)
+	w = mw
 	keyP, err := getKey(req)
 	if err != nil {
 		failWithRcode(w, req, dns.RcodeRefused)
@@ -551,7 +620,10 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 	if handleSpecialNames(w, req) {
 		return
 	}
-	maxPayloadSize := getMaxPayloadSize(req)
+	if handleBlocked(w, req) {
+		return
+	}
+	maxPayloadSize := getMaxPayloadSize(w, req)
 	var resp *dns.Msg
 	cacheValP, _ := cache.Get(*keyP)
 	if cacheValP != nil {
@@ -563,6 +635,11 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 			resp.Question = req.Question
 		}
 	}
+	if resp != nil {
+		atomic.AddUint64(&metrics.cacheHits, 1)
+	} else {
+		atomic.AddUint64(&metrics.cacheMisses, 1)
+	}
 	if *debug {
 		question := req.Question[0]
 		cachedStr := ""
@@ -575,6 +652,7 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 		slipValue := atomic.LoadUint32(&slip)
 		if slipValue > 0 && slipValue%2 == 0 {
 			atomic.CompareAndSwapUint32(&slip, slipValue, slipValue+1)
+			atomic.AddUint64(&metrics.slipped, 1)
 			if slipValue%4 == 0 {
 				sendTruncated(w, req.MsgHdr)
 			} else {
@@ -601,7 +679,7 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 	}
 	packed, _ := resp.Pack()
 	packedLen := len(packed)
-	if uint16(packedLen) > maxPayloadSize {
+	if packedLen > int(maxPayloadSize) {
 		sendTruncated(w, resp.MsgHdr)
 	} else {
 		w.WriteMsg(resp)
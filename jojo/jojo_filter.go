@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// BlockedTTL TTL of the answers to blocked names
+	BlockedTTL = 300
+	// FilterPollPeriod How often the block and allow lists are checked for changes, in seconds
+	FilterPollPeriod = 10
+)
+
+// hostsFileNames Names of hosts files that are not domains to block
+var hostsFileNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// DomainTrie Set of domains, each of which matches itself and its subdomains.
+// Nodes are keyed by label, from the top level domain down.
+type DomainTrie struct {
+	children map[string]*DomainTrie
+	terminal bool
+}
+
+// Add Adds a domain to the set
+func (t *DomainTrie) Add(name string) {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.terminal {
+			return // a parent domain is already in the set
+		}
+		child := node.children[labels[i]]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*DomainTrie)
+			}
+			child = new(DomainTrie)
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.terminal, node.children = true, nil
+}
+
+// Match Tells whether name is a domain of the set or a subdomain of one
+func (t *DomainTrie) Match(name string) bool {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	node := t
+	for i := len(labels) - 1; i >= 0 && !node.terminal; i-- {
+		if node = node.children[labels[i]]; node == nil {
+			return false
+		}
+	}
+	return node.terminal && len(labels) > 0
+}
+
+// Filter Blocked and allowed domains. A new Filter replaces the old one as a
+// whole on reload, so that queries are never answered from half-loaded lists.
+type Filter struct {
+	blocked *DomainTrie
+	allowed *DomainTrie
+	null    bool // answer 0.0.0.0 and :: instead of NXDOMAIN
+}
+
+// Blocked Tells whether name is blocked and not allowed
+func (f *Filter) Blocked(name string) bool {
+	return f.blocked.Match(name) && !f.allowed.Match(name)
+}
+
+// filter The Filter in force, if any
+var filter atomic.Value
+
+func splitList(str string) []string {
+	var res []string
+	for _, s := range strings.Split(str, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func loadFilter(blockFiles, allowFiles []string, mode string) (*Filter, error) {
+	f := &Filter{blocked: new(DomainTrie), allowed: new(DomainTrie)}
+	switch mode {
+	case "nxdomain":
+	case "null":
+		f.null = true
+	default:
+		return nil, fmt.Errorf("Unsupported block mode [%v]", mode)
+	}
+	for _, file := range blockFiles {
+		if err := loadDomainList(file, f.blocked); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range allowFiles {
+		if err := loadDomainList(file, f.allowed); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// loadDomainList Adds the domains listed in file to trie. Each line holds a
+// domain, or an address followed by domains as in a hosts file. Comments start
+// with #.
+func loadDomainList(file string, trie *DomainTrie) error {
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		names := fields[:1]
+		if net.ParseIP(fields[0]) != nil {
+			names = fields[1:]
+		}
+		for _, name := range names {
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+			if hostsFileNames[name] {
+				continue
+			}
+			if _, ok := dns.IsDomainName(name); !ok || name == "" {
+				return fmt.Errorf("%v:%d: invalid domain name [%v]", file, lineNo, name)
+			}
+			trie.Add(name)
+		}
+	}
+	return scanner.Err()
+}
+
+// fileStamps Identifies the versions of files by their size and modification time
+func fileStamps(files []string) string {
+	var stamps []string
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			stamps = append(stamps, file+" missing")
+			continue
+		}
+		stamps = append(stamps, fmt.Sprintf("%v %d %v", file, fi.Size(), fi.ModTime().UnixNano()))
+	}
+	return strings.Join(stamps, ",")
+}
+
+func reloadFilter(blockFiles, allowFiles []string, mode string) error {
+	f, err := loadFilter(blockFiles, allowFiles, mode)
+	if err != nil {
+		return err
+	}
+	filter.Store(f)
+	return nil
+}
+
+// filterThread Reloads the block and allow lists on SIGHUP, and when any of
+// the files changes. The lists in force are kept if the new ones do not load.
+func filterThread(blockFiles, allowFiles []string, mode string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	files := append(append([]string{}, blockFiles...), allowFiles...)
+	stamps := fileStamps(files)
+	ticker := time.NewTicker(FilterPollPeriod * time.Second)
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading the block and allow lists")
+		case <-ticker.C:
+			if stamps == fileStamps(files) {
+				continue
+			}
+			log.Println("Block or allow lists changed, reloading them")
+		}
+		stamps = fileStamps(files)
+		if err := reloadFilter(blockFiles, allowFiles, mode); err != nil {
+			log.Printf("Keeping the block and allow lists in force: %v\n", err)
+		}
+	}
+}
+
+func handleBlocked(w dns.ResponseWriter, req *dns.Msg) bool {
+	f, _ := filter.Load().(*Filter)
+	if f == nil {
+		return false
+	}
+	question := req.Question[0]
+	if !f.Blocked(question.Name) {
+		return false
+	}
+	atomic.AddUint64(&metrics.blocked, 1)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	if !f.null {
+		m.Rcode = dns.RcodeNameError
+		w.WriteMsg(m)
+		return true
+	}
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: BlockedTTL}
+	switch question.Qtype {
+	case dns.TypeA:
+		m.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4zero}}
+	case dns.TypeAAAA:
+		m.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero}}
+	}
+	w.WriteMsg(m)
+	return true
+}
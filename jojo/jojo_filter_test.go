@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func writeList(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func useFilter(t *testing.T, blockFiles, allowFiles []string, mode string) {
+	t.Helper()
+	if err := reloadFilter(blockFiles, allowFiles, mode); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { filter.Store((*Filter)(nil)) })
+}
+
+func query(name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	dw := &dohResponseWriter{}
+	route(dw, req)
+	return dw.msg
+}
+
+func TestDomainTrie(t *testing.T) {
+	trie := new(DomainTrie)
+	trie.Add("ads.example.com")
+	trie.Add("Tracker.NET.")
+	trie.Add("deep.tracker.net") // covered by tracker.net
+	for name, want := range map[string]bool{
+		"ads.example.com.":      true,
+		"x.y.ads.example.com.":  true,
+		"ADS.example.com":       true,
+		"example.com.":          false,
+		"badads.example.com.":   false,
+		"tracker.net.":          true,
+		"deep.tracker.net.":     true,
+		"net.":                  false,
+		".":                     false,
+		"ads.example.com.evil.": false,
+		"other.tracker.net.":    true,
+	} {
+		if got := trie.Match(name); got != want {
+			t.Errorf("Match(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestLoadDomainList(t *testing.T) {
+	dir := t.TempDir()
+	hosts := writeList(t, dir, "hosts", "# hosts format\n127.0.0.1 localhost\n0.0.0.0 ads.example.com tracker.example.com # inline\n::1 ip6-localhost\n\n")
+	plain := writeList(t, dir, "plain", "metrics.example.net\n  pixel.example.org.  \n")
+	f, err := loadFilter([]string{hosts, plain}, nil, "nxdomain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"ads.example.com.":     true,
+		"tracker.example.com.": true,
+		"metrics.example.net.": true,
+		"pixel.example.org.":   true,
+		"localhost.":           false,
+		"ip6-localhost.":       false,
+		"example.com.":         false,
+	} {
+		if got := f.Blocked(name); got != want {
+			t.Errorf("Blocked(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	bad := writeList(t, dir, "bad", "ok.example.com\nnot..valid\n")
+	if _, err := loadFilter([]string{bad}, nil, "nxdomain"); err == nil {
+		t.Error("loaded a list with an invalid name")
+	}
+	if _, err := loadFilter([]string{plain}, nil, "refuse"); err == nil {
+		t.Error("loaded an unsupported block mode")
+	}
+	if _, err := loadFilter([]string{filepath.Join(dir, "missing")}, nil, "nxdomain"); err == nil {
+		t.Error("loaded a missing list")
+	}
+}
+
+func TestBlockedNXDOMAIN(t *testing.T) {
+	setupTestResolver(t)
+	dir := t.TempDir()
+	useFilter(t, []string{writeList(t, dir, "block", "example.com\n")},
+		[]string{writeList(t, dir, "allow", "allowed.example.com\n")}, "nxdomain")
+
+	before := snapshotStats().Blocked
+	resp := query("ads.example.com.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Fatalf("got %v", resp)
+	}
+	if got := snapshotStats().Blocked - before; got != 1 {
+		t.Errorf("counted %d blocked queries, want 1", got)
+	}
+	checkAnswer(t, query("www.allowed.example.com.", dns.TypeA), "www.allowed.example.com.")
+	checkAnswer(t, query("example.org.", dns.TypeA), "example.org.")
+}
+
+func TestBlockedNull(t *testing.T) {
+	setupTestResolver(t)
+	useFilter(t, []string{writeList(t, t.TempDir(), "block", "0.0.0.0 null.example.com\n")}, nil, "null")
+
+	resp := query("null.example.com.", dns.TypeA)
+	if a, ok := resp.Answer[0].(*dns.A); resp.Rcode != dns.RcodeSuccess || !ok || !a.A.Equal(net.IPv4zero) || a.Hdr.Ttl != BlockedTTL {
+		t.Errorf("got %v", resp)
+	}
+	resp = query("null.example.com.", dns.TypeAAAA)
+	if aaaa, ok := resp.Answer[0].(*dns.AAAA); resp.Rcode != dns.RcodeSuccess || !ok || !aaaa.AAAA.Equal(net.IPv6zero) {
+		t.Errorf("got %v", resp)
+	}
+	resp = query("null.example.com.", dns.TypeMX)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("got %v", resp)
+	}
+}
+
+func TestReloadFilter(t *testing.T) {
+	setupTestResolver(t)
+	dir := t.TempDir()
+	block := writeList(t, dir, "block", "old.example.com\n")
+	useFilter(t, []string{block}, nil, "nxdomain")
+	if resp := query("old.example.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("got %v", resp)
+	}
+
+	writeList(t, dir, "block", "new.example.com\n")
+	if err := reloadFilter([]string{block}, nil, "nxdomain"); err != nil {
+		t.Fatal(err)
+	}
+	checkAnswer(t, query("old.example.com.", dns.TypeA), "old.example.com.")
+	if resp := query("new.example.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("got %v", resp)
+	}
+
+	writeList(t, dir, "block", "not..valid\n")
+	if err := reloadFilter([]string{block}, nil, "nxdomain"); err == nil {
+		t.Fatal("reloaded a list with an invalid name")
+	}
+	if resp := query("new.example.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("lists in force were replaced by a failed reload: %v", resp)
+	}
+}
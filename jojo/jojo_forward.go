@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// forwardRules Upstream pools of the domain suffixes forwarded to their own
+// servers, keyed by lower case suffix
+var forwardRules map[string]*UpstreamServers
+
+// parseForwardRules Parses rules such as
+// corp.example=10.0.0.53:53,10.0.1.53:53;lab.example=tls://10.1.0.53
+func parseForwardRules(str string) (map[string]*UpstreamServers, error) {
+	res := make(map[string]*UpstreamServers)
+	for _, rule := range strings.Split(str, ";") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Forwarding rule [%v] is not suffix=servers", rule)
+		}
+		suffix := dns.Fqdn(strings.ToLower(strings.TrimSpace(parts[0])))
+		if _, ok := dns.IsDomainName(suffix); !ok || suffix == "." {
+			return nil, fmt.Errorf("Invalid domain suffix in forwarding rule [%v]", rule)
+		}
+		if res[suffix] != nil {
+			return nil, fmt.Errorf("More than one forwarding rule for [%v]", suffix)
+		}
+		pool, err := parseUpstreamServers(suffix, strings.Join(splitList(parts[1]), ","))
+		if err != nil {
+			return nil, err
+		}
+		res[suffix] = pool
+	}
+	return res, nil
+}
+
+// upstreamsFor Returns the pool of the longest forwarded suffix of name, or
+// the default upstream servers
+func upstreamsFor(name string) *UpstreamServers {
+	name = strings.ToLower(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if pool := forwardRules[name[off:]]; pool != nil {
+			return pool
+		}
+	}
+	return upstreamServers
+}
+
+// upstreamPools Returns the default upstream servers, followed by the pools of
+// the forwarding rules sorted by suffix
+func upstreamPools() []*UpstreamServers {
+	pools := []*UpstreamServers{upstreamServers}
+	for _, pool := range forwardRules {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools[1:], func(i, j int) bool { return pools[i+1].suffix < pools[j+1].suffix })
+	return pools
+}
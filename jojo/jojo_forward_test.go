@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startCountingServer Starts a UDP server answering every A query with ip
+func startCountingServer(t *testing.T, ip string, count *uint32) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddUint32(count, 1)
+			m := new(dns.Msg)
+			m.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A " + ip)
+			m.Answer = []dns.RR{rr}
+			w.WriteMsg(m)
+		})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	<-started
+	return pc.LocalAddr().String()
+}
+
+func TestParseForwardRules(t *testing.T) {
+	rules, err := parseForwardRules(" Corp.Example=10.0.0.53:53, 10.0.1.53:53 ; lab.example.=tls://10.1.0.53;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || len(rules["corp.example."].servers) != 2 || rules["lab.example."].suffix != "lab.example." {
+		t.Fatalf("got %v", rules)
+	}
+	if _, ok := rules["lab.example."].transports["tls://10.1.0.53"].(*tlsUpstream); !ok {
+		t.Error("lab.example. is not forwarded over TLS")
+	}
+	for _, str := range []string{
+		"corp.example",
+		"corp.example=",
+		"=10.0.0.53:53",
+		".=10.0.0.53:53",
+		"corp..example=10.0.0.53:53",
+		"corp.example=10.0.0.53:53;corp.example.=10.0.1.53:53",
+		"corp.example=ftp://10.0.0.53",
+	} {
+		if _, err := parseForwardRules(str); err == nil {
+			t.Errorf("parsed %q", str)
+		}
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	setupTestResolver(t)
+	cache.Purge()
+	var corpQueries [2]uint32
+	corp := []string{
+		startCountingServer(t, "198.51.100.1", &corpQueries[0]),
+		startCountingServer(t, "198.51.100.1", &corpQueries[1]),
+	}
+	rules, err := parseForwardRules("corp.example=" + corp[0] + "," + corp[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwardRules = rules
+	t.Cleanup(func() { forwardRules = nil })
+	pool := rules["corp.example."]
+
+	for i := 0; i < 32; i++ {
+		name := fmt.Sprintf("host%d.Corp.Example.", i)
+		resp := query(name, dns.TypeA)
+		if a, ok := resp.Answer[0].(*dns.A); !ok || !a.A.Equal(net.IP{198, 51, 100, 1}) {
+			t.Fatalf("%v: got %v", name, resp)
+		}
+	}
+	if atomic.LoadUint32(&corpQueries[0]) == 0 || atomic.LoadUint32(&corpQueries[1]) == 0 {
+		t.Errorf("queries not spread across the pool: %v", corpQueries)
+	}
+	before := atomic.LoadUint32(&upstreamQueries)
+	checkAnswer(t, query("www.example.com.", dns.TypeA), "www.example.com.")
+	checkAnswer(t, query("notcorp.example.", dns.TypeA), "notcorp.example.")
+	if got := atomic.LoadUint32(&upstreamQueries) - before; got != 2 {
+		t.Errorf("default upstream server answered %d queries, want 2", got)
+	}
+
+	// failures only take servers of their own pool offline
+	for i := uint(0); i < *maxFailures; i++ {
+		pool.markFailed(corp[0])
+	}
+	pool.lock.RLock()
+	live := append([]string{}, pool.live...)
+	pool.lock.RUnlock()
+	if len(live) != 1 || live[0] != corp[1] {
+		t.Errorf("live corp servers %v, want [%v]", live, corp[1])
+	}
+	if got := len(upstreamServers.live); got != 1 {
+		t.Errorf("%d live default servers, want 1", got)
+	}
+	before = atomic.LoadUint32(&corpQueries[1])
+	for i := 0; i < 4; i++ {
+		query(fmt.Sprintf("failover%d.corp.example.", i), dns.TypeA)
+	}
+	if got := atomic.LoadUint32(&corpQueries[1]) - before; got != 4 {
+		t.Errorf("live corp server answered %d queries, want 4", got)
+	}
+
+	upstreams := snapshotStats().Upstreams
+	if len(upstreams) != 3 || upstreams[0].Pool != "." || upstreams[1].Pool != "corp.example." || upstreams[1].Live {
+		t.Errorf("upstreams %+v", upstreams)
+	}
+	pool.probe(false)
+	if pool.lock.RLock(); len(pool.live) != 2 {
+		t.Errorf("probing did not bring back the corp servers: %v", pool.live)
+	}
+	pool.lock.RUnlock()
+}
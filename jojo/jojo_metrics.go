@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Metrics Counters served on the metrics listener
+type Metrics struct {
+	cacheHits   uint64
+	cacheMisses uint64
+	slipped     uint64
+	evicted     uint64
+	tooOld      uint64
+	blocked     uint64
+	lock        sync.Mutex
+	queries     map[QueryLabels]uint64
+}
+
+// QueryLabels Query type and response code a query is counted under
+type QueryLabels struct {
+	Qtype string `json:"qtype"`
+	Rcode string `json:"rcode"`
+}
+
+// UpstreamStats Counters of the queries sent to an upstream server
+type UpstreamStats struct {
+	queries  uint64
+	failures uint64
+	rttNanos uint64
+}
+
+// Stats Snapshot of the metrics, served as JSON on /stats
+type Stats struct {
+	Queries     []QueryCount   `json:"queries"`
+	CacheHits   uint64         `json:"cache_hits"`
+	CacheMisses uint64         `json:"cache_misses"`
+	CacheSize   int            `json:"cache_size"`
+	Slip        uint32         `json:"slip"`
+	Slipped     uint64         `json:"slipped"`
+	Evicted     uint64         `json:"evicted"`
+	TooOld      uint64         `json:"too_old"`
+	Blocked     uint64         `json:"blocked"`
+	Upstreams   []UpstreamStat `json:"upstreams"`
+}
+
+// QueryCount Number of queries answered with a query type and response code
+type QueryCount struct {
+	QueryLabels
+	Count uint64 `json:"count"`
+}
+
+// UpstreamStat State and counters of an upstream server
+type UpstreamStat struct {
+	Pool     string  `json:"pool"` // domain suffix forwarded to the server, . for the default servers
+	Addr     string  `json:"addr"`
+	Live     bool    `json:"live"`
+	Failures uint    `json:"failures"` // unanswered queries counted towards -maxfailures
+	Queries  uint64  `json:"queries"`
+	Errors   uint64  `json:"errors"`
+	RTT      float64 `json:"rtt_seconds"` // total of the answered queries
+}
+
+var metrics = Metrics{queries: make(map[QueryLabels]uint64)}
+
+// metricsResponseWriter Counts the response route writes to a query
+type metricsResponseWriter struct {
+	dns.ResponseWriter
+	rcode   int
+	written bool
+}
+
+func (mw *metricsResponseWriter) WriteMsg(msg *dns.Msg) error {
+	mw.rcode, mw.written = msg.Rcode, true
+	return mw.ResponseWriter.WriteMsg(msg)
+}
+
+func (mw *metricsResponseWriter) Write(packed []byte) (int, error) {
+	if len(packed) >= 4 {
+		mw.rcode, mw.written = int(packed[3]&0xf), true
+	}
+	return mw.ResponseWriter.Write(packed)
+}
+
+func (mw *metricsResponseWriter) record(req *dns.Msg) {
+	labels := QueryLabels{Qtype: "none", Rcode: "dropped"}
+	if len(req.Question) > 0 {
+		// the client picks the qtype; unassigned ones share a label
+		labels.Qtype = "other"
+		if name, ok := dns.TypeToString[req.Question[0].Qtype]; ok {
+			labels.Qtype = name
+		}
+	}
+	if mw.written {
+		labels.Rcode = dns.RcodeToString[mw.rcode]
+	}
+	metrics.lock.Lock()
+	metrics.queries[labels]++
+	metrics.lock.Unlock()
+}
+
+func (us *UpstreamServers) recordUpstream(addr string, rtt float64, err error) {
+	stats := us.stats[addr]
+	atomic.AddUint64(&stats.queries, 1)
+	if err != nil {
+		atomic.AddUint64(&stats.failures, 1)
+		return
+	}
+	atomic.AddUint64(&stats.rttNanos, uint64(rtt*1e9))
+}
+
+func snapshotStats() Stats {
+	stats := Stats{
+		CacheHits:   atomic.LoadUint64(&metrics.cacheHits),
+		CacheMisses: atomic.LoadUint64(&metrics.cacheMisses),
+		CacheSize:   cache.Len(),
+		Slip:        atomic.LoadUint32(&slip),
+		Slipped:     atomic.LoadUint64(&metrics.slipped),
+		Evicted:     atomic.LoadUint64(&metrics.evicted),
+		TooOld:      atomic.LoadUint64(&metrics.tooOld),
+		Blocked:     atomic.LoadUint64(&metrics.blocked),
+	}
+	metrics.lock.Lock()
+	for labels, count := range metrics.queries {
+		stats.Queries = append(stats.Queries, QueryCount{QueryLabels: labels, Count: count})
+	}
+	metrics.lock.Unlock()
+	sort.Slice(stats.Queries, func(i, j int) bool {
+		a, b := stats.Queries[i], stats.Queries[j]
+		return a.Qtype < b.Qtype || a.Qtype == b.Qtype && a.Rcode < b.Rcode
+	})
+	for _, pool := range upstreamPools() {
+		pool.lock.RLock()
+		for _, server := range pool.servers {
+			counters := pool.stats[server.addr]
+			stats.Upstreams = append(stats.Upstreams, UpstreamStat{
+				Pool:     pool.suffix,
+				Addr:     server.addr,
+				Live:     !server.offline,
+				Failures: server.failures,
+				Queries:  atomic.LoadUint64(&counters.queries),
+				Errors:   atomic.LoadUint64(&counters.failures),
+				RTT:      float64(atomic.LoadUint64(&counters.rttNanos)) / 1e9,
+			})
+		}
+		pool.lock.RUnlock()
+	}
+	return stats
+}
+
+// writeMetrics Writes stats in the Prometheus text exposition format
+func writeMetrics(w io.Writer, stats Stats) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	metric("jojo_queries_total", "counter", "Queries answered, by query type and response code.")
+	for _, q := range stats.Queries {
+		fmt.Fprintf(w, "jojo_queries_total{qtype=%q,rcode=%q} %d\n", q.Qtype, q.Rcode, q.Count)
+	}
+	metric("jojo_cache_hits_total", "counter", "Queries answered from the cache.")
+	fmt.Fprintf(w, "jojo_cache_hits_total %d\n", stats.CacheHits)
+	metric("jojo_cache_misses_total", "counter", "Queries not found in the cache.")
+	fmt.Fprintf(w, "jojo_cache_misses_total %d\n", stats.CacheMisses)
+	metric("jojo_cache_entries", "gauge", "Responses held in the ARC cache.")
+	fmt.Fprintf(w, "jojo_cache_entries %d\n", stats.CacheSize)
+	metric("jojo_slip", "gauge", "Requests dropped by the resolver threads since the last vacuum.")
+	fmt.Fprintf(w, "jojo_slip %d\n", stats.Slip)
+	metric("jojo_slipped_queries_total", "counter", "Queries truncated or dropped to shed load.")
+	fmt.Fprintf(w, "jojo_slipped_queries_total %d\n", stats.Slipped)
+	metric("jojo_resolver_evicted_total", "counter", "Requests evicted from a full resolver queue.")
+	fmt.Fprintf(w, "jojo_resolver_evicted_total %d\n", stats.Evicted)
+	metric("jojo_resolver_too_old_total", "counter", "Requests that waited longer than -maxrtt in the resolver queue.")
+	fmt.Fprintf(w, "jojo_resolver_too_old_total %d\n", stats.TooOld)
+	metric("jojo_blocked_queries_total", "counter", "Queries for blocked names.")
+	fmt.Fprintf(w, "jojo_blocked_queries_total %d\n", stats.Blocked)
+	metric("jojo_upstream_up", "gauge", "Whether an upstream server is live.")
+	for _, u := range stats.Upstreams {
+		up := 0
+		if u.Live {
+			up = 1
+		}
+		fmt.Fprintf(w, "jojo_upstream_up{server=%q,pool=%q} %d\n", u.Addr, u.Pool, up)
+	}
+	metric("jojo_upstream_failures", "gauge", "Unanswered queries counted towards -maxfailures.")
+	for _, u := range stats.Upstreams {
+		fmt.Fprintf(w, "jojo_upstream_failures{server=%q,pool=%q} %d\n", u.Addr, u.Pool, u.Failures)
+	}
+	metric("jojo_upstream_queries_total", "counter", "Queries sent to an upstream server.")
+	for _, u := range stats.Upstreams {
+		fmt.Fprintf(w, "jojo_upstream_queries_total{server=%q,pool=%q} %d\n", u.Addr, u.Pool, u.Queries)
+	}
+	metric("jojo_upstream_errors_total", "counter", "Queries to an upstream server that failed.")
+	for _, u := range stats.Upstreams {
+		fmt.Fprintf(w, "jojo_upstream_errors_total{server=%q,pool=%q} %d\n", u.Addr, u.Pool, u.Errors)
+	}
+	metric("jojo_upstream_rtt_seconds_total", "counter", "Total round trip time of the queries an upstream server answered.")
+	for _, u := range stats.Upstreams {
+		fmt.Fprintf(w, "jojo_upstream_rtt_seconds_total{server=%q,pool=%q} %g\n", u.Addr, u.Pool, u.RTT)
+	}
+}
+
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, snapshotStats())
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snapshotStats())
+	})
+	return mux
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func getStats(t *testing.T, srv *httptest.Server) Stats {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats Stats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func queryCount(stats Stats, qtype, rcode string) uint64 {
+	for _, q := range stats.Queries {
+		if q.Qtype == qtype && q.Rcode == rcode {
+			return q.Count
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	setupTestResolver(t)
+	srv := httptest.NewServer(metricsHandler())
+	defer srv.Close()
+	before := getStats(t, srv)
+
+	req := new(dns.Msg)
+	req.SetQuestion("metrics.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		route(&dohResponseWriter{}, req)
+	}
+	req.SetQuestion("com.", dns.TypeA) // refused, too few labels
+	route(&dohResponseWriter{}, req)
+	for _, qtype := range []uint16{4321, 65280} { // unassigned and private use
+		req.SetQuestion("com.", qtype)
+		route(&dohResponseWriter{}, req)
+	}
+
+	after := getStats(t, srv)
+	if got := queryCount(after, "A", "NOERROR") - queryCount(before, "A", "NOERROR"); got != 2 {
+		t.Errorf("counted %d A NOERROR queries, want 2", got)
+	}
+	if got := queryCount(after, "A", "REFUSED") - queryCount(before, "A", "REFUSED"); got != 1 {
+		t.Errorf("counted %d A REFUSED queries, want 1", got)
+	}
+	if got := queryCount(after, "other", "REFUSED") - queryCount(before, "other", "REFUSED"); got != 2 {
+		t.Errorf("counted %d queries of unknown types, want 2", got)
+	}
+	for _, q := range after.Queries {
+		if strings.HasPrefix(q.Qtype, "TYPE") {
+			t.Errorf("counted queries under qtype %q", q.Qtype)
+		}
+	}
+	if hits, misses := after.CacheHits-before.CacheHits, after.CacheMisses-before.CacheMisses; hits != 1 || misses != 1 {
+		t.Errorf("counted %d cache hits and %d misses, want 1 and 1", hits, misses)
+	}
+	if after.CacheSize < 1 {
+		t.Errorf("cache size %d", after.CacheSize)
+	}
+	if len(after.Upstreams) != 1 || after.Upstreams[0].Queries-before.Upstreams[0].Queries != 1 || !after.Upstreams[0].Live {
+		t.Errorf("upstreams %+v", after.Upstreams)
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, want := range []string{
+		"# TYPE jojo_queries_total counter\n",
+		`jojo_queries_total{qtype="A",rcode="REFUSED"} `,
+		"jojo_cache_hits_total ",
+		"jojo_cache_entries ",
+		"jojo_slip 0\n",
+		"jojo_resolver_evicted_total ",
+		"jojo_resolver_too_old_total ",
+		`jojo_upstream_up{server="127.0.0.1:`,
+		`jojo_upstream_rtt_seconds_total{server="127.0.0.1:`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS over TLS (RFC 7858) and DNS over HTTPS (RFC 8484) listeners. Both hand
+// queries to route, so they share the cache and the upstream servers with the
+// plain listeners.
+
+const (
+	// DoHMediaType Media type of DNS messages carried over HTTPS
+	DoHMediaType = "application/dns-message"
+	// DoHTimeout Timeout to read a DNS over HTTPS request and write its response
+	DoHTimeout = 10 * time.Second
+)
+
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key are required by the encrypted listeners")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+func newDoTServer(addr string, tlsConfig *tls.Config) (*dns.Server, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Server{Addr: addr, Net: "tcp-tls", TLSConfig: tlsConfig,
+		Listener: tls.NewListener(tcpListener, tlsConfig)}, nil
+}
+
+func newDoHServer(addr string, path string, tlsConfig *tls.Config) (*http.Server, net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, dohHandler{})
+	server := &http.Server{Addr: addr, Handler: mux, TLSConfig: tlsConfig.Clone(),
+		ReadTimeout: DoHTimeout, WriteTimeout: DoHTimeout}
+	return server, listener, nil
+}
+
+// dohHandler answers queries sent base64url encoded in the dns parameter of a
+// GET, or as the body of a POST.
+type dohHandler struct{}
+
+func (dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var packed []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != DoHMediaType {
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if len(packed) > dns.MaxMsgSize {
+			http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err == nil && len(packed) > 0 {
+		err = req.Unpack(packed)
+	}
+	if err != nil || len(packed) == 0 {
+		http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+		return
+	}
+	dw := &dohResponseWriter{remote: tcpAddrOf(r.RemoteAddr)}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dw.local = local
+	}
+	route(dw, req)
+	if dw.packed == nil {
+		http.Error(w, "No response", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", DoHMediaType)
+	if dw.msg != nil && len(dw.msg.Answer) > 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(minAnswerTTL(dw.msg))))
+	}
+	w.Write(dw.packed)
+}
+
+func tcpAddrOf(hostPort string) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", hostPort)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+func minAnswerTTL(msg *dns.Msg) uint32 {
+	ttl := uint32(MaxTTL)
+	for _, rr := range msg.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// dohResponseWriter Collects the response of route to a DNS over HTTPS query.
+// It looks like a TCP connection to route, as HTTPS runs over one.
+type dohResponseWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+	packed []byte
+}
+
+func (dw *dohResponseWriter) LocalAddr() net.Addr  { return dw.local }
+func (dw *dohResponseWriter) RemoteAddr() net.Addr { return dw.remote }
+
+func (dw *dohResponseWriter) WriteMsg(msg *dns.Msg) error {
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	dw.msg, dw.packed = msg, packed
+	return nil
+}
+
+func (dw *dohResponseWriter) Write(packed []byte) (int, error) {
+	if len(packed) > dns.MaxMsgSize {
+		return 0, fmt.Errorf("message too large: %d bytes", len(packed))
+	}
+	dw.packed = append([]byte(nil), packed...)
+	return len(packed), nil
+}
+
+func (dw *dohResponseWriter) Close() error        { return nil }
+func (dw *dohResponseWriter) TsigStatus() error   { return nil }
+func (dw *dohResponseWriter) TsigTimersOnly(bool) {}
+func (dw *dohResponseWriter) Hijack()             {}
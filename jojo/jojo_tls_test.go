@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+)
+
+var setupOnce sync.Once
+
+// upstreamQueries Number of queries the test upstream server has answered
+var upstreamQueries uint32
+
+// setupTestResolver Points route at an upstream server on the loopback that
+// answers every TXT query with a record of bigTXTSize bytes, and every other
+// query with an A record of 192.0.2.1.
+func setupTestResolver(t *testing.T) {
+	t.Helper()
+	setupOnce.Do(func() {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		started := make(chan struct{})
+		upstream := &dns.Server{PacketConn: pc, NotifyStartedFunc: func() { close(started) },
+			Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+				atomic.AddUint32(&upstreamQueries, 1)
+				m := new(dns.Msg)
+				m.SetReply(req)
+				rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+				if req.Question[0].Qtype == dns.TypeTXT {
+					rr = bigTXT(req.Question[0].Name)
+				}
+				m.Answer = []dns.RR{rr}
+				w.WriteMsg(m)
+			})}
+		go upstream.ActivateAndServe()
+		<-started
+
+		cache, _ = lru.NewARC(64)
+		upstreamServers, _ = parseUpstreamServers(".", pc.LocalAddr().String())
+		resolverRing = make(chan QueuedRequest, 4)
+		udpClient = dns.Client{Net: "udp", DialTimeout: globalTimeout, ReadTimeout: globalTimeout, WriteTimeout: globalTimeout}
+		tcpClient = dns.Client{Net: "tcp", DialTimeout: globalTimeout, ReadTimeout: globalTimeout, WriteTimeout: globalTimeout}
+		for i := 0; i < 4; i++ {
+			go resolverThread()
+		}
+		dns.HandleFunc(".", route)
+	})
+}
+
+// bigTXTSize Size of the TXT data the test upstream server answers with, more
+// than fits in a response without EDNS
+const bigTXTSize = 1100
+
+func bigTXT(name string) *dns.TXT {
+	txt := &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300}}
+	for i := 0; i < bigTXTSize/220; i++ {
+		txt.Txt = append(txt.Txt, strings.Repeat("x", 220))
+	}
+	return txt
+}
+
+// checkBigAnswer Checks resp holds the whole TXT record of bigTXT
+func checkBigAnswer(t *testing.T, resp *dns.Msg) {
+	t.Helper()
+	if resp.Rcode != dns.RcodeSuccess || resp.Truncated || len(resp.Answer) != 1 {
+		t.Fatalf("got rcode %v, truncated %v, %d answers", dns.RcodeToString[resp.Rcode], resp.Truncated, len(resp.Answer))
+	}
+	if txt, ok := resp.Answer[0].(*dns.TXT); !ok || len(strings.Join(txt.Txt, "")) != bigTXTSize {
+		t.Fatalf("answer %.80v", resp.Answer[0])
+	}
+}
+
+func checkAnswer(t *testing.T, resp *dns.Msg, name string) {
+	t.Helper()
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("got %v", resp)
+	}
+	a, ok := resp.Answer[0].(*dns.A)
+	if !ok || a.Hdr.Name != name || !a.A.Equal(net.IP{192, 0, 2, 1}) {
+		t.Fatalf("answer %v", resp.Answer[0])
+	}
+}
+
+func dohQuery(t *testing.T, client *http.Client, url, method string, req *dns.Msg) *dns.Msg {
+	t.Helper()
+	packed, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp *http.Response
+	if method == http.MethodGet {
+		resp, err = client.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(packed))
+	} else {
+		resp, err = client.Post(url, DoHMediaType, bytes.NewReader(packed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != DoHMediaType {
+		t.Fatalf("%s got %s, %q", method, resp.Status, resp.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		t.Fatal(err)
+	}
+	if m.Id != req.Id {
+		t.Fatalf("response id %d, want %d", m.Id, req.Id)
+	}
+	return m
+}
+
+func TestDoH(t *testing.T) {
+	setupTestResolver(t)
+	srv := httptest.NewTLSServer(dohHandler{})
+	defer srv.Close()
+	before := atomic.LoadUint32(&upstreamQueries)
+
+	req := new(dns.Msg)
+	req.SetQuestion("doh.example.com.", dns.TypeA)
+	checkAnswer(t, dohQuery(t, srv.Client(), srv.URL, http.MethodGet, req), "doh.example.com.")
+	req.Id++
+	checkAnswer(t, dohQuery(t, srv.Client(), srv.URL, http.MethodPost, req), "doh.example.com.")
+	if got := atomic.LoadUint32(&upstreamQueries) - before; got != 1 {
+		t.Fatalf("upstream asked %d times, want once with the second answer cached", got)
+	}
+
+	// answers too big for a response without EDNS are not truncated
+	req.SetQuestion("big.doh.example.com.", dns.TypeTXT)
+	checkBigAnswer(t, dohQuery(t, srv.Client(), srv.URL, http.MethodPost, req))
+}
+
+func TestDoHBadRequests(t *testing.T) {
+	setupTestResolver(t)
+	srv := httptest.NewTLSServer(dohHandler{})
+	defer srv.Close()
+	client := srv.Client()
+
+	for _, c := range []struct {
+		method, query, contentType string
+		body                       []byte
+		status                     int
+	}{
+		{http.MethodGet, "", "", nil, http.StatusBadRequest},
+		{http.MethodGet, "?dns=not*base64", "", nil, http.StatusBadRequest},
+		{http.MethodPost, "", "text/plain", []byte("hello"), http.StatusUnsupportedMediaType},
+		{http.MethodPost, "", DoHMediaType, []byte{1, 2, 3}, http.StatusBadRequest},
+		{http.MethodPut, "", DoHMediaType, nil, http.StatusMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(c.method, srv.URL+c.query, bytes.NewReader(c.body))
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %q %q got %s, want %d", c.method, c.query, c.contentType, resp.Status, c.status)
+		}
+	}
+}
+
+func TestDoT(t *testing.T) {
+	setupTestResolver(t)
+	// borrow the certificate of a test HTTPS server
+	https := httptest.NewTLSServer(http.NotFoundHandler())
+	defer https.Close()
+	server, err := newDoTServer("127.0.0.1:0", https.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	client := dns.Client{Net: "tcp-tls", Timeout: 5 * time.Second, TLSConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}}
+	before := atomic.LoadUint32(&upstreamQueries)
+	req := new(dns.Msg)
+	req.SetQuestion("dot.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		resp, _, err := client.Exchange(req, server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAnswer(t, resp, "dot.example.com.")
+	}
+	if got := atomic.LoadUint32(&upstreamQueries) - before; got != 1 {
+		t.Fatalf("upstream asked %d times, want once with the second answer cached", got)
+	}
+
+	// answers too big for a response without EDNS are not truncated
+	req.SetQuestion("big.dot.example.com.", dns.TypeTXT)
+	resp, _, err := client.Exchange(req, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBigAnswer(t, resp)
+}
+
+func TestLoadTLSConfigNeedsCertificate(t *testing.T) {
+	if _, err := loadTLSConfig("", ""); err == nil {
+		t.Fatal("loaded a TLS configuration without a certificate")
+	}
+	if _, err := loadTLSConfig("/nonexistent/cert.pem", "/nonexistent/key.pem"); err == nil {
+		t.Fatal("loaded a TLS configuration from missing files")
+	}
+}
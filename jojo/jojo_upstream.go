@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// DoTPort Default port of DNS over TLS upstream servers
+	DoTPort = "853"
+	// MaxIdleConnsPerUpstream Idle connections kept open to each encrypted upstream server
+	MaxIdleConnsPerUpstream = 16
+)
+
+// Upstream Transport to an upstream server. Exchange returns the response to
+// req and the round trip time.
+type Upstream interface {
+	Exchange(req *dns.Msg) (*dns.Msg, time.Duration, error)
+}
+
+// newUpstream Returns the transport for an -upstream entry: host:port for
+// plain DNS, tls://host[:port] for DNS over TLS or https://host/path for DNS
+// over HTTPS. tlsConfig, if not nil, is used to connect to encrypted servers.
+func newUpstream(addr string, tlsConfig *tls.Config) (Upstream, error) {
+	if !strings.Contains(addr, "://") {
+		return &plainUpstream{addr: addr}, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("No host in upstream server [%v]", addr)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	switch u.Scheme {
+	case "tls":
+		hostPort := u.Host
+		if u.Port() == "" {
+			hostPort = net.JoinHostPort(u.Hostname(), DoTPort)
+		}
+		return &tlsUpstream{addr: hostPort, tlsConfig: tlsConfig,
+			idle: make(chan *dns.Conn, MaxIdleConnsPerUpstream)}, nil
+	case "https":
+		transport := &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true,
+			MaxIdleConnsPerHost: MaxIdleConnsPerUpstream, IdleConnTimeout: 90 * time.Second}
+		return &httpsUpstream{url: u.String(), client: &http.Client{Transport: transport}}, nil
+	}
+	return nil, fmt.Errorf("Unsupported scheme in upstream server [%v]", addr)
+}
+
+// plainUpstream Plain DNS over UDP, retried over TCP when truncated
+type plainUpstream struct {
+	addr string
+}
+
+func (u *plainUpstream) Exchange(req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	resolved, rtt, err := udpClient.Exchange(req, u.addr)
+	if err != nil || (resolved != nil && resolved.Truncated) {
+		resolved, rtt, err = tcpClient.Exchange(req, u.addr)
+	}
+	return resolved, rtt, err
+}
+
+// tlsUpstream DNS over TLS, reusing idle connections
+type tlsUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+	idle      chan *dns.Conn
+}
+
+func (u *tlsUpstream) Exchange(req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	conn, reused, err := u.conn()
+	if err != nil {
+		return nil, 0, err
+	}
+	resolved, rtt, err := u.exchange(conn, req)
+	if err != nil && reused && closedByPeer(err) {
+		// the server closed the idle connection; a fresh one is tried once
+		if conn, err = u.dial(); err != nil {
+			return nil, 0, err
+		}
+		resolved, rtt, err = u.exchange(conn, req)
+	}
+	return resolved, rtt, err
+}
+
+// exchange Sends req over conn and keeps conn idle for reuse once answered
+func (u *tlsUpstream) exchange(conn *dns.Conn, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+	conn.SetDeadline(start.Add(globalTimeout))
+	resolved, err := exchangeConn(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return resolved, rtt, nil
+}
+
+func (u *tlsUpstream) conn() (*dns.Conn, bool, error) {
+	select {
+	case conn := <-u.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err := u.dial()
+	return conn, false, err
+}
+
+func (u *tlsUpstream) dial() (*dns.Conn, error) {
+	return dns.DialTimeoutWithTLS("tcp-tls", u.addr, u.tlsConfig, globalTimeout)
+}
+
+// closedByPeer Whether err shows the server closed the connection, rather
+// than that it did not answer in time
+func closedByPeer(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+func exchangeConn(conn *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	if err := conn.WriteMsg(req); err != nil {
+		return nil, err
+	}
+	resolved, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resolved.Id != req.Id {
+		return nil, dns.ErrId
+	}
+	return resolved, nil
+}
+
+// httpsUpstream DNS over HTTPS, over a client that keeps connections alive
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) Exchange(req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// a zero id makes responses cacheable by HTTP caches
+	query := req.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), globalTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	httpReq.Header.Set("Content-Type", DoHMediaType)
+	httpReq.Header.Set("Accept", DoHMediaType)
+	start := time.Now()
+	resp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("[%v] responded %v", u.url, resp.Status)
+	}
+	if resp.Header.Get("Content-Type") != DoHMediaType {
+		return nil, 0, errors.New("Unexpected content type in DNS over HTTPS response")
+	}
+	resolved := new(dns.Msg)
+	if err := resolved.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+	resolved.Id = req.Id
+	return resolved, rtt, nil
+}
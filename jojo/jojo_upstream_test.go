@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func answerA(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 192.0.2.1")
+	m.Answer = []dns.RR{rr}
+	w.WriteMsg(m)
+}
+
+// countingListener Counts the connections it accepts
+type countingListener struct {
+	net.Listener
+	accepted uint32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddUint32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+// testTLS Returns a server TLS configuration with the certificate of a test
+// HTTPS server, and a client one that trusts it.
+func testTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	https := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(https.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	return https.TLS, &tls.Config{RootCAs: roots}
+}
+
+func exchangeThrice(t *testing.T, upstream Upstream, name string) {
+	t.Helper()
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		resolved, _, err := upstream.Exchange(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resolved.Id != req.Id {
+			t.Fatalf("response id %d, want %d", resolved.Id, req.Id)
+		}
+		checkAnswer(t, resolved, name)
+	}
+}
+
+func TestTLSUpstreamReusesConnections(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &countingListener{Listener: tls.NewListener(tcpListener, serverTLS)}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(answerA), NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	upstream, err := newUpstream("tls://"+tcpListener.Addr().String(), clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangeThrice(t, upstream, "dot.example.com.")
+	if got := atomic.LoadUint32(&listener.accepted); got != 1 {
+		t.Fatalf("opened %d connections, want 1", got)
+	}
+}
+
+// hangingTLSListener Returns the address of a DNS over TLS server that
+// accepts connections and never answers
+func hangingTLSListener(t *testing.T, serverTLS *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestTLSUpstreamTimeoutIsNotRetried(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	addr := hangingTLSListener(t, serverTLS)
+	defer func(timeout time.Duration) { globalTimeout = timeout }(globalTimeout)
+	globalTimeout = 100 * time.Millisecond
+
+	upstream, err := newUpstream("tls://"+addr, clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := upstream.(*tlsUpstream)
+	for i := 0; i < MaxIdleConnsPerUpstream; i++ {
+		conn, err := u.dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.idle <- conn
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("hang.example.com.", dns.TypeA)
+	start := time.Now()
+	if _, _, err := upstream.Exchange(req); err == nil {
+		t.Fatal("no error from an upstream that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 3*globalTimeout {
+		t.Errorf("Exchange took %v, want one timeout of %v", elapsed, globalTimeout)
+	}
+	if got := len(u.idle); got != MaxIdleConnsPerUpstream-1 {
+		t.Errorf("%d idle connections left, want all but the one that timed out", got)
+	}
+}
+
+func TestHTTPSUpstreamReusesConnections(t *testing.T) {
+	var conns uint32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if r.Method != http.MethodPost || req.Unpack(body) != nil || req.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		dw := &dohResponseWriter{}
+		answerA(dw, req)
+		w.Header().Set("Content-Type", DoHMediaType)
+		w.Write(dw.packed)
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddUint32(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	upstream, err := newUpstream(srv.URL+"/dns-query", &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchangeThrice(t, upstream, "doh.example.com.")
+	if got := atomic.LoadUint32(&conns); got != 1 {
+		t.Fatalf("opened %d connections, want 1", got)
+	}
+}
+
+func TestNewUpstream(t *testing.T) {
+	for addr, want := range map[string]string{
+		"9.9.9.9:53":                      "9.9.9.9:53",
+		"tls://9.9.9.9":                   "9.9.9.9:853",
+		"tls://dns.quad9.net:8853":        "dns.quad9.net:8853",
+		"https://dns.quad9.net/dns-query": "https://dns.quad9.net/dns-query",
+		"https://9.9.9.9:8443/dns-query":  "https://9.9.9.9:8443/dns-query",
+		"ftp://dns.quad9.net/dns-query":   "",
+		"tls://":                          "",
+		"https:///dns-query":              "",
+	} {
+		upstream, err := newUpstream(addr, nil)
+		var got string
+		switch u := upstream.(type) {
+		case *plainUpstream:
+			got = u.addr
+		case *tlsUpstream:
+			got = u.addr
+		case *httpsUpstream:
+			got = u.url
+		}
+		if got != want || (err == nil) != (want != "") {
+			t.Errorf("newUpstream(%q) = %q, %v, want %q", addr, got, err, want)
+		}
+	}
+}
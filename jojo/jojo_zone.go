@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// MaxCNAMEChain Maximum number of CNAME records followed within a local zone
+const MaxCNAMEChain = 8
+
+// Zone Records served locally. A zone with an SOA record is answered
+// authoritatively: names under its origin that it lacks get NXDOMAIN.
+type Zone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR // keyed by lower case owner name
+	nodes   map[string]bool     // owner names and their ancestors up to the origin
+}
+
+// zones Authoritative local zones, keyed by lower case origin
+var zones map[string]*Zone
+
+// parseZone Reads RFC 1035 master file records, with relative names taken to
+// be under origin until a $ORIGIN. An empty origin makes relative names before
+// any $ORIGIN an error. The zone's origin is taken from the SOA record, if
+// any, and defaults to the root.
+func parseZone(r io.Reader, origin, file string) (*Zone, error) {
+	z := &Zone{origin: ".", records: make(map[string][]dns.RR), nodes: make(map[string]bool)}
+	zp := dns.NewZoneParser(r, origin, file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			if z.soa != nil {
+				return nil, fmt.Errorf("%v: more than one SOA record", file)
+			}
+			z.soa, z.origin = soa, strings.ToLower(soa.Hdr.Name)
+		}
+		name := strings.ToLower(rr.Header().Name)
+		z.records[name] = append(z.records[name], rr)
+	}
+	if err := zp.Err(); err != nil {
+		if origin == "" {
+			return nil, fmt.Errorf("%v (names before any $ORIGIN must be absolute, or the zone given as origin=file)", err)
+		}
+		return nil, err
+	}
+	for name := range z.records {
+		if !dns.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("%v: [%v] is out of zone [%v]", file, name, z.origin)
+		}
+		for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+			z.nodes[name[off:]] = true
+			if name[off:] == z.origin {
+				break
+			}
+		}
+	}
+	return z, nil
+}
+
+// loadZones Loads the zone files of -zones entries, each a file name or
+// origin=file for a file whose relative names are under origin
+func loadZones(entries []string) (map[string]*Zone, error) {
+	res := make(map[string]*Zone)
+	for _, entry := range entries {
+		var origin, file string
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			origin, file = dns.Fqdn(entry[:i]), entry[i+1:]
+			if _, ok := dns.IsDomainName(origin); !ok || origin == "." && entry[:i] != "." {
+				return nil, fmt.Errorf("%v: bad origin [%v]", file, entry[:i])
+			}
+		} else {
+			file = entry
+		}
+		fp, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		z, err := parseZone(fp, origin, file)
+		fp.Close()
+		if err != nil {
+			return nil, err
+		}
+		if z.soa == nil {
+			return nil, fmt.Errorf("%v: no SOA record", file)
+		}
+		if res[z.origin] != nil {
+			return nil, fmt.Errorf("%v: zone [%v] is loaded twice", file, z.origin)
+		}
+		res[z.origin] = z
+	}
+	return res, nil
+}
+
+// zoneFor Returns the zone with the longest origin name belongs to
+func zoneFor(name string) *Zone {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z := zones[name[off:]]; z != nil {
+			return z
+		}
+	}
+	return zones["."]
+}
+
+// lookup Returns the records of name, synthesized from a wildcard if name does
+// not exist, and whether name exists at all
+func (z *Zone) lookup(name string) ([]dns.RR, bool) {
+	if rrs := z.records[name]; rrs != nil {
+		return rrs, true
+	}
+	if z.nodes[name] {
+		return nil, true // empty non-terminal
+	}
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		encloser := name[off:]
+		if !z.nodes[encloser] {
+			continue
+		}
+		// the closest encloser ends the search, whether or not it has a wildcard
+		wildcard := z.records["*."+encloser]
+		if wildcard == nil {
+			return nil, false
+		}
+		rrs := make([]dns.RR, len(wildcard))
+		for i, rr := range wildcard {
+			rrs[i] = dns.Copy(rr)
+			rrs[i].Header().Name = name
+		}
+		return rrs, true
+	}
+	return nil, false
+}
+
+// negativeSOA Returns the SOA record for the authority section of negative
+// answers, with the TTL of RFC 2308
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// answer Returns the response of z to req, following CNAME records within the
+// zone, or nil if z has no SOA record and lacks the name
+func (z *Zone) answer(req *dns.Msg) *dns.Msg {
+	question := req.Question[0]
+	name := strings.ToLower(question.Name)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = z.soa != nil
+	m.RecursionAvailable = true
+	for chain := 0; ; chain++ {
+		rrs, exists := z.lookup(name)
+		if !exists || rrs == nil {
+			if len(m.Answer) > 0 {
+				return m // a CNAME target is an empty non-terminal or does not exist
+			}
+			if z.soa == nil {
+				return nil
+			}
+			if !exists {
+				m.Rcode = dns.RcodeNameError
+			}
+			m.Ns = []dns.RR{z.negativeSOA()}
+			return m
+		}
+		var cname dns.RR
+		answered := false
+		for _, rr := range rrs {
+			switch rrtype := rr.Header().Rrtype; {
+			case rrtype == question.Qtype || question.Qtype == dns.TypeANY:
+				m.Answer = append(m.Answer, rr)
+				answered = true
+			case rrtype == dns.TypeCNAME:
+				cname = rr
+			}
+		}
+		if answered {
+			return m
+		}
+		if cname == nil {
+			if z.soa != nil {
+				m.Ns = []dns.RR{z.negativeSOA()}
+			}
+			return m
+		}
+		m.Answer = append(m.Answer, cname)
+		name = strings.ToLower(cname.(*dns.CNAME).Target)
+		if chain >= MaxCNAMEChain || !dns.IsSubDomain(z.origin, name) {
+			return m
+		}
+	}
+}
+
+// answerLocally Returns the response of the local records and zones to req,
+// or nil if they do not cover its name
+func answerLocally(req *dns.Msg) *dns.Msg {
+	name := strings.ToLower(req.Question[0].Name)
+	if z := zoneFor(name); z != nil {
+		return z.answer(req)
+	}
+	if localRRS != nil && dns.IsSubDomain(localRRS.origin, name) {
+		return localRRS.answer(req)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$ORIGIN home.example.
+$TTL 3600
+@        IN SOA  ns.home.example. admin.home.example. 1 7200 900 1209600 300
+         IN NS   ns
+ns       IN A    192.0.2.53
+nas      IN A    192.0.2.10
+nas      IN A    192.0.2.11
+nas      IN AAAA 2001:db8::10
+files    IN CNAME nas
+share    IN CNAME files
+web      IN CNAME www.example.org.
+a.b.deep IN TXT  "below an empty non-terminal"
+*.dyn    IN A    192.0.2.99
+`
+
+func useZones(t *testing.T, files ...string) {
+	t.Helper()
+	loaded, err := loadZones(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones = loaded
+	t.Cleanup(func() { zones = nil })
+}
+
+func answerTypes(resp *dns.Msg) string {
+	var types []string
+	for _, rr := range resp.Answer {
+		types = append(types, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+	}
+	return strings.Join(types, ",")
+}
+
+func TestZone(t *testing.T) {
+	setupTestResolver(t)
+	useZones(t, writeList(t, t.TempDir(), "home.example.zone", testZone))
+
+	for _, test := range []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answer  string
+		soaInNs bool
+	}{
+		{"nas.home.example.", dns.TypeA, dns.RcodeSuccess, "nas.home.example. A,nas.home.example. A", false},
+		{"NAS.Home.Example.", dns.TypeAAAA, dns.RcodeSuccess, "nas.home.example. AAAA", false},
+		{"nas.home.example.", dns.TypeMX, dns.RcodeSuccess, "", true},
+		{"share.home.example.", dns.TypeAAAA, dns.RcodeSuccess, "share.home.example. CNAME,files.home.example. CNAME,nas.home.example. AAAA", false},
+		{"files.home.example.", dns.TypeCNAME, dns.RcodeSuccess, "files.home.example. CNAME", false},
+		{"web.home.example.", dns.TypeA, dns.RcodeSuccess, "web.home.example. CNAME", false},
+		{"host.dyn.home.example.", dns.TypeA, dns.RcodeSuccess, "host.dyn.home.example. A", false},
+		{"host.dyn.home.example.", dns.TypeTXT, dns.RcodeSuccess, "", true},
+		{"deep.home.example.", dns.TypeTXT, dns.RcodeSuccess, "", true},
+		{"x.deep.home.example.", dns.TypeTXT, dns.RcodeNameError, "", true},
+		{"missing.home.example.", dns.TypeA, dns.RcodeNameError, "", true},
+		{"home.example.", dns.TypeNS, dns.RcodeSuccess, "home.example. NS", false},
+	} {
+		resp := query(test.name, test.qtype)
+		if resp.Rcode != test.rcode || !resp.Authoritative || answerTypes(resp) != test.answer {
+			t.Errorf("%v %v: got %v", test.name, dns.TypeToString[test.qtype], resp)
+			continue
+		}
+		soa, ok := (*dns.SOA)(nil), false
+		if len(resp.Ns) == 1 {
+			soa, ok = resp.Ns[0].(*dns.SOA)
+		}
+		if ok != test.soaInNs || (ok && soa.Hdr.Ttl != 300) {
+			t.Errorf("%v %v: authority %v", test.name, dns.TypeToString[test.qtype], resp.Ns)
+		}
+	}
+
+	// names outside the zones are still resolved upstream
+	resp := query("nas.example.org.", dns.TypeA)
+	checkAnswer(t, resp, "nas.example.org.")
+	if resp.Authoritative {
+		t.Error("authoritative answer from upstream")
+	}
+}
+
+func TestLocalRRS(t *testing.T) {
+	setupTestResolver(t)
+	file := writeList(t, t.TempDir(), "local", "printer.lan.example. 60 IN A 192.0.2.20\nprinter.lan.example. 60 IN TXT \"2nd floor\"\n")
+	parseLocalRRSFile(file)
+	t.Cleanup(func() { localRRS = nil })
+
+	if resp := query("printer.lan.example.", dns.TypeTXT); answerTypes(resp) != "printer.lan.example. TXT" || resp.Authoritative {
+		t.Errorf("got %v", resp)
+	}
+	if resp := query("printer.lan.example.", dns.TypeAAAA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("got %v", resp)
+	}
+	checkAnswer(t, query("scanner.lan.example.", dns.TypeA), "scanner.lan.example.")
+}
+
+func TestLocalRRSWithSOA(t *testing.T) {
+	setupTestResolver(t)
+	file := writeList(t, t.TempDir(), "local", "lan.example. 60 IN SOA ns.lan.example. admin.lan.example. 1 2 3 4 60\n"+
+		"printer.lan.example. 60 IN A 192.0.2.20\n")
+	parseLocalRRSFile(file)
+	t.Cleanup(func() { localRRS = nil })
+
+	if resp := query("scanner.lan.example.", dns.TypeA); resp.Rcode != dns.RcodeNameError || !resp.Authoritative {
+		t.Errorf("got %v", resp)
+	}
+	checkAnswer(t, query("scanner.office.example.", dns.TypeA), "scanner.office.example.")
+}
+
+func TestLoadZoneWithOrigin(t *testing.T) {
+	file := writeList(t, t.TempDir(), "relative", "@ IN SOA ns admin 1 2 3 4 5\nwww IN A 192.0.2.1\n")
+	loaded, err := loadZones([]string{"office.example=" + file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := loaded["office.example."]
+	if z == nil || len(z.records["www.office.example."]) != 1 || z.soa.Ns != "ns.office.example." {
+		t.Fatalf("loaded %v", loaded)
+	}
+}
+
+func TestLoadZonesErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"nosoa":     "www.home.example. IN A 192.0.2.1\n",
+		"twosoa":    strings.Repeat("home.example. IN SOA ns.home.example. admin.home.example. 1 2 3 4 5\n", 2),
+		"outside":   "home.example. IN SOA ns.home.example. admin.home.example. 1 2 3 4 5\nwww.example.org. IN A 192.0.2.1\n",
+		"badsyntax": "home.example. IN SOA ns.home.example. admin.home.example. 1 2 3 4 5\nwww IN A not-an-address\n",
+	} {
+		if _, err := loadZones([]string{writeList(t, dir, name, content)}); err == nil {
+			t.Errorf("loaded zone %v", name)
+		}
+	}
+	// without $ORIGIN relative names would silently land under the root
+	relative := writeList(t, dir, "relative", "@ IN SOA ns admin 1 2 3 4 5\nwww IN A 192.0.2.1\n")
+	if _, err := loadZones([]string{relative}); err == nil || !strings.Contains(err.Error(), "origin=file") {
+		t.Errorf("loaded a zone without an origin: %v", err)
+	}
+	if _, err := loadZones([]string{"bad..origin=" + relative}); err == nil {
+		t.Error("loaded a zone with a bad origin")
+	}
+	zone := writeList(t, dir, "zone", testZone)
+	if _, err := loadZones([]string{zone, zone}); err == nil {
+		t.Error("loaded a zone twice")
+	}
+	if _, err := loadZones([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Error("loaded a missing zone file")
+	}
+}
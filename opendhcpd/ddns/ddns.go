@@ -0,0 +1,269 @@
+// Package ddns registers DHCP clients in DNS with RFC 2136 dynamic updates.
+//
+// When a client is given a lease under a host name, an A record for the name
+// in the forward zone and, if a reverse zone is configured, a PTR record for
+// the address are put in place, each alongside a DHCID record identifying the
+// client (RFC 4701). Following RFC 4703, a name is only taken if it is unused
+// or its DHCID shows it belongs to the same client, so records put in place by
+// hand or for another client are never replaced. Both are deleted again when
+// the lease ends. Updates are signed with TSIG if a key is configured.
+package ddns
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultTTL       = 300
+	tsigFudge        = 300
+	updateTimeout    = 5 * time.Second
+	maxHostnameLabel = 63
+)
+
+// Config is where and how to send updates.
+type Config struct {
+	Server        string `json:"server"`                   // name server to update, e.g. 10.10.200.2:53
+	Zone          string `json:"zone"`                     // forward zone the clients are named in, e.g. office.local
+	ReverseZone   string `json:"reverse_zone,omitempty"`   // e.g. 200.10.10.in-addr.arpa; no PTR records without it
+	TTL           uint32 `json:"ttl,omitempty"`            // seconds, 300 if unset
+	TSIGName      string `json:"tsig_name,omitempty"`      // key name, to sign updates
+	TSIGSecret    string `json:"tsig_secret,omitempty"`    // base64 encoded key
+	TSIGAlgorithm string `json:"tsig_algorithm,omitempty"` // hmac-sha256 if unset
+}
+
+var algorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Updater sends dynamic updates to one name server. It is safe for
+// concurrent use.
+type Updater struct {
+	server      string
+	zone        string
+	reverseZone string
+	ttl         uint32
+	keyName     string
+	algorithm   string
+	client      *dns.Client
+}
+
+// New returns an Updater for cfg.
+func New(cfg Config) (*Updater, error) {
+	if cfg.Server == "" {
+		return nil, errors.New("ddns: no server is configured")
+	}
+	server := cfg.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	if _, ok := dns.IsDomainName(cfg.Zone); !ok || cfg.Zone == "" {
+		return nil, fmt.Errorf("ddns: invalid zone %q", cfg.Zone)
+	}
+	if _, ok := dns.IsDomainName(cfg.ReverseZone); !ok && cfg.ReverseZone != "" {
+		return nil, fmt.Errorf("ddns: invalid reverse zone %q", cfg.ReverseZone)
+	}
+	u := &Updater{
+		server: server,
+		zone:   dns.Fqdn(strings.ToLower(cfg.Zone)),
+		ttl:    cfg.TTL,
+		client: &dns.Client{Timeout: updateTimeout},
+	}
+	if cfg.ReverseZone != "" {
+		u.reverseZone = dns.Fqdn(strings.ToLower(cfg.ReverseZone))
+	}
+	if u.ttl == 0 {
+		u.ttl = defaultTTL
+	}
+	if cfg.TSIGName != "" {
+		if _, err := base64.StdEncoding.DecodeString(cfg.TSIGSecret); err != nil || cfg.TSIGSecret == "" {
+			return nil, errors.New("ddns: TSIG secret must be base64 encoded")
+		}
+		alg := cfg.TSIGAlgorithm
+		if alg == "" {
+			alg = "hmac-sha256"
+		}
+		if u.algorithm = algorithms[strings.ToLower(alg)]; u.algorithm == "" {
+			return nil, fmt.Errorf("ddns: unknown TSIG algorithm %q", alg)
+		}
+		u.keyName = dns.Fqdn(strings.ToLower(cfg.TSIGName))
+		u.client.TsigSecret = map[string]string{u.keyName: cfg.TSIGSecret}
+	}
+	return u, nil
+}
+
+// Name returns the fully qualified name a client with host name host is
+// registered under. Anything after the first dot is dropped and characters
+// not allowed in a host name are replaced, so a client cannot name itself
+// into another zone. It returns "" for a host name with nothing usable in it.
+func (u *Updater) Name(host string) string {
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		host = host[:i]
+	}
+	label := []byte(strings.ToLower(host))
+	for i, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			label[i] = '-'
+		}
+	}
+	host = strings.Trim(string(label), "-")
+	if len(host) > maxHostnameLabel {
+		host = host[:maxHostnameLabel]
+	}
+	if host == "" {
+		return ""
+	}
+	return host + "." + u.zone
+}
+
+// Add points name at ip for the client with hardware address hwaddr, and ip
+// back at name. A record of name or PTR record of ip is only replaced if the
+// client registered it.
+func (u *Updater) Add(name string, ip net.IP, hwaddr net.HardwareAddr) error {
+	a := &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: u.ttl}, A: ip.To4()}
+	if err := u.claim(u.zone, a, hwaddr); err != nil {
+		return fmt.Errorf("update A record of %s: %s", name, err)
+	}
+	if ptr := u.ptr(name, ip); ptr != nil {
+		if err := u.claim(u.reverseZone, ptr, hwaddr); err != nil {
+			return fmt.Errorf("update PTR record of %s: %s", ip, err)
+		}
+	}
+	return nil
+}
+
+// Remove deletes the A record pointing name at ip and the PTR record of ip
+// that the client with hardware address hwaddr registered. Records that
+// another client has since put in place are left alone.
+func (u *Updater) Remove(name string, ip net.IP, hwaddr net.HardwareAddr) error {
+	a := &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: ip.To4()}
+	if err := u.release(u.zone, a, hwaddr); err != nil {
+		return fmt.Errorf("delete A record of %s: %s", name, err)
+	}
+	if ptr := u.ptr(name, ip); ptr != nil {
+		if err := u.release(u.reverseZone, ptr, hwaddr); err != nil {
+			return fmt.Errorf("delete PTR record of %s: %s", ip, err)
+		}
+	}
+	return nil
+}
+
+// claim puts rr in place of the records of its type at its owner name, along
+// with the DHCID of client hwaddr, if the name is not in use or its DHCID is
+// the client's (RFC 4703 section 5.3).
+func (u *Updater) claim(zone string, rr dns.RR, hwaddr net.HardwareAddr) error {
+	id := u.dhcid(rr.Header().Name, hwaddr)
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	m.NameNotUsed([]dns.RR{rr})
+	m.Insert([]dns.RR{rr, id})
+	err := u.send(m)
+	if err != rcodeError(dns.RcodeYXDomain) {
+		return err
+	}
+
+	m = new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Used([]dns.RR{id})
+	m.RemoveRRset([]dns.RR{rr})
+	m.Insert([]dns.RR{rr})
+	if err := u.send(m); err == rcodeError(dns.RcodeNXRrset) {
+		return errors.New("name is in use by another client")
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// release deletes rr if the DHCID at its owner name is that of client hwaddr,
+// and then the DHCID once no records of the type of rr are left (RFC 4703
+// section 5.5).
+func (u *Updater) release(zone string, rr dns.RR, hwaddr net.HardwareAddr) error {
+	id := u.dhcid(rr.Header().Name, hwaddr)
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Used([]dns.RR{id})
+	m.Remove([]dns.RR{rr})
+	if err := u.send(m); err == rcodeError(dns.RcodeNXRrset) {
+		return nil // registered by another client since
+	} else if err != nil {
+		return err
+	}
+
+	m = new(dns.Msg)
+	m.SetUpdate(zone)
+	m.Used([]dns.RR{id})
+	m.RRsetNotUsed([]dns.RR{rr})
+	m.RemoveRRset([]dns.RR{id})
+	if err := u.send(m); err != rcodeError(dns.RcodeYXRrset) && err != rcodeError(dns.RcodeNXRrset) {
+		return err
+	}
+	return nil
+}
+
+// dhcid returns the DHCID record at owner identifying the client with
+// Ethernet address hwaddr: identifier type 0 (the chaddr), digest type 1
+// (SHA-256) over the hardware type, the address and the owner name in wire
+// format (RFC 4701 section 3).
+func (u *Updater) dhcid(owner string, hwaddr net.HardwareAddr) *dns.DHCID {
+	buf := make([]byte, 1+len(hwaddr)+256)
+	buf[0] = 1 // htype Ethernet
+	n := 1 + copy(buf[1:], hwaddr)
+	off, err := dns.PackDomainName(dns.CanonicalName(owner), buf, n, nil, false)
+	if err != nil {
+		off = n // owner names are validated before they get here
+	}
+	digest := sha256.Sum256(buf[:off])
+	rdata := append([]byte{0, 0, 1}, digest[:]...)
+	return &dns.DHCID{
+		Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeDHCID, Class: dns.ClassINET, Ttl: u.ttl},
+		Digest: base64.StdEncoding.EncodeToString(rdata),
+	}
+}
+
+// ptr returns the PTR record of ip pointing at name, or nil if ip is not in
+// the reverse zone.
+func (u *Updater) ptr(name string, ip net.IP) *dns.PTR {
+	if u.reverseZone == "" {
+		return nil
+	}
+	rev, err := dns.ReverseAddr(ip.String())
+	if err != nil || !dns.IsSubDomain(u.reverseZone, rev) {
+		return nil
+	}
+	return &dns.PTR{Hdr: dns.RR_Header{Name: rev, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: u.ttl}, Ptr: name}
+}
+
+// send signs m if there is a key and sends it, returning an error unless the
+// server accepts the update.
+func (u *Updater) send(m *dns.Msg) error {
+	if u.keyName != "" {
+		m.SetTsig(u.keyName, u.algorithm, tsigFudge, time.Now().Unix())
+	}
+	r, _, err := u.client.Exchange(m, u.server)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return rcodeError(r.Rcode)
+	}
+	return nil
+}
+
+// rcodeError is the answer of a server that did not apply an update, such as
+// one whose prerequisites failed.
+type rcodeError int
+
+func (e rcodeError) Error() string {
+	return "server answered " + dns.RcodeToString[int(e)]
+}
@@ -0,0 +1,214 @@
+package ddns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/ishworgurung/opendhcpd/ddns/ddnstest"
+	"github.com/miekg/dns"
+)
+
+const testSecret = "c2VjcmV0IGtleSBmb3IgdGVzdGluZyBvbmx5"
+
+var (
+	laptopMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+	phoneMAC  = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02}
+)
+
+func newTestUpdater(t *testing.T, srv *ddnstest.Server, keyName, secret string) *Updater {
+	t.Helper()
+	u, err := New(Config{
+		Server:      srv.Addr,
+		Zone:        "office.local",
+		ReverseZone: "200.10.10.in-addr.arpa",
+		TSIGName:    keyName,
+		TSIGSecret:  secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestAddAndRemove(t *testing.T) {
+	srv, err := ddnstest.NewServer("dhcp-key", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	u := newTestUpdater(t, srv, "dhcp-key", testSecret)
+
+	ip := net.IP{10, 10, 200, 11}
+	if err := u.Add("laptop.office.local.", ip, laptopMAC); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Lookup("laptop.office.local.", dns.TypeA); !reflect.DeepEqual(got, []string{"10.10.200.11"}) {
+		t.Fatalf("A records %v", got)
+	}
+	if got := srv.Lookup("11.200.10.10.in-addr.arpa.", dns.TypePTR); !reflect.DeepEqual(got, []string{"laptop.office.local."}) {
+		t.Fatalf("PTR records %v", got)
+	}
+
+	// the name moving to another address replaces its record
+	if err := u.Add("laptop.office.local.", net.IP{10, 10, 200, 12}, laptopMAC); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Lookup("laptop.office.local.", dns.TypeA); !reflect.DeepEqual(got, []string{"10.10.200.12"}) {
+		t.Fatalf("A records after moving %v", got)
+	}
+
+	// removing the stale registration leaves the current one alone
+	if err := u.Remove("laptop.office.local.", ip, laptopMAC); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Lookup("laptop.office.local.", dns.TypeA); !reflect.DeepEqual(got, []string{"10.10.200.12"}) {
+		t.Fatalf("A records after removing the old address %v", got)
+	}
+	if got := srv.Lookup("11.200.10.10.in-addr.arpa.", dns.TypePTR); len(got) != 0 {
+		t.Fatalf("PTR records after removal %v", got)
+	}
+	if got := srv.Lookup("laptop.office.local.", dns.TypeDHCID); len(got) != 1 {
+		t.Fatalf("DHCID records of the current registration %v", got)
+	}
+
+	if err := u.Remove("laptop.office.local.", net.IP{10, 10, 200, 12}, laptopMAC); err != nil {
+		t.Fatal(err)
+	}
+	for _, rt := range []uint16{dns.TypeA, dns.TypeDHCID} {
+		if got := srv.Lookup("laptop.office.local.", rt); len(got) != 0 {
+			t.Fatalf("%s records after removal %v", dns.TypeToString[rt], got)
+		}
+	}
+}
+
+func TestOtherClientsRecordsAreKept(t *testing.T) {
+	srv, err := ddnstest.NewServer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	u := newTestUpdater(t, srv, "", "")
+
+	if err := u.Add("laptop.office.local.", net.IP{10, 10, 200, 11}, laptopMAC); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Add("laptop.office.local.", net.IP{10, 10, 200, 12}, phoneMAC); err == nil {
+		t.Fatal("another client took over a registered name")
+	}
+	if got := srv.Lookup("laptop.office.local.", dns.TypeA); !reflect.DeepEqual(got, []string{"10.10.200.11"}) {
+		t.Fatalf("A records %v", got)
+	}
+	if err := u.Remove("laptop.office.local.", net.IP{10, 10, 200, 11}, phoneMAC); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Lookup("laptop.office.local.", dns.TypeA); !reflect.DeepEqual(got, []string{"10.10.200.11"}) {
+		t.Fatalf("A records after another client's removal %v", got)
+	}
+	if got := srv.Lookup("11.200.10.10.in-addr.arpa.", dns.TypePTR); !reflect.DeepEqual(got, []string{"laptop.office.local."}) {
+		t.Fatalf("PTR records after another client's removal %v", got)
+	}
+}
+
+func TestStaticRecordsAreKept(t *testing.T) {
+	srv, err := ddnstest.NewServer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	u := newTestUpdater(t, srv, "", "")
+	fileserver, _ := dns.NewRR("fileserver.office.local. 3600 IN A 10.10.200.2")
+	ptr, _ := dns.NewRR("13.200.10.10.in-addr.arpa. 3600 IN PTR printer.office.local.")
+	srv.Insert(fileserver, ptr)
+
+	if err := u.Add("fileserver.office.local.", net.IP{10, 10, 200, 12}, laptopMAC); err == nil {
+		t.Fatal("a client took over a name added by hand")
+	}
+	if got := srv.Lookup("fileserver.office.local.", dns.TypeA); !reflect.DeepEqual(got, []string{"10.10.200.2"}) {
+		t.Fatalf("A records %v", got)
+	}
+
+	// the forward record goes in, the PTR record added by hand stays
+	if err := u.Add("laptop.office.local.", net.IP{10, 10, 200, 13}, laptopMAC); err == nil {
+		t.Fatal("a client took over a PTR record added by hand")
+	}
+	if got := srv.Lookup("laptop.office.local.", dns.TypeA); !reflect.DeepEqual(got, []string{"10.10.200.13"}) {
+		t.Fatalf("A records %v", got)
+	}
+	if got := srv.Lookup("13.200.10.10.in-addr.arpa.", dns.TypePTR); !reflect.DeepEqual(got, []string{"printer.office.local."}) {
+		t.Fatalf("PTR records %v", got)
+	}
+	if err := u.Remove("laptop.office.local.", net.IP{10, 10, 200, 13}, laptopMAC); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Lookup("13.200.10.10.in-addr.arpa.", dns.TypePTR); !reflect.DeepEqual(got, []string{"printer.office.local."}) {
+		t.Fatalf("PTR records after removal %v", got)
+	}
+}
+
+func TestUnsignedUpdateIsRefused(t *testing.T) {
+	srv, err := ddnstest.NewServer("dhcp-key", testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, u := range []*Updater{
+		newTestUpdater(t, srv, "", ""),
+		newTestUpdater(t, srv, "dhcp-key", "d3Jvbmcgc2VjcmV0"),
+	} {
+		if err := u.Add("laptop.office.local.", net.IP{10, 10, 200, 11}, laptopMAC); err == nil {
+			t.Error("update accepted without the right key")
+		}
+	}
+	if got := srv.Lookup("laptop.office.local.", dns.TypeA); len(got) != 0 {
+		t.Fatalf("A records %v", got)
+	}
+}
+
+func TestNoPTROutsideReverseZone(t *testing.T) {
+	srv, err := ddnstest.NewServer("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	u := newTestUpdater(t, srv, "", "")
+	if err := u.Add("lab.office.local.", net.IP{10, 20, 0, 5}, laptopMAC); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Updates() != 1 {
+		t.Fatalf("sent %d updates, want only the forward one", srv.Updates())
+	}
+}
+
+func TestName(t *testing.T) {
+	u, err := New(Config{Server: "127.0.0.1", Zone: "office.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"Laptop":            "laptop.office.local.",
+		"laptop.evil.com":   "laptop.office.local.",
+		"Bob's iPhone":      "bob-s-iphone.office.local.",
+		"--":                "",
+		"":                  "",
+		"printer-2nd-floor": "printer-2nd-floor.office.local.",
+	} {
+		if got := u.Name(host); got != want {
+			t.Errorf("Name(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestNewRejectsBadConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{Zone: "office.local"},
+		{Server: "127.0.0.1", Zone: ""},
+		{Server: "127.0.0.1", Zone: "office.local", TSIGName: "k", TSIGSecret: "not base64!"},
+		{Server: "127.0.0.1", Zone: "office.local", TSIGName: "k", TSIGSecret: testSecret, TSIGAlgorithm: "hmac-sha3"},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v) succeeded", cfg)
+		}
+	}
+}
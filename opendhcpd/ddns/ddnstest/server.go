@@ -0,0 +1,221 @@
+// Package ddnstest provides a name server that accepts dynamic updates, for
+// testing.
+package ddnstest
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Server is a name server on a loopback address that applies every update
+// whose prerequisites hold (RFC 2136 section 3.2), checking its TSIG signature
+// if a key is given, and answers nothing else.
+type Server struct {
+	Addr string // host:port to send updates to
+
+	mu      sync.Mutex
+	records map[string][]dns.RR // by owner name and type
+	updates int
+	keyName string
+	srv     *dns.Server
+}
+
+// NewServer starts a Server. Updates must be signed with key keyName if it is
+// not empty.
+func NewServer(keyName, secret string) (*Server, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Addr: pc.LocalAddr().String(), records: make(map[string][]dns.RR)}
+	started := make(chan struct{})
+	s.srv = &dns.Server{
+		PacketConn:        pc,
+		Handler:           s,
+		NotifyStartedFunc: func() { close(started) },
+		// the default refuses anything but queries
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	if keyName != "" {
+		s.keyName = dns.Fqdn(keyName)
+		s.srv.TsigSecret = map[string]string{s.keyName: secret}
+	}
+	go s.srv.ActivateAndServe()
+	<-started
+	return s, nil
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.srv.Shutdown()
+}
+
+// ServeDNS applies an update.
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	t := r.IsTsig()
+	if t != nil {
+		m.SetTsig(t.Hdr.Name, t.Algorithm, 300, time.Now().Unix())
+	}
+	switch {
+	case r.Opcode != dns.OpcodeUpdate:
+		m.Rcode = dns.RcodeNotImplemented
+	case s.keyName != "" && (t == nil || t.Hdr.Name != s.keyName || w.TsigStatus() != nil):
+		m.Rcode = dns.RcodeNotAuth
+	default:
+		m.Rcode = s.apply(r.Answer, r.Ns)
+	}
+	w.WriteMsg(m)
+}
+
+// apply makes the updates in rrs if prereqs hold and returns the response
+// code.
+func (s *Server) apply(prereqs, rrs []dns.RR) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rcode := s.check(prereqs); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	s.updates++
+	for _, rr := range rrs {
+		h := rr.Header()
+		key := dns.CanonicalName(h.Name) + " " + dns.TypeToString[h.Rrtype]
+		switch h.Class {
+		case dns.ClassANY: // delete the RRset
+			delete(s.records, key)
+		case dns.ClassNONE: // delete the RR
+			var kept []dns.RR
+			for _, have := range s.records[key] {
+				if !sameData(have, rr) {
+					kept = append(kept, have)
+				}
+			}
+			s.records[key] = kept
+		default:
+			if !s.has(key, rr) {
+				s.records[key] = append(s.records[key], rr)
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// check returns the response code of an update with prerequisites prereqs.
+// The caller holds s.mu.
+func (s *Server) check(prereqs []dns.RR) int {
+	want := make(map[string][]dns.RR) // value dependent RRsets
+	for _, rr := range prereqs {
+		h := rr.Header()
+		key := dns.CanonicalName(h.Name) + " " + dns.TypeToString[h.Rrtype]
+		switch {
+		case h.Class == dns.ClassANY && h.Rrtype == dns.TypeANY:
+			if !s.nameUsed(h.Name) {
+				return dns.RcodeNameError
+			}
+		case h.Class == dns.ClassNONE && h.Rrtype == dns.TypeANY:
+			if s.nameUsed(h.Name) {
+				return dns.RcodeYXDomain
+			}
+		case h.Class == dns.ClassANY:
+			if len(s.records[key]) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case h.Class == dns.ClassNONE:
+			if len(s.records[key]) != 0 {
+				return dns.RcodeYXRrset
+			}
+		default:
+			want[key] = append(want[key], rr)
+		}
+	}
+	for key, rrs := range want {
+		if len(s.records[key]) != len(rrs) {
+			return dns.RcodeNXRrset
+		}
+		for _, rr := range rrs {
+			if !s.has(key, rr) {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+func (s *Server) nameUsed(name string) bool {
+	prefix := dns.CanonicalName(name) + " "
+	for key, rrs := range s.records {
+		if strings.HasPrefix(key, prefix) && len(rrs) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) has(key string, rr dns.RR) bool {
+	for _, have := range s.records[key] {
+		if sameData(have, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Insert puts rrs in place as if they had been added by hand.
+func (s *Server) Insert(rrs ...dns.RR) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rr := range rrs {
+		h := rr.Header()
+		key := dns.CanonicalName(h.Name) + " " + dns.TypeToString[h.Rrtype]
+		if !s.has(key, rr) {
+			s.records[key] = append(s.records[key], rr)
+		}
+	}
+}
+
+func sameData(a, b dns.RR) bool {
+	switch a := a.(type) {
+	case *dns.A:
+		b, ok := b.(*dns.A)
+		return ok && a.A.Equal(b.A)
+	case *dns.PTR:
+		b, ok := b.(*dns.PTR)
+		return ok && dns.CanonicalName(a.Ptr) == dns.CanonicalName(b.Ptr)
+	case *dns.DHCID:
+		b, ok := b.(*dns.DHCID)
+		return ok && a.Digest == b.Digest
+	}
+	return false
+}
+
+// Lookup returns the data of the records of name and type t, sorted.
+func (s *Server) Lookup(name string, t uint16) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var data []string
+	for _, rr := range s.records[dns.CanonicalName(name)+" "+dns.TypeToString[t]] {
+		switch rr := rr.(type) {
+		case *dns.A:
+			data = append(data, rr.A.String())
+		case *dns.PTR:
+			data = append(data, rr.Ptr)
+		case *dns.DHCID:
+			data = append(data, rr.Digest)
+		}
+	}
+	sort.Strings(data)
+	return data
+}
+
+// Updates returns the number of updates applied.
+func (s *Server) Updates() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updates
+}
@@ -0,0 +1,267 @@
+package dhcpv4
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// leaseInfo is a lease as the admin API lists it.
+type leaseInfo struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expiry   time.Time `json:"expiry"`
+	Pool     string    `json:"pool"`
+}
+
+// poolStats is the utilisation of a pool's dynamic range.
+type poolStats struct {
+	Name        string  `json:"name"`
+	Subnet      string  `json:"subnet"`
+	Start       string  `json:"start"`
+	End         string  `json:"end"`
+	Size        int     `json:"size"`
+	Leased      int     `json:"leased"`
+	Reserved    int     `json:"reserved"` // reserved and not leased
+	Declined    int     `json:"declined"` // quarantined as in use
+	Free        int     `json:"free"`
+	Utilisation float64 `json:"utilisation"` // percentage of the range not free
+}
+
+// AdminHandler serves the admin API:
+//
+//	GET    /leases              active leases
+//	DELETE /leases/<ip>         force-release a lease
+//	GET    /reservations        reservations
+//	POST   /reservations        add a reservation, given as in the reservations file
+//	DELETE /reservations/<mac>  remove a reservation
+//	GET    /pools               pool utilisation
+//
+// Reservations changed through the API are written back to the reservations
+// file, if there is one. The API is not authenticated; listen on a trusted
+// address only.
+func (h *Handler) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/leases", h.serveLeases)
+	mux.HandleFunc("/leases/", h.serveLeases)
+	mux.HandleFunc("/reservations", h.serveReservations)
+	mux.HandleFunc("/reservations/", h.serveReservations)
+	mux.HandleFunc("/pools", h.servePools)
+	return mux
+}
+
+func (h *Handler) serveLeases(w http.ResponseWriter, r *http.Request) {
+	arg := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/leases"), "/")
+	switch {
+	case r.Method == http.MethodGet && arg == "":
+		writeJSON(w, http.StatusOK, h.leaseList())
+	case r.Method == http.MethodDelete && arg != "":
+		ip := net.ParseIP(arg).To4()
+		if ip == nil {
+			writeError(w, http.StatusBadRequest, "invalid IP address "+arg)
+			return
+		}
+		if !h.releaseLease(ip) {
+			writeError(w, http.StatusNotFound, "no lease on "+arg)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *Handler) serveReservations(w http.ResponseWriter, r *http.Request) {
+	arg := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/reservations"), "/")
+	switch {
+	case r.Method == http.MethodGet && arg == "":
+		h.mu.Lock()
+		list := h.reservations.list()
+		h.mu.Unlock()
+		writeJSON(w, http.StatusOK, list)
+	case r.Method == http.MethodPost && arg == "":
+		var res Reservation
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		status, err := h.addReservation(res)
+		if err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete && arg != "":
+		status, err := h.removeReservation(arg)
+		if err != nil {
+			writeError(w, status, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *Handler) servePools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, h.poolStats())
+}
+
+// leaseList returns the active leases of every pool, ordered by address.
+func (h *Handler) leaseList() []leaseInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	var list []leaseInfo
+	for _, p := range h.pools {
+		for i, l := range p.leases {
+			if l.declined || !l.expiry.After(now) {
+				continue
+			}
+			list = append(list, leaseInfo{
+				MAC:      l.nic,
+				IP:       p.addr(i).String(),
+				Hostname: l.hostname,
+				Expiry:   l.expiry,
+				Pool:     p.name,
+			})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return string(net.ParseIP(list[i].IP).To4()) < string(net.ParseIP(list[j].IP).To4())
+	})
+	if list == nil {
+		list = []leaseInfo{}
+	}
+	return list
+}
+
+// releaseLease ends the lease on ip, reporting whether there was one. The
+// client keeps using the address until it next renews and is refused.
+func (h *Handler) releaseLease(ip net.IP) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := h.poolContaining(ip)
+	if p == nil {
+		return false
+	}
+	i := p.slot(ip)
+	l, ok := p.leases[i]
+	if !ok || l.declined {
+		return false
+	}
+	h.dropLease(p, i)
+	h.logger.Info().Msgf("lease %s of %s released by an administrator", ip, l.nic)
+	return true
+}
+
+// addReservation adds res and saves the reservations. It returns the HTTP
+// status to report if it fails.
+func (h *Handler) addReservation(res Reservation) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ip := net.ParseIP(res.IP).To4(); ip != nil && h.poolContaining(ip) == nil {
+		return http.StatusBadRequest, fmt.Errorf("%s %q: %s %s", errInvalidReservation, res.MAC, res.IP, errReservationOutsidePools)
+	}
+	if mac, err := net.ParseMAC(res.MAC); err == nil {
+		if h.reservations.forMAC(mac.String()) != nil || h.reservations.reservedForOther(net.ParseIP(res.IP), mac.String()) {
+			return http.StatusConflict, fmt.Errorf("%s %q: client or address already reserved", errInvalidReservation, res.MAC)
+		}
+	}
+	if err := h.reservations.add(res); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if err := h.saveReservations(); err != nil {
+		h.reservations.remove(res.MAC)
+		return http.StatusInternalServerError, err
+	}
+	h.logger.Info().Msgf("reservation of %s for %s added by an administrator", res.IP, res.MAC)
+	return 0, nil
+}
+
+// removeReservation removes the reservation of client mac and saves the
+// reservations. It returns the HTTP status to report if it fails.
+func (h *Handler) removeReservation(mac string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	res := h.reservations.forMAC(hw.String())
+	if res == nil {
+		return http.StatusNotFound, fmt.Errorf("no reservation for %s", mac)
+	}
+	h.reservations.remove(mac)
+	if err := h.saveReservations(); err != nil {
+		h.reservations.add(res.Reservation)
+		return http.StatusInternalServerError, err
+	}
+	h.logger.Info().Msgf("reservation of %s for %s removed by an administrator", res.IP, res.MAC)
+	return 0, nil
+}
+
+// saveReservations writes the reservations back to the reservations file, if
+// there is one. The caller holds h.mu.
+func (h *Handler) saveReservations() error {
+	if h.reservationsFile == "" {
+		return nil
+	}
+	if err := h.reservations.save(h.reservationsFile); err != nil {
+		h.logger.Error().Msgf("%s %s: %s", errSaveReservations, h.reservationsFile, err)
+		return fmt.Errorf("%s: %s", errSaveReservations, err)
+	}
+	return nil
+}
+
+// poolStats returns the utilisation of every pool.
+func (h *Handler) poolStats() []poolStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	stats := make([]poolStats, 0, len(h.pools))
+	for _, p := range h.pools {
+		st := poolStats{
+			Name:   p.name,
+			Subnet: p.subnet.String(),
+			Start:  p.start.String(),
+			End:    p.addr(p.leaseRange - 1).String(),
+			Size:   p.leaseRange,
+		}
+		for i := 0; i < p.leaseRange; i++ {
+			l, ok := p.leases[i]
+			switch {
+			case ok && l.expiry.After(now) && l.declined:
+				st.Declined++
+			case ok && l.expiry.After(now):
+				st.Leased++
+			case h.reservations.reservedForOther(p.addr(i), ""):
+				st.Reserved++
+			default:
+				st.Free++
+			}
+		}
+		st.Utilisation = float64(st.Size-st.Free) * 100 / float64(st.Size)
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
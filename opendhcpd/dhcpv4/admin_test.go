@@ -0,0 +1,157 @@
+package dhcpv4
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func adminDo(t *testing.T, srv *httptest.Server, method, path, body string, want int, v interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: got %d %s, want %d", method, path, resp.StatusCode, b, want)
+	}
+	if v != nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	pc := testPool("office", "10.0.0.0/24", "10.0.0.100")
+	pc.Range = 4
+	h := newTestHandler(t, pc)
+	h.reservationsFile = filepath.Join(t.TempDir(), "reservations.json")
+	srv := httptest.NewServer(h.AdminHandler())
+	defer srv.Close()
+
+	ip := discover(t, h, "02:00:00:00:00:01")
+	request(t, h, "02:00:00:00:00:01", ip)
+
+	var leases []leaseInfo
+	adminDo(t, srv, "GET", "/leases", "", http.StatusOK, &leases)
+	if len(leases) != 1 || leases[0].MAC != "02:00:00:00:00:01" || leases[0].IP != ip.String() || leases[0].Pool != "office" {
+		t.Fatalf("leases = %+v", leases)
+	}
+
+	// reserve a free address in the range for another client
+	reserved := "10.0.0.103"
+	if ip.String() == reserved {
+		reserved = "10.0.0.102"
+	}
+	body := fmt.Sprintf(`{"mac": "02:00:00:00:00:02", "ip": %q, "hostname": "printer"}`, reserved)
+	adminDo(t, srv, "POST", "/reservations", body, http.StatusCreated, nil)
+	adminDo(t, srv, "POST", "/reservations", body, http.StatusConflict, nil)
+	adminDo(t, srv, "POST", "/reservations", `{"mac": "02:00:00:00:00:03", "ip": "192.168.1.1"}`, http.StatusBadRequest, nil)
+	if got := discover(t, h, "02:00:00:00:00:02"); got.String() != reserved {
+		t.Fatalf("reserved client offered %s, want %s", got, reserved)
+	}
+	b, err := ioutil.ReadFile(h.reservationsFile)
+	if err != nil || !strings.Contains(string(b), reserved) {
+		t.Fatalf("reservation not saved: %s %v", b, err)
+	}
+
+	var pools []poolStats
+	adminDo(t, srv, "GET", "/pools", "", http.StatusOK, &pools)
+	if len(pools) != 1 || pools[0].Size != 4 || pools[0].Leased != 1 || pools[0].Reserved != 1 || pools[0].Free != 2 || pools[0].Utilisation != 50 {
+		t.Fatalf("pools = %+v", pools)
+	}
+
+	adminDo(t, srv, "DELETE", "/leases/"+ip.String(), "", http.StatusNoContent, nil)
+	adminDo(t, srv, "DELETE", "/leases/"+ip.String(), "", http.StatusNotFound, nil)
+	adminDo(t, srv, "GET", "/leases", "", http.StatusOK, &leases)
+	if len(leases) != 0 {
+		t.Fatalf("leases after release = %+v", leases)
+	}
+	for _, l := range h.db.Leases() {
+		if l.IP.Equal(ip) {
+			t.Fatal("released lease still in the lease database")
+		}
+	}
+
+	adminDo(t, srv, "DELETE", "/reservations/02-00-00-00-00-02", "", http.StatusNoContent, nil)
+	adminDo(t, srv, "DELETE", "/reservations/02:00:00:00:00:02", "", http.StatusNotFound, nil)
+	var list []Reservation
+	adminDo(t, srv, "GET", "/reservations", "", http.StatusOK, &list)
+	if len(list) != 0 {
+		t.Fatalf("reservations after removal = %+v", list)
+	}
+}
+
+// TestAdminAPIConcurrentWithServing is meant for the race detector.
+func TestAdminAPIConcurrentWithServing(t *testing.T) {
+	h := newTestHandler(t, testPool("office", "10.0.0.0/24", "10.0.0.10"))
+	srv := httptest.NewServer(h.AdminHandler())
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		c := c
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				mac := net.HardwareAddr{2, 0, 0, 0, byte(c), byte(i)}
+				offer := serve(h, dhcp.RequestPacket(dhcp.Discover, mac, nil, []byte{1, 2, 3, 4}, false, nil), "")
+				if offer == nil {
+					continue
+				}
+				serve(h, dhcp.RequestPacket(dhcp.Request, mac, nil, []byte{1, 2, 3, 4}, false,
+					[]dhcp.Option{{Code: dhcp.OptionRequestedIPAddress, Value: offer.YIAddr()}}), "")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				var leases []leaseInfo
+				if err := getJSON(srv, "/leases", &leases); err != nil {
+					t.Error(err)
+					return
+				}
+				for _, l := range leases {
+					req, _ := http.NewRequest("DELETE", srv.URL+"/leases/"+l.IP, nil)
+					if resp, err := srv.Client().Do(req); err == nil {
+						resp.Body.Close()
+					}
+				}
+				if err := getJSON(srv, "/pools", &[]poolStats{}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func getJSON(srv *httptest.Server, path string, v interface{}) error {
+	resp, err := srv.Client().Get(srv.URL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
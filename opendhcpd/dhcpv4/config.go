@@ -0,0 +1,75 @@
+package dhcpv4
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+
+	"github.com/ishworgurung/opendhcpd/ddns"
+)
+
+// Config is the server configuration. It is read from a JSON file, or built
+// from the command line flags for a single pool.
+type Config struct {
+	LeaseFile        string       `json:"lease_file,omitempty"`
+	ReservationsFile string       `json:"reservations_file,omitempty"`
+	Probe            string       `json:"probe,omitempty"`         // "icmp" to check addresses before offering them
+	ProbeTimeout     int          `json:"probe_timeout,omitempty"` // milliseconds
+	DeclineTime      int          `json:"decline_time,omitempty"`  // seconds a conflicting address is held back
+	AdminListen      string       `json:"admin_listen,omitempty"`  // address of the admin API, e.g. 127.0.0.1:6767
+	DDNS             *ddns.Config `json:"ddns,omitempty"`          // where to register clients in DNS
+	Pools            []PoolConfig `json:"pools"`
+}
+
+// PoolConfig is a range of addresses handed out on one subnet, along with the
+// options sent to its clients.
+type PoolConfig struct {
+	Name       string            `json:"name"`
+	Interface  string            `json:"interface,omitempty"`  // serve clients on this interface
+	CircuitID  string            `json:"circuit_id,omitempty"` // or relayed with this option 82 circuit-id
+	RemoteID   string            `json:"remote_id,omitempty"`  // and remote-id
+	Subnet     string            `json:"subnet"`               // e.g. 10.10.200.0/24
+	Start      string            `json:"start"`
+	Range      int               `json:"range"` // number of addresses from start
+	Router     string            `json:"router"`
+	DNS        []string          `json:"dns"`
+	DomainName string            `json:"domain_name,omitempty"`
+	LeaseTime  int               `json:"lease_time"`        // seconds
+	Options    map[string]string `json:"options,omitempty"` // see parseOptions
+	Boot       *BootConfig       `json:"boot,omitempty"`    // network boot loader, if any
+}
+
+// LoadConfig reads the configuration file at path.
+func LoadConfig(path string) (Config, error) {
+	var c Config
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// SinglePoolConfig returns the configuration of a server with one pool, as
+// given on the command line.
+func SinglePoolConfig(start, router, netmask, dns string, max, leaseSec int, domainName, leaseFile, reservationsFile string) Config {
+	subnet := ""
+	si, sm := net.ParseIP(start).To4(), net.ParseIP(netmask).To4()
+	if si != nil && sm != nil {
+		subnet = (&net.IPNet{IP: si.Mask(net.IPMask(sm)), Mask: net.IPMask(sm)}).String()
+	}
+	return Config{
+		LeaseFile:        leaseFile,
+		ReservationsFile: reservationsFile,
+		Pools: []PoolConfig{{
+			Name:       "default",
+			Subnet:     subnet,
+			Start:      start,
+			Range:      max,
+			Router:     router,
+			DNS:        []string{dns},
+			DomainName: domainName,
+			LeaseTime:  leaseSec,
+		}},
+	}
+}
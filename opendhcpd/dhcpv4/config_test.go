@@ -0,0 +1,133 @@
+package dhcpv4
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func validPool(name, subnet, start string) PoolConfig {
+	_, ipn, _ := net.ParseCIDR(subnet)
+	return PoolConfig{
+		Name:      name,
+		Subnet:    subnet,
+		Start:     start,
+		Range:     10,
+		Router:    dhcp.IPAdd(ipn.IP, 1).String(),
+		DNS:       []string{"10.0.0.53"},
+		LeaseTime: 3600,
+	}
+}
+
+func TestNewPools(t *testing.T) {
+	pools, err := newPools([]PoolConfig{
+		validPool("office", "10.0.0.0/24", "10.0.0.100"),
+		validPool("lab", "10.0.1.0/24", "10.0.1.100"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pools) != 2 || pools[0].name != "office" || pools[1].subnet.String() != "10.0.1.0/24" || pools[1].leaseRange != 10 {
+		t.Fatalf("got pools %+v", pools)
+	}
+}
+
+func TestNewPoolsRejectsBadConfig(t *testing.T) {
+	for name, change := range map[string]func(*PoolConfig){
+		"bad start":         func(pc *PoolConfig) { pc.Start = "10.0.0" },
+		"IPv6 start":        func(pc *PoolConfig) { pc.Start = "2001:db8::100" },
+		"bad subnet":        func(pc *PoolConfig) { pc.Subnet = "10.0.0.0/33" },
+		"IPv6 subnet":       func(pc *PoolConfig) { pc.Subnet = "2001:db8::/64" },
+		"bad router":        func(pc *PoolConfig) { pc.Router = "gateway" },
+		"bad DNS":           func(pc *PoolConfig) { pc.DNS = []string{"10.0.0.53", "dns"} },
+		"no lease time":     func(pc *PoolConfig) { pc.LeaseTime = 0 },
+		"empty range":       func(pc *PoolConfig) { pc.Range = 0 },
+		"start outside":     func(pc *PoolConfig) { pc.Start = "10.0.1.100" },
+		"range past subnet": func(pc *PoolConfig) { pc.Range = 200 },
+		"bad domain name":   func(pc *PoolConfig) { pc.DomainName = "..." },
+		"bad option":        func(pc *PoolConfig) { pc.Options = map[string]string{"mtu": "big"} },
+		"unknown option":    func(pc *PoolConfig) { pc.Options = map[string]string{"no_such_option": "1"} },
+	} {
+		pc := validPool("office", "10.0.0.0/24", "10.0.0.100")
+		change(&pc)
+		if _, err := newPools([]PoolConfig{pc}); err == nil {
+			t.Errorf("%s: accepted %+v", name, pc)
+		} else if !strings.Contains(err.Error(), `pool "office"`) {
+			t.Errorf("%s: error %q does not name the pool", name, err)
+		}
+	}
+}
+
+func TestNewPoolsRejectsOverlappingSubnets(t *testing.T) {
+	if _, err := newPools(nil); err == nil {
+		t.Error("accepted a configuration without pools")
+	}
+	for _, pcs := range [][]PoolConfig{
+		{validPool("a", "10.0.0.0/24", "10.0.0.100"), validPool("b", "10.0.0.0/24", "10.0.0.150")},
+		{validPool("a", "10.0.0.0/24", "10.0.0.100"), validPool("b", "10.0.0.0/16", "10.0.1.100")},
+		{validPool("a", "10.0.0.0/16", "10.0.1.100"), validPool("b", "10.0.0.0/24", "10.0.0.100")},
+		{validPool("a", "10.0.0.0/24", "10.0.0.100"), validPool("b", "10.0.1.0/24", "10.0.1.100"), validPool("c", "10.0.1.128/25", "10.0.1.200")},
+	} {
+		_, err := newPools(pcs)
+		if err == nil || !strings.Contains(err.Error(), errOverlappingPools) {
+			t.Errorf("%d pools: got %v, want an overlap error", len(pcs), err)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "opendhcpd.json")
+	if err := ioutil.WriteFile(path, []byte(`{
+		"lease_file": "/var/lib/opendhcpd/dhcpd.leases",
+		"pools": [{"name": "office", "subnet": "10.0.0.0/24", "start": "10.0.0.100", "range": 10,
+			"router": "10.0.0.1", "dns": ["10.0.0.53"], "lease_time": 3600, "options": {"mtu": "9000"}}]
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Pools) != 1 || c.Pools[0].Options["mtu"] != "9000" || c.LeaseFile != "/var/lib/opendhcpd/dhcpd.leases" {
+		t.Fatalf("loaded %+v", c)
+	}
+	if _, err := newPools(c.Pools); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string]string{
+		"truncated":   `{"pools": [{"name": "office"`,
+		"wrong types": `{"pools": [{"name": "office", "range": "10"}]}`,
+	} {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(p); err == nil {
+			t.Errorf("loaded the %s configuration", name)
+		}
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("loaded a missing configuration file")
+	}
+}
+
+func TestSinglePoolConfig(t *testing.T) {
+	c := SinglePoolConfig("10.0.0.100", "10.0.0.1", "255.255.255.0", "10.0.0.53", 50, 3600, "office", "leases", "")
+	pools, err := newPools(c.Pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pools[0].subnet.String() != "10.0.0.0/24" || pools[0].leaseRange != 50 {
+		t.Fatalf("got pool %+v", pools[0])
+	}
+	c = SinglePoolConfig("10.0.0.100", "10.0.0.1", "not a mask", "10.0.0.53", 50, 3600, "office", "leases", "")
+	if _, err := newPools(c.Pools); err == nil {
+		t.Error("accepted a bad netmask")
+	}
+}
@@ -0,0 +1,104 @@
+package dhcpv4
+
+import (
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Prober checks whether an address is already in use before it is offered,
+// such as by a device configured with a static address inside the range.
+type Prober interface {
+	Probe(ip net.IP) (inUse bool, err error)
+}
+
+// ICMPProber probes an address with an ICMP echo request and takes any reply
+// within the timeout as a sign that it is in use. It needs a raw socket and
+// so the privileges the server runs with anyway.
+type ICMPProber struct {
+	Timeout time.Duration
+	id      int
+	seq     uint32
+}
+
+// NewICMPProber returns an ICMPProber that waits timeout for a reply.
+func NewICMPProber(timeout time.Duration) *ICMPProber {
+	return &ICMPProber{Timeout: timeout, id: rand.Intn(1 << 16)}
+}
+
+// Probe sends an echo request to ip and waits for the reply.
+func (p *ICMPProber) Probe(ip net.IP) (bool, error) {
+	c, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	seq := int(atomic.AddUint32(&p.seq, 1) & 0xffff)
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: p.id, Seq: seq, Data: []byte("opendhcpd")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+	if _, err := c.WriteTo(b, &net.IPAddr{IP: ip}); err != nil {
+		return false, err
+	}
+
+	if err := c.SetReadDeadline(time.Now().Add(p.Timeout)); err != nil {
+		return false, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := c.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return false, nil
+			}
+			return false, err
+		}
+		if pa, ok := peer.(*net.IPAddr); !ok || !pa.IP.Equal(ip) {
+			continue
+		}
+		m, err := icmp.ParseMessage(1, buf[:n]) // protocol 1 is ICMP for IPv4
+		if err != nil || m.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := m.Body.(*icmp.Echo); ok && echo.ID == p.id && echo.Seq == seq {
+			return true, nil
+		}
+	}
+}
+
+// inUse probes ip, if a prober is set. An address that cannot be probed is
+// taken to be free so that a broken prober does not stop the server.
+func (h *Handler) inUse(ip net.IP) bool {
+	if h.prober == nil {
+		return false
+	}
+	used, err := h.prober.Probe(ip)
+	if err != nil {
+		h.logger.Warn().Msgf("%s %s: %s", errProbeFailed, ip, err)
+		return false
+	}
+	if used {
+		h.logger.Warn().Msgf("address %s is already in use, quarantining it for %s", ip, h.declineTime)
+	}
+	return used
+}
+
+// quarantine keeps lease table slot i of pool p from being handed out until
+// the decline cool-down has passed.
+func (h *Handler) quarantine(p *pool, i int) {
+	h.unregister(p.addr(i), p.leases[i])
+	p.leases[i] = lease{declined: true, expiry: time.Now().Add(h.declineTime)}
+	if err := h.db.Release(p.addr(i)); err != nil {
+		h.logger.Error().Msgf("%s: %s", errLeaseDBWrite, err)
+	}
+}
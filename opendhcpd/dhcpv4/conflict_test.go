@@ -0,0 +1,281 @@
+package dhcpv4
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"golang.org/x/net/ipv4"
+)
+
+// fakeProber reports the addresses in used as in use and records every probe.
+type fakeProber struct {
+	mu     sync.Mutex
+	used   map[string]bool
+	err    error
+	probed []string
+}
+
+func (p *fakeProber) Probe(ip net.IP) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.probed = append(p.probed, ip.String())
+	return p.used[ip.String()], p.err
+}
+
+func discover(t *testing.T, h *Handler, mac string) net.IP {
+	t.Helper()
+	offer := serve(h, dhcp.RequestPacket(dhcp.Discover, mustMAC(t, mac), nil, []byte{1, 2, 3, 4}, false, nil), "")
+	if offer == nil {
+		return nil
+	}
+	return append(net.IP(nil), offer.YIAddr()...)
+}
+
+// offer discovers like a client retransmitting its DISCOVER until a probe has
+// found an address to offer it, or there is no probe left waiting for one.
+func offer(t *testing.T, h *Handler, mac string) net.IP {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if ip := discover(t, h, mac); ip != nil {
+			return ip
+		}
+		h.mu.Lock()
+		waiting := h.probeFor[mustMAC(t, mac).String()]
+		h.mu.Unlock()
+		if !waiting {
+			return discover(t, h, mac)
+		}
+	}
+	t.Fatalf("no offer for %s", mac)
+	return nil
+}
+
+func request(t *testing.T, h *Handler, mac string, ip net.IP) dhcp.MessageType {
+	t.Helper()
+	return messageType(t, serve(h, dhcp.RequestPacket(dhcp.Request, mustMAC(t, mac), nil, []byte{1, 2, 3, 4}, false,
+		[]dhcp.Option{{Code: dhcp.OptionRequestedIPAddress, Value: ip.To4()}}), ""))
+}
+
+func TestConflictingAddressIsNotOffered(t *testing.T) {
+	pc := testPool("small", "10.0.0.0/24", "10.0.0.100")
+	pc.Range = 3
+	h := newTestHandler(t, pc)
+	fp := &fakeProber{used: map[string]bool{"10.0.0.100": true, "10.0.0.101": true}}
+	h.prober = fp
+
+	ip := offer(t, h, "02:00:00:00:00:01")
+	if !ip.Equal(net.IP{10, 0, 0, 102}) {
+		t.Fatalf("offered %s, want the only free address 10.0.0.102", ip)
+	}
+	if got := request(t, h, "02:00:00:00:00:01", ip); got != dhcp.ACK {
+		t.Fatalf("got %s, want ACK", got)
+	}
+	// the rest of the range is in use, so there is nothing left to offer
+	for _, mac := range []string{"02:00:00:00:00:02", "02:00:00:00:00:03"} {
+		if ip := offer(t, h, mac); ip != nil {
+			t.Fatalf("offered %s to %s from an exhausted range", ip, mac)
+		}
+	}
+	// the conflicts are quarantined, not probed again on every discover
+	probes := map[string]int{}
+	fp.mu.Lock()
+	for _, ip := range fp.probed {
+		probes[ip]++
+	}
+	fp.mu.Unlock()
+	if probes["10.0.0.100"] != 1 || probes["10.0.0.101"] != 1 {
+		t.Fatalf("probes %v, want each conflicting address probed once", probes)
+	}
+	if got := request(t, h, "02:00:00:00:00:02", net.IP{10, 0, 0, 100}); got != dhcp.NAK {
+		t.Fatalf("request for a quarantined address got %s, want NAK", got)
+	}
+}
+
+func TestProbeErrorDoesNotBlockOffers(t *testing.T) {
+	h := newTestHandler(t, testPool("p", "10.0.0.0/24", "10.0.0.100"))
+	h.prober = &fakeProber{err: errors.New("operation not permitted")}
+	if ip := offer(t, h, "02:00:00:00:00:01"); ip == nil {
+		t.Fatal("no offer when the prober fails")
+	}
+}
+
+func TestDeclineQuarantinesAddress(t *testing.T) {
+	pc := testPool("small", "10.0.0.0/24", "10.0.0.100")
+	pc.Range = 2
+	h := newTestHandler(t, pc)
+	h.declineTime = time.Hour
+
+	ip := discover(t, h, "02:00:00:00:00:01")
+	if got := request(t, h, "02:00:00:00:00:01", ip); got != dhcp.ACK {
+		t.Fatalf("got %s, want ACK", got)
+	}
+	// another client cannot get an address quarantined by someone else's decline
+	serve(h, dhcp.RequestPacket(dhcp.Decline, mustMAC(t, "02:00:00:00:00:09"), nil, []byte{1, 2, 3, 4}, false,
+		[]dhcp.Option{{Code: dhcp.OptionRequestedIPAddress, Value: ip.To4()}}), "")
+	if got := request(t, h, "02:00:00:00:00:01", ip); got != dhcp.ACK {
+		t.Fatalf("decline by a client not holding the lease took effect: got %s", got)
+	}
+
+	serve(h, dhcp.RequestPacket(dhcp.Decline, mustMAC(t, "02:00:00:00:00:01"), nil, []byte{1, 2, 3, 4}, false,
+		[]dhcp.Option{{Code: dhcp.OptionRequestedIPAddress, Value: ip.To4()}}), "")
+	for _, mac := range []string{"02:00:00:00:00:01", "02:00:00:00:00:02"} {
+		if got := discover(t, h, mac); got.Equal(ip) {
+			t.Fatalf("declined address %s offered to %s", ip, mac)
+		}
+	}
+	if got := request(t, h, "02:00:00:00:00:02", ip); got != dhcp.NAK {
+		t.Fatalf("request for a declined address got %s, want NAK", got)
+	}
+
+	// once the cool-down has passed the address is handed out again
+	p := h.pools[0]
+	l := p.leases[p.slot(ip)]
+	l.expiry = time.Now().Add(-time.Second)
+	p.leases[p.slot(ip)] = l
+	if got := request(t, h, "02:00:00:00:00:02", ip); got != dhcp.ACK {
+		t.Fatalf("request after the cool-down got %s, want ACK", got)
+	}
+}
+
+func TestMalformedDeclineIsIgnored(t *testing.T) {
+	h := newTestHandler(t, testPool("p", "10.0.0.0/24", "10.0.0.100"))
+	ip := discover(t, h, "02:00:00:00:00:01")
+	request(t, h, "02:00:00:00:00:01", ip)
+	for _, v := range [][]byte{{10, 0, 0}, {10, 0, 0, 100, 1}} {
+		serve(h, dhcp.RequestPacket(dhcp.Decline, mustMAC(t, "02:00:00:00:00:01"), nil, []byte{1, 2, 3, 4}, false,
+			[]dhcp.Option{{Code: dhcp.OptionRequestedIPAddress, Value: v}}), "")
+	}
+	if got := request(t, h, "02:00:00:00:00:01", ip); got != dhcp.ACK {
+		t.Fatalf("lease lost after a malformed decline: got %s", got)
+	}
+}
+
+// blockingProber holds the first probe until release is closed.
+type blockingProber struct {
+	mu      sync.Mutex
+	probed  bool
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingProber() *blockingProber {
+	return &blockingProber{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (p *blockingProber) Probe(ip net.IP) (bool, error) {
+	p.mu.Lock()
+	first := !p.probed
+	p.probed = true
+	p.mu.Unlock()
+	if first {
+		close(p.started)
+		<-p.release
+	}
+	return false, nil
+}
+
+// discoverAsync sends a DISCOVER from mac as the server would, with the offers
+// sent once a probe has finished going to the returned channel.
+func discoverAsync(t *testing.T, h *Handler, mac string) <-chan net.IP {
+	t.Helper()
+	offers := make(chan net.IP, 1)
+	send := func(res dhcp.Packet) { offers <- append(net.IP(nil), res.YIAddr()...) }
+	req := dhcp.RequestPacket(dhcp.Discover, mustMAC(t, mac), nil, []byte{1, 2, 3, 4}, false, nil)
+	if res := h.serveDHCP(req, dhcp.Discover, req.ParseOptions(), "", send); res != nil {
+		send(res)
+	}
+	return offers
+}
+
+func TestConcurrentDiscoversGetDifferentAddresses(t *testing.T) {
+	pc := testPool("small", "10.0.0.0/24", "10.0.0.100")
+	pc.Range = 2
+	h := newTestHandler(t, pc)
+	bp := newBlockingProber()
+	h.prober = bp
+
+	first := discoverAsync(t, h, "02:00:00:00:00:01")
+	<-bp.started
+	second := <-discoverAsync(t, h, "02:00:00:00:00:02")
+	close(bp.release)
+	if ip := <-first; ip == nil || second == nil || ip.Equal(second) {
+		t.Fatalf("offered %s and %s", ip, second)
+	}
+}
+
+func TestReloadDuringProbe(t *testing.T) {
+	h := newTestHandler(t, testPool("p", "10.0.0.0/24", "10.0.0.100"))
+	bp := newBlockingProber()
+	h.prober = bp
+
+	offers := discoverAsync(t, h, "02:00:00:00:00:01")
+	<-bp.started
+	if err := h.Reload(Config{Pools: []PoolConfig{testPool("p", "10.0.0.0/24", "10.0.0.200")}}); err != nil {
+		t.Fatal(err)
+	}
+	close(bp.release)
+	if ip := offer(t, h, "02:00:00:00:00:01"); ip == nil || ip[3] < 200 {
+		t.Fatalf("offered %s after the reload, want an address from the new range", ip)
+	}
+	select {
+	case ip := <-offers:
+		t.Fatalf("offered %s from a pool replaced while it was probed", ip)
+	default:
+	}
+}
+
+// TestRequestAnsweredDuringProbe checks that a probe does not hold up the
+// socket: another client is answered while it runs, and the probed client
+// gets its offer once the probe is done.
+func TestRequestAnsweredDuringProbe(t *testing.T) {
+	h := newTestHandler(t, testPool("p", "10.0.0.0/24", "10.0.0.100"))
+	bp := newBlockingProber()
+	h.prober = bp
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := ipv4.NewPacketConn(l)
+	defer conn.Close()
+	go h.serve(conn)
+
+	client := func(mac string) (net.Conn, net.HardwareAddr) {
+		c, err := net.Dial("udp4", l.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c, mustMAC(t, mac)
+	}
+	recv := func(c net.Conn) dhcp.Packet {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		b := make([]byte, 1500)
+		n, err := c.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dhcp.Packet(b[:n])
+	}
+
+	c1, mac1 := client("02:00:00:00:00:01")
+	c1.Write(dhcp.RequestPacket(dhcp.Discover, mac1, nil, []byte{1, 2, 3, 4}, false, nil))
+	<-bp.started
+
+	c2, mac2 := client("02:00:00:00:00:02")
+	c2.Write(dhcp.RequestPacket(dhcp.Request, mac2, nil, []byte{5, 6, 7, 8}, false,
+		[]dhcp.Option{{Code: dhcp.OptionRequestedIPAddress, Value: []byte{10, 0, 0, 109}}}))
+	if got := messageType(t, recv(c2)); got != dhcp.ACK {
+		t.Fatalf("request during a probe got %s, want ACK", got)
+	}
+
+	close(bp.release)
+	res := recv(c1)
+	if got := messageType(t, res); got != dhcp.Offer || res.YIAddr().Equal(net.IP{10, 0, 0, 109}) {
+		t.Fatalf("got %s of %s after the probe", got, res.YIAddr())
+	}
+}
@@ -1,12 +1,46 @@
 package dhcpv4
 
+import "time"
+
 const (
 	internalLeaseTableSize       = 1024
+	leaseDBCompactInterval       = time.Hour
+	dhcpServerPort               = 67
+	dhcpClientPort               = 68
+	defaultDiscoverInterval      = time.Minute
+	defaultReportInterval        = time.Hour
+	webhookTimeout               = 10 * time.Second
+	defaultDeclineTime           = 10 * time.Minute
+	maxProbeAttempts             = 4
+	defaultProbeTimeout          = 500 * time.Millisecond
+	probedHoldTime               = time.Minute
+	dnsUpdateQueueSize           = 256
+	dnsExpiryInterval            = time.Minute
 	errFailParseStartIP          = "failed to parse start IP address"
 	errFailParseDefaultGatewayIP = "failed to parse default gateway IP address"
 	errFailParseDNSIP            = "failed to parse DNS IP address"
-	errFailParseNetmaskIP        = "failed to parse netmask IP address"
+	errFailParseSubnet           = "failed to parse subnet"
+	errRangeOutsideSubnet        = "lease range must be > 0 addresses and lie within the subnet"
+	errNoPools                   = "no pools are configured"
+	errOverlappingPools          = "subnet overlaps that of pool"
 	errNegativeLeaseSec          = "lease duration must be > 0 seconds. ideally, keep it above 7200 seconds"
 	errInvalidDomainName         = "invalid domain name was provided. ideally, use non-unicode (for now) domain names"
 	errInitialisationFailed      = "could not initialise DHCPv4 handler"
+	errLeaseDBOpen               = "failed to open lease database"
+	errLeaseDBWrite              = "failed to write lease database"
+	errLeaseDBCompact            = "failed to compact lease database"
+	errLoadReservations          = "failed to load reservations"
+	errInvalidReservation        = "invalid reservation for"
+	errInvalidOption             = "invalid option"
+	errSaveReservations          = "failed to save reservations"
+	errReservationOutsidePools   = "is outside every pool"
+	errProbeFailed               = "failed to probe address"
+	errUnknownProber             = "unknown conflict prober"
+	errDDNSConfig                = "invalid dynamic DNS configuration"
+	errDNSUpdate                 = "failed to update DNS"
+	errInterfaceAddress          = "failed to find the address of the pool's interface"
+	errBindUnsupported           = "binding to an interface is not supported on this platform"
+	errInvalidBoot               = "invalid boot configuration"
+	errInvalidKnownServer        = "failed to parse known server address"
+	errWebhook                   = "failed to call webhook"
 )
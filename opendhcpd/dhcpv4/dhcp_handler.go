@@ -3,79 +3,174 @@ package dhcpv4
 import (
 	"errors"
 	"net"
-	"strings"
+	"sync"
 	"time"
-	"unicode"
 
+	"github.com/ishworgurung/opendhcpd/ddns"
 	"github.com/ishworgurung/opendhcpd/helper"
-	dhcp "github.com/krolaw/dhcp4"
+	"github.com/ishworgurung/opendhcpd/leasedb"
 	"github.com/rs/zerolog"
+	"golang.org/x/net/ipv4"
 )
 
 type Handler struct {
-	ip            net.IP         // Server IP to use
-	options       dhcp.Options   // Options to send to DHCP Clients
-	start         net.IP         // Start of IP range to distribute
-	leaseRange    int            // Number of IPs to distribute (starting from start)
-	leaseDuration time.Duration  // Lease period
-	leases        map[int]lease  // Map to keep track of leases
-	logger        zerolog.Logger // The logger
-	dhcpContex    dhcpCtx
+	mu               sync.Mutex         // Guards the pools' leases and the reservations
+	ip               net.IP             // Server IP to use where no pool or interface tells otherwise
+	pools            []*pool            // Pools to hand out leases from
+	db               *leasedb.DB        // Persistent copy of the leases
+	reservations     *reservations      // Addresses reserved for particular clients
+	reservationsFile string             // Where reservations changed at runtime are saved
+	prober           Prober             // Checks addresses are unused before offering them
+	probing          map[string]bool    // Addresses being probed, not offered to anyone else
+	probed           map[string]probed  // Address found free for each client, held for its offer
+	probeFor         map[string]bool    // Clients whose offer waits for a probe
+	declineTime      time.Duration      // How long an address found in use is held back
+	ddns             *ddns.Updater      // Registers clients in DNS, if set
+	dnsUpdates       chan dnsUpdate     // DNS updates waiting to be sent
+	conns            []*ipv4.PacketConn // Sockets opened by Listen
+	closed           bool               // Set by Close
+	stopc            chan struct{}      // Closed by Close to stop the background loops
+	logger           zerolog.Logger     // The logger
+	dhcpContex       dhcpCtx
 }
 
-func New(start, router, netmask, dns string, max, leaseSec int, domainName string, log zerolog.Logger) (*Handler, error) {
-	var l, si, r, sm, d net.IP
-	var err error
-
-	if l, err = helper.Localip(); err != nil {
+func New(cfg Config, log zerolog.Logger) (*Handler, error) {
+	pools, err := newPools(cfg.Pools)
+	if err != nil {
 		log.Error().Msg(err.Error())
 		return nil, err
 	}
-	l = l.To4()
-
-	if si = net.ParseIP(start).To4(); si == nil {
-		log.Error().Msg(errFailParseStartIP)
-		return nil, errors.New(errFailParseStartIP)
-	}
-	if r = net.ParseIP(router).To4(); r == nil {
-		log.Error().Msg(errFailParseDefaultGatewayIP)
-		return nil, errors.New(errFailParseDefaultGatewayIP)
+	l, err := serverIPs(pools, nil, log)
+	if err != nil {
+		return nil, err
 	}
-	if d = net.ParseIP(dns).To4(); d == nil {
-		log.Error().Msg(errFailParseDNSIP)
-		return nil, errors.New(errFailParseDNSIP)
+	rs, err := loadReservations(cfg.ReservationsFile)
+	if err != nil {
+		log.Error().Msgf("%s from %s: %s", errLoadReservations, cfg.ReservationsFile, err)
+		return nil, errors.New(errLoadReservations)
 	}
-	if sm = net.ParseIP(netmask).To4(); sm == nil {
-		log.Error().Msg(errFailParseNetmaskIP)
-		return nil, errors.New(errFailParseNetmaskIP)
+	var prober Prober
+	switch cfg.Probe {
+	case "":
+	case "icmp":
+		timeout := defaultProbeTimeout
+		if cfg.ProbeTimeout > 0 {
+			timeout = time.Duration(cfg.ProbeTimeout) * time.Millisecond
+		}
+		prober = NewICMPProber(timeout)
+	default:
+		log.Error().Msgf("%s %q", errUnknownProber, cfg.Probe)
+		return nil, errors.New(errUnknownProber)
 	}
-	if leaseSec <= 0 {
-		log.Error().Msg(errNegativeLeaseSec)
-		return nil, errors.New(errNegativeLeaseSec)
+	var updater *ddns.Updater
+	if cfg.DDNS != nil {
+		if updater, err = ddns.New(*cfg.DDNS); err != nil {
+			log.Error().Msgf("%s: %s", errDDNSConfig, err)
+			return nil, errors.New(errDDNSConfig)
+		}
 	}
-	ld := time.Duration(leaseSec) * time.Second
-	ml := int(max)
-	dn := strings.TrimFunc(domainName, func(r rune) bool {
-		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
-	})
-	if len(dn) == 0 {
-		log.Error().Msg(errInvalidDomainName)
-		return nil, errors.New(errInvalidDomainName)
+	db, err := leasedb.Open(cfg.LeaseFile)
+	if err != nil {
+		log.Error().Msgf("%s %s: %s", errLeaseDBOpen, cfg.LeaseFile, err)
+		return nil, errors.New(errLeaseDBOpen)
 	}
 	dd := &dhcpCtx{
-		bindIP:        l,
-		routerIP:      r,
-		dnsIP:         d,
-		subnetMask:    sm,
-		startIP:       si,
-		numLeaseMax:   ml,
-		leaseDuration: ld,
-		domainName:    dn,
+		bindIP:           l,
+		pools:            pools,
+		leaseDB:          db,
+		reservations:     rs,
+		reservationsFile: cfg.ReservationsFile,
+		prober:           prober,
+		declineTime:      time.Duration(cfg.DeclineTime) * time.Second,
+		ddns:             updater,
 	}
 	dh, err := newDHCPv4Handler(dd, log)
 	if err != nil {
+		db.Close()
 		log.Error().Msgf("could not initialise DHCP dhcpv4 %s", err)
 		return nil, errors.New(errInitialisationFailed)
 	}
 	return dh, nil
 }
+
+// serverIPs sets the server identifier of each pool configured for an
+// interface to the interface's address. It returns the server's default
+// address l, looked up if it is nil and pools without an interface need it.
+func serverIPs(pools []*pool, l net.IP, log zerolog.Logger) (net.IP, error) {
+	var err error
+	for _, p := range pools {
+		if p.iface == "" {
+			if l == nil {
+				if l, err = helper.Localip(); err != nil {
+					log.Error().Msg(err.Error())
+					return nil, err
+				}
+				l = l.To4()
+			}
+			continue
+		}
+		if p.serverIP, err = helper.InterfaceIPv4(p.iface, p.subnet); err != nil {
+			log.Error().Msgf("pool %q: %s: %s", p.name, errInterfaceAddress, err)
+			return nil, errors.New(errInterfaceAddress)
+		}
+	}
+	return l, nil
+}
+
+// Reload replaces the pools and reservations with those of cfg. Leases on
+// addresses that still belong to a pool are kept; the others are forgotten,
+// and refused when the client renews. The interfaces served on and the other
+// settings only change on a restart.
+func (h *Handler) Reload(cfg Config) error {
+	pools, err := newPools(cfg.Pools)
+	if err != nil {
+		h.logger.Error().Msg(err.Error())
+		return err
+	}
+	l, err := serverIPs(pools, h.ip, h.logger)
+	if err != nil {
+		return err
+	}
+	rs, err := loadReservations(cfg.ReservationsFile)
+	if err != nil {
+		h.logger.Error().Msgf("%s from %s: %s", errLoadReservations, cfg.ReservationsFile, err)
+		return errors.New(errLoadReservations)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	old := h.pools
+	h.pools, h.reservations, h.reservationsFile, h.ip = pools, rs, cfg.ReservationsFile, l
+	kept, dropped := 0, 0
+	for _, op := range old {
+		for i, v := range op.leases {
+			ip := op.addr(i)
+			p := h.poolContaining(ip)
+			if p == nil || !p.inRange(p.slot(ip)) && !h.reservedTo(p, v.nic, ip) {
+				h.unregister(ip, v)
+				dropped++
+				continue
+			}
+			p.leases[p.slot(ip)] = v
+			kept++
+		}
+	}
+	h.logger.Info().Msgf("reloaded %d pools and %d reservations, keeping %d leases and dropping %d", len(pools), len(rs.byMAC), kept, dropped)
+	return nil
+}
+
+// Close stops serving, then writes the lease database out compacted and
+// closes it.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed {
+		close(h.stopc)
+	}
+	h.closed = true
+	h.closeConns()
+	if err := h.db.Compact(); err != nil {
+		h.logger.Error().Msgf("%s: %s", errLeaseDBCompact, err)
+	}
+	return h.db.Close()
+}
@@ -5,55 +5,132 @@ import (
 	"net"
 	"time"
 
+	"github.com/ishworgurung/opendhcpd/ddns"
+	"github.com/ishworgurung/opendhcpd/leasedb"
 	dhcp "github.com/krolaw/dhcp4"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 type lease struct {
-	nic    string    // Client's CHAddr
-	expiry time.Time // When the lease expires
+	nic      string    // Client's CHAddr
+	hostname string    // Client's or reservation's host name, if any
+	expiry   time.Time // When the lease expires
+	declined bool      // Address found in use; held back until expiry
+	dnsName  string    // Name the lease is registered under in DNS, if any
 }
 
 // dhcpCtx holds the internal DHCP context
 type dhcpCtx struct {
-	bindIP        net.IP
-	routerIP      net.IP
-	dnsIP         net.IP
-	subnetMask    net.IP
-	startIP       net.IP
-	numLeaseMax   int
-	leaseDuration time.Duration
-	domainName    string
+	bindIP           net.IP
+	pools            []*pool
+	leaseDB          *leasedb.DB
+	reservations     *reservations
+	reservationsFile string
+	prober           Prober
+	declineTime      time.Duration
+	ddns             *ddns.Updater
 }
 
 // New creates a new DHCPv4 server object
 func newDHCPv4Handler(dhcpIo *dhcpCtx, zlogger zerolog.Logger) (*Handler, error) {
 	dhandler := &Handler{
-		ip:            []byte(dhcpIo.bindIP),
-		start:         dhcpIo.startIP,
-		leaseDuration: dhcpIo.leaseDuration,
-		leaseRange:    dhcpIo.numLeaseMax,
-		leases:        make(map[int]lease, internalLeaseTableSize),
-		options: dhcp.Options{
-			dhcp.OptionSubnetMask:       []byte(dhcpIo.subnetMask),
-			dhcp.OptionRouter:           []byte(dhcpIo.routerIP),
-			dhcp.OptionDomainNameServer: []byte(dhcpIo.dnsIP),
-			dhcp.OptionDomainName:       []byte(dhcpIo.domainName),
-		},
-		logger: zlogger,
+		ip:               []byte(dhcpIo.bindIP),
+		pools:            dhcpIo.pools,
+		logger:           zlogger,
+		db:               dhcpIo.leaseDB,
+		reservations:     dhcpIo.reservations,
+		reservationsFile: dhcpIo.reservationsFile,
+		prober:           dhcpIo.prober,
+		probing:          make(map[string]bool),
+		probed:           make(map[string]probed),
+		probeFor:         make(map[string]bool),
+		declineTime:      dhcpIo.declineTime,
+		ddns:             dhcpIo.ddns,
+		stopc:            make(chan struct{}),
+	}
+	if dhandler.declineTime <= 0 {
+		dhandler.declineTime = defaultDeclineTime
+	}
+	dhandler.restoreLeases()
+	if dhandler.ddns != nil {
+		dhandler.dnsUpdates = make(chan dnsUpdate, dnsUpdateQueueSize)
+		go dhandler.updateDNS()
+		go dhandler.expireDNS()
 	}
 	return dhandler, nil
 }
 
-// Start starts serving DHCPv4 replies to DHCPv4 clients.
-func (h *Handler) Start() error {
-	h.logger.Info().Msgf("dhcpv4 server started listening on %s:67", h.ip)
-	return dhcp.ListenAndServe(h)
+// restoreLeases fills the lease tables from the lease database. Leases that
+// belong to no pool's range and are not reserved are left to expire in the
+// database.
+func (h *Handler) restoreLeases() {
+	n := 0
+	for _, l := range h.db.Leases() {
+		p := h.poolContaining(l.IP)
+		if p == nil {
+			h.logger.Warn().Msgf("ignoring stored lease %s for %s outside every pool", l.IP, l.HWAddr)
+			continue
+		}
+		leaseNum := p.slot(l.IP)
+		if !h.reservedTo(p, l.HWAddr, l.IP) && !p.inRange(leaseNum) { // a reserved address may lie outside the range
+			h.logger.Warn().Msgf("ignoring stored lease %s for %s outside the lease range", l.IP, l.HWAddr)
+			continue
+		}
+		restored := lease{nic: l.HWAddr, hostname: l.Hostname, expiry: l.Expiry}
+		if h.ddns != nil {
+			// registered before the restart, so removed when the lease ends
+			restored.dnsName = h.ddns.Name(l.Hostname)
+		}
+		p.leases[leaseNum] = restored
+		n++
+	}
+	h.logger.Info().Msgf("restored %d leases", n)
 }
 
-// ServeDHCP serves the response to DHCPv4 clients based on the type of request they ask.
-func (h *Handler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (d dhcp.Packet) {
+// compactLeases periodically rewrites the lease database without released and
+// expired leases until the handler is closed.
+func (h *Handler) compactLeases() {
+	t := time.NewTicker(leaseDBCompactInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.stopc:
+			return
+		case <-t.C:
+		}
+		if h.db.Stale() == 0 {
+			continue
+		}
+		if err := h.db.Compact(); err != nil {
+			h.logger.Error().Msgf("%s: %s", errLeaseDBCompact, err)
+		}
+	}
+}
+
+// ServeDHCP serves the response to DHCPv4 clients based on the type of request
+// they ask, without knowing the interface the request was received on.
+func (h *Handler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) dhcp.Packet {
+	return h.serveDHCP(p, msgType, options, "", nil)
+}
+
+// serveDHCP serves a request received on interface ifname from the pool that
+// covers the client. A DISCOVER whose offer waits for an address to be probed
+// is answered later through send, or if send is nil on its retransmission.
+func (h *Handler) serveDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options, ifname string, send func(dhcp.Packet)) (d dhcp.Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var ri relayInfo
+	if relayed(p) {
+		ri = parseRelayInfo(options[dhcp.OptionRelayAgentInformation])
+		h.logger.Info().Msgf("%s from %s relayed by %s (circuit-id %q, remote-id %q)",
+			msgType, p.CHAddr(), p.GIAddr(), ri.circuitID, ri.remoteID)
+	}
+	pl := h.poolFor(ifname, p.GIAddr(), ri)
+	if pl == nil {
+		h.logger.Debug().Msgf("no pool for %s from %s on %q via %s", msgType, p.CHAddr(), ifname, p.GIAddr())
+		return nil
+	}
 	reqIP := net.IP(options[dhcp.OptionRequestedIPAddress])
 	if reqIP == nil {
 		reqIP = net.IP(p.CIAddr())
@@ -61,23 +138,17 @@ func (h *Handler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhc
 	switch msgType {
 
 	case dhcp.Discover:
-		free, nic := -1, p.CHAddr().String()
-		for i, v := range h.leases { // Find previous lease
-			if v.nic == nic {
-				free = i
-				goto reply
-			}
-		}
-		if free = h.freeLease(); free == -1 {
+		ip := h.offerFor(pl, p.CHAddr().String(), h.reoffer(p, ifname, send))
+		if ip == nil {
 			return
 		}
-	reply:
-		h.logger.Info().Msgf("Sent lease to %s", reqIP)
-		return dhcp.ReplyPacket(p, dhcp.Offer, h.ip, dhcp.IPAdd(h.start, free), h.leaseDuration,
-			h.options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+		h.logger.Info().Msgf("Sent lease to %s from pool %s", ip, pl.name)
+		res := reply(p, options, dhcp.Offer, h.serverIP(pl, ifname), ip, pl.leaseDuration, h.replyOptions(pl, p.CHAddr().String(), options))
+		pl.boot.setFields(res, options)
+		return res
 
 	case dhcp.Request:
-		if server, ok := options[dhcp.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.ip) {
+		if server, ok := options[dhcp.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.serverIP(pl, ifname)) {
 			return nil // Message not for this dhcp server
 		}
 
@@ -85,24 +156,46 @@ func (h *Handler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhc
 			reqIP = net.IP(p.CIAddr())
 		}
 		if len(reqIP) == 4 && !reqIP.Equal(net.IPv4zero) {
-			if leaseNum := dhcp.IPRange(h.start, reqIP) - 1; leaseNum >= 0 && leaseNum < h.leaseRange {
-				if l, exists := h.leases[leaseNum]; !exists || l.nic == p.CHAddr().String() {
-					h.leases[leaseNum] = lease{nic: p.CHAddr().String(), expiry: time.Now().Add(h.leaseDuration)}
-					h.logger.Info().Msgf("Sent ACK to %s", reqIP)
-					return dhcp.ReplyPacket(p, dhcp.ACK, h.ip, reqIP, h.leaseDuration,
-						h.options.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+			nic := p.CHAddr().String()
+			if leaseNum, ok := h.leaseFor(pl, reqIP, nic); ok {
+				h.dropOtherLeases(pl, nic, leaseNum)
+				hostname := string(options[dhcp.OptionHostName])
+				if res := h.reservation(pl, nic); res != nil && res.Hostname != "" {
+					hostname = res.Hostname
 				}
+				l := lease{nic: nic, hostname: hostname, expiry: time.Now().Add(pl.leaseDuration)}
+				h.register(reqIP, pl.leases[leaseNum], &l)
+				pl.leases[leaseNum] = l
+				h.persistLease(reqIP, l)
+				h.logger.Info().Msgf("Sent ACK to %s", reqIP)
+				res := reply(p, options, dhcp.ACK, h.serverIP(pl, ifname), reqIP, pl.leaseDuration, h.replyOptions(pl, nic, options))
+				pl.boot.setFields(res, options)
+				return res
 			}
 			h.logger.Info().Msgf("Received DHCP request for invalid IP address %s", reqIP)
 		}
 		h.logger.Info().Msgf("Sent NAK to %s", reqIP)
-		return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0, nil)
+		return reply(p, options, dhcp.NAK, h.serverIP(pl, ifname), nil, 0, nil)
 
-	case dhcp.Release, dhcp.Decline:
+	case dhcp.Decline:
 		nic := p.CHAddr().String()
-		for i, v := range h.leases {
+		if reqIP = reqIP.To4(); len(reqIP) != 4 {
+			h.logger.Info().Msgf("ignoring decline by %s without a valid address", nic)
+			return nil
+		}
+		leaseNum := pl.slot(reqIP)
+		if l, ok := pl.leases[leaseNum]; ok && l.nic == nic {
+			h.quarantine(pl, leaseNum)
+			h.logger.Warn().Msgf("%s declined %s as in use, quarantining it for %s", nic, reqIP, h.declineTime)
+			return nil
+		}
+		h.logger.Info().Msgf("ignoring decline of %s by %s, which does not hold it", reqIP, nic)
+
+	case dhcp.Release:
+		nic := p.CHAddr().String()
+		for i, v := range pl.leases {
 			if v.nic == nic {
-				delete(h.leases, i)
+				h.dropLease(pl, i)
 				log.Printf("Deleted the lease %s", reqIP)
 				break
 			}
@@ -111,12 +204,226 @@ func (h *Handler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhc
 	return nil
 }
 
-func (h *Handler) freeLease() int {
+// persistLease writes a granted lease to the lease database. A failed write is
+// logged rather than refused: the client still gets its lease, which is only
+// at risk if the server restarts before it is renewed.
+func (h *Handler) persistLease(ip net.IP, l lease) {
+	err := h.db.Put(leasedb.Lease{IP: ip, HWAddr: l.nic, Hostname: l.hostname, Expiry: l.expiry})
+	if err != nil {
+		h.logger.Error().Msgf("%s: %s", errLeaseDBWrite, err)
+	}
+}
+
+// reservation returns the reservation of client nic if it is for an address
+// in pool p.
+func (h *Handler) reservation(p *pool, nic string) *reservation {
+	if res := h.reservations.forMAC(nic); res != nil && p.subnet.Contains(res.ip) {
+		return res
+	}
+	return nil
+}
+
+// reservedTo reports whether ip in pool p is reserved for client nic.
+func (h *Handler) reservedTo(p *pool, nic string, ip net.IP) bool {
+	res := h.reservation(p, nic)
+	return res != nil && res.ip.Equal(ip)
+}
+
+// offerFor picks the address in pool p to offer client nic: its reservation,
+// else the address of its previous lease, else a free one. With a prober set,
+// a free address is only offered once a probe has found it unused: the probe
+// runs in the background so the server keeps answering other clients, and
+// found is called once it has succeeded. offerFor returns nil when the range
+// is exhausted or the offer waits for a probe.
+func (h *Handler) offerFor(p *pool, nic string, found func()) net.IP {
+	if res := h.reservation(p, nic); res != nil {
+		return res.ip
+	}
+	for i, v := range p.leases { // Find previous lease
+		if ip := p.addr(i); v.nic == nic && !v.declined && !h.reservations.reservedForOther(ip, nic) {
+			return ip
+		}
+	}
+	if h.prober == nil {
+		if free := h.freeLease(p); free != -1 {
+			return p.addr(free)
+		}
+		return nil
+	}
+	if ip := h.probedFor(p, nic); ip != nil {
+		return ip
+	}
+	if !h.probeFor[nic] && h.freeLease(p) != -1 {
+		h.probeFor[nic] = true
+		go h.probeFree(p, nic, found)
+	}
+	return nil
+}
+
+// probed is an address a probe found unused, held for the client it was
+// probed for.
+type probed struct {
+	ip   net.IP
+	time time.Time
+}
+
+// probedFor returns the address of pool p held for client nic, if it is still
+// free.
+func (h *Handler) probedFor(p *pool, nic string) net.IP {
+	pr, ok := h.probed[nic]
+	if !ok {
+		return nil
+	}
+	if time.Since(pr.time) > probedHoldTime || !p.subnet.Contains(pr.ip) {
+		delete(h.probed, nic)
+		return nil
+	}
+	i := p.slot(pr.ip)
+	if l, ok := p.leases[i]; !p.inRange(i) || ok && !l.expiry.Before(time.Now()) || h.reservations.reservedForOther(pr.ip, nic) {
+		delete(h.probed, nic)
+		return nil
+	}
+	return pr.ip
+}
+
+// probeFree probes free addresses of pool p for client nic, quarantining those
+// found in use, and holds the first unused one for the client. found is then
+// called, unless it is nil or the handler has been closed.
+func (h *Handler) probeFree(p *pool, nic string, found func()) {
+	h.mu.Lock()
+	ip := h.findUnused(p)
+	delete(h.probeFor, nic)
+	if ip != nil {
+		h.probed[nic] = probed{ip: ip, time: time.Now()}
+	}
+	closed := h.closed
+	h.mu.Unlock()
+	if ip != nil && found != nil && !closed {
+		found()
+	}
+}
+
+// findUnused returns a free address of pool p that a probe found unused,
+// trying up to maxProbeAttempts of them. h.mu is released while an address is
+// probed. It returns nil if none is found, or when the pools were reloaded in
+// the meantime.
+func (h *Handler) findUnused(p *pool) net.IP {
+	for attempt := 0; attempt < maxProbeAttempts; attempt++ {
+		free := h.freeLease(p)
+		if free == -1 {
+			return nil
+		}
+		ip := p.addr(free)
+		h.probing[ip.String()] = true
+		h.mu.Unlock()
+		used := h.inUse(ip)
+		h.mu.Lock()
+		delete(h.probing, ip.String())
+		if !h.hasPool(p) {
+			return nil
+		}
+		if l, ok := p.leases[free]; ok && !l.expiry.Before(time.Now()) {
+			continue // taken by a request while it was probed
+		}
+		if !used {
+			return ip
+		}
+		h.quarantine(p, free)
+	}
+	return nil
+}
+
+// reoffer returns the function that answers DISCOVER p, received on interface
+// ifname, through send once a probe has found an address to offer. It returns
+// nil if send is nil.
+func (h *Handler) reoffer(p dhcp.Packet, ifname string, send func(dhcp.Packet)) func() {
+	if send == nil {
+		return nil
+	}
+	p = append(dhcp.Packet(nil), p...) // the caller reuses its buffer
+	return func() {
+		if res := h.serveDHCP(p, dhcp.Discover, p.ParseOptions(), ifname, nil); res != nil {
+			send(res)
+		}
+	}
+}
+
+// leaseFor returns the lease table slot of ip in pool p and whether client nic
+// may take it. A client with a reservation may only take its reserved address,
+// which it takes over from any other holder; no other client may take a
+// reserved address.
+func (h *Handler) leaseFor(p *pool, ip net.IP, nic string) (int, bool) {
+	leaseNum := p.slot(ip)
+	if res := h.reservation(p, nic); res != nil {
+		return leaseNum, ip.Equal(res.ip)
+	}
+	if !p.inRange(leaseNum) || h.reservations.reservedForOther(ip, nic) {
+		return leaseNum, false
+	}
+	l, exists := p.leases[leaseNum]
+	if l.declined {
+		return leaseNum, !l.expiry.After(time.Now())
+	}
+	return leaseNum, !exists || l.nic == nic
+}
+
+// dropOtherLeases releases any lease client nic holds in pool p besides the
+// one in slot keep, such as a dynamic lease held before it was given a
+// reservation.
+func (h *Handler) dropOtherLeases(p *pool, nic string, keep int) {
+	for i, v := range p.leases {
+		if v.nic == nic && i != keep {
+			h.dropLease(p, i)
+		}
+	}
+}
+
+// dropLease ends the lease in slot i of pool p.
+func (h *Handler) dropLease(p *pool, i int) {
+	h.unregister(p.addr(i), p.leases[i])
+	delete(p.leases, i)
+	if err := h.db.Release(p.addr(i)); err != nil {
+		h.logger.Error().Msgf("%s: %s", errLeaseDBWrite, err)
+	}
+}
+
+// replyOptions returns the options requested by client nic, with those of its
+// reservation taking precedence over the pool's and its boot options.
+func (h *Handler) replyOptions(p *pool, nic string, options dhcp.Options) []dhcp.Option {
+	opts := p.options
+	res := h.reservation(p, nic)
+	if p.boot != nil || res != nil && len(res.options) > 0 {
+		opts = make(dhcp.Options, len(p.options)+2)
+		for code, v := range p.options {
+			opts[code] = v
+		}
+		if p.boot != nil {
+			p.boot.addOptions(opts, options)
+		}
+		if res != nil {
+			for code, v := range res.options {
+				opts[code] = v
+			}
+		}
+	}
+	return opts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList])
+}
+
+func (h *Handler) freeLease(p *pool) int {
 	now := time.Now()
-	b := rand.Intn(h.leaseRange) // Try random first
-	for _, v := range [][]int{{b, h.leaseRange}, {0, b}} {
+	held := make(map[string]bool, len(h.probed))
+	for _, pr := range h.probed {
+		if now.Sub(pr.time) <= probedHoldTime {
+			held[pr.ip.String()] = true
+		}
+	}
+	b := rand.Intn(p.leaseRange) // Try random first
+	for _, v := range [][]int{{b, p.leaseRange}, {0, b}} {
 		for i := v[0]; i < v[1]; i++ {
-			if l, ok := h.leases[i]; !ok || l.expiry.Before(now) {
+			if ip := p.addr(i).String(); h.reservations.reservedForOther(p.addr(i), "") || h.probing[ip] || held[ip] {
+				continue
+			}
+			if l, ok := p.leases[i]; !ok || l.expiry.Before(now) {
 				return i
 			}
 		}
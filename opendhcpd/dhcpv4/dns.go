@@ -0,0 +1,114 @@
+package dhcpv4
+
+import (
+	"net"
+	"time"
+)
+
+// dnsUpdate is a registration or removal of a client's DNS records waiting
+// to be sent.
+type dnsUpdate struct {
+	add    bool
+	name   string
+	ip     net.IP
+	hwaddr net.HardwareAddr // identifies the client to the name server
+}
+
+// register queues the registration in DNS of lease l on ip under the client's
+// host name, recording the name in l. old is the lease l replaces: if it is
+// registered under the same name nothing is sent, and a registration under
+// another name is removed.
+func (h *Handler) register(ip net.IP, old lease, l *lease) {
+	if h.ddns == nil {
+		return
+	}
+	l.dnsName = h.ddns.Name(l.hostname)
+	if l.dnsName == old.dnsName {
+		return
+	}
+	h.unregister(ip, old)
+	if l.dnsName != "" {
+		h.queueDNS(dnsUpdate{add: true, name: l.dnsName, ip: ip, hwaddr: clientHWAddr(*l)})
+	}
+}
+
+// unregister queues the removal from DNS of lease l on ip, if it is
+// registered.
+func (h *Handler) unregister(ip net.IP, l lease) {
+	if h.ddns == nil || l.dnsName == "" {
+		return
+	}
+	h.queueDNS(dnsUpdate{name: l.dnsName, ip: ip, hwaddr: clientHWAddr(l)})
+}
+
+// clientHWAddr returns the hardware address of the client holding l.
+func clientHWAddr(l lease) net.HardwareAddr {
+	hw, _ := net.ParseMAC(l.nic) // set from the client's chaddr
+	return hw
+}
+
+// queueDNS hands u to updateDNS. Updates are dropped rather than hold up
+// replies when the name server falls behind.
+func (h *Handler) queueDNS(u dnsUpdate) {
+	select {
+	case h.dnsUpdates <- u:
+	default:
+		h.logger.Error().Msgf("%s %s: too many updates pending", errDNSUpdate, u.name)
+	}
+}
+
+// updateDNS sends the queued updates in order until the handler is closed.
+func (h *Handler) updateDNS() {
+	for {
+		var u dnsUpdate
+		select {
+		case <-h.stopc:
+			return
+		case u = <-h.dnsUpdates:
+		}
+		var err error
+		if u.add {
+			err = h.ddns.Add(u.name, u.ip, u.hwaddr)
+		} else {
+			err = h.ddns.Remove(u.name, u.ip, u.hwaddr)
+		}
+		if err != nil {
+			h.logger.Error().Msgf("%s: %s", errDNSUpdate, err)
+			continue
+		}
+		if u.add {
+			h.logger.Info().Msgf("registered %s as %s in DNS", u.ip, u.name)
+		} else {
+			h.logger.Info().Msgf("removed %s as %s from DNS", u.ip, u.name)
+		}
+	}
+}
+
+// expireDNS periodically removes the DNS records of leases that have run out
+// without being released, until the handler is closed.
+func (h *Handler) expireDNS() {
+	t := time.NewTicker(dnsExpiryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.stopc:
+			return
+		case <-t.C:
+		}
+		h.unregisterExpired(time.Now())
+	}
+}
+
+func (h *Handler) unregisterExpired(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, p := range h.pools {
+		for i, l := range p.leases {
+			if l.dnsName != "" && !l.expiry.After(now) {
+				h.unregister(p.addr(i), l)
+				l.dnsName = ""
+				p.leases[i] = l
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package dhcpv4
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ishworgurung/opendhcpd/ddns"
+	"github.com/ishworgurung/opendhcpd/ddns/ddnstest"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/miekg/dns"
+)
+
+// waitFor polls the records of name and type t until they are want.
+func waitFor(t *testing.T, srv *ddnstest.Server, name string, rt uint16, want ...string) {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got = srv.Lookup(name, rt); reflect.DeepEqual(got, want) || len(got) == 0 && len(want) == 0 {
+			return
+		}
+	}
+	t.Fatalf("%s %s records are %v, want %v", name, dns.TypeToString[rt], got, want)
+}
+
+func requestWithHostname(t *testing.T, h *Handler, mac string, ip net.IP, hostname string) dhcp.MessageType {
+	t.Helper()
+	return messageType(t, serve(h, dhcp.RequestPacket(dhcp.Request, mustMAC(t, mac), nil, []byte{1, 2, 3, 4}, false, []dhcp.Option{
+		{Code: dhcp.OptionRequestedIPAddress, Value: ip.To4()},
+		{Code: dhcp.OptionHostName, Value: []byte(hostname)},
+	}), ""))
+}
+
+func TestLeasesAreRegisteredInDNS(t *testing.T) {
+	srv, err := ddnstest.NewServer("dhcp-key", "c2VjcmV0IGtleSBmb3IgdGVzdGluZyBvbmx5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	u, err := ddns.New(ddns.Config{
+		Server:      srv.Addr,
+		Zone:        "office.local",
+		ReverseZone: "0.0.10.in-addr.arpa",
+		TSIGName:    "dhcp-key",
+		TSIGSecret:  "c2VjcmV0IGtleSBmb3IgdGVzdGluZyBvbmx5",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, testPool("office", "10.0.0.0/24", "10.0.0.100"))
+	h.ddns = u
+	h.dnsUpdates = make(chan dnsUpdate, dnsUpdateQueueSize)
+	go h.updateDNS()
+
+	ip := discover(t, h, "02:00:00:00:00:01")
+	if got := requestWithHostname(t, h, "02:00:00:00:00:01", ip, "Laptop"); got != dhcp.ACK {
+		t.Fatalf("got %s, want ACK", got)
+	}
+	rev, _ := dns.ReverseAddr(ip.String())
+	waitFor(t, srv, "laptop.office.local.", dns.TypeA, ip.String())
+	waitFor(t, srv, rev, dns.TypePTR, "laptop.office.local.")
+
+	// a renewal under the same name sends nothing
+	updates := srv.Updates()
+	requestWithHostname(t, h, "02:00:00:00:00:01", ip, "Laptop")
+	serve(h, dhcp.RequestPacket(dhcp.Release, mustMAC(t, "02:00:00:00:00:01"), ip, []byte{1, 2, 3, 4}, false, nil), "")
+	waitFor(t, srv, "laptop.office.local.", dns.TypeA)
+	waitFor(t, srv, rev, dns.TypePTR)
+	waitFor(t, srv, "laptop.office.local.", dns.TypeDHCID)
+	waitFor(t, srv, rev, dns.TypeDHCID)
+	if got := srv.Updates() - updates; got != 4 {
+		t.Fatalf("renewal and release sent %d updates, want only the removals of the 2 records and their DHCIDs", got)
+	}
+
+	// a lease that runs out is removed too
+	ip = discover(t, h, "02:00:00:00:00:02")
+	requestWithHostname(t, h, "02:00:00:00:00:02", ip, "printer")
+	waitFor(t, srv, "printer.office.local.", dns.TypeA, ip.String())
+	h.unregisterExpired(time.Now().Add(2 * time.Hour))
+	waitFor(t, srv, "printer.office.local.", dns.TypeA)
+}
+
+func TestCloseStopsDNSLoops(t *testing.T) {
+	h := newTestHandler(t, testPool("office", "10.0.0.0/24", "10.0.0.100"))
+	h.dnsUpdates = make(chan dnsUpdate, dnsUpdateQueueSize)
+	done := make(chan struct{}, 2)
+	go func() {
+		h.updateDNS()
+		done <- struct{}{}
+	}()
+	go func() {
+		h.expireDNS()
+		done <- struct{}{}
+	}()
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("DNS loops still running after Close")
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package dhcpv4
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ishworgurung/opendhcpd/leasedb"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/rs/zerolog"
+)
+
+var testServerIP = net.IP{10, 0, 0, 1}
+
+// newTestHandler returns a handler serving the given pools, with its lease
+// database in a temporary directory.
+func newTestHandler(t *testing.T, pcs ...PoolConfig) *Handler {
+	t.Helper()
+	pools, err := newPools(pcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := leasedb.Open(filepath.Join(t.TempDir(), "dhcpd.leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	h, err := newDHCPv4Handler(&dhcpCtx{
+		bindIP:       testServerIP,
+		pools:        pools,
+		leaseDB:      db,
+		reservations: newReservations(),
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testPool(name, subnet, start string) PoolConfig {
+	_, ipn, _ := net.ParseCIDR(subnet)
+	return PoolConfig{
+		Name:      name,
+		Subnet:    subnet,
+		Start:     start,
+		Range:     10,
+		Router:    dhcp.IPAdd(ipn.IP, 1).String(),
+		DNS:       []string{"10.0.0.53"},
+		LeaseTime: 3600,
+	}
+}
+
+func mustMAC(t *testing.T, s string) net.HardwareAddr {
+	t.Helper()
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mac
+}
+
+// serve passes req to the handler as if it arrived on interface ifname.
+func serve(h *Handler, req dhcp.Packet, ifname string) dhcp.Packet {
+	options := req.ParseOptions()
+	return h.serveDHCP(req, dhcp.MessageType(options[dhcp.OptionDHCPMessageType][0]), options, ifname, nil)
+}
+
+func messageType(t *testing.T, p dhcp.Packet) dhcp.MessageType {
+	t.Helper()
+	if p == nil {
+		t.Fatal("no reply")
+	}
+	mt := p.ParseOptions()[dhcp.OptionDHCPMessageType]
+	if len(mt) != 1 {
+		t.Fatal("reply without a message type")
+	}
+	return dhcp.MessageType(mt[0])
+}
+
+func TestServerIdentifierPerPool(t *testing.T) {
+	office := testPool("office", "10.0.0.0/24", "10.0.0.100")
+	office.Interface = "eth1"
+	lab := testPool("lab", "10.20.0.0/24", "10.20.0.100")
+	lab.Interface = "eth2"
+	h := newTestHandler(t, office, lab)
+	h.pools[0].serverIP = net.IP{10, 0, 0, 2}
+	h.pools[1].serverIP = net.IP{10, 20, 0, 2}
+	if got := h.bindInterfaces(); len(got) != 2 || got[0] != "eth1" || got[1] != "eth2" {
+		t.Fatalf("bind interfaces %v", got)
+	}
+
+	mac := mustMAC(t, "02:00:00:00:00:01")
+	offer := serve(h, dhcp.RequestPacket(dhcp.Discover, mac, nil, []byte{1, 2, 3, 4}, false, nil), "eth2")
+	if sid := net.IP(offer.ParseOptions()[dhcp.OptionServerIdentifier]); !sid.Equal(net.IP{10, 20, 0, 2}) {
+		t.Fatalf("offer on eth2 identifies the server as %s", sid)
+	}
+	request := func(server net.IP) dhcp.Packet {
+		return serve(h, dhcp.RequestPacket(dhcp.Request, mac, nil, []byte{1, 2, 3, 4}, false, []dhcp.Option{
+			{Code: dhcp.OptionRequestedIPAddress, Value: offer.YIAddr()},
+			{Code: dhcp.OptionServerIdentifier, Value: server},
+		}), "eth2")
+	}
+	// a request naming the server by its address on the other interface is
+	// for another server as far as the client's link is concerned
+	if res := request(net.IP{10, 0, 0, 2}); res != nil {
+		t.Fatalf("request for the server's eth1 address on eth2 got %s", messageType(t, res))
+	}
+	if got := messageType(t, request(net.IP{10, 20, 0, 2})); got != dhcp.ACK {
+		t.Fatalf("got %s, want ACK", got)
+	}
+}
+
+func TestReloadKeepsLeases(t *testing.T) {
+	h := newTestHandler(t, testPool("office", "10.0.0.0/24", "10.0.0.100"))
+	ip1 := discover(t, h, "02:00:00:00:00:01")
+	request(t, h, "02:00:00:00:00:01", ip1)
+	ip2 := discover(t, h, "02:00:00:00:00:02")
+	request(t, h, "02:00:00:00:00:02", ip2)
+
+	// changing a pool's options keeps every lease
+	office := testPool("office", "10.0.0.0/24", "10.0.0.100")
+	office.DNS = []string{"10.0.0.54"}
+	cfg := Config{Pools: []PoolConfig{office}}
+	if err := h.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for mac, ip := range map[string]net.IP{"02:00:00:00:00:01": ip1, "02:00:00:00:00:02": ip2} {
+		if got := discover(t, h, mac); !got.Equal(ip) {
+			t.Fatalf("%s offered %s after reload, want its lease %s", mac, got, ip)
+		}
+	}
+
+	// moving the range keeps only the lease on an address now reserved
+	path := filepath.Join(t.TempDir(), "reservations.json")
+	if err := ioutil.WriteFile(path, []byte(`[{"mac": "02:00:00:00:00:01", "ip": "`+ip1.String()+`"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg = Config{ReservationsFile: path, Pools: []PoolConfig{testPool("office", "10.0.0.0/24", "10.0.0.200")}}
+	if err := h.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := request(t, h, "02:00:00:00:00:01", ip1); got != dhcp.ACK {
+		t.Fatalf("renewing the reserved lease got %s, want ACK", got)
+	}
+	if got := request(t, h, "02:00:00:00:00:02", ip2); got != dhcp.NAK {
+		t.Fatalf("renewing a lease outside the new range got %s, want NAK", got)
+	}
+
+	// a configuration that does not load leaves everything as it was
+	if err := h.Reload(Config{ReservationsFile: filepath.Join(t.TempDir(), "missing.json"), Pools: cfg.Pools}); err == nil {
+		t.Fatal("reloaded with a missing reservations file")
+	}
+	if got := request(t, h, "02:00:00:00:00:01", ip1); got != dhcp.ACK {
+		t.Fatalf("after a failed reload got %s, want ACK", got)
+	}
+}
+
+func TestClosePersistsLeases(t *testing.T) {
+	h := newTestHandler(t, testPool("office", "10.0.0.0/24", "10.0.0.100"))
+	ip := discover(t, h, "02:00:00:00:00:01")
+	request(t, h, "02:00:00:00:00:01", ip)
+	request(t, h, "02:00:00:00:00:01", ip)
+	if h.db.Stale() == 0 {
+		t.Fatal("renewal left no stale record to compact")
+	}
+	compacting := make(chan struct{})
+	go func() {
+		h.compactLeases()
+		close(compacting)
+	}()
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-compacting:
+	case <-time.After(time.Second):
+		t.Fatal("compaction still running after Close")
+	}
+	if h.db.Stale() != 0 {
+		t.Fatalf("%d stale records left after Close", h.db.Stale())
+	}
+	if h.db.Put(leasedb.Lease{IP: ip}) == nil {
+		t.Fatal("lease database still open after Close")
+	}
+}
@@ -0,0 +1,29 @@
+package dhcpv4
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// listen opens a socket on port, bound to interface ifname if it is not
+// empty. Sockets bound to different interfaces share the port.
+func listen(ifname string, port int) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+				return
+			}
+			if ifname != "" {
+				err = syscall.BindToDevice(int(fd), ifname)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	return lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", port))
+}
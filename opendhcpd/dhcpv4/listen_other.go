@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package dhcpv4
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// listen opens a socket on port. Binding to an interface needs
+// SO_BINDTODEVICE, which only Linux has.
+func listen(ifname string, port int) (net.PacketConn, error) {
+	if ifname != "" {
+		return nil, errors.New(errBindUnsupported)
+	}
+	return net.ListenPacket("udp4", fmt.Sprintf(":%d", port))
+}
@@ -0,0 +1,220 @@
+package dhcpv4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/rs/zerolog"
+)
+
+// MonitorConfig configures a Monitor.
+type MonitorConfig struct {
+	Interface        string   // watch this interface only, if set
+	Known            []string // server identifiers that are expected, besides the host's own addresses
+	Webhook          string   // URL each sighting is POSTed to as JSON, if set
+	DiscoverInterval int      // seconds between test DISCOVERs
+	ReportInterval   int      // seconds before a server still seen is reported again
+}
+
+// Sighting is an OFFER or ACK seen from a DHCP server that is not known.
+type Sighting struct {
+	ServerID  string    `json:"server_id"`
+	Source    string    `json:"source"` // address the reply came from
+	Type      string    `json:"message_type"`
+	YourIP    string    `json:"your_ip"`
+	ClientMAC string    `json:"client_mac"`
+	Interface string    `json:"interface,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Monitor watches for replies from DHCP servers other than the known ones,
+// and draws them out with a DISCOVER now and then. Only broadcast replies
+// reach it: those to its own DISCOVERs, and those to clients that ask for
+// them or have no address yet.
+type Monitor struct {
+	ifname           string
+	mac              net.HardwareAddr // Client address the DISCOVERs are sent from
+	known            map[string]bool  // Expected server identifiers
+	webhook          string
+	discoverInterval time.Duration
+	reportInterval   time.Duration
+	client           *http.Client
+
+	mu       sync.Mutex
+	reported map[string]time.Time // When each unknown server was last reported
+	logger   zerolog.Logger
+}
+
+func NewMonitor(cfg MonitorConfig, log zerolog.Logger) (*Monitor, error) {
+	m := &Monitor{
+		ifname:           cfg.Interface,
+		known:            make(map[string]bool),
+		webhook:          cfg.Webhook,
+		discoverInterval: time.Duration(cfg.DiscoverInterval) * time.Second,
+		reportInterval:   time.Duration(cfg.ReportInterval) * time.Second,
+		client:           &http.Client{Timeout: webhookTimeout},
+		reported:         make(map[string]time.Time),
+		logger:           log,
+	}
+	if m.discoverInterval <= 0 {
+		m.discoverInterval = defaultDiscoverInterval
+	}
+	if m.reportInterval <= 0 {
+		m.reportInterval = defaultReportInterval
+	}
+	for _, s := range cfg.Known {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			log.Error().Msgf("%s %q", errInvalidKnownServer, s)
+			return nil, errors.New(errInvalidKnownServer)
+		}
+		m.known[ip.String()] = true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			m.known[ipn.IP.To4().String()] = true
+		}
+	}
+	if m.ifname != "" {
+		ifi, err := net.InterfaceByName(m.ifname)
+		if err != nil {
+			return nil, err
+		}
+		m.mac = ifi.HardwareAddr
+	}
+	if len(m.mac) != 6 {
+		// a random, locally administered unicast address
+		m.mac = make(net.HardwareAddr, 6)
+		if _, err := rand.Read(m.mac); err != nil {
+			return nil, err
+		}
+		m.mac[0] = m.mac[0]&^1 | 2
+	}
+	return m, nil
+}
+
+// Run listens on the DHCP client port and sends DISCOVERs until it fails.
+func (m *Monitor) Run() error {
+	conn, err := listen(m.ifname, dhcpClientPort)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	m.logger.Info().Msgf("monitoring for DHCP servers, sending DISCOVERs from %s every %s", m.mac, m.discoverInterval)
+	go m.discoverLoop(conn)
+
+	buffer := make([]byte, 1500)
+	for {
+		n, src, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		if s := m.check(dhcp.Packet(buffer[:n]), src, time.Now()); s != nil {
+			m.report(*s)
+		}
+	}
+}
+
+func (m *Monitor) discoverLoop(conn net.PacketConn) {
+	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpServerPort}
+	for {
+		if _, err := conn.WriteTo(m.discover(), dst); err != nil {
+			m.logger.Error().Msgf("failed to send DISCOVER: %s", err)
+		}
+		time.Sleep(m.discoverInterval)
+	}
+}
+
+// discover returns a DISCOVER that asks for the reply to be broadcast, so
+// that it reaches the monitor without an address.
+func (m *Monitor) discover() dhcp.Packet {
+	xid := make([]byte, 4)
+	rand.Read(xid)
+	return dhcp.RequestPacket(dhcp.Discover, m.mac, nil, xid, true, []dhcp.Option{
+		{Code: dhcp.OptionParameterRequestList, Value: []byte{
+			byte(dhcp.OptionSubnetMask), byte(dhcp.OptionRouter), byte(dhcp.OptionDomainNameServer), byte(dhcp.OptionServerIdentifier),
+		}},
+	})
+}
+
+// check returns a sighting of the server that sent p from src, if p is an
+// OFFER or ACK from a server that is not known and has not been reported in
+// the last report interval.
+func (m *Monitor) check(p dhcp.Packet, src net.Addr, now time.Time) *Sighting {
+	if len(p) < 240 || p.OpCode() != dhcp.BootReply {
+		return nil
+	}
+	options := p.ParseOptions()
+	t := options[dhcp.OptionDHCPMessageType]
+	if len(t) != 1 || dhcp.MessageType(t[0]) != dhcp.Offer && dhcp.MessageType(t[0]) != dhcp.ACK {
+		return nil
+	}
+	var source net.IP
+	if ua, ok := src.(*net.UDPAddr); ok {
+		source = ua.IP
+	}
+	serverID := net.IP(options[dhcp.OptionServerIdentifier]).To4()
+	if serverID == nil {
+		serverID = source.To4()
+	}
+	if serverID == nil || m.known[serverID.String()] {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last, ok := m.reported[serverID.String()]; ok && now.Sub(last) < m.reportInterval {
+		return nil
+	}
+	m.reported[serverID.String()] = now
+	return &Sighting{
+		ServerID:  serverID.String(),
+		Source:    source.String(),
+		Type:      dhcp.MessageType(t[0]).String(),
+		YourIP:    p.YIAddr().String(),
+		ClientMAC: p.CHAddr().String(),
+		Interface: m.ifname,
+		Time:      now,
+	}
+}
+
+// report logs a sighting and sends it to the webhook in the background.
+func (m *Monitor) report(s Sighting) {
+	m.logger.Warn().Msgf("unknown DHCP server %s (from %s) sent %s of %s to %s", s.ServerID, s.Source, s.Type, s.YourIP, s.ClientMAC)
+	if m.webhook == "" {
+		return
+	}
+	go func() {
+		if err := m.post(s); err != nil {
+			m.logger.Error().Msgf("%s %s: %s", errWebhook, m.webhook, err)
+		}
+	}()
+}
+
+func (m *Monitor) post(s Sighting) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	res, err := m.client.Post(m.webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package dhcpv4
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/rs/zerolog"
+)
+
+// offerFrom is an OFFER from the server at serverID to a client.
+func offerFrom(t *testing.T, serverID net.IP) dhcp.Packet {
+	t.Helper()
+	req := dhcp.RequestPacket(dhcp.Discover, mustMAC(t, "02:00:00:00:00:01"), nil, []byte{1, 2, 3, 4}, true, nil)
+	return dhcp.ReplyPacket(req, dhcp.Offer, serverID, net.IP{192, 168, 1, 50}, time.Hour, nil)
+}
+
+func TestMonitorReportsUnknownServers(t *testing.T) {
+	sightings := make(chan Sighting, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var s Sighting
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			t.Error(err)
+		}
+		sightings <- s
+	}))
+	defer hook.Close()
+	m, err := NewMonitor(MonitorConfig{Known: []string{"10.0.0.1"}, Webhook: hook.URL, ReportInterval: 3600}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &net.UDPAddr{IP: net.IP{192, 168, 1, 1}, Port: 67}
+	now := time.Now()
+
+	if s := m.check(offerFrom(t, net.IP{10, 0, 0, 1}), src, now); s != nil {
+		t.Fatalf("known server reported: %+v", s)
+	}
+	s := m.check(offerFrom(t, net.IP{192, 168, 1, 1}), src, now)
+	if s == nil {
+		t.Fatal("unknown server not reported")
+	}
+	if s.ServerID != "192.168.1.1" || s.Type != "Offer" || s.YourIP != "192.168.1.50" || s.ClientMAC != "02:00:00:00:00:01" {
+		t.Fatalf("sighting %+v", s)
+	}
+	m.report(*s)
+	select {
+	case got := <-sightings:
+		if got.ServerID != "192.168.1.1" || got.Source != "192.168.1.1" {
+			t.Fatalf("webhook got %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+
+	// the same server is reported again only after the report interval
+	if s := m.check(offerFrom(t, net.IP{192, 168, 1, 1}), src, now.Add(time.Minute)); s != nil {
+		t.Fatal("reported again within the report interval")
+	}
+	if s := m.check(offerFrom(t, net.IP{192, 168, 1, 1}), src, now.Add(2*time.Hour)); s == nil {
+		t.Fatal("not reported again after the report interval")
+	}
+}
+
+func TestMonitorIgnoresOtherMessages(t *testing.T) {
+	m, err := NewMonitor(MonitorConfig{}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &net.UDPAddr{IP: net.IP{192, 168, 1, 1}, Port: 67}
+	req := dhcp.RequestPacket(dhcp.Discover, mustMAC(t, "02:00:00:00:00:01"), nil, []byte{1, 2, 3, 4}, true, nil)
+	nak := dhcp.ReplyPacket(req, dhcp.NAK, net.IP{192, 168, 1, 1}, nil, 0, nil)
+	for _, p := range []dhcp.Packet{req, nak, {1, 2, 3}} {
+		if s := m.check(p, src, time.Now()); s != nil {
+			t.Fatalf("reported %+v", s)
+		}
+	}
+}
+
+func TestMonitorDiscover(t *testing.T) {
+	m, err := NewMonitor(MonitorConfig{}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := m.discover()
+	if mt := p.ParseOptions()[dhcp.OptionDHCPMessageType]; len(mt) != 1 || dhcp.MessageType(mt[0]) != dhcp.Discover {
+		t.Fatal("not a DISCOVER")
+	}
+	if !p.Broadcast() || p.CHAddr().String() != m.mac.String() {
+		t.Fatalf("broadcast %v from %s, want a broadcast from %s", p.Broadcast(), p.CHAddr(), m.mac)
+	}
+	if m.mac[0]&3 != 2 {
+		t.Fatalf("random client address %s is not locally administered unicast", m.mac)
+	}
+}
+
+func TestNewMonitorRejectsBadKnownServer(t *testing.T) {
+	if _, err := NewMonitor(MonitorConfig{Known: []string{"dhcp.example.com"}}, zerolog.Nop()); err == nil {
+		t.Fatal("accepted a known server that is not an address")
+	}
+}
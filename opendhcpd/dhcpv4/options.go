@@ -0,0 +1,120 @@
+package dhcpv4
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+type optionKind int
+
+const (
+	kindIP optionKind = iota
+	kindIPs
+	kindString
+	kindUint16
+	kindRoutes
+)
+
+// namedOptions are the options that can be set by name in the reservations
+// file. Any other option is set by its decimal code with a hex value.
+var namedOptions = map[string]struct {
+	code dhcp.OptionCode
+	kind optionKind
+}{
+	"subnet_mask":   {dhcp.OptionSubnetMask, kindIP},
+	"router":        {dhcp.OptionRouter, kindIPs},
+	"dns":           {dhcp.OptionDomainNameServer, kindIPs},
+	"domain_name":   {dhcp.OptionDomainName, kindString},
+	"mtu":           {dhcp.OptionInterfaceMTU, kindUint16},
+	"ntp":           {dhcp.OptionNetworkTimeProtocolServers, kindIPs},
+	"static_routes": {dhcp.OptionClasslessRouteFormat, kindRoutes},
+}
+
+// parseOptions encodes options given as name or code and a textual value,
+// such as "ntp": "10.0.0.1, 10.0.0.2", "mtu": "9000",
+// "static_routes": "10.1.0.0/16 10.0.0.1" or "150": "0a0000fe".
+func parseOptions(in map[string]string) (dhcp.Options, error) {
+	opts := make(dhcp.Options, len(in))
+	for name, value := range in {
+		code, b, err := parseOption(name, strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s %q: %s", errInvalidOption, name, err)
+		}
+		opts[code] = b
+	}
+	return opts, nil
+}
+
+func parseOption(name, value string) (dhcp.OptionCode, []byte, error) {
+	o, ok := namedOptions[name]
+	if !ok {
+		code, err := strconv.ParseUint(name, 10, 8)
+		if err != nil || code == 0 || code == 255 {
+			return 0, nil, fmt.Errorf("unknown option")
+		}
+		b, err := hex.DecodeString(value)
+		return dhcp.OptionCode(code), b, err
+	}
+
+	switch o.kind {
+	case kindIP:
+		ip := net.ParseIP(value).To4()
+		if ip == nil {
+			return 0, nil, fmt.Errorf("not an IPv4 address")
+		}
+		return o.code, []byte(ip), nil
+	case kindIPs:
+		var ips []net.IP
+		for _, s := range strings.Split(value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s)).To4()
+			if ip == nil {
+				return 0, nil, fmt.Errorf("not a list of IPv4 addresses")
+			}
+			ips = append(ips, ip)
+		}
+		return o.code, dhcp.JoinIPs(ips), nil
+	case kindUint16:
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return 0, nil, err
+		}
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(n))
+		return o.code, b, nil
+	case kindRoutes:
+		b, err := classlessRoutes(value)
+		return o.code, b, err
+	}
+	return o.code, []byte(value), nil
+}
+
+// classlessRoutes encodes a comma separated list of "destination/prefix
+// router" pairs as RFC 3442 classless static routes.
+func classlessRoutes(value string) ([]byte, error) {
+	var b []byte
+	for _, route := range strings.Split(value, ",") {
+		f := strings.Fields(route)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("route %q is not \"destination/prefix router\"", route)
+		}
+		_, dst, err := net.ParseCIDR(f[0])
+		if err != nil || dst.IP.To4() == nil {
+			return nil, fmt.Errorf("route %q has no IPv4 destination", route)
+		}
+		router := net.ParseIP(f[1]).To4()
+		if router == nil {
+			return nil, fmt.Errorf("route %q has no IPv4 router", route)
+		}
+		width, _ := dst.Mask.Size()
+		b = append(b, byte(width))
+		b = append(b, dst.IP.To4()[:(width+7)/8]...)
+		b = append(b, router...)
+	}
+	return b, nil
+}
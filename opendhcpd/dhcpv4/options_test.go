@@ -0,0 +1,64 @@
+package dhcpv4
+
+import (
+	"bytes"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func TestParseOption(t *testing.T) {
+	for _, tc := range []struct {
+		name, value string
+		code        dhcp.OptionCode
+		want        []byte
+	}{
+		{"mtu", "9000", dhcp.OptionInterfaceMTU, []byte{0x23, 0x28}},
+		{"mtu", "576", dhcp.OptionInterfaceMTU, []byte{0x02, 0x40}},
+		{"ntp", "10.0.0.1", dhcp.OptionNetworkTimeProtocolServers, []byte{10, 0, 0, 1}},
+		{"ntp", "10.0.0.1, 10.0.0.2", dhcp.OptionNetworkTimeProtocolServers, []byte{10, 0, 0, 1, 10, 0, 0, 2}},
+		// RFC 3442: prefix width, the significant octets of the destination, the router
+		{"static_routes", "10.1.0.0/16 10.0.0.1", dhcp.OptionClasslessRouteFormat,
+			[]byte{16, 10, 1, 10, 0, 0, 1}},
+		{"static_routes", "0.0.0.0/0 10.0.0.1, 192.168.128.0/17 10.0.0.2, 10.2.3.4/32 10.0.0.3", dhcp.OptionClasslessRouteFormat,
+			[]byte{0, 10, 0, 0, 1, 17, 192, 168, 128, 10, 0, 0, 2, 32, 10, 2, 3, 4, 10, 0, 0, 3}},
+		{"static_routes", "10.1.2.3/9 10.0.0.1", dhcp.OptionClasslessRouteFormat,
+			[]byte{9, 10, 0, 10, 0, 0, 1}},
+		{"subnet_mask", "255.255.255.0", dhcp.OptionSubnetMask, []byte{255, 255, 255, 0}},
+		{"domain_name", "office.example", dhcp.OptionDomainName, []byte("office.example")},
+		{"150", "0a0000fe", 150, []byte{10, 0, 0, 254}},
+	} {
+		code, b, err := parseOption(tc.name, tc.value)
+		if err != nil {
+			t.Errorf("%s %q: %s", tc.name, tc.value, err)
+			continue
+		}
+		if code != tc.code || !bytes.Equal(b, tc.want) {
+			t.Errorf("%s %q = option %d %v, want option %d %v", tc.name, tc.value, code, b, tc.code, tc.want)
+		}
+	}
+}
+
+func TestParseOptionErrors(t *testing.T) {
+	for _, tc := range []struct{ name, value string }{
+		{"mtu", "65536"},
+		{"mtu", "-1"},
+		{"mtu", "jumbo"},
+		{"ntp", "10.0.0.1, ntp.example"},
+		{"ntp", "2001:db8::1"},
+		{"static_routes", "10.1.0.0/16"},
+		{"static_routes", "10.1.0.0 10.0.0.1"},
+		{"static_routes", "2001:db8::/32 10.0.0.1"},
+		{"static_routes", "10.1.0.0/16 gateway"},
+		{"subnet_mask", "24"},
+		{"0", "00"},
+		{"255", "00"},
+		{"256", "00"},
+		{"no_such_option", "1"},
+		{"150", "not hex"},
+	} {
+		if _, b, err := parseOption(tc.name, tc.value); err == nil {
+			t.Errorf("%s %q = %v, want an error", tc.name, tc.value, b)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package dhcpv4
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ishworgurung/opendhcpd/helper"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+type pool struct {
+	name          string
+	iface         string        // Interface the pool is served on, if any
+	serverIP      net.IP        // Address of iface, announced as the server identifier
+	circuitID     string        // Relay agent circuit-id the pool is served to, if any
+	remoteID      string        // Relay agent remote-id the pool is served to, if any
+	subnet        *net.IPNet    // Subnet of the pool's clients
+	start         net.IP        // Start of IP range to distribute
+	leaseRange    int           // Number of IPs to distribute (starting from start)
+	leaseDuration time.Duration // Lease period
+	options       dhcp.Options  // Options to send to DHCP Clients
+	boot          *boot         // Where network booting clients fetch their loader, if set
+	leases        map[int]lease // Map to keep track of leases
+}
+
+func newPool(pc PoolConfig) (*pool, error) {
+	var si, r net.IP
+	var dns []net.IP
+
+	if si = net.ParseIP(pc.Start).To4(); si == nil {
+		return nil, poolError(pc, errFailParseStartIP)
+	}
+	_, subnet, err := net.ParseCIDR(pc.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return nil, poolError(pc, errFailParseSubnet)
+	}
+	if r = net.ParseIP(pc.Router).To4(); r == nil {
+		return nil, poolError(pc, errFailParseDefaultGatewayIP)
+	}
+	for _, s := range pc.DNS {
+		d := net.ParseIP(s).To4()
+		if d == nil {
+			return nil, poolError(pc, errFailParseDNSIP)
+		}
+		dns = append(dns, d)
+	}
+	if pc.LeaseTime <= 0 {
+		return nil, poolError(pc, errNegativeLeaseSec)
+	}
+	if pc.Range <= 0 || !subnet.Contains(si) || !subnet.Contains(dhcp.IPAdd(si, pc.Range-1)) {
+		return nil, poolError(pc, errRangeOutsideSubnet)
+	}
+
+	options := dhcp.Options{
+		dhcp.OptionSubnetMask: []byte(subnet.Mask),
+		dhcp.OptionRouter:     []byte(r),
+	}
+	if len(dns) > 0 {
+		options[dhcp.OptionDomainNameServer] = dhcp.JoinIPs(dns)
+	}
+	if pc.DomainName != "" {
+		dn := strings.TrimFunc(pc.DomainName, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		if len(dn) == 0 {
+			return nil, poolError(pc, errInvalidDomainName)
+		}
+		options[dhcp.OptionDomainName] = []byte(dn)
+	}
+	extra, err := parseOptions(pc.Options)
+	if err != nil {
+		return nil, poolError(pc, err.Error())
+	}
+	for code, v := range extra {
+		options[code] = v
+	}
+	var b *boot
+	if pc.Boot != nil {
+		if b, err = newBoot(pc.Boot); err != nil {
+			return nil, poolError(pc, err.Error())
+		}
+	}
+
+	return &pool{
+		name:          pc.Name,
+		iface:         pc.Interface,
+		circuitID:     pc.CircuitID,
+		remoteID:      pc.RemoteID,
+		subnet:        subnet,
+		start:         si,
+		leaseRange:    pc.Range,
+		leaseDuration: time.Duration(pc.LeaseTime) * time.Second,
+		options:       options,
+		boot:          b,
+		leases:        make(map[int]lease, internalLeaseTableSize),
+	}, nil
+}
+
+func poolError(pc PoolConfig, msg string) error {
+	return fmt.Errorf("pool %q: %s", pc.Name, msg)
+}
+
+// newPools builds the pools of a configuration, checking that no two of them
+// share a subnet.
+func newPools(pcs []PoolConfig) ([]*pool, error) {
+	if len(pcs) == 0 {
+		return nil, errors.New(errNoPools)
+	}
+	var pools []*pool
+	for _, pc := range pcs {
+		p, err := newPool(pc)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range pools {
+			if q.subnet.Contains(p.subnet.IP) || p.subnet.Contains(q.subnet.IP) {
+				return nil, fmt.Errorf("pool %q: %s %q", p.name, errOverlappingPools, q.name)
+			}
+		}
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+// inRange reports whether lease table slot i is part of the dynamic range.
+func (p *pool) inRange(i int) bool {
+	return i >= 0 && i < p.leaseRange
+}
+
+// slot returns the lease table slot of ip. Addresses outside the range, which
+// only reserved clients hold, have slots outside [0, leaseRange).
+func (p *pool) slot(ip net.IP) int {
+	return dhcp.IPRange(p.start, ip) - 1
+}
+
+// addr returns the address of lease table slot i.
+func (p *pool) addr(i int) net.IP {
+	return dhcp.IPAdd(p.start, i)
+}
+
+// poolFor selects the pool that serves a request received on interface
+// ifname, through the relay at giaddr if it is not 0.0.0.0. A relayed request
+// is served from the pool configured for its relay agent information, else
+// from the pool whose subnet holds giaddr. Otherwise the pool configured for
+// the interface is used, then one whose subnet holds an address of the
+// interface, and finally the only pool if there is just one.
+func (h *Handler) poolFor(ifname string, giaddr net.IP, ri relayInfo) *pool {
+	if giaddr != nil && !giaddr.Equal(net.IPv4zero) {
+		for _, p := range h.pools {
+			if p.matches(ri) {
+				return p
+			}
+		}
+		return h.poolContaining(giaddr)
+	}
+	if ifname != "" {
+		for _, p := range h.pools {
+			if p.iface == ifname {
+				return p
+			}
+		}
+		if ifi, err := net.InterfaceByName(ifname); err == nil {
+			addrs, _ := ifi.Addrs()
+			for _, a := range addrs {
+				if ipn, ok := a.(*net.IPNet); ok {
+					if p := h.poolContaining(ipn.IP); p != nil && p.iface == "" {
+						return p
+					}
+				}
+			}
+		}
+	}
+	if len(h.pools) == 1 && h.pools[0].iface == "" {
+		return h.pools[0]
+	}
+	return nil
+}
+
+// poolContaining returns the pool whose subnet holds ip, or nil.
+func (h *Handler) poolContaining(ip net.IP) *pool {
+	for _, p := range h.pools {
+		if p.subnet.Contains(ip) {
+			return p
+		}
+	}
+	return nil
+}
+
+// hasPool reports whether p is still one of the pools served, that is it has
+// not been replaced by a reload.
+func (h *Handler) hasPool(p *pool) bool {
+	for _, hp := range h.pools {
+		if hp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// serverIP returns the server identifier to announce to the clients of pool
+// p that are reached through interface ifname: the address of the pool's
+// interface, else the address of ifname, preferring one in the pool's subnet,
+// else the server's default address.
+func (h *Handler) serverIP(p *pool, ifname string) net.IP {
+	if p.serverIP != nil {
+		return p.serverIP
+	}
+	if ifname != "" {
+		if ip, err := helper.InterfaceIPv4(ifname, p.subnet); err == nil {
+			return ip
+		}
+	}
+	return h.ip
+}
+
+// bindInterfaces returns the interfaces to serve on when every pool is
+// configured for one, or nil to serve on all of them.
+func (h *Handler) bindInterfaces() []string {
+	var ifaces []string
+	seen := make(map[string]bool)
+	for _, p := range h.pools {
+		if p.iface == "" {
+			return nil
+		}
+		if !seen[p.iface] {
+			seen[p.iface] = true
+			ifaces = append(ifaces, p.iface)
+		}
+	}
+	return ifaces
+}
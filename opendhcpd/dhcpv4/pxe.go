@@ -0,0 +1,125 @@
+package dhcpv4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// BootConfig tells the clients of a pool that boot from the network where to
+// fetch their boot loader from.
+type BootConfig struct {
+	NextServer string     `json:"next_server"`    // TFTP server, by address or name
+	File       string     `json:"file,omitempty"` // boot file for clients no entry of Files matches
+	Files      []BootFile `json:"files,omitempty"`
+}
+
+// BootFile is the boot file for clients of some architectures or vendor
+// class. A client gets the file of the first entry it matches.
+type BootFile struct {
+	Arch        []int  `json:"arch,omitempty"`         // option 93 architecture types, e.g. 0 for BIOS, 7 and 9 for x64 UEFI
+	VendorClass string `json:"vendor_class,omitempty"` // prefix of the option 60 vendor class, e.g. "HTTPClient"
+	File        string `json:"file"`
+}
+
+type boot struct {
+	nextServer net.IP // siaddr, if the next server is given by address
+	serverName string // sent as option 66
+	file       string
+	files      []bootFile
+}
+
+type bootFile struct {
+	arch        []uint16
+	vendorClass string
+	file        string
+}
+
+// maxBootFileLen is the size of the file field, less its terminating NUL.
+const maxBootFileLen = 127
+
+func newBoot(bc *BootConfig) (*boot, error) {
+	if bc.NextServer == "" {
+		return nil, fmt.Errorf("%s: no next server", errInvalidBoot)
+	}
+	if len(bc.File) > maxBootFileLen {
+		return nil, fmt.Errorf("%s: file %q is too long", errInvalidBoot, bc.File)
+	}
+	b := &boot{
+		nextServer: net.ParseIP(bc.NextServer).To4(),
+		serverName: bc.NextServer,
+		file:       bc.File,
+	}
+	for _, f := range bc.Files {
+		if f.File == "" || len(f.File) > maxBootFileLen {
+			return nil, fmt.Errorf("%s: file %q is empty or too long", errInvalidBoot, f.File)
+		}
+		if len(f.Arch) == 0 && f.VendorClass == "" {
+			return nil, fmt.Errorf("%s: file %q is for no architecture or vendor class", errInvalidBoot, f.File)
+		}
+		bf := bootFile{vendorClass: f.VendorClass, file: f.File}
+		for _, a := range f.Arch {
+			if a < 0 || a > 0xffff {
+				return nil, fmt.Errorf("%s: architecture %d", errInvalidBoot, a)
+			}
+			bf.arch = append(bf.arch, uint16(a))
+		}
+		b.files = append(b.files, bf)
+	}
+	return b, nil
+}
+
+// fileFor picks the boot file for a client from the architectures and vendor
+// class in its request options.
+func (b *boot) fileFor(options dhcp.Options) string {
+	arch := options[dhcp.OptionClientArchitecture]
+	vendorClass := string(options[dhcp.OptionVendorClassIdentifier])
+	for _, f := range b.files {
+		if f.matches(arch, vendorClass) {
+			return f.file
+		}
+	}
+	return b.file
+}
+
+// matches reports whether a client sending architecture types arch, as
+// option 93 encodes them, and vendorClass should get file f.
+func (f *bootFile) matches(arch []byte, vendorClass string) bool {
+	if !strings.HasPrefix(vendorClass, f.vendorClass) {
+		return false
+	}
+	if len(f.arch) == 0 {
+		return true
+	}
+	for ; len(arch) >= 2; arch = arch[2:] {
+		for _, a := range f.arch {
+			if binary.BigEndian.Uint16(arch) == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addOptions adds options 66 and 67 for a client to opts.
+func (b *boot) addOptions(opts, options dhcp.Options) {
+	opts[dhcp.OptionTFTPServerName] = []byte(b.serverName)
+	if file := b.fileFor(options); file != "" {
+		opts[dhcp.OptionBootFileName] = []byte(file)
+	}
+}
+
+// setFields fills in the BOOTP next server and boot file fields of res, for
+// clients that do not request options 66 and 67.
+func (b *boot) setFields(res dhcp.Packet, options dhcp.Options) {
+	if b == nil {
+		return
+	}
+	if b.nextServer != nil {
+		res.SetSIAddr(b.nextServer)
+	}
+	res.SetFile([]byte(b.fileFor(options)))
+}
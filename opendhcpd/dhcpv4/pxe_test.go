@@ -0,0 +1,117 @@
+package dhcpv4
+
+import (
+	"net"
+	"testing"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func bootPool() PoolConfig {
+	pc := testPool("lab", "10.0.0.0/24", "10.0.0.100")
+	pc.Boot = &BootConfig{
+		NextServer: "10.0.0.5",
+		File:       "pxelinux.0",
+		Files: []BootFile{
+			{VendorClass: "HTTPClient", File: "http://10.0.0.5/boot/ipxe.efi"},
+			{Arch: []int{7, 9}, File: "ipxe.efi"},
+		},
+	}
+	return pc
+}
+
+// pxeDiscover is a DISCOVER from a network booting client of architecture
+// arch, or from one that does not say if arch is negative.
+func pxeDiscover(t *testing.T, mac string, arch int, vendorClass string) dhcp.Packet {
+	t.Helper()
+	opts := []dhcp.Option{{Code: dhcp.OptionParameterRequestList, Value: []byte{1, 3, 66, 67}}}
+	if arch >= 0 {
+		opts = append(opts, dhcp.Option{Code: dhcp.OptionClientArchitecture, Value: []byte{byte(arch >> 8), byte(arch)}})
+	}
+	if vendorClass != "" {
+		opts = append(opts, dhcp.Option{Code: dhcp.OptionVendorClassIdentifier, Value: []byte(vendorClass)})
+	}
+	return dhcp.RequestPacket(dhcp.Discover, mustMAC(t, mac), nil, []byte{1, 2, 3, 4}, false, opts)
+}
+
+func checkBoot(t *testing.T, res dhcp.Packet, file string) {
+	t.Helper()
+	if res == nil {
+		t.Fatal("no reply")
+	}
+	if !res.SIAddr().Equal(net.IP{10, 0, 0, 5}) {
+		t.Errorf("siaddr %s, want 10.0.0.5", res.SIAddr())
+	}
+	if got := string(res.File()); got != file {
+		t.Errorf("file %q, want %q", got, file)
+	}
+	opts := res.ParseOptions()
+	if got := string(opts[dhcp.OptionTFTPServerName]); got != "10.0.0.5" {
+		t.Errorf("option 66 %q, want 10.0.0.5", got)
+	}
+	if got := string(opts[dhcp.OptionBootFileName]); got != file {
+		t.Errorf("option 67 %q, want %q", got, file)
+	}
+}
+
+func TestBootFileByArchitectureAndVendorClass(t *testing.T) {
+	h := newTestHandler(t, bootPool())
+	for _, c := range []struct {
+		name, mac   string
+		arch        int
+		vendorClass string
+		file        string
+	}{
+		{"BIOS", "02:00:00:00:00:01", 0, "PXEClient:Arch:00000:UNDI:002001", "pxelinux.0"},
+		{"UEFI x64", "02:00:00:00:00:02", 7, "PXEClient:Arch:00007:UNDI:003016", "ipxe.efi"},
+		{"UEFI x64 alternate", "02:00:00:00:00:03", 9, "PXEClient:Arch:00009:UNDI:003016", "ipxe.efi"},
+		{"UEFI HTTP boot", "02:00:00:00:00:04", 16, "HTTPClient:Arch:00016:UNDI:003001", "http://10.0.0.5/boot/ipxe.efi"},
+		{"no architecture", "02:00:00:00:00:05", -1, "", "pxelinux.0"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			checkBoot(t, serve(h, pxeDiscover(t, c.mac, c.arch, c.vendorClass), ""), c.file)
+		})
+	}
+}
+
+func TestBootFieldsInACK(t *testing.T) {
+	h := newTestHandler(t, bootPool())
+	offer := serve(h, pxeDiscover(t, "02:00:00:00:00:01", 7, ""), "")
+	req := dhcp.RequestPacket(dhcp.Request, mustMAC(t, "02:00:00:00:00:01"), nil, []byte{1, 2, 3, 4}, false, []dhcp.Option{
+		{Code: dhcp.OptionRequestedIPAddress, Value: offer.YIAddr()},
+		{Code: dhcp.OptionParameterRequestList, Value: []byte{1, 3, 66, 67}},
+		{Code: dhcp.OptionClientArchitecture, Value: []byte{0, 7}},
+	})
+	res := serve(h, req, "")
+	if got := messageType(t, res); got != dhcp.ACK {
+		t.Fatalf("got %s, want ACK", got)
+	}
+	checkBoot(t, res, "ipxe.efi")
+}
+
+func TestNoBootFieldsWithoutBootConfig(t *testing.T) {
+	h := newTestHandler(t, testPool("office", "10.0.0.0/24", "10.0.0.100"))
+	res := serve(h, pxeDiscover(t, "02:00:00:00:00:01", 0, "PXEClient"), "")
+	if !res.SIAddr().Equal(net.IPv4zero) || len(res.File()) != 0 {
+		t.Fatalf("siaddr %s, file %q", res.SIAddr(), res.File())
+	}
+	opts := res.ParseOptions()
+	if _, ok := opts[dhcp.OptionBootFileName]; ok {
+		t.Fatal("option 67 sent without a boot configuration")
+	}
+}
+
+func TestNewBootRejectsBadConfig(t *testing.T) {
+	long := string(make([]byte, 128))
+	for _, bc := range []BootConfig{
+		{File: "pxelinux.0"},
+		{NextServer: "10.0.0.5", File: long},
+		{NextServer: "10.0.0.5", Files: []BootFile{{Arch: []int{7}}}},
+		{NextServer: "10.0.0.5", Files: []BootFile{{File: "ipxe.efi"}}},
+		{NextServer: "10.0.0.5", Files: []BootFile{{Arch: []int{65536}, File: "ipxe.efi"}}},
+	} {
+		if _, err := newBoot(&bc); err == nil {
+			t.Errorf("newBoot(%+v) succeeded", bc)
+		}
+	}
+}
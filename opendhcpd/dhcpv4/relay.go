@@ -0,0 +1,81 @@
+package dhcpv4
+
+import (
+	"encoding/hex"
+	"net"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// relayAgentPort is the port relay agents take replies on (RFC 1542).
+var relayAgentPort = 67
+
+// Sub-options of the relay agent information option (RFC 3046).
+const (
+	relayCircuitID = 1
+	relayRemoteID  = 2
+)
+
+// relayInfo is the relay agent information (option 82) that a relay adds to
+// the requests it forwards. IDs are kept as text if printable, else as hex.
+type relayInfo struct {
+	circuitID string
+	remoteID  string
+}
+
+func parseRelayInfo(b []byte) relayInfo {
+	var ri relayInfo
+	for len(b) >= 2 {
+		code, n := b[0], int(b[1])
+		if len(b) < 2+n {
+			break
+		}
+		switch code {
+		case relayCircuitID:
+			ri.circuitID = formatRelayID(b[2 : 2+n])
+		case relayRemoteID:
+			ri.remoteID = formatRelayID(b[2 : 2+n])
+		}
+		b = b[2+n:]
+	}
+	return ri
+}
+
+func formatRelayID(b []byte) string {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return hex.EncodeToString(b)
+		}
+	}
+	return string(b)
+}
+
+// relayed reports whether req was forwarded by a relay agent.
+func relayed(req dhcp.Packet) bool {
+	return !req.GIAddr().Equal(net.IPv4zero)
+}
+
+// matches reports whether the pool is configured for relay information ri.
+// A pool with neither ID set matches no relay information.
+func (p *pool) matches(ri relayInfo) bool {
+	if p.circuitID == "" && p.remoteID == "" {
+		return false
+	}
+	return (p.circuitID == "" || p.circuitID == ri.circuitID) &&
+		(p.remoteID == "" || p.remoteID == ri.remoteID)
+}
+
+// reply builds the reply to req. Relay agent information is echoed back to the
+// relay as RFC 3046 requires, and a NAK sent through a relay is marked for
+// broadcast since the client may not have a usable address.
+func reply(req dhcp.Packet, options dhcp.Options, mt dhcp.MessageType, serverID, yiaddr net.IP, leaseDuration time.Duration, opts []dhcp.Option) dhcp.Packet {
+	if ri, ok := options[dhcp.OptionRelayAgentInformation]; ok {
+		opts = append(opts, dhcp.Option{Code: dhcp.OptionRelayAgentInformation, Value: ri})
+	}
+	res := dhcp.ReplyPacket(req, mt, serverID, yiaddr, leaseDuration, opts)
+	if mt == dhcp.NAK && relayed(req) {
+		res.SetBroadcast(true)
+	}
+	return res
+}
@@ -0,0 +1,210 @@
+package dhcpv4
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"golang.org/x/net/ipv4"
+)
+
+// agentInfo encodes option 82 with the given circuit-id and remote-id.
+func agentInfo(circuitID, remoteID []byte) []byte {
+	b := append([]byte{relayCircuitID, byte(len(circuitID))}, circuitID...)
+	return append(append(b, relayRemoteID, byte(len(remoteID))), remoteID...)
+}
+
+// relayedPacket builds a request as a relay agent at giaddr forwards it, with
+// relay agent information appended after the client's options.
+func relayedPacket(mt dhcp.MessageType, mac net.HardwareAddr, giaddr net.IP, info []byte, opts ...dhcp.Option) dhcp.Packet {
+	if info != nil {
+		opts = append(opts, dhcp.Option{Code: dhcp.OptionRelayAgentInformation, Value: info})
+	}
+	p := dhcp.RequestPacket(mt, mac, nil, []byte{0xde, 0xad, 0xbe, 0xef}, false, opts)
+	p.SetGIAddr(giaddr)
+	p.SetHops(1)
+	return p
+}
+
+func TestRelayedDiscoverAndRequest(t *testing.T) {
+	h := newTestHandler(t,
+		testPool("local", "10.0.0.0/24", "10.0.0.100"),
+		testPool("vlan20", "10.20.0.0/24", "10.20.0.100"),
+	)
+	mac := mustMAC(t, "02:00:00:00:00:01")
+	giaddr := net.IP{10, 20, 0, 1}
+	info := agentInfo([]byte("sw1/ge-0/0/7"), []byte("sw1"))
+
+	offer := serve(h, relayedPacket(dhcp.Discover, mac, giaddr, info), "eth0")
+	if mt := messageType(t, offer); mt != dhcp.Offer {
+		t.Fatalf("got %s, want Offer", mt)
+	}
+	yiaddr := append(net.IP(nil), offer.YIAddr()...)
+	if n := dhcp.IPRange(net.IP{10, 20, 0, 100}, yiaddr); n < 1 || n > 10 {
+		t.Fatalf("offered %s outside the relay's pool", yiaddr)
+	}
+	checkRelayReply(t, offer, giaddr, info)
+	if got := offer.ParseOptions()[dhcp.OptionRouter]; !bytes.Equal(got, []byte{10, 20, 0, 1}) {
+		t.Fatalf("router %v, want the relay pool's", net.IP(got))
+	}
+
+	ack := serve(h, relayedPacket(dhcp.Request, mac, giaddr, info,
+		dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: yiaddr.To4()},
+		dhcp.Option{Code: dhcp.OptionServerIdentifier, Value: offer.ParseOptions()[dhcp.OptionServerIdentifier]},
+	), "eth0")
+	if mt := messageType(t, ack); mt != dhcp.ACK {
+		t.Fatalf("got %s, want ACK", mt)
+	}
+	if !ack.YIAddr().Equal(yiaddr) {
+		t.Fatalf("acked %s, offered %s", ack.YIAddr(), yiaddr)
+	}
+	checkRelayReply(t, ack, giaddr, info)
+}
+
+// checkRelayReply checks that a reply goes back to the relay agent that
+// forwarded the request, with its relay agent information.
+func checkRelayReply(t *testing.T, res dhcp.Packet, giaddr net.IP, info []byte) {
+	t.Helper()
+	if !res.GIAddr().Equal(giaddr) {
+		t.Fatalf("reply giaddr %s, want %s", res.GIAddr(), giaddr)
+	}
+	if got := res.ParseOptions()[dhcp.OptionRelayAgentInformation]; !bytes.Equal(got, info) {
+		t.Fatalf("relay agent information %x not echoed, got %x", info, got)
+	}
+	dst := replyAddr(res, &net.UDPAddr{IP: giaddr, Port: 67})
+	if !dst.IP.Equal(giaddr) || dst.Port != relayAgentPort {
+		t.Fatalf("reply sent to %s, want unicast to the relay", dst)
+	}
+}
+
+func TestRelayedRequestOutsidePoolIsNAKed(t *testing.T) {
+	h := newTestHandler(t,
+		testPool("local", "10.0.0.0/24", "10.0.0.100"),
+		testPool("vlan20", "10.20.0.0/24", "10.20.0.100"),
+	)
+	// a client that moved from the local segment to the relayed one
+	nak := serve(h, relayedPacket(dhcp.Request, mustMAC(t, "02:00:00:00:00:02"), net.IP{10, 20, 0, 1}, nil,
+		dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: []byte{10, 0, 0, 100}},
+	), "eth0")
+	if mt := messageType(t, nak); mt != dhcp.NAK {
+		t.Fatalf("got %s, want NAK", mt)
+	}
+	if !nak.Broadcast() {
+		t.Fatal("NAK through a relay is not marked for broadcast")
+	}
+	if _, ok := nak.ParseOptions()[dhcp.OptionRelayAgentInformation]; ok {
+		t.Fatal("relay agent information added to a reply to a request without it")
+	}
+}
+
+func TestRelayAgentInformationSelectsPool(t *testing.T) {
+	voice := testPool("voice", "10.30.0.0/24", "10.30.0.100")
+	voice.CircuitID = "sw1/ge-0/0/7"
+	h := newTestHandler(t,
+		testPool("vlan20", "10.20.0.0/24", "10.20.0.100"),
+		voice,
+	)
+	mac := mustMAC(t, "02:00:00:00:00:03")
+	giaddr := net.IP{10, 20, 0, 1}
+
+	for _, tc := range []struct {
+		info []byte
+		want net.IP
+	}{
+		{agentInfo([]byte("sw1/ge-0/0/7"), []byte("sw1")), net.IP{10, 30, 0, 0}},
+		{agentInfo([]byte("sw1/ge-0/0/8"), []byte("sw1")), net.IP{10, 20, 0, 0}},
+		{nil, net.IP{10, 20, 0, 0}},
+	} {
+		offer := serve(h, relayedPacket(dhcp.Discover, mac, giaddr, tc.info), "eth0")
+		if mt := messageType(t, offer); mt != dhcp.Offer {
+			t.Fatalf("got %s, want Offer", mt)
+		}
+		if got := offer.YIAddr().Mask(net.CIDRMask(24, 32)); !got.Equal(tc.want) {
+			t.Errorf("circuit %q: offered %s, want an address in %s/24", parseRelayInfo(tc.info).circuitID, offer.YIAddr(), tc.want)
+		}
+	}
+}
+
+func TestParseRelayInfo(t *testing.T) {
+	for _, tc := range []struct {
+		in                  []byte
+		circuitID, remoteID string
+	}{
+		{agentInfo([]byte("eth1:10"), []byte("switch-a")), "eth1:10", "switch-a"},
+		// binary IDs, as many switches send, are shown in hex
+		{agentInfo([]byte{0, 4, 0, 20, 1, 7}, []byte{0, 6, 2, 0, 0, 0, 0, 9}), "000400140107", "0006020000000009"},
+		// unknown sub-options are skipped
+		{append([]byte{9, 2, 0xff, 0xff}, agentInfo([]byte("c"), []byte("r"))...), "c", "r"},
+		// a truncated sub-option ends parsing
+		{[]byte{relayCircuitID, 1, 'a', relayRemoteID, 9, 'r'}, "a", ""},
+		{[]byte{relayCircuitID, 10, 'a', 'b'}, "", ""},
+	} {
+		ri := parseRelayInfo(tc.in)
+		if ri.circuitID != tc.circuitID || ri.remoteID != tc.remoteID {
+			t.Errorf("parseRelayInfo(%x) = %q, %q; want %q, %q", tc.in, ri.circuitID, ri.remoteID, tc.circuitID, tc.remoteID)
+		}
+	}
+}
+
+// TestServeRepliesToRelay sends a relayed DISCOVER to a listening server and
+// expects the OFFER back at the relay agent's address.
+func TestServeRepliesToRelay(t *testing.T) {
+	h := newTestHandler(t, testPool("lo", "127.0.0.0/8", "127.0.0.100"))
+
+	relay, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	defer func(port int) { relayAgentPort = port }(relayAgentPort)
+	relayAgentPort = relay.LocalAddr().(*net.UDPAddr).Port
+
+	l, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := ipv4.NewPacketConn(l)
+	if err := conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		h.serve(conn)
+		close(done)
+	}()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	info := agentInfo([]byte("lo"), []byte("test-relay"))
+	req := relayedPacket(dhcp.Discover, mustMAC(t, "02:00:00:00:00:04"), net.IP{127, 0, 0, 1}, info)
+	// the relay sends from its own port; the reply must still reach the agent port
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.WriteTo(req, l.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := relay.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no reply at the relay agent: %v", err)
+	}
+	res := dhcp.Packet(buf[:n])
+	if mt := messageType(t, res); mt != dhcp.Offer {
+		t.Fatalf("got %s, want Offer", mt)
+	}
+	if !bytes.Equal(res.XId(), req.XId()) {
+		t.Fatalf("reply xid %x, want %x", res.XId(), req.XId())
+	}
+	if got := res.ParseOptions()[dhcp.OptionRelayAgentInformation]; !bytes.Equal(got, info) {
+		t.Fatalf("relay agent information %x not echoed, got %x", info, got)
+	}
+}
@@ -0,0 +1,144 @@
+package dhcpv4
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// Reservation pins a client, by hardware address, to an address. The
+// reservations file is a JSON array of them.
+type Reservation struct {
+	MAC      string            `json:"mac"`
+	IP       string            `json:"ip"`
+	Hostname string            `json:"hostname,omitempty"`
+	Options  map[string]string `json:"options,omitempty"` // see parseOptions
+}
+
+type reservation struct {
+	Reservation
+	ip      net.IP
+	options dhcp.Options
+}
+
+// reservations indexes reservations by client and by address. Neither may
+// appear in two reservations.
+type reservations struct {
+	byMAC map[string]*reservation
+	byIP  map[string]*reservation
+}
+
+func newReservations() *reservations {
+	return &reservations{
+		byMAC: make(map[string]*reservation),
+		byIP:  make(map[string]*reservation),
+	}
+}
+
+// loadReservations reads the reservations file at path. An empty path means
+// there are none.
+func loadReservations(path string) (*reservations, error) {
+	rs := newReservations()
+	if path == "" {
+		return rs, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []Reservation
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, err
+	}
+	for _, r := range list {
+		if err := rs.add(r); err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// add validates r and adds it, refusing a client or address that is already
+// reserved.
+func (rs *reservations) add(r Reservation) error {
+	mac, err := net.ParseMAC(r.MAC)
+	if err != nil {
+		return fmt.Errorf("%s %q: %s", errInvalidReservation, r.MAC, err)
+	}
+	ip := net.ParseIP(r.IP).To4()
+	if ip == nil {
+		return fmt.Errorf("%s %q: invalid IP address %q", errInvalidReservation, r.MAC, r.IP)
+	}
+	opts, err := parseOptions(r.Options)
+	if err != nil {
+		return fmt.Errorf("%s %q: %s", errInvalidReservation, r.MAC, err)
+	}
+	if len(r.Hostname) > 0 {
+		opts[dhcp.OptionHostName] = []byte(r.Hostname)
+	}
+	r.MAC = mac.String()
+	if _, ok := rs.byMAC[r.MAC]; ok {
+		return fmt.Errorf("%s %q: client already has a reservation", errInvalidReservation, r.MAC)
+	}
+	if other, ok := rs.byIP[ip.String()]; ok {
+		return fmt.Errorf("%s %q: %s is reserved for %s", errInvalidReservation, r.MAC, ip, other.MAC)
+	}
+	res := &reservation{Reservation: r, ip: ip, options: opts}
+	rs.byMAC[r.MAC] = res
+	rs.byIP[ip.String()] = res
+	return nil
+}
+
+// remove deletes the reservation of a client and reports whether there was one.
+func (rs *reservations) remove(mac string) bool {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return false
+	}
+	res, ok := rs.byMAC[hw.String()]
+	if !ok {
+		return false
+	}
+	delete(rs.byMAC, res.MAC)
+	delete(rs.byIP, res.ip.String())
+	return true
+}
+
+// list returns the reservations ordered by client.
+func (rs *reservations) list() []Reservation {
+	list := make([]Reservation, 0, len(rs.byMAC))
+	for _, res := range rs.byMAC {
+		list = append(list, res.Reservation)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].MAC < list[j].MAC })
+	return list
+}
+
+// save writes the reservations to the file at path, replacing it atomically.
+func (rs *reservations) save(path string) error {
+	b, err := json.MarshalIndent(rs.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// forMAC returns the reservation of client nic, or nil.
+func (rs *reservations) forMAC(nic string) *reservation {
+	return rs.byMAC[nic]
+}
+
+// reservedForOther reports whether ip is reserved for a client other than nic.
+func (rs *reservations) reservedForOther(ip net.IP, nic string) bool {
+	res, ok := rs.byIP[ip.String()]
+	return ok && res.MAC != nic
+}
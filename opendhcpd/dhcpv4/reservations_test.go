@@ -0,0 +1,143 @@
+package dhcpv4
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ishworgurung/opendhcpd/leasedb"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/rs/zerolog"
+)
+
+// newReservedHandler returns a handler for the range 10.0.0.100-101 with the
+// given reservations and the leases already in the lease database.
+func newReservedHandler(t *testing.T, rs []Reservation, stored ...leasedb.Lease) *Handler {
+	t.Helper()
+	db, err := leasedb.Open(filepath.Join(t.TempDir(), "dhcpd.leases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, l := range stored {
+		if err := db.Put(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := newReservations()
+	for _, r := range rs {
+		if err := res.add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pools, err := newPools([]PoolConfig{{
+		Name:      "office",
+		Subnet:    "10.0.0.0/24",
+		Start:     "10.0.0.100",
+		Range:     2,
+		Router:    "10.0.0.1",
+		DNS:       []string{"10.0.0.53"},
+		LeaseTime: 3600,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := newDHCPv4Handler(&dhcpCtx{
+		bindIP:       net.IP{10, 0, 0, 1},
+		pools:        pools,
+		leaseDB:      db,
+		reservations: res,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// reservationReply sends a message of type mt from mac, asking for ip if it
+// is not nil, and returns the reply.
+func reservationReply(t *testing.T, h *Handler, mt dhcp.MessageType, mac string, ip net.IP) dhcp.Packet {
+	t.Helper()
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opts []dhcp.Option
+	if ip != nil {
+		opts = []dhcp.Option{{Code: dhcp.OptionRequestedIPAddress, Value: ip.To4()}}
+	}
+	req := dhcp.RequestPacket(mt, hw, nil, []byte{1, 2, 3, 4}, false, opts)
+	return h.ServeDHCP(req, mt, req.ParseOptions())
+}
+
+func replyType(p dhcp.Packet) dhcp.MessageType {
+	if p == nil {
+		return 0
+	}
+	return dhcp.MessageType(p.ParseOptions()[dhcp.OptionDHCPMessageType][0])
+}
+
+func TestReservedClientGetsFixedAddress(t *testing.T) {
+	inRange, outside := net.IP{10, 0, 0, 101}, net.IP{10, 0, 0, 50}
+	h := newReservedHandler(t, []Reservation{
+		{MAC: "02:00:00:00:00:0a", IP: inRange.String(), Options: map[string]string{"mtu": "9000"}},
+		{MAC: "02:00:00:00:00:0b", IP: outside.String()},
+	},
+		// a dynamic lease held before the client was given its reservation
+		leasedb.Lease{IP: net.IP{10, 0, 0, 100}, HWAddr: "02:00:00:00:00:0a", Expiry: time.Now().Add(time.Hour)},
+	)
+
+	for i := 0; i < 3; i++ {
+		offer := reservationReply(t, h, dhcp.Discover, "02:00:00:00:00:0a", nil)
+		if replyType(offer) != dhcp.Offer || !offer.YIAddr().Equal(inRange) {
+			t.Fatalf("offered %v, want the reserved %s", offer, inRange)
+		}
+		if mtu := offer.ParseOptions()[dhcp.OptionInterfaceMTU]; len(mtu) != 2 || mtu[0] != 0x23 || mtu[1] != 0x28 {
+			t.Errorf("offer has MTU option %v, want the reservation's", mtu)
+		}
+	}
+	if got := replyType(reservationReply(t, h, dhcp.Request, "02:00:00:00:00:0a", net.IP{10, 0, 0, 100})); got != dhcp.NAK {
+		t.Fatalf("request for another address got %s, want NAK", got)
+	}
+	if got := replyType(reservationReply(t, h, dhcp.Request, "02:00:00:00:00:0a", inRange)); got != dhcp.ACK {
+		t.Fatalf("request for the reserved address got %s, want ACK", got)
+	}
+
+	// the earlier dynamic lease was dropped, and the reserved address is never
+	// offered to or taken by another client
+	offer := reservationReply(t, h, dhcp.Discover, "02:00:00:00:00:0c", nil)
+	if replyType(offer) != dhcp.Offer || !offer.YIAddr().Equal(net.IP{10, 0, 0, 100}) {
+		t.Fatalf("offered %v to another client, want 10.0.0.100", offer)
+	}
+	if got := replyType(reservationReply(t, h, dhcp.Request, "02:00:00:00:00:0c", inRange)); got != dhcp.NAK {
+		t.Fatalf("another client's request for the reserved address got %s, want NAK", got)
+	}
+
+	// a reservation outside the range is handed out too
+	offer = reservationReply(t, h, dhcp.Discover, "02:00:00:00:00:0b", nil)
+	if replyType(offer) != dhcp.Offer || !offer.YIAddr().Equal(outside) {
+		t.Fatalf("offered %v, want the reserved %s", offer, outside)
+	}
+	if got := replyType(reservationReply(t, h, dhcp.Request, "02:00:00:00:00:0b", outside)); got != dhcp.ACK {
+		t.Fatalf("request for a reserved address outside the range got %s, want ACK", got)
+	}
+}
+
+func TestReservationsRejectDuplicates(t *testing.T) {
+	rs := newReservations()
+	if err := rs.add(Reservation{MAC: "02:00:00:00:00:0a", IP: "10.0.0.10"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Reservation{
+		{MAC: "02-00-00-00-00-0A", IP: "10.0.0.11"},
+		{MAC: "02:00:00:00:00:0b", IP: "10.0.0.10"},
+		{MAC: "not a mac", IP: "10.0.0.12"},
+		{MAC: "02:00:00:00:00:0c", IP: "10.0.0.300"},
+		{MAC: "02:00:00:00:00:0d", IP: "10.0.0.13", Options: map[string]string{"mtu": "big"}},
+	} {
+		if err := rs.add(r); err == nil {
+			t.Errorf("added %+v", r)
+		}
+	}
+}
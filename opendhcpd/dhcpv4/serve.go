@@ -0,0 +1,137 @@
+package dhcpv4
+
+import (
+	"net"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"golang.org/x/net/ipv4"
+)
+
+// Start starts serving DHCPv4 replies to DHCPv4 clients.
+func (h *Handler) Start() error {
+	if err := h.Listen(); err != nil {
+		return err
+	}
+	return h.Serve()
+}
+
+// Listen opens the server sockets. When every pool is configured for an
+// interface, the server binds to those interfaces only.
+func (h *Handler) Listen() error {
+	ifaces := h.bindInterfaces()
+	if len(ifaces) == 0 {
+		ifaces = []string{""}
+	}
+	for _, ifname := range ifaces {
+		l, err := listen(ifname, dhcpServerPort)
+		if err != nil {
+			h.closeConns()
+			return err
+		}
+		conn := ipv4.NewPacketConn(l)
+		h.conns = append(h.conns, conn)
+		if err := conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+			h.closeConns()
+			return err
+		}
+		if ifname == "" {
+			h.logger.Info().Msgf("dhcpv4 server started listening on %s:67", h.ip)
+		} else {
+			h.logger.Info().Msgf("dhcpv4 server started listening on %s:67 (%s)", h.serverIP(h.poolFor(ifname, nil, relayInfo{}), ifname), ifname)
+		}
+	}
+	return nil
+}
+
+// Serve answers requests on the sockets opened by Listen until one of them
+// fails, or returns nil once the handler is closed.
+func (h *Handler) Serve() error {
+	go h.compactLeases()
+	errs := make(chan error, len(h.conns))
+	for _, conn := range h.conns {
+		go func(conn *ipv4.PacketConn) { errs <- h.serve(conn) }(conn)
+	}
+	err := <-errs
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closeConns()
+	return err
+}
+
+func (h *Handler) closeConns() {
+	for _, conn := range h.conns {
+		conn.Close()
+	}
+}
+
+// serve reads requests from conn and writes the replies back out of the
+// interface each request came in on. It works like dhcp.Serve, but passes the
+// receiving interface on so that the pool can be chosen by it.
+func (h *Handler) serve(conn *ipv4.PacketConn) error {
+	buffer := make([]byte, 1500)
+	for {
+		n, cm, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		if n < 240 { // Packet too small to be DHCP
+			continue
+		}
+		req := dhcp.Packet(buffer[:n])
+		if req.HLen() > 16 { // Invalid size
+			continue
+		}
+		options := req.ParseOptions()
+		t := options[dhcp.OptionDHCPMessageType]
+		if len(t) != 1 {
+			continue
+		}
+		reqType := dhcp.MessageType(t[0])
+		if reqType < dhcp.Discover || reqType > dhcp.Inform {
+			continue
+		}
+
+		var ifname string
+		if cm != nil {
+			if ifi, err := net.InterfaceByIndex(cm.IfIndex); err == nil {
+				ifname = ifi.Name
+			}
+		}
+		dst := replyAddr(req, addr)
+		dst.IP = append(net.IP(nil), dst.IP...) // an offer may be sent after the buffer is reused
+		var wcm *ipv4.ControlMessage
+		if cm != nil && dst.IP.Equal(net.IPv4bcast) {
+			// a broadcast goes out of the interface the request came in on
+			wcm = &ipv4.ControlMessage{IfIndex: cm.IfIndex}
+		}
+		send := func(res dhcp.Packet) {
+			if _, err := conn.WriteTo(res, wcm, dst); err != nil {
+				h.logger.Error().Msgf("failed to send reply to %s: %s", dst, err)
+			}
+		}
+		if res := h.serveDHCP(req, reqType, options, ifname, send); res != nil {
+			send(res)
+		}
+	}
+}
+
+// replyAddr returns where to send the reply to req, which came from src. A
+// relayed request is answered through the relay agent. A client without an
+// address yet, or one that asked for it, is answered by broadcast.
+func replyAddr(req dhcp.Packet, src net.Addr) *net.UDPAddr {
+	if relayed(req) {
+		return &net.UDPAddr{IP: req.GIAddr(), Port: relayAgentPort}
+	}
+	ua, _ := src.(*net.UDPAddr)
+	if ua == nil || ua.IP.Equal(net.IPv4zero) || req.Broadcast() {
+		port := dhcpClientPort
+		if ua != nil {
+			port = ua.Port
+		}
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: port}
+	}
+	return ua
+}
@@ -0,0 +1,65 @@
+package dhcpv6
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+)
+
+// Config is the DHCPv6 server configuration. It lives in the same JSON file
+// as the DHCPv4 one, under its own keys, or is built from the command line
+// flags for a single pool.
+type Config struct {
+	LeaseFile   string       `json:"lease_file6,omitempty"`
+	DeclineTime int          `json:"decline_time,omitempty"` // seconds a declined address is held back
+	Pools       []PoolConfig `json:"pools6,omitempty"`
+}
+
+// PoolConfig is a range of addresses handed out on one link, along with the
+// options sent to its clients.
+type PoolConfig struct {
+	Name          string   `json:"name"`
+	Interface     string   `json:"interface,omitempty"` // serve clients on this interface
+	Prefix        string   `json:"prefix"`              // e.g. 2001:db8:1::/64
+	Start         string   `json:"start"`
+	Range         int      `json:"range"` // number of addresses from start
+	DNS           []string `json:"dns"`
+	DomainSearch  []string `json:"domain_search,omitempty"`
+	LeaseTime     int      `json:"lease_time"`               // valid lifetime in seconds
+	PreferredTime int      `json:"preferred_time,omitempty"` // seconds, the lease time if unset
+}
+
+// LoadConfig reads the DHCPv6 part of the configuration file at path.
+func LoadConfig(path string) (Config, error) {
+	var c Config
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// SinglePoolConfig returns the configuration of a server with one pool, as
+// given on the command line. The pool's prefix is the /64 holding start.
+func SinglePoolConfig(start string, max int, dns string, leaseSec int, domainName, leaseFile string) Config {
+	prefix := ""
+	if si := net.ParseIP(start); si != nil && si.To4() == nil {
+		mask := net.CIDRMask(64, 128)
+		prefix = (&net.IPNet{IP: si.Mask(mask), Mask: mask}).String()
+	}
+	pc := PoolConfig{
+		Name:      "default",
+		Prefix:    prefix,
+		Start:     start,
+		Range:     max,
+		LeaseTime: leaseSec,
+	}
+	if dns != "" {
+		pc.DNS = []string{dns}
+	}
+	if domainName != "" {
+		pc.DomainSearch = []string{domainName}
+	}
+	return Config{LeaseFile: leaseFile, Pools: []PoolConfig{pc}}
+}
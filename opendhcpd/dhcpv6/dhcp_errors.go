@@ -0,0 +1,24 @@
+package dhcpv6
+
+import "time"
+
+const (
+	internalLeaseTableSize  = 1024
+	leaseDBCompactInterval  = time.Hour
+	defaultDeclineTime      = 10 * time.Minute
+	serverPort              = 547
+	allServersMulticast     = "ff02::1:2"
+	errFailParsePrefix      = "failed to parse prefix"
+	errFailParseStartIP     = "failed to parse start IPv6 address"
+	errFailParseDNSIP       = "failed to parse DNS IPv6 address"
+	errRangeOutsidePrefix   = "lease range must be > 0 addresses and lie within the prefix"
+	errNegativeLeaseSec     = "lease duration must be > 0 seconds. ideally, keep it above 7200 seconds"
+	errPreferredAboveValid  = "preferred lifetime must not exceed the lease duration"
+	errInvalidDomainName    = "invalid domain name in the domain search list"
+	errOverlappingPools     = "prefix overlaps that of pool"
+	errNoServerDUID         = "no interface with a hardware address to derive the server DUID from"
+	errInitialisationFailed = "could not initialise DHCPv6 handler"
+	errLeaseDBOpen          = "failed to open lease database"
+	errLeaseDBWrite         = "failed to write lease database"
+	errLeaseDBCompact       = "failed to compact lease database"
+)
@@ -0,0 +1,130 @@
+// Package dhcpv6 serves stateful DHCPv6 address assignment (IA_NA) and
+// stateless configuration to clients on directly attached links.
+package dhcpv6
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ishworgurung/opendhcpd/leasedb"
+	"github.com/rs/zerolog"
+	"golang.org/x/net/ipv6"
+)
+
+type Handler struct {
+	mu          sync.Mutex       // Guards the pools' leases
+	duid        []byte           // Server DUID, sent as the server identifier
+	pools       []*pool          // Pools to hand out leases from
+	db          *leasedb.DB      // Persistent copy of the leases
+	declineTime time.Duration    // How long a declined address is held back
+	logger      zerolog.Logger   // The logger
+	conn        *ipv6.PacketConn // Socket opened by Listen
+	closed      bool             // Set by Close
+	stopc       chan struct{}    // Closed by Close to stop compaction
+}
+
+func New(cfg Config, log zerolog.Logger) (*Handler, error) {
+	duid, err := serverDUID(cfg.Pools)
+	if err != nil {
+		log.Error().Msg(err.Error())
+		return nil, err
+	}
+	pools, err := newPools(cfg.Pools)
+	if err != nil {
+		log.Error().Msg(err.Error())
+		return nil, err
+	}
+	db, err := leasedb.Open(cfg.LeaseFile)
+	if err != nil {
+		log.Error().Msgf("%s %s: %s", errLeaseDBOpen, cfg.LeaseFile, err)
+		return nil, errors.New(errLeaseDBOpen)
+	}
+	dd := &dhcpCtx{
+		duid:        duid,
+		pools:       pools,
+		leaseDB:     db,
+		declineTime: time.Duration(cfg.DeclineTime) * time.Second,
+	}
+	dh, err := newDHCPv6Handler(dd, log)
+	if err != nil {
+		db.Close()
+		log.Error().Msgf("could not initialise DHCP dhcpv6 %s", err)
+		return nil, errors.New(errInitialisationFailed)
+	}
+	return dh, nil
+}
+
+// serverDUID derives the server DUID from the hardware address of the first
+// interface a pool is configured on, else of the first interface that has
+// one. It stays the same across restarts as long as the hardware does.
+func serverDUID(pcs []PoolConfig) ([]byte, error) {
+	for _, pc := range pcs {
+		if pc.Interface == "" {
+			continue
+		}
+		if ifi, err := net.InterfaceByName(pc.Interface); err == nil && len(ifi.HardwareAddr) > 0 {
+			return duidLL(ifi.HardwareAddr), nil
+		}
+	}
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifi := range ifis {
+		if ifi.Flags&net.FlagLoopback == 0 && len(ifi.HardwareAddr) > 0 {
+			return duidLL(ifi.HardwareAddr), nil
+		}
+	}
+	return nil, errors.New(errNoServerDUID)
+}
+
+// Reload replaces the pools with those of cfg. Leases on addresses that still
+// belong to a pool's range are kept; the others are forgotten, and given zero
+// lifetimes when the client renews. The interfaces served on and the other
+// settings only change on a restart.
+func (h *Handler) Reload(cfg Config) error {
+	pools, err := newPools(cfg.Pools)
+	if err != nil {
+		h.logger.Error().Msg(err.Error())
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	old := h.pools
+	h.pools = pools
+	kept, dropped := 0, 0
+	for _, op := range old {
+		for i, v := range op.leases {
+			ip := op.addr(i)
+			if p := h.poolContaining(ip); p != nil && p.inRange(p.slot(ip)) {
+				p.leases[p.slot(ip)] = v
+				kept++
+				continue
+			}
+			dropped++
+		}
+	}
+	h.logger.Info().Msgf("reloaded %d DHCPv6 pools, keeping %d leases and dropping %d", len(pools), kept, dropped)
+	return nil
+}
+
+// Close stops serving, then writes the lease database out compacted and
+// closes it.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed {
+		close(h.stopc)
+	}
+	h.closed = true
+	if h.conn != nil {
+		h.conn.Close()
+	}
+	if err := h.db.Compact(); err != nil {
+		h.logger.Error().Msgf("%s: %s", errLeaseDBCompact, err)
+	}
+	return h.db.Close()
+}
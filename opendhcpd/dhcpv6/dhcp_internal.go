@@ -0,0 +1,318 @@
+package dhcpv6
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/ishworgurung/opendhcpd/leasedb"
+	"github.com/rs/zerolog"
+)
+
+type lease struct {
+	duid     string    // Client's DUID, hex encoded
+	iaid     uint32    // Identity association the address is bound to
+	expiry   time.Time // When the valid lifetime ends
+	declined bool      // Address declined by a client; held back until expiry
+}
+
+// dhcpCtx holds the internal DHCP context
+type dhcpCtx struct {
+	duid        []byte
+	pools       []*pool
+	leaseDB     *leasedb.DB
+	declineTime time.Duration
+}
+
+// New creates a new DHCPv6 server object
+func newDHCPv6Handler(dhcpIo *dhcpCtx, zlogger zerolog.Logger) (*Handler, error) {
+	dhandler := &Handler{
+		duid:        dhcpIo.duid,
+		pools:       dhcpIo.pools,
+		logger:      zlogger,
+		db:          dhcpIo.leaseDB,
+		declineTime: dhcpIo.declineTime,
+		stopc:       make(chan struct{}),
+	}
+	if dhandler.declineTime <= 0 {
+		dhandler.declineTime = defaultDeclineTime
+	}
+	dhandler.restoreLeases()
+	return dhandler, nil
+}
+
+// restoreLeases fills the lease tables from the lease database. Leases that
+// belong to no pool's range are left to expire in the database.
+func (h *Handler) restoreLeases() {
+	n := 0
+	for _, l := range h.db.Leases() {
+		p := h.poolContaining(l.IP)
+		if p == nil || !p.inRange(p.slot(l.IP)) {
+			h.logger.Warn().Msgf("ignoring stored lease %s for %s outside every pool", l.IP, l.HWAddr)
+			continue
+		}
+		p.leases[p.slot(l.IP)] = lease{duid: l.HWAddr, iaid: l.IAID, expiry: l.Expiry}
+		n++
+	}
+	h.logger.Info().Msgf("restored %d DHCPv6 leases", n)
+}
+
+// compactLeases periodically rewrites the lease database without released and
+// expired leases until the handler is closed.
+func (h *Handler) compactLeases() {
+	t := time.NewTicker(leaseDBCompactInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.stopc:
+			return
+		case <-t.C:
+		}
+		if h.db.Stale() == 0 {
+			continue
+		}
+		if err := h.db.Compact(); err != nil {
+			h.logger.Error().Msgf("%s: %s", errLeaseDBCompact, err)
+		}
+	}
+}
+
+// serveDHCP serves a message received on interface ifname from the pool that
+// covers the link. It returns nil if the message is to be dropped.
+func (h *Handler) serveDHCP(req *Message, ifname string) *Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	clientID := req.Options.Get(OptionClientID)
+	if !h.acceptable(req, clientID, req.Options.Get(OptionServerID)) {
+		h.logger.Debug().Msgf("dropping malformed or misdirected %s", req.Type)
+		return nil
+	}
+	p := h.poolFor(ifname)
+	if p == nil {
+		h.logger.Warn().Msgf("no pool serves %s received on %q", req.Type, ifname)
+		return nil
+	}
+	duid := hex.EncodeToString(clientID)
+	resp := &Message{Type: Reply, TxID: req.TxID}
+	if clientID != nil {
+		resp.Options.Add(OptionClientID, clientID)
+	}
+	resp.Options.Add(OptionServerID, h.duid)
+
+	switch req.Type {
+	case Solicit:
+		rapid := req.Options.Has(OptionRapidCommit)
+		if !rapid {
+			resp.Type = Advertise
+		}
+		for _, ia := range identityAssociations(req) {
+			resp.Options.Add(OptionIANA, h.assign(p, duid, ia, rapid).marshal())
+		}
+		if rapid {
+			resp.Options.Add(OptionRapidCommit, nil)
+		}
+		h.logger.Info().Msgf("Sent %s to %s", resp.Type, duid)
+	case Request:
+		for _, ia := range identityAssociations(req) {
+			resp.Options.Add(OptionIANA, h.assign(p, duid, ia, true).marshal())
+		}
+		h.logger.Info().Msgf("Sent REPLY to %s", duid)
+	case Renew, Rebind:
+		for _, ia := range identityAssociations(req) {
+			resp.Options.Add(OptionIANA, h.extend(p, duid, ia).marshal())
+		}
+	case Confirm:
+		var addrs []iaAddr
+		for _, ia := range identityAssociations(req) {
+			addrs = append(addrs, ia.addrs()...)
+		}
+		if len(addrs) == 0 {
+			return nil
+		}
+		code, msg := StatusSuccess, "all addresses are on-link"
+		for _, a := range addrs {
+			if !p.prefix.Contains(a.IP) {
+				code, msg = StatusNotOnLink, "not on-link: "+a.IP.String()
+				break
+			}
+		}
+		resp.Options.Add(OptionStatusCode, statusCode(code, msg))
+	case Release:
+		for _, ia := range identityAssociations(req) {
+			for _, a := range ia.addrs() {
+				if i, ok := h.binding(p, duid, ia.IAID, a.IP); ok {
+					delete(p.leases, i)
+					if err := h.db.Release(a.IP); err != nil {
+						h.logger.Error().Msgf("%s: %s", errLeaseDBWrite, err)
+					}
+					h.logger.Info().Msgf("Deleted the lease %s", a.IP)
+				}
+			}
+		}
+		resp.Options.Add(OptionStatusCode, statusCode(StatusSuccess, "released"))
+		return resp
+	case Decline:
+		for _, ia := range identityAssociations(req) {
+			for _, a := range ia.addrs() {
+				if i, ok := h.binding(p, duid, ia.IAID, a.IP); ok {
+					h.logger.Warn().Msgf("address %s declined by %s, quarantining it for %s", a.IP, duid, h.declineTime)
+					h.quarantine(p, i)
+				}
+			}
+		}
+		resp.Options.Add(OptionStatusCode, statusCode(StatusSuccess, "declined"))
+		return resp
+	}
+	resp.Options = append(resp.Options, p.options...)
+	return resp
+}
+
+// acceptable reports whether req carries the client and server identifiers
+// that RFC 8415 section 16 requires of its type, with the server identifier,
+// where there is one, being ours.
+func (h *Handler) acceptable(req *Message, clientID, serverID []byte) bool {
+	switch req.Type {
+	case Solicit, Confirm, Rebind:
+		return clientID != nil && serverID == nil
+	case Request, Renew, Release, Decline:
+		return clientID != nil && bytes.Equal(serverID, h.duid)
+	case InformationRequest:
+		return (serverID == nil || bytes.Equal(serverID, h.duid)) && !req.Options.Has(OptionIANA)
+	}
+	return false
+}
+
+// identityAssociations returns the well-formed IA_NA options of req.
+func identityAssociations(req *Message) []iaNA {
+	var ias []iaNA
+	for _, b := range req.Options.All(OptionIANA) {
+		if ia, err := parseIANA(b); err == nil {
+			ias = append(ias, ia)
+		}
+	}
+	return ias
+}
+
+// assign picks the address in pool p for IA ia of client duid: the one
+// already bound to it, else the one it asked for if that is free, else any
+// free one. The binding is recorded if commit is set, and not for an
+// ADVERTISE.
+func (h *Handler) assign(p *pool, duid string, ia iaNA, commit bool) iaNA {
+	i := h.bound(p, duid, ia.IAID)
+	if i == -1 {
+		for _, a := range ia.addrs() {
+			if j := p.slot(a.IP); p.inRange(j) && h.free(p, j) {
+				i = j
+				break
+			}
+		}
+	}
+	if i == -1 {
+		i = h.freeLease(p)
+	}
+	if i == -1 {
+		h.logger.Warn().Msgf("pool %q has no addresses left for %s", p.name, duid)
+		out := iaNA{IAID: ia.IAID}
+		out.Options.Add(OptionStatusCode, statusCode(StatusNoAddrsAvail, "no addresses available"))
+		return out
+	}
+	if commit {
+		h.bind(p, i, duid, ia.IAID)
+	}
+	return p.iaFor(ia.IAID, p.addr(i))
+}
+
+// extend renews or rebinds the addresses of IA ia of client duid in pool p.
+// An address the client may keep gets fresh lifetimes; a free one is bound
+// again, as after a restart that lost the lease. Any other address is returned
+// with zero lifetimes so that the client stops using it.
+func (h *Handler) extend(p *pool, duid string, ia iaNA) iaNA {
+	addrs := ia.addrs()
+	out := iaNA{IAID: ia.IAID}
+	if len(addrs) == 0 {
+		out.Options.Add(OptionStatusCode, statusCode(StatusNoBinding, "no addresses in the IA"))
+		return out
+	}
+	for _, a := range addrs {
+		i := p.slot(a.IP)
+		_, mine := h.binding(p, duid, ia.IAID, a.IP)
+		if p.prefix.Contains(a.IP) && p.inRange(i) && (mine || h.free(p, i)) {
+			h.bind(p, i, duid, ia.IAID)
+			kept := p.iaFor(ia.IAID, a.IP)
+			out.T1, out.T2 = kept.T1, kept.T2
+			out.Options = append(out.Options, kept.Options...)
+			continue
+		}
+		out.Options.Add(OptionIAAddr, iaAddr{IP: a.IP}.marshal())
+	}
+	return out
+}
+
+// bound returns the lease table slot of pool p bound to IA iaid of client
+// duid, or -1.
+func (h *Handler) bound(p *pool, duid string, iaid uint32) int {
+	for i, l := range p.leases {
+		if l.duid == duid && l.iaid == iaid && !l.declined {
+			return i
+		}
+	}
+	return -1
+}
+
+// binding returns the lease table slot of ip in pool p and whether it is
+// bound to IA iaid of client duid.
+func (h *Handler) binding(p *pool, duid string, iaid uint32, ip net.IP) (int, bool) {
+	i := p.slot(ip)
+	l, ok := p.leases[i]
+	return i, ok && p.inRange(i) && !l.declined && l.duid == duid && l.iaid == iaid
+}
+
+// free reports whether lease table slot i of pool p may be handed out.
+func (h *Handler) free(p *pool, i int) bool {
+	l, ok := p.leases[i]
+	return !ok || !l.expiry.After(time.Now())
+}
+
+// bind records that slot i of pool p is bound to IA iaid of client duid for
+// the valid lifetime.
+func (h *Handler) bind(p *pool, i int, duid string, iaid uint32) {
+	l := lease{duid: duid, iaid: iaid, expiry: time.Now().Add(p.valid)}
+	p.leases[i] = l
+	err := h.db.Put(leasedb.Lease{IP: p.addr(i), HWAddr: l.duid, IAID: l.iaid, Expiry: l.expiry})
+	if err != nil {
+		h.logger.Error().Msgf("%s: %s", errLeaseDBWrite, err)
+	}
+}
+
+// quarantine keeps lease table slot i of pool p from being handed out until
+// the decline cool-down has passed.
+func (h *Handler) quarantine(p *pool, i int) {
+	p.leases[i] = lease{declined: true, expiry: time.Now().Add(h.declineTime)}
+	if err := h.db.Release(p.addr(i)); err != nil {
+		h.logger.Error().Msgf("%s: %s", errLeaseDBWrite, err)
+	}
+}
+
+// freeLease returns a free lease table slot of pool p, or -1.
+func (h *Handler) freeLease(p *pool) int {
+	b := rand.Intn(p.leaseRange) // Try random first
+	for _, v := range [][]int{{b, p.leaseRange}, {0, b}} {
+		for i := v[0]; i < v[1]; i++ {
+			if h.free(p, i) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// iaFor returns IA iaid holding ip with the pool's lifetimes. The client
+// renews at half the preferred lifetime and rebinds at 0.8 of it.
+func (p *pool) iaFor(iaid uint32, ip net.IP) iaNA {
+	preferred, valid := uint32(p.preferred/time.Second), uint32(p.valid/time.Second)
+	ia := iaNA{IAID: iaid, T1: preferred / 2, T2: uint32(uint64(preferred) * 4 / 5)}
+	ia.Options.Add(OptionIAAddr, iaAddr{IP: ip, Preferred: preferred, Valid: valid}.marshal())
+	return ia
+}
@@ -0,0 +1,359 @@
+package dhcpv6
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ishworgurung/opendhcpd/leasedb"
+	"github.com/rs/zerolog"
+)
+
+var testServerDUID = []byte{0x00, 0x03, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0xfe}
+
+// newTestHandler returns a handler serving the given pools, with its lease
+// database at path, or in a temporary directory if path is empty.
+func newTestHandler(t *testing.T, path string, pcs ...PoolConfig) *Handler {
+	t.Helper()
+	pools, err := newPools(pcs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "dhcpd6.leases")
+	}
+	db, err := leasedb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	h, err := newDHCPv6Handler(&dhcpCtx{
+		duid:    testServerDUID,
+		pools:   pools,
+		leaseDB: db,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testPool() PoolConfig {
+	return PoolConfig{
+		Name:         "lan",
+		Prefix:       "2001:db8:1::/64",
+		Start:        "2001:db8:1::100",
+		Range:        10,
+		DNS:          []string{"2001:db8:1::53"},
+		DomainSearch: []string{"example.com"},
+		LeaseTime:    3600,
+	}
+}
+
+// solicit is a SOLICIT as a client sends it: client 02:00:00:00:00:01 asks for
+// IA_NA 1 and the DNS servers and domain search list.
+var solicit = []byte{
+	0x01, 0x10, 0x08, 0x74, // SOLICIT, transaction-id
+	0x00, 0x01, 0x00, 0x0a, 0x00, 0x03, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, // client id, DUID-LL
+	0x00, 0x06, 0x00, 0x04, 0x00, 0x17, 0x00, 0x18, // ORO: DNS servers, domain list
+	0x00, 0x08, 0x00, 0x02, 0x00, 0x00, // elapsed time
+	0x00, 0x03, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, // IA_NA 1
+}
+
+var testClientDUID = []byte{0x00, 0x03, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+// exchange encodes req, passes it to the handler and decodes the reply.
+func exchange(t *testing.T, h *Handler, req *Message) *Message {
+	t.Helper()
+	return exchangeRaw(t, h, req.Marshal())
+}
+
+func exchangeRaw(t *testing.T, h *Handler, b []byte) *Message {
+	t.Helper()
+	req, err := ParseMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := h.serveDHCP(req, "")
+	if res == nil {
+		return nil
+	}
+	reply, err := ParseMessage(res.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// clientMessage returns a message of type mt from the test client holding
+// the given IA_NA 1 addresses, addressed to server duid if it is not nil.
+func clientMessage(mt MessageType, duid []byte, addrs ...net.IP) *Message {
+	m := &Message{Type: mt, TxID: [3]byte{1, 2, 3}}
+	m.Options.Add(OptionClientID, testClientDUID)
+	if duid != nil {
+		m.Options.Add(OptionServerID, duid)
+	}
+	ia := iaNA{IAID: 1}
+	for _, ip := range addrs {
+		ia.Options.Add(OptionIAAddr, iaAddr{IP: ip}.marshal())
+	}
+	m.Options.Add(OptionIANA, ia.marshal())
+	return m
+}
+
+// leased returns the address and valid lifetime of the first IA_NA of m, and
+// its status code.
+func leased(t *testing.T, m *Message) (net.IP, uint32, uint16) {
+	t.Helper()
+	if m == nil {
+		t.Fatal("no reply")
+	}
+	ias := identityAssociations(m)
+	if len(ias) == 0 {
+		t.Fatal("reply without an IA_NA")
+	}
+	status := StatusSuccess
+	if b := ias[0].Options.Get(OptionStatusCode); b != nil {
+		status, _ = parseStatusCode(b)
+	}
+	addrs := ias[0].addrs()
+	if len(addrs) == 0 {
+		return nil, 0, status
+	}
+	return addrs[0].IP, addrs[0].Valid, status
+}
+
+func TestSolicitRequestRenewRelease(t *testing.T) {
+	h := newTestHandler(t, "", testPool())
+	_, lan, _ := net.ParseCIDR("2001:db8:1::/64")
+
+	adv := exchangeRaw(t, h, solicit)
+	if adv.Type != Advertise || adv.TxID != [3]byte{0x10, 0x08, 0x74} {
+		t.Fatalf("got %s %x, want ADVERTISE 100874", adv.Type, adv.TxID)
+	}
+	if !bytes.Equal(adv.Options.Get(OptionClientID), testClientDUID) || !bytes.Equal(adv.Options.Get(OptionServerID), testServerDUID) {
+		t.Fatal("ADVERTISE does not identify the client and server")
+	}
+	ip, valid, _ := leased(t, adv)
+	if !lan.Contains(ip) || valid != 3600 {
+		t.Fatalf("advertised %s valid for %d", ip, valid)
+	}
+	if !bytes.Equal(adv.Options.Get(OptionDNSServers), net.ParseIP("2001:db8:1::53")) {
+		t.Fatalf("DNS servers %x", adv.Options.Get(OptionDNSServers))
+	}
+	if len(h.db.Leases()) != 0 {
+		t.Fatal("ADVERTISE recorded a binding")
+	}
+
+	reply := exchange(t, h, clientMessage(Request, testServerDUID, ip))
+	if got, _, status := leased(t, reply); reply.Type != Reply || !got.Equal(ip) || status != StatusSuccess {
+		t.Fatalf("REQUEST got %s %s status %d, want REPLY %s", reply.Type, got, status, ip)
+	}
+	ia := identityAssociations(reply)[0]
+	if ia.T1 != 1800 || ia.T2 != 2880 {
+		t.Fatalf("T1, T2 = %d, %d", ia.T1, ia.T2)
+	}
+	ls := h.db.Leases()
+	if len(ls) != 1 || !ls[0].IP.Equal(ip) || ls[0].HWAddr != "00030001020000000001" || ls[0].IAID != 1 {
+		t.Fatalf("lease database holds %+v", ls)
+	}
+
+	// the same client soliciting again is offered the address it holds
+	if got, _, _ := leased(t, exchangeRaw(t, h, solicit)); !got.Equal(ip) {
+		t.Fatalf("re-solicit advertised %s, want %s", got, ip)
+	}
+	if got, valid, _ := leased(t, exchange(t, h, clientMessage(Renew, testServerDUID, ip))); !got.Equal(ip) || valid != 3600 {
+		t.Fatalf("RENEW got %s valid for %d", got, valid)
+	}
+
+	// another client renewing an address it does not hold is told to stop using it
+	other := clientMessage(Rebind, nil, ip)
+	other.Options[0].Data = []byte{0x00, 0x03, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	if got, valid, _ := leased(t, exchange(t, h, other)); !got.Equal(ip) || valid != 0 {
+		t.Fatalf("REBIND by another client got %s valid for %d, want zero lifetimes", got, valid)
+	}
+
+	reply = exchange(t, h, clientMessage(Release, testServerDUID, ip))
+	if code, _ := parseStatusCode(reply.Options.Get(OptionStatusCode)); reply.Type != Reply || code != StatusSuccess {
+		t.Fatalf("RELEASE got %s status %d", reply.Type, code)
+	}
+	if len(h.db.Leases()) != 0 || len(h.pools[0].leases) != 0 {
+		t.Fatal("released lease still held")
+	}
+}
+
+func TestRapidCommit(t *testing.T) {
+	h := newTestHandler(t, "", testPool())
+	req := clientMessage(Solicit, nil)
+	req.Options.Add(OptionRapidCommit, nil)
+	reply := exchange(t, h, req)
+	if reply.Type != Reply || !reply.Options.Has(OptionRapidCommit) {
+		t.Fatalf("got %s, want REPLY with rapid commit", reply.Type)
+	}
+	ip, _, _ := leased(t, reply)
+	if ls := h.db.Leases(); len(ls) != 1 || !ls[0].IP.Equal(ip) {
+		t.Fatalf("lease database holds %+v, want %s", ls, ip)
+	}
+}
+
+func TestMisdirectedMessagesAreDropped(t *testing.T) {
+	h := newTestHandler(t, "", testPool())
+	other := []byte{0x00, 0x03, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0xff}
+	for _, m := range []*Message{
+		clientMessage(Request, other),          // for another server
+		clientMessage(Request, nil),            // for no server
+		clientMessage(Solicit, testServerDUID), // a SOLICIT names no server
+		{Type: Solicit},                        // without a client id
+		{Type: Reply},                          // sent by a server
+	} {
+		if reply := exchange(t, h, m); reply != nil {
+			t.Errorf("%s answered with %s", m.Type, reply.Type)
+		}
+	}
+}
+
+func TestNoAddrsAvail(t *testing.T) {
+	pc := testPool()
+	pc.Range = 1
+	h := newTestHandler(t, "", pc)
+	exchange(t, h, clientMessage(Request, testServerDUID, net.ParseIP("2001:db8:1::100")))
+
+	req := clientMessage(Solicit, nil)
+	req.Options[0].Data = []byte{0x00, 0x03, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	if ip, _, status := leased(t, exchange(t, h, req)); ip != nil || status != StatusNoAddrsAvail {
+		t.Fatalf("got %s status %d, want NoAddrsAvail", ip, status)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	h := newTestHandler(t, "", testPool())
+	for _, tc := range []struct {
+		ip   string
+		want uint16
+	}{
+		{"2001:db8:1::1234", StatusSuccess},
+		{"2001:db8:2::1234", StatusNotOnLink},
+	} {
+		reply := exchange(t, h, clientMessage(Confirm, nil, net.ParseIP(tc.ip)))
+		if code, _ := parseStatusCode(reply.Options.Get(OptionStatusCode)); code != tc.want {
+			t.Errorf("CONFIRM %s got status %d, want %d", tc.ip, code, tc.want)
+		}
+	}
+}
+
+func TestDecline(t *testing.T) {
+	pc := testPool()
+	pc.Range = 2
+	h := newTestHandler(t, "", pc)
+	ip := net.ParseIP("2001:db8:1::100")
+	exchange(t, h, clientMessage(Request, testServerDUID, ip))
+	exchange(t, h, clientMessage(Decline, testServerDUID, ip))
+
+	for i := 0; i < 3; i++ {
+		if got, _, _ := leased(t, exchange(t, h, clientMessage(Solicit, nil))); !got.Equal(net.ParseIP("2001:db8:1::101")) {
+			t.Fatalf("advertised %s, want the address that was not declined", got)
+		}
+	}
+}
+
+func TestInformationRequest(t *testing.T) {
+	h := newTestHandler(t, "", testPool())
+	req := []byte{
+		0x0b, 0xaa, 0xbb, 0xcc, // INFORMATION-REQUEST
+		0x00, 0x01, 0x00, 0x0a, 0x00, 0x03, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x06, 0x00, 0x04, 0x00, 0x17, 0x00, 0x18,
+	}
+	reply := exchangeRaw(t, h, req)
+	if reply.Type != Reply || reply.TxID != [3]byte{0xaa, 0xbb, 0xcc} {
+		t.Fatalf("got %s %x", reply.Type, reply.TxID)
+	}
+	if reply.Options.Has(OptionIANA) {
+		t.Fatal("stateless reply carries an address")
+	}
+	want := []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0}
+	if got := reply.Options.Get(OptionDomainList); !bytes.Equal(got, want) {
+		t.Fatalf("domain list %q, want %q", got, want)
+	}
+	if len(h.db.Leases()) != 0 {
+		t.Fatal("stateless request recorded a binding")
+	}
+}
+
+func TestLeasesSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcpd6.leases")
+	h := newTestHandler(t, path, testPool())
+	ip, _, _ := leased(t, exchange(t, h, clientMessage(Request, testServerDUID)))
+	h.db.Close()
+
+	h = newTestHandler(t, path, testPool())
+	if got, _, _ := leased(t, exchangeRaw(t, h, solicit)); !got.Equal(ip) {
+		t.Fatalf("after restart advertised %s, want %s", got, ip)
+	}
+	l := h.pools[0].leases[h.pools[0].slot(ip)]
+	if l.iaid != 1 || time.Until(l.expiry) < 59*time.Minute {
+		t.Fatalf("restored lease %+v", l)
+	}
+}
+
+func TestReloadKeepsLeases(t *testing.T) {
+	h := newTestHandler(t, "", testPool())
+	ip, _, _ := leased(t, exchange(t, h, clientMessage(Request, testServerDUID)))
+
+	pc := testPool()
+	pc.DNS = []string{"2001:db8:1::54"}
+	if err := h.Reload(Config{Pools: []PoolConfig{pc}}); err != nil {
+		t.Fatal(err)
+	}
+	reply := exchange(t, h, clientMessage(Renew, testServerDUID, ip))
+	if got, valid, _ := leased(t, reply); !got.Equal(ip) || valid != 3600 {
+		t.Fatalf("RENEW after reload got %s valid for %d", got, valid)
+	}
+	if !bytes.Equal(reply.Options.Get(OptionDNSServers), net.ParseIP("2001:db8:1::54")) {
+		t.Fatalf("DNS servers after reload %x", reply.Options.Get(OptionDNSServers))
+	}
+
+	// a lease the new range no longer covers is dropped
+	pc.Start = "2001:db8:1::200"
+	if err := h.Reload(Config{Pools: []PoolConfig{pc}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, valid, _ := leased(t, exchange(t, h, clientMessage(Renew, testServerDUID, ip))); !got.Equal(ip) || valid != 0 {
+		t.Fatalf("RENEW outside the new range got %s valid for %d, want zero lifetimes", got, valid)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	m, err := ParseMessage(solicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != Solicit || len(m.Options) != 4 || !bytes.Equal(m.Marshal(), solicit) {
+		t.Fatalf("parsed %+v", m)
+	}
+	if _, err := ParseMessage(solicit[:len(solicit)-1]); err == nil {
+		t.Fatal("truncated message parsed")
+	}
+	ias := identityAssociations(m)
+	if len(ias) != 1 || ias[0].IAID != 1 || binary.BigEndian.Uint16(m.Options.Get(OptionORO)) != OptionDNSServers {
+		t.Fatalf("IAs %+v", ias)
+	}
+}
+
+func TestIPArithmetic(t *testing.T) {
+	p, err := newPool(PoolConfig{Name: "p", Prefix: "2001:db8::/64", Start: "2001:db8::fffe", Range: 4, LeaseTime: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.addr(3); !got.Equal(net.ParseIP("2001:db8::1:1")) {
+		t.Fatalf("addr(3) = %s", got)
+	}
+	if got := p.slot(net.ParseIP("2001:db8::1:1")); got != 3 {
+		t.Fatalf("slot = %d", got)
+	}
+	if got := p.slot(net.ParseIP("2001:db8::1")); got != -1 {
+		t.Fatalf("slot before start = %d", got)
+	}
+}
@@ -0,0 +1,293 @@
+package dhcpv6
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// MessageType is the type of a DHCPv6 message (RFC 8415 section 7.3).
+type MessageType byte
+
+const (
+	Solicit            MessageType = 1
+	Advertise          MessageType = 2
+	Request            MessageType = 3
+	Confirm            MessageType = 4
+	Renew              MessageType = 5
+	Rebind             MessageType = 6
+	Reply              MessageType = 7
+	Release            MessageType = 8
+	Decline            MessageType = 9
+	InformationRequest MessageType = 11
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case Solicit:
+		return "SOLICIT"
+	case Advertise:
+		return "ADVERTISE"
+	case Request:
+		return "REQUEST"
+	case Confirm:
+		return "CONFIRM"
+	case Renew:
+		return "RENEW"
+	case Rebind:
+		return "REBIND"
+	case Reply:
+		return "REPLY"
+	case Release:
+		return "RELEASE"
+	case Decline:
+		return "DECLINE"
+	case InformationRequest:
+		return "INFORMATION-REQUEST"
+	}
+	return "UNKNOWN"
+}
+
+// Option codes (RFC 8415 section 21, RFC 3646).
+const (
+	OptionClientID        uint16 = 1
+	OptionServerID        uint16 = 2
+	OptionIANA            uint16 = 3
+	OptionIAAddr          uint16 = 5
+	OptionORO             uint16 = 6
+	OptionPreference      uint16 = 7
+	OptionElapsedTime     uint16 = 8
+	OptionStatusCode      uint16 = 13
+	OptionRapidCommit     uint16 = 14
+	OptionDNSServers      uint16 = 23
+	OptionDomainList      uint16 = 24
+	OptionInfoRefreshTime uint16 = 32
+	optionHeaderLen              = 4
+	messageHeaderLen             = 4
+	iaNAHeaderLen                = 12
+	iaAddrHeaderLen              = 24
+	statusCodeHeaderLen          = 2
+	maxDomainLabelLen            = 63
+	duidTypeLL            uint16 = 3
+	hardwareTypeEthernet  uint16 = 1
+)
+
+// Status codes (RFC 8415 section 21.13).
+const (
+	StatusSuccess      uint16 = 0
+	StatusUnspecFail   uint16 = 1
+	StatusNoAddrsAvail uint16 = 2
+	StatusNoBinding    uint16 = 3
+	StatusNotOnLink    uint16 = 4
+)
+
+var errTruncated = errors.New("truncated DHCPv6 message")
+
+// Option is a DHCPv6 option as it appears on the wire.
+type Option struct {
+	Code uint16
+	Data []byte
+}
+
+// Options is a list of options in the order they appear in a message. Unlike
+// DHCPv4, an option such as IA_NA may occur more than once.
+type Options []Option
+
+// Get returns the data of the first option with code, or nil.
+func (o Options) Get(code uint16) []byte {
+	for _, opt := range o {
+		if opt.Code == code {
+			return opt.Data
+		}
+	}
+	return nil
+}
+
+// Has reports whether an option with code is present.
+func (o Options) Has(code uint16) bool {
+	for _, opt := range o {
+		if opt.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// All returns the data of every option with code.
+func (o Options) All(code uint16) [][]byte {
+	var all [][]byte
+	for _, opt := range o {
+		if opt.Code == code {
+			all = append(all, opt.Data)
+		}
+	}
+	return all
+}
+
+// Add appends an option.
+func (o *Options) Add(code uint16, data []byte) {
+	*o = append(*o, Option{Code: code, Data: data})
+}
+
+func parseOptions(b []byte) (Options, error) {
+	var o Options
+	for len(b) > 0 {
+		if len(b) < optionHeaderLen {
+			return nil, errTruncated
+		}
+		code, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < optionHeaderLen+n {
+			return nil, errTruncated
+		}
+		o.Add(code, b[optionHeaderLen:optionHeaderLen+n])
+		b = b[optionHeaderLen+n:]
+	}
+	return o, nil
+}
+
+func (o Options) marshal(b []byte) []byte {
+	for _, opt := range o {
+		b = append(b, byte(opt.Code>>8), byte(opt.Code), byte(len(opt.Data)>>8), byte(len(opt.Data)))
+		b = append(b, opt.Data...)
+	}
+	return b
+}
+
+// Message is a DHCPv6 client or server message. Relay messages are not
+// supported.
+type Message struct {
+	Type    MessageType
+	TxID    [3]byte
+	Options Options
+}
+
+// ParseMessage decodes a client or server message.
+func ParseMessage(b []byte) (*Message, error) {
+	if len(b) < messageHeaderLen {
+		return nil, errTruncated
+	}
+	m := &Message{Type: MessageType(b[0])}
+	copy(m.TxID[:], b[1:messageHeaderLen])
+	opts, err := parseOptions(b[messageHeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+	m.Options = opts
+	return m, nil
+}
+
+// Marshal encodes the message.
+func (m *Message) Marshal() []byte {
+	b := append([]byte{byte(m.Type)}, m.TxID[:]...)
+	return m.Options.marshal(b)
+}
+
+// iaNA is an identity association for non-temporary addresses.
+type iaNA struct {
+	IAID    uint32
+	T1, T2  uint32
+	Options Options
+}
+
+func parseIANA(b []byte) (iaNA, error) {
+	if len(b) < iaNAHeaderLen {
+		return iaNA{}, errTruncated
+	}
+	opts, err := parseOptions(b[iaNAHeaderLen:])
+	if err != nil {
+		return iaNA{}, err
+	}
+	return iaNA{
+		IAID:    binary.BigEndian.Uint32(b),
+		T1:      binary.BigEndian.Uint32(b[4:]),
+		T2:      binary.BigEndian.Uint32(b[8:]),
+		Options: opts,
+	}, nil
+}
+
+func (ia iaNA) marshal() []byte {
+	b := make([]byte, iaNAHeaderLen, iaNAHeaderLen+iaAddrHeaderLen+optionHeaderLen)
+	binary.BigEndian.PutUint32(b, ia.IAID)
+	binary.BigEndian.PutUint32(b[4:], ia.T1)
+	binary.BigEndian.PutUint32(b[8:], ia.T2)
+	return ia.Options.marshal(b)
+}
+
+// addrs returns the addresses the client asked for in the IA.
+func (ia iaNA) addrs() []iaAddr {
+	var addrs []iaAddr
+	for _, b := range ia.Options.All(OptionIAAddr) {
+		if a, err := parseIAAddr(b); err == nil {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// iaAddr is an address of an IA_NA with its lifetimes in seconds.
+type iaAddr struct {
+	IP        net.IP
+	Preferred uint32
+	Valid     uint32
+}
+
+func parseIAAddr(b []byte) (iaAddr, error) {
+	if len(b) < iaAddrHeaderLen {
+		return iaAddr{}, errTruncated
+	}
+	return iaAddr{
+		IP:        net.IP(append([]byte(nil), b[:net.IPv6len]...)),
+		Preferred: binary.BigEndian.Uint32(b[16:]),
+		Valid:     binary.BigEndian.Uint32(b[20:]),
+	}, nil
+}
+
+func (a iaAddr) marshal() []byte {
+	b := make([]byte, iaAddrHeaderLen)
+	copy(b, a.IP.To16())
+	binary.BigEndian.PutUint32(b[16:], a.Preferred)
+	binary.BigEndian.PutUint32(b[20:], a.Valid)
+	return b
+}
+
+// statusCode returns a status code option.
+func statusCode(code uint16, msg string) []byte {
+	return append([]byte{byte(code >> 8), byte(code)}, msg...)
+}
+
+// parseStatusCode returns the code of a status code option.
+func parseStatusCode(b []byte) (uint16, bool) {
+	if len(b) < statusCodeHeaderLen {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+// encodeDomainList encodes domain names in DNS wire format without
+// compression, as option 24 carries them.
+func encodeDomainList(names []string) ([]byte, error) {
+	var b []byte
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if name == "" {
+			return nil, errors.New(errInvalidDomainName)
+		}
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > maxDomainLabelLen {
+				return nil, errors.New(errInvalidDomainName)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+		b = append(b, 0)
+	}
+	return b, nil
+}
+
+// duidLL returns a DUID based on link-layer address hw (RFC 8415 section
+// 11.4).
+func duidLL(hw net.HardwareAddr) []byte {
+	b := []byte{byte(duidTypeLL >> 8), byte(duidTypeLL), byte(hardwareTypeEthernet >> 8), byte(hardwareTypeEthernet)}
+	return append(b, hw...)
+}
@@ -0,0 +1,176 @@
+package dhcpv6
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+type pool struct {
+	name       string
+	iface      string        // Interface the pool is served on, if any
+	prefix     *net.IPNet    // Prefix of the pool's link
+	start      net.IP        // Start of IP range to distribute
+	leaseRange int           // Number of IPs to distribute (starting from start)
+	preferred  time.Duration // Preferred lifetime of the addresses
+	valid      time.Duration // Valid lifetime, which is the lease period
+	options    Options       // Options to send to DHCP clients
+	leases     map[int]lease // Map to keep track of leases
+}
+
+func newPool(pc PoolConfig) (*pool, error) {
+	si := net.ParseIP(pc.Start)
+	if si == nil || si.To4() != nil {
+		return nil, poolError(pc, errFailParseStartIP)
+	}
+	_, prefix, err := net.ParseCIDR(pc.Prefix)
+	if err != nil || prefix.IP.To4() != nil {
+		return nil, poolError(pc, errFailParsePrefix)
+	}
+	if pc.LeaseTime <= 0 {
+		return nil, poolError(pc, errNegativeLeaseSec)
+	}
+	preferred := pc.PreferredTime
+	if preferred <= 0 {
+		preferred = pc.LeaseTime
+	}
+	if preferred > pc.LeaseTime {
+		return nil, poolError(pc, errPreferredAboveValid)
+	}
+	if pc.Range <= 0 || !prefix.Contains(si) || !prefix.Contains(ipAdd(si, pc.Range-1)) {
+		return nil, poolError(pc, errRangeOutsidePrefix)
+	}
+
+	var options Options
+	if len(pc.DNS) > 0 {
+		var dns []byte
+		for _, s := range pc.DNS {
+			d := net.ParseIP(s)
+			if d == nil || d.To4() != nil {
+				return nil, poolError(pc, errFailParseDNSIP)
+			}
+			dns = append(dns, d...)
+		}
+		options.Add(OptionDNSServers, dns)
+	}
+	if len(pc.DomainSearch) > 0 {
+		dl, err := encodeDomainList(pc.DomainSearch)
+		if err != nil {
+			return nil, poolError(pc, err.Error())
+		}
+		options.Add(OptionDomainList, dl)
+	}
+
+	return &pool{
+		name:       pc.Name,
+		iface:      pc.Interface,
+		prefix:     prefix,
+		start:      si,
+		leaseRange: pc.Range,
+		preferred:  time.Duration(preferred) * time.Second,
+		valid:      time.Duration(pc.LeaseTime) * time.Second,
+		options:    options,
+		leases:     make(map[int]lease, internalLeaseTableSize),
+	}, nil
+}
+
+func poolError(pc PoolConfig, msg string) error {
+	return fmt.Errorf("pool %q: %s", pc.Name, msg)
+}
+
+// newPools builds the pools of a configuration, checking that no two of them
+// share a prefix. Unlike DHCPv4, no pools at all is fine: the server is then
+// not started.
+func newPools(pcs []PoolConfig) ([]*pool, error) {
+	var pools []*pool
+	for _, pc := range pcs {
+		p, err := newPool(pc)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range pools {
+			if q.prefix.Contains(p.prefix.IP) || p.prefix.Contains(q.prefix.IP) {
+				return nil, fmt.Errorf("pool %q: %s %q", p.name, errOverlappingPools, q.name)
+			}
+		}
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+// inRange reports whether lease table slot i is part of the dynamic range.
+func (p *pool) inRange(i int) bool {
+	return i >= 0 && i < p.leaseRange
+}
+
+// slot returns the lease table slot of ip, or -1 if ip is before the start
+// of the range or too far beyond it to have one.
+func (p *pool) slot(ip net.IP) int {
+	a, b := p.start.To16(), ip.To16()
+	if b == nil || !bytes.Equal(a[:8], b[:8]) {
+		return -1
+	}
+	lo, hi := binary.BigEndian.Uint64(a[8:]), binary.BigEndian.Uint64(b[8:])
+	if hi < lo || hi-lo > 1<<31-1 {
+		return -1
+	}
+	return int(hi - lo)
+}
+
+// addr returns the address of lease table slot i.
+func (p *pool) addr(i int) net.IP {
+	return ipAdd(p.start, i)
+}
+
+// ipAdd returns ip advanced by n addresses.
+func ipAdd(ip net.IP, n int) net.IP {
+	r := make(net.IP, net.IPv6len)
+	copy(r, ip.To16())
+	carry := uint64(n)
+	for i := net.IPv6len - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(r[i]) + carry&0xff
+		r[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	return r
+}
+
+// poolFor selects the pool that serves a request received on interface
+// ifname: the pool configured for the interface, then one whose prefix holds
+// an address of the interface, and finally the only pool if there is just
+// one. Clients send from link-local addresses, so the source tells nothing.
+func (h *Handler) poolFor(ifname string) *pool {
+	if ifname != "" {
+		for _, p := range h.pools {
+			if p.iface == ifname {
+				return p
+			}
+		}
+		if ifi, err := net.InterfaceByName(ifname); err == nil {
+			addrs, _ := ifi.Addrs()
+			for _, a := range addrs {
+				if ipn, ok := a.(*net.IPNet); ok {
+					if p := h.poolContaining(ipn.IP); p != nil && p.iface == "" {
+						return p
+					}
+				}
+			}
+		}
+	}
+	if len(h.pools) == 1 && h.pools[0].iface == "" {
+		return h.pools[0]
+	}
+	return nil
+}
+
+// poolContaining returns the pool whose prefix holds ip, or nil.
+func (h *Handler) poolContaining(ip net.IP) *pool {
+	for _, p := range h.pools {
+		if p.prefix.Contains(ip) {
+			return p
+		}
+	}
+	return nil
+}
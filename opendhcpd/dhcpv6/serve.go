@@ -0,0 +1,116 @@
+package dhcpv6
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv6"
+)
+
+// Start starts serving DHCPv6 replies to DHCPv6 clients.
+func (h *Handler) Start() error {
+	if err := h.Listen(); err != nil {
+		return err
+	}
+	return h.Serve()
+}
+
+// Listen opens the server socket and joins the All_DHCP_Relay_Agents_and_Servers
+// group on the interfaces to serve.
+func (h *Handler) Listen() error {
+	l, err := net.ListenPacket("udp6", fmt.Sprintf("[::]:%d", serverPort))
+	if err != nil {
+		return err
+	}
+	conn := ipv6.NewPacketConn(l)
+	if err := conn.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		conn.Close()
+		return err
+	}
+	group := &net.UDPAddr{IP: net.ParseIP(allServersMulticast)}
+	joined := 0
+	for _, ifi := range h.interfaces() {
+		if err := conn.JoinGroup(&ifi, group); err != nil {
+			h.logger.Warn().Msgf("failed to join %s on %s: %s", allServersMulticast, ifi.Name, err)
+			continue
+		}
+		joined++
+	}
+	if joined == 0 {
+		conn.Close()
+		return fmt.Errorf("failed to join %s on any interface", allServersMulticast)
+	}
+	h.conn = conn
+	h.logger.Info().Msgf("dhcpv6 server started listening on [::]:%d", serverPort)
+	return nil
+}
+
+// Serve answers messages on the socket opened by Listen until it fails, or
+// returns nil once the handler is closed.
+func (h *Handler) Serve() error {
+	go h.compactLeases()
+	err := h.serve(h.conn)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.conn.Close()
+	return err
+}
+
+// interfaces returns the interfaces to listen for clients on: those that
+// pools are configured on, or else every multicast capable one.
+func (h *Handler) interfaces() []net.Interface {
+	var ifis []net.Interface
+	for _, p := range h.pools {
+		if p.iface == "" {
+			continue
+		}
+		if ifi, err := net.InterfaceByName(p.iface); err == nil {
+			ifis = append(ifis, *ifi)
+		}
+	}
+	if len(ifis) == len(h.pools) {
+		return ifis
+	}
+	all, _ := net.Interfaces()
+	ifis = ifis[:0]
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+			ifis = append(ifis, ifi)
+		}
+	}
+	return ifis
+}
+
+// serve reads messages from conn and unicasts the replies back to the
+// client's link-local address out of the interface each came in on.
+func (h *Handler) serve(conn *ipv6.PacketConn) error {
+	buffer := make([]byte, 1500)
+	for {
+		n, cm, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		req, err := ParseMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+		var ifname string
+		var wcm *ipv6.ControlMessage
+		if cm != nil {
+			if ifi, err := net.InterfaceByIndex(cm.IfIndex); err == nil {
+				ifname = ifi.Name
+			}
+			wcm = &ipv6.ControlMessage{IfIndex: cm.IfIndex}
+		}
+		res := h.serveDHCP(req, ifname)
+		if res == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(res.Marshal(), wcm, addr); err != nil {
+			h.logger.Error().Msgf("failed to send reply to %s: %s", addr, err)
+		}
+	}
+}
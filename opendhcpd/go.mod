@@ -5,8 +5,9 @@ go 1.14
 require (
 	github.com/kardianos/osext v0.0.0-20170510131534-ae77be60afb1 // indirect
 	github.com/krolaw/dhcp4 v0.0.0-20180925202202-7cead472c414
+	github.com/miekg/dns v1.1.50
 	github.com/rs/zerolog v1.11.0
 	github.com/sevlyar/go-daemon v0.1.4
 	github.com/urfave/cli v1.20.0
-	golang.org/x/net v0.0.0-20190119204137-ed066c81e75e // indirect
+	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985
 )
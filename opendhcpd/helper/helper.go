@@ -36,3 +36,34 @@ func Localip() (net.IP, error) {
 	}
 	return nil, errors.New("valid IP address not found for all network interfaces")
 }
+
+// InterfaceIPv4 returns the IPv4 address of the network interface name,
+// preferring one within subnet if subnet is not nil.
+func InterfaceIPv4(name string, subnet *net.IPNet) (net.IP, error) {
+	nif, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := nif.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var first net.IP
+	for _, addr := range addrs {
+		ipn, ok := addr.(*net.IPNet)
+		if !ok || ipn.IP.To4() == nil {
+			continue
+		}
+		ip := ipn.IP.To4()
+		if subnet != nil && subnet.Contains(ip) {
+			return ip, nil
+		}
+		if first == nil {
+			first = ip
+		}
+	}
+	if first == nil {
+		return nil, errors.New("no IPv4 address on interface " + name)
+	}
+	return first, nil
+}
@@ -0,0 +1,28 @@
+package helper
+
+import (
+	"net"
+	"os"
+)
+
+// SdNotify sends state, such as "READY=1", to the systemd service manager
+// the way sd_notify(3) does. It reports whether it was sent: outside a
+// systemd service with Type=notify there is no one to send it to.
+func SdNotify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	if name[0] == '@' { // abstract socket
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,254 @@
+// Package leasedb persists DHCP leases in an append-only file.
+//
+// Every grant and release is appended to the file as a JSON record and synced
+// to disk before the reply goes out. Open replays the file, keeping the last
+// record for each address and dropping leases that have expired, and Compact
+// rewrites the file so that it holds only the live leases.
+package leasedb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	opBind    = "bind"
+	opRelease = "release"
+
+	maxRecordSize = 64 * 1024
+)
+
+var errClosed = errors.New("lease database is closed")
+
+// Lease is a binding of an address to a client.
+type Lease struct {
+	IP       net.IP    `json:"ip"`
+	HWAddr   string    `json:"hwaddr"`         // client hardware address or DUID
+	IAID     uint32    `json:"iaid,omitempty"` // identity association of a DHCPv6 lease
+	Hostname string    `json:"hostname,omitempty"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// Expired reports whether the lease has run out at now.
+func (l Lease) Expired(now time.Time) bool {
+	return !l.Expiry.After(now)
+}
+
+type record struct {
+	Op string `json:"op"`
+	Lease
+}
+
+// DB is an append-only lease file and the live leases replayed from it. It is
+// safe for concurrent use.
+type DB struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	leases  map[string]Lease // by IP
+	records int              // records in the file, live or not
+	closed  bool
+}
+
+// Open loads the lease file at path, creating it if needed, and compacts it.
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db := &DB{path: path, leases: make(map[string]Lease)}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	if err := db.Compact(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// load replays the lease file. A record cut short by a crash can only be the
+// last one and is skipped.
+func (db *DB) load() error {
+	f, err := os.Open(db.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 4096), maxRecordSize)
+	for sc.Scan() {
+		var r record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil || r.IP == nil {
+			continue
+		}
+		switch r.Op {
+		case opBind:
+			db.leases[r.IP.String()] = r.Lease
+		case opRelease:
+			delete(db.leases, r.IP.String())
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	db.dropExpired(time.Now())
+	return nil
+}
+
+func (db *DB) dropExpired(now time.Time) {
+	for ip, l := range db.leases {
+		if l.Expired(now) {
+			delete(db.leases, ip)
+		}
+	}
+}
+
+// Leases returns the leases that have not expired, ordered by address.
+func (db *DB) Leases() []Lease {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	now := time.Now()
+	ls := make([]Lease, 0, len(db.leases))
+	for _, l := range db.leases {
+		if !l.Expired(now) {
+			ls = append(ls, l)
+		}
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		return string(ls[i].IP.To16()) < string(ls[j].IP.To16())
+	})
+	return ls
+}
+
+// Put records a granted or renewed lease.
+func (db *DB) Put(l Lease) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.append(record{Op: opBind, Lease: l}); err != nil {
+		return err
+	}
+	db.leases[l.IP.String()] = l
+	return nil
+}
+
+// Release records that the lease on ip has ended. Releasing an address
+// without a lease is a no-op.
+func (db *DB) Release(ip net.IP) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.leases[ip.String()]; !ok {
+		return nil
+	}
+	if err := db.append(record{Op: opRelease, Lease: Lease{IP: ip}}); err != nil {
+		return err
+	}
+	delete(db.leases, ip.String())
+	return nil
+}
+
+// append writes r to the end of the file and syncs it. The caller holds db.mu.
+func (db *DB) append(r record) error {
+	if db.closed {
+		return errClosed
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := db.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	db.records++
+	return db.f.Sync()
+}
+
+// Compact rewrites the lease file with only the leases that are still live.
+// The new file replaces the old one atomically, so a crash leaves one or the
+// other.
+func (db *DB) Compact() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return errClosed
+	}
+	db.dropExpired(time.Now())
+
+	tmp := db.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, l := range db.leases {
+		if err := enc.Encode(record{Op: opBind, Lease: l}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		return err
+	}
+
+	nf, err := os.OpenFile(db.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if db.f != nil {
+		db.f.Close()
+	}
+	db.f = nf
+	db.records = len(db.leases)
+	return nil
+}
+
+// Stale returns the number of records in the file that no longer describe a
+// live lease, which Compact would drop: those superseded or released, and
+// those of leases that have expired.
+func (db *DB) Stale() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	live, now := 0, time.Now()
+	for _, l := range db.leases {
+		if !l.Expired(now) {
+			live++
+		}
+	}
+	return db.records - live
+}
+
+// Close syncs and closes the lease file.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	err := db.f.Sync()
+	if cerr := db.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,201 @@
+package leasedb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, path string) *DB {
+	t.Helper()
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func put(t *testing.T, db *DB, ip, hwaddr string, expiry time.Time) {
+	t.Helper()
+	if err := db.Put(Lease{IP: net.ParseIP(ip), HWAddr: hwaddr, Expiry: expiry}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ips(ls []Lease) []string {
+	var s []string
+	for _, l := range ls {
+		s = append(s, l.IP.String())
+	}
+	return s
+}
+
+func checkLeases(t *testing.T, db *DB, want ...string) {
+	t.Helper()
+	got := ips(db.Leases())
+	if len(got) != len(want) {
+		t.Fatalf("leases %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("leases %v, want %v", got, want)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	db := open(t, path)
+	later := time.Now().Add(time.Hour)
+	put(t, db, "10.0.0.2", "02:00:00:00:00:02", later)
+	put(t, db, "10.0.0.1", "02:00:00:00:00:01", later)
+	put(t, db, "10.0.0.3", "02:00:00:00:00:03", later)
+	put(t, db, "10.0.0.1", "02:00:00:00:00:01", later.Add(time.Hour)) // renewal
+	if err := db.Release(net.ParseIP("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Release(net.ParseIP("10.0.0.4")); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.Stale(); got != 3 {
+		t.Errorf("%d stale records, want 3", got)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = open(t, path)
+	checkLeases(t, db, "10.0.0.1", "10.0.0.2")
+	if l := db.Leases()[0]; l.HWAddr != "02:00:00:00:00:01" || !l.Expiry.Equal(later.Add(time.Hour)) {
+		t.Errorf("replayed %+v, want the renewal", l)
+	}
+	if got := db.Stale(); got != 0 {
+		t.Errorf("%d stale records after Open, want 0", got)
+	}
+}
+
+func TestOpenDropsExpiredLeases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	db := open(t, path)
+	put(t, db, "10.0.0.1", "02:00:00:00:00:01", time.Now().Add(time.Hour))
+	put(t, db, "10.0.0.2", "02:00:00:00:00:02", time.Now().Add(-time.Second))
+	checkLeases(t, db, "10.0.0.1")
+	db.Close()
+
+	db = open(t, path)
+	checkLeases(t, db, "10.0.0.1")
+	db.Close()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("10.0.0.2")) {
+		t.Errorf("expired lease still in the file:\n%s", b)
+	}
+}
+
+func TestOpenSkipsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	db := open(t, path)
+	put(t, db, "10.0.0.1", "02:00:00:00:00:01", time.Now().Add(time.Hour))
+	db.Close()
+
+	// a crash part way through appending the next record
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"op":"bind","ip":"10.0.0.2","hwaddr":"02:00`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db = open(t, path)
+	checkLeases(t, db, "10.0.0.1")
+	put(t, db, "10.0.0.2", "02:00:00:00:00:02", time.Now().Add(time.Hour))
+	db.Close()
+	db = open(t, path)
+	checkLeases(t, db, "10.0.0.1", "10.0.0.2")
+}
+
+func TestStaleCountsExpiredLeases(t *testing.T) {
+	db := open(t, filepath.Join(t.TempDir(), "dhcpd.leases"))
+	put(t, db, "10.0.0.1", "02:00:00:00:00:01", time.Now().Add(time.Hour))
+	put(t, db, "10.0.0.2", "02:00:00:00:00:02", time.Now().Add(-time.Second))
+	if got := db.Stale(); got != 1 {
+		t.Errorf("%d stale records, want the expired lease's", got)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.Stale(); got != 0 {
+		t.Errorf("%d stale records after Compact, want 0", got)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dhcpd.leases")
+	db := open(t, path)
+	for i := 0; i < 10; i++ {
+		put(t, db, "10.0.0.1", "02:00:00:00:00:01", time.Now().Add(time.Hour))
+	}
+	put(t, db, "10.0.0.2", "02:00:00:00:00:02", time.Now().Add(time.Hour))
+	db.Release(net.ParseIP("10.0.0.2"))
+
+	// a temporary file left by a compaction that crashed is replaced
+	if err := ioutil.WriteFile(path+".tmp", []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(after, []byte("\n")); n != 1 || len(after) >= len(before) {
+		t.Errorf("compacted file has %d records:\n%s", n, after)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	if got := db.Stale(); got != 0 {
+		t.Errorf("%d stale records after Compact, want 0", got)
+	}
+
+	// appends go to the new file
+	put(t, db, "10.0.0.3", "02:00:00:00:00:03", time.Now().Add(time.Hour))
+	db.Close()
+	db = open(t, path)
+	checkLeases(t, db, "10.0.0.1", "10.0.0.3")
+}
+
+func TestClosed(t *testing.T) {
+	db := open(t, filepath.Join(t.TempDir(), "dhcpd.leases"))
+	put(t, db, "10.0.0.1", "02:00:00:00:00:01", time.Now().Add(time.Hour))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if err := db.Put(Lease{IP: net.ParseIP("10.0.0.2")}); err != errClosed {
+		t.Errorf("Put after Close returned %v", err)
+	}
+	if err := db.Release(net.ParseIP("10.0.0.1")); err != errClosed {
+		t.Errorf("Release after Close returned %v", err)
+	}
+	if err := db.Compact(); err != errClosed {
+		t.Errorf("Compact after Close returned %v", err)
+	}
+	checkLeases(t, db, "10.0.0.1")
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/ishworgurung/opendhcpd/dhcpv4"
+	"github.com/ishworgurung/opendhcpd/dhcpv6"
+	"github.com/ishworgurung/opendhcpd/helper"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/sevlyar/go-daemon"
@@ -12,14 +19,27 @@ import (
 )
 
 func main() {
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	// journald adds its own timestamps and does not render colours
+	if os.Getenv("JOURNAL_STREAM") != "" {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, NoColor: true, PartsOrder: []string{zerolog.LevelFieldName, zerolog.CallerFieldName, zerolog.MessageFieldName}})
+	} else {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	}
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 
 	app := cli.NewApp()
 	app.Version = "0.2.0"
 	app.Name = "opendhcpd"
-	app.Usage = "no nonsense minimal DHCPv4 daemon"
+	app.Usage = "no nonsense minimal DHCPv4 and DHCPv6 daemon"
 	cliFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "config,c",
+			Usage: "configuration file with one or more pools, instead of the pool flags",
+		},
+		cli.StringFlag{
+			Name:  "interface,i",
+			Usage: "serve only on this interface, identifying the server by its address",
+		},
 		cli.StringFlag{
 			Name:  "dhcp_start,s",
 			Usage: "dhcp start",
@@ -48,6 +68,40 @@ func main() {
 			Name:  "domain_name,n",
 			Usage: "domain name",
 		},
+		cli.StringFlag{
+			Name:  "lease_file,f",
+			Usage: "lease database file",
+			Value: "/var/lib/opendhcpd/dhcpd.leases",
+		},
+		cli.StringFlag{
+			Name:  "reservations_file,x",
+			Usage: "static reservations file",
+		},
+		cli.StringFlag{
+			Name:  "probe,p",
+			Usage: "check addresses are unused before offering them: icmp",
+		},
+		cli.StringFlag{
+			Name:  "admin_listen,a",
+			Usage: "serve the admin HTTP API on this address, e.g. 127.0.0.1:6767",
+		},
+		cli.StringFlag{
+			Name:  "dhcp6_start,S",
+			Usage: "dhcpv6 start, which turns on the dhcpv6 server",
+		},
+		cli.StringFlag{
+			Name:  "dhcp6_range,R",
+			Usage: "dhcpv6 range",
+		},
+		cli.StringFlag{
+			Name:  "dns6_resolver,D",
+			Usage: "dhcpv6 dns resolver",
+		},
+		cli.StringFlag{
+			Name:  "lease_file6,F",
+			Usage: "dhcpv6 lease database file",
+			Value: "/var/lib/opendhcpd/dhcpd6.leases",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -57,20 +111,100 @@ func main() {
 			Usage:   "run opendhcpd in foreground",
 			Flags:   cliFlags,
 			Action: func(c *cli.Context) error {
-				d, err := dhcpv4.New(
-					c.String("dhcp_start"),
-					c.String("default_gw"),
-					c.String("subnet_mask"),
-					c.String("dns_resolver"),
-					c.Int("dhcp_range"),
-					c.Int("lease_duration_sec"),
-					c.String("domain_name"),
-					log.Logger,
-				)
+				cfg, cfg6, err := configs(c)
+				if err != nil {
+					log.Fatal().Msg(err.Error())
+				}
+				d, err := dhcpv4.New(cfg, log.Logger)
 				if err != nil {
 					log.Fatal().Msg(err.Error())
 				}
-				log.Fatal().Msg(d.Start().Error())
+				if err := d.Listen(); err != nil {
+					log.Fatal().Msg(err.Error())
+				}
+				var d6 *dhcpv6.Handler
+				if len(cfg6.Pools) > 0 {
+					if d6, err = dhcpv6.New(cfg6, log.Logger); err != nil {
+						log.Fatal().Msg(err.Error())
+					}
+					if err := d6.Listen(); err != nil {
+						log.Fatal().Msg(err.Error())
+					}
+				}
+				if cfg.AdminListen != "" {
+					go func() {
+						log.Info().Msgf("admin API listening on %s", cfg.AdminListen)
+						log.Fatal().Msg(http.ListenAndServe(cfg.AdminListen, d.AdminHandler()).Error())
+					}()
+				}
+				go serve(d.Serve)
+				if d6 != nil {
+					go serve(d6.Serve)
+				}
+				notify("READY=1")
+
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+				for sig := range signals {
+					if sig != syscall.SIGHUP {
+						log.Info().Msgf("%s, shutting down", sig)
+						notify("STOPPING=1")
+						if d6 != nil {
+							d6.Close()
+						}
+						if err := d.Close(); err != nil {
+							log.Error().Msgf("failed to close the lease database: %s", err)
+						}
+						return nil
+					}
+					log.Info().Msg("SIGHUP received, reloading the configuration")
+					notify("RELOADING=1")
+					reload(c, d, d6)
+					notify("READY=1")
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "monitor",
+			Aliases: []string{"mon"},
+			Usage:   "watch for DHCP servers other than this one",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "interface,i",
+					Usage: "watch only this interface",
+				},
+				cli.StringSliceFlag{
+					Name:  "known,k",
+					Usage: "server identifier of an expected DHCP server, besides this host's addresses; may be repeated",
+				},
+				cli.StringFlag{
+					Name:  "webhook,w",
+					Usage: "URL to POST each unknown server seen to, as JSON",
+				},
+				cli.IntFlag{
+					Name:  "discover_interval,t",
+					Usage: "seconds between test DISCOVERs",
+					Value: 60,
+				},
+				cli.IntFlag{
+					Name:  "report_interval,e",
+					Usage: "seconds before a server still seen is reported again",
+					Value: 3600,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				m, err := dhcpv4.NewMonitor(dhcpv4.MonitorConfig{
+					Interface:        c.String("interface"),
+					Known:            c.StringSlice("known"),
+					Webhook:          c.String("webhook"),
+					DiscoverInterval: c.Int("discover_interval"),
+					ReportInterval:   c.Int("report_interval"),
+				}, log.Logger)
+				if err != nil {
+					log.Fatal().Msg(err.Error())
+				}
+				log.Fatal().Msg(m.Run().Error())
 				return nil
 			},
 		},
@@ -87,6 +221,18 @@ func main() {
 				r := c.Int("dhcp_range")
 				l := c.Int("lease_duration_sec")
 				n := c.String("domain_name")
+				args := []string{
+					"opendhcpd",
+					"rs", "-s", s, "-r", strconv.Itoa(r), "-g", g,
+					"-d", d, "-m", m, "-l", strconv.Itoa(l), "-n", n,
+				}
+				// pass on only what was given, so as not to override the config file
+				for _, name := range []string{"lease_file", "reservations_file", "config", "interface", "probe", "admin_listen",
+					"dhcp6_start", "dhcp6_range", "dns6_resolver", "lease_file6"} {
+					if c.IsSet(name) {
+						args = append(args, "--"+name, c.String(name))
+					}
+				}
 
 				daemonCtx := &daemon.Context{
 					PidFileName: "/var/run/opendhcpd.pid",
@@ -95,11 +241,7 @@ func main() {
 					LogFilePerm: 0644,
 					WorkDir:     "/tmp",
 					Umask:       0022,
-					Args: []string{
-						"opendhcpd",
-						"rs", "-s", s, "-r", strconv.Itoa(r), "-g", g,
-						"-d", d, "-m", m, "-l", strconv.Itoa(l), "-n", n,
-					},
+					Args:        args,
 				}
 				reb, err := daemonCtx.Reborn()
 				if err != nil {
@@ -120,3 +262,122 @@ func main() {
 		log.Fatal().Msg(err.Error())
 	}
 }
+
+// configs builds the DHCPv4 and DHCPv6 configurations from the command line
+// and the configuration file it names. The DHCPv6 one has no pools unless
+// some are asked for.
+func configs(c *cli.Context) (dhcpv4.Config, dhcpv6.Config, error) {
+	cfg := dhcpv4.SinglePoolConfig(
+		c.String("dhcp_start"),
+		c.String("default_gw"),
+		c.String("subnet_mask"),
+		c.String("dns_resolver"),
+		c.Int("dhcp_range"),
+		c.Int("lease_duration_sec"),
+		c.String("domain_name"),
+		c.String("lease_file"),
+		c.String("reservations_file"),
+	)
+	cfg6 := dhcpv6.SinglePoolConfig(
+		c.String("dhcp6_start"),
+		c.Int("dhcp6_range"),
+		c.String("dns6_resolver"),
+		c.Int("lease_duration_sec"),
+		c.String("domain_name"),
+		c.String("lease_file6"),
+	)
+	if !c.IsSet("dhcp6_start") {
+		cfg6.Pools = nil
+	}
+	if iface := c.String("interface"); iface != "" {
+		cfg.Pools[0].Interface = iface
+		for i := range cfg6.Pools {
+			cfg6.Pools[i].Interface = iface
+		}
+	}
+	if path := c.String("config"); path != "" {
+		if c.IsSet("interface") {
+			return cfg, cfg6, errors.New("-i applies to the pool given by flags; set interface on each pool of the configuration file instead")
+		}
+		var err error
+		if cfg, err = loadConfig(path, c); err != nil {
+			return cfg, cfg6, fmt.Errorf("failed to load config %s: %s", path, err)
+		}
+		if cfg6, err = loadConfig6(path, c); err != nil {
+			return cfg, cfg6, fmt.Errorf("failed to load config %s: %s", path, err)
+		}
+	}
+	if c.IsSet("probe") {
+		cfg.Probe = c.String("probe")
+	}
+	if c.IsSet("admin_listen") {
+		cfg.AdminListen = c.String("admin_listen")
+	}
+	return cfg, cfg6, nil
+}
+
+// reload rebuilds the configurations and hands the pools and reservations to
+// the running servers, which keep the leases they still cover. A server that
+// is not running is not started: that takes a restart.
+func reload(c *cli.Context, d *dhcpv4.Handler, d6 *dhcpv6.Handler) {
+	cfg, cfg6, err := configs(c)
+	if err != nil {
+		log.Error().Msgf("keeping the running configuration: %s", err)
+		return
+	}
+	if err := d.Reload(cfg); err != nil {
+		log.Error().Msgf("keeping the running DHCPv4 configuration: %s", err)
+	}
+	switch {
+	case d6 != nil:
+		if err := d6.Reload(cfg6); err != nil {
+			log.Error().Msgf("keeping the running DHCPv6 configuration: %s", err)
+		}
+	case len(cfg6.Pools) > 0:
+		log.Warn().Msg("DHCPv6 pools are configured but the DHCPv6 server is not running; restart to start it")
+	}
+}
+
+// serve runs a server's Serve and exits if it fails.
+func serve(f func() error) {
+	if err := f(); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+}
+
+// notify tells systemd about a change of state when running as a Type=notify
+// service.
+func notify(state string) {
+	if _, err := helper.SdNotify(state); err != nil {
+		log.Warn().Msgf("failed to notify systemd of %s: %s", state, err)
+	}
+}
+
+// loadConfig reads the configuration file at path. Lease and reservations
+// files given on the command line take precedence over the file's.
+func loadConfig(path string, c *cli.Context) (dhcpv4.Config, error) {
+	cfg, err := dhcpv4.LoadConfig(path)
+	if err != nil {
+		return cfg, err
+	}
+	if c.IsSet("lease_file") || cfg.LeaseFile == "" {
+		cfg.LeaseFile = c.String("lease_file")
+	}
+	if c.IsSet("reservations_file") {
+		cfg.ReservationsFile = c.String("reservations_file")
+	}
+	return cfg, nil
+}
+
+// loadConfig6 reads the DHCPv6 part of the configuration file at path. A lease
+// file given on the command line takes precedence over the file's.
+func loadConfig6(path string, c *cli.Context) (dhcpv6.Config, error) {
+	cfg, err := dhcpv6.LoadConfig(path)
+	if err != nil {
+		return cfg, err
+	}
+	if c.IsSet("lease_file6") || cfg.LeaseFile == "" {
+		cfg.LeaseFile = c.String("lease_file6")
+	}
+	return cfg, nil
+}